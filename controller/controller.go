@@ -1,8 +1,14 @@
 package controller
 
 import (
+	"net"
+	"time"
+
 	"github.com/gkontos/goapi/db"
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/mailer"
 	"github.com/gkontos/goapi/security"
+	"github.com/gkontos/goapi/util"
 	"github.com/go-chi/chi/v5"
 )
 
@@ -15,8 +21,20 @@ type apiRouter struct {
 }
 
 type apiController struct {
-	dbh db.DbHandler
-	th  security.TokenHandler
+	dbh    db.DbHandler
+	th     security.TokenHandler
+	as     security.AuthorizationServer
+	mailer mailer.Mailer
+	// erasureCoolingOff is how long an erasure can be cancelled before the user is erased
+	erasureCoolingOff time.Duration
+	// preferencesSchema validates the preferences users store, any JSON object is accepted when it is nil
+	preferencesSchema *util.JSONSchema
+	// scimAuthProvider is the login provider of the users created by provisioning clients
+	scimAuthProvider string
+	// scimAllowedRoles are the roles which provisioning clients can give users
+	scimAllowedRoles []string
+	// trustedProxies are the proxies whose X-Forwarded-For entries are used as the client address
+	trustedProxies []*net.IPNet
 }
 
 func NewRouter(allow_origin string, apiController *apiController, dbHandler db.DbHandler) ApiRouter {
@@ -26,9 +44,21 @@ func NewRouter(allow_origin string, apiController *apiController, dbHandler db.D
 	}
 }
 
-func NewController(dbHandler db.DbHandler) *apiController {
+func NewController(dbHandler db.DbHandler, m mailer.Mailer, erasureCoolingOff time.Duration) *apiController {
+	preferencesSchema, err := loadPreferencesSchema()
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("preferences schema is invalid")
+		panic(err)
+	}
 	return &apiController{
-		dbh: dbHandler,
-		th:  security.GetNewHandler(dbHandler),
+		dbh:               dbHandler,
+		th:                security.GetNewHandler(dbHandler),
+		as:                security.NewAuthorizationServer(dbHandler),
+		mailer:            m,
+		erasureCoolingOff: erasureCoolingOff,
+		preferencesSchema: preferencesSchema,
+		scimAuthProvider:  scimAuthProvider(),
+		scimAllowedRoles:  scimAllowedRoles(),
+		trustedProxies:    trustedProxies(),
 	}
 }
@@ -0,0 +1,100 @@
+package controller
+
+import (
+	"net/http"
+
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/security"
+	"github.com/gkontos/goapi/util"
+)
+
+type DeviceAuthorizationRequest struct {
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope"`
+}
+
+type DeviceTokenRequest struct {
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	DeviceCode   string `json:"device_code"`
+}
+
+type DeviceDecisionRequest struct {
+	UserCode string `json:"user_code"`
+	Approve  bool   `json:"approve"`
+}
+
+// DeviceAuthorizationCreate starts the device flow for a cli which can not receive a browser redirect
+func (api *apiController) DeviceAuthorizationCreate(w http.ResponseWriter, r *http.Request) {
+
+	deviceRequest := &DeviceAuthorizationRequest{}
+	if parseErr := util.ParseJsonRequest(r, &deviceRequest); parseErr != nil {
+		util.ReturnErrorJSON(w, parseErr)
+		return
+	}
+
+	resp, err := api.as.StartDeviceAuthorization(deviceRequest.ClientID, deviceRequest.Scope)
+	if err != nil {
+		returnOAuthError(w, err, "unable to start device authorization")
+		return
+	}
+
+	util.ReturnBodyJSON(w, resp, http.StatusOK)
+
+}
+
+// DeviceTokenPoll is polled by the cli until the user has approved the request.  Confidential clients authenticate
+// with their secret in the body or with basic auth, as at the token endpoint.
+func (api *apiController) DeviceTokenPoll(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Cache-Control", "no-store")
+	tokenRequest := &DeviceTokenRequest{}
+	if parseErr := util.ParseJsonRequest(r, &tokenRequest); parseErr != nil {
+		util.ReturnErrorJSON(w, parseErr)
+		return
+	}
+
+	clientID, clientSecret := clientCredentials(r, tokenRequest.ClientID, tokenRequest.ClientSecret)
+	token, _, err := api.as.PollDeviceToken(clientID, clientSecret, tokenRequest.DeviceCode)
+	if err != nil {
+		returnOAuthError(w, err, "unable to poll device token")
+		return
+	}
+
+	util.ReturnBodyJSON(w, token, http.StatusOK)
+
+}
+
+// DeviceApprovalGet returns the pending request for the user code so the approval page can show which client is asking
+func (api *apiController) DeviceApprovalGet(w http.ResponseWriter, r *http.Request) {
+
+	approval, err := api.as.GetDeviceApprovalRequest(r.URL.Query().Get("user_code"))
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("unable to get device request")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	util.ReturnBodyJSON(w, approval, http.StatusOK)
+
+}
+
+// DeviceApprovalDecide approves or denies the pending request for the logged in user
+func (api *apiController) DeviceApprovalDecide(w http.ResponseWriter, r *http.Request) {
+
+	claims := r.Context().Value(security.UserContextKey).(security.Claims)
+	decision := &DeviceDecisionRequest{}
+	if parseErr := util.ParseJsonRequest(r, &decision); parseErr != nil {
+		util.ReturnErrorJSON(w, parseErr)
+		return
+	}
+
+	if err := api.as.DecideDeviceAuthorization(decision.UserCode, decision.Approve, claims); err != nil {
+		logger.Logger.Error().Err(err).Msg("unable to decide device request")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	util.ReturnBlankJSON(w, http.StatusNoContent)
+
+}
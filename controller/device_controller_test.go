@@ -0,0 +1,163 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/security"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceAuthorizationCreate(t *testing.T) {
+	logger.InitLogger(true, true)
+	path := "/v1/login/device"
+
+	cases := []struct {
+		requestBody          []byte
+		expectedResponseCode int
+		expectedResponseBody []byte
+	}{
+		// ok
+		{
+			requestBody:          []byte(`{"client_id":"somecli","scope":"openid"}`),
+			expectedResponseCode: http.StatusOK,
+		},
+		// unknown client
+		{
+			requestBody:          []byte(`{"client_id":"unknown"}`),
+			expectedResponseCode: http.StatusUnauthorized,
+			expectedResponseBody: []byte(`{"error":"invalid_client"}`),
+		},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("POST", path, bytes.NewBuffer(c.requestBody))
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+
+		ctrl := &apiController{as: &testAuthorizationServer{}}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.DeviceAuthorizationCreate)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match")
+		if c.expectedResponseBody != nil {
+			assert.Equal(t, string(c.expectedResponseBody), string(bytes.TrimSpace(rr.Body.Bytes())), "body didn't match")
+		} else {
+			var resp security.DeviceAuthorizationResponse
+			json.Unmarshal(rr.Body.Bytes(), &resp)
+			assert.Equal(t, "BCDF-GHJK", resp.UserCode)
+			assert.True(t, resp.DeviceCode != "")
+		}
+	}
+}
+
+func TestDeviceTokenPoll(t *testing.T) {
+	logger.InitLogger(true, true)
+	path := "/v1/login/device/token"
+
+	cases := []struct {
+		requestBody          []byte
+		basicAuth            []string
+		expectedResponseCode int
+		expectedResponseBody []byte
+	}{
+		// approved
+		{
+			requestBody:          []byte(`{"client_id":"somecli","client_secret":"secret","device_code":"somedevicecode"}`),
+			expectedResponseCode: http.StatusOK,
+		},
+		{
+			requestBody:          []byte(`{"device_code":"somedevicecode"}`),
+			basicAuth:            []string{"somecli", "secret"},
+			expectedResponseCode: http.StatusOK,
+		},
+		// a confidential client must authenticate
+		{
+			requestBody:          []byte(`{"client_id":"somecli","device_code":"somedevicecode"}`),
+			expectedResponseCode: http.StatusUnauthorized,
+			expectedResponseBody: []byte(`{"error":"invalid_client"}`),
+		},
+		// waiting for the user
+		{
+			requestBody:          []byte(`{"client_id":"somecli","client_secret":"secret","device_code":"pendingcode"}`),
+			expectedResponseCode: http.StatusBadRequest,
+			expectedResponseBody: []byte(`{"error":"authorization_pending"}`),
+		},
+		// unexpected error
+		{
+			requestBody:          []byte(`{"client_id":"somecli","client_secret":"secret","device_code":"broken"}`),
+			expectedResponseCode: http.StatusInternalServerError,
+			expectedResponseBody: []byte(`{"error":"server_error"}`),
+		},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("POST", path, bytes.NewBuffer(c.requestBody))
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		if c.basicAuth != nil {
+			rootRequest.SetBasicAuth(c.basicAuth[0], c.basicAuth[1])
+		}
+
+		ctrl := &apiController{as: &testAuthorizationServer{}}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.DeviceTokenPoll)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match")
+		if c.expectedResponseBody != nil {
+			assert.Equal(t, string(c.expectedResponseBody), string(bytes.TrimSpace(rr.Body.Bytes())), "body didn't match")
+		} else {
+			var resp model.Token
+			json.Unmarshal(rr.Body.Bytes(), &resp)
+			assert.True(t, resp.Token != "")
+			assert.True(t, resp.RefreshToken != "")
+		}
+	}
+}
+
+func TestDeviceApprovalDecide(t *testing.T) {
+	logger.InitLogger(true, true)
+	path := "/v1/device"
+
+	cases := []struct {
+		requestBody          []byte
+		expectedResponseCode int
+	}{
+		// ok
+		{
+			requestBody:          []byte(`{"user_code":"BCDF-GHJK","approve":true}`),
+			expectedResponseCode: http.StatusNoContent,
+		},
+		// expired or unknown code
+		{
+			requestBody:          []byte(`{"user_code":"ZZZZ-ZZZZ","approve":true}`),
+			expectedResponseCode: http.StatusNotFound,
+		},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("POST", path, bytes.NewBuffer(c.requestBody))
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		claims := security.Claims{UID: "someuid", Username: "tom"}
+		rootRequest = rootRequest.WithContext(context.WithValue(rootRequest.Context(), security.UserContextKey, claims))
+
+		ctrl := &apiController{as: &testAuthorizationServer{}}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.DeviceApprovalDecide)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match")
+	}
+}
@@ -0,0 +1,139 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/security"
+	"github.com/gkontos/goapi/util"
+)
+
+// reauthWindow is how long after logging in users can request the erasure of their own account
+var reauthWindow = 5 * time.Minute
+
+// RequestErasure schedules the anonymization of a user after the cooling-off period, during which the request can be
+// cancelled.  Without a cooling-off period the user is erased straight away.  Users erasing their own account must
+// have logged in recently.
+func (api *apiController) RequestErasure(w http.ResponseWriter, r *http.Request) {
+
+	uid, err := uidParam(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	claims := r.Context().Value(security.UserContextKey).(security.Claims)
+	if claims.UID == uid && !recentlyAuthenticated(claims) {
+		util.ReturnErrorJSON(w, &model.ReauthenticationRequiredError{Err: errors.New("log in again to erase your account")})
+		return
+	}
+
+	erasure, err := api.tenantDbh(r).ScheduleErasure(uid, claims.UID, time.Now().Add(api.erasureCoolingOff))
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error requesting erasure")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	api.audit(r, "user.erasure.request", uid, model.JSONMap{"erase_after": erasure.EraseAfter})
+
+	if api.erasureCoolingOff > 0 {
+		util.ReturnBodyJSON(w, erasure, http.StatusAccepted)
+		return
+	}
+	if err := api.eraseUser(claims.UID, uid); err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	if erasure, err = api.dbh.GetErasure(uid); err != nil {
+		logger.Logger.Error().Err(err).Msg("error getting erasure")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	util.ReturnBodyJSON(w, erasure, http.StatusOK)
+
+}
+
+// GetErasure returns the erasure requested for a user
+func (api *apiController) GetErasure(w http.ResponseWriter, r *http.Request) {
+
+	uid, err := uidParam(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	erasure, err := api.tenantDbh(r).GetErasure(uid)
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error getting erasure")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	util.ReturnBodyJSON(w, erasure, http.StatusOK)
+
+}
+
+// CancelErasure withdraws an erasure during its cooling-off period
+func (api *apiController) CancelErasure(w http.ResponseWriter, r *http.Request) {
+
+	uid, err := uidParam(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	if err := api.tenantDbh(r).CancelErasure(uid); err != nil {
+		logger.Logger.Error().Err(err).Msg("error cancelling erasure")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	api.audit(r, "user.erasure.cancel", uid, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
+
+// EraseDueUsers erases the users whose cooling-off period has passed
+func (api *apiController) EraseDueUsers() {
+	uids, err := api.dbh.GetDueErasures()
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error getting due erasures")
+		return
+	}
+	for _, uid := range uids {
+		// a failed erasure stays due and is retried
+		_ = api.eraseUser("", uid)
+	}
+}
+
+// RunErasures erases due users every interval.  It does not return.
+func (api *apiController) RunErasures(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		api.EraseDueUsers()
+	}
+}
+
+// eraseUser anonymizes the user and records the erasure.  The audit entry has no details so that it does not
+// identify the user.
+func (api *apiController) eraseUser(actorUID string, uid string) error {
+	if err := api.dbh.EraseUser(uid); err != nil {
+		logger.Logger.Error().Err(err).Str("uid", uid).Msg("unable to erase user")
+		return err
+	}
+	security.InvalidateUser(uid)
+	entry := &model.AuditEntry{ActorUID: actorUID, Action: "user.erase", TargetUID: uid}
+	if err := api.dbh.InsertAuditEntry(entry); err != nil {
+		logger.Logger.Error().Err(err).Str("action", entry.Action).Str("target_uid", uid).Msg("unable to write audit entry")
+	}
+	return nil
+}
+
+// recentlyAuthenticated reports whether the user logged in within the reauthWindow.  Refreshing a token keeps the
+// time of the original login.
+func recentlyAuthenticated(claims security.Claims) bool {
+	return claims.AuthTime != nil && time.Since(claims.AuthTime.Time) <= reauthWindow
+}
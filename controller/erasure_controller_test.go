@@ -0,0 +1,179 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gkontos/goapi/db"
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/security"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestErasure(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	recent := jwt.NewNumericDate(time.Now().Add(-time.Minute))
+	stale := jwt.NewNumericDate(time.Now().Add(-time.Hour))
+
+	cases := []struct {
+		name                 string
+		uid                  string
+		claims               security.Claims
+		coolingOff           time.Duration
+		expectedResponseCode int
+		expectedCode         string
+		expectedAudits       []string
+		expectedErased       bool
+	}{
+		{name: "self after logging in", uid: testUID, claims: security.Claims{UID: testUID, AuthTime: recent},
+			expectedResponseCode: http.StatusOK, expectedAudits: []string{"user.erasure.request", "user.erase"}, expectedErased: true},
+		{name: "self without logging in again", uid: testUID, claims: security.Claims{UID: testUID, AuthTime: stale},
+			expectedResponseCode: http.StatusUnauthorized, expectedCode: "reauthentication_required"},
+		{name: "self without auth time", uid: testUID, claims: security.Claims{UID: testUID},
+			expectedResponseCode: http.StatusUnauthorized, expectedCode: "reauthentication_required"},
+		{name: "admin", uid: testUID, claims: security.Claims{UID: "someadminuid", AuthTime: stale},
+			expectedResponseCode: http.StatusOK, expectedAudits: []string{"user.erasure.request", "user.erase"}, expectedErased: true},
+		{name: "admin with cooling off", uid: testUID, claims: security.Claims{UID: "someadminuid"}, coolingOff: 72 * time.Hour,
+			expectedResponseCode: http.StatusAccepted, expectedAudits: []string{"user.erasure.request"}},
+		{name: "missing user", uid: "8a4f1f16-5e44-4f55-8a44-5d6b0c7e9d21", claims: security.Claims{UID: "someadminuid"},
+			expectedResponseCode: http.StatusNotFound},
+		{name: "not a uid", uid: "tom", claims: security.Claims{UID: "someadminuid"},
+			expectedResponseCode: http.StatusNotFound},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("POST", "/v1/users/"+c.uid+"/erasure", nil)
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		rootRequest = withURLParams(rootRequest, map[string]string{"uid": c.uid})
+		rootRequest = withClaims(rootRequest, c.claims)
+
+		dbh := &erasureTestDbHandler{}
+		ctrl := &apiController{dbh: dbh, erasureCoolingOff: c.coolingOff}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.RequestErasure)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match %s", c.name)
+		if c.expectedCode != "" {
+			var body map[string]string
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+			assert.Equal(t, c.expectedCode, body["code"], c.name)
+		}
+		actions := make([]string, 0)
+		for _, a := range dbh.audits {
+			actions = append(actions, a.Action)
+		}
+		assert.Equal(t, len(c.expectedAudits), len(actions), c.name)
+		if len(c.expectedAudits) > 0 {
+			assert.Equal(t, c.expectedAudits, actions, c.name)
+		}
+		assert.Equal(t, c.expectedErased, dbh.erased, c.name)
+	}
+}
+
+func TestCancelErasure(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	cases := []struct {
+		erasure              *model.Erasure
+		expectedResponseCode int
+		expectedAudits       int
+	}{
+		{erasure: &model.Erasure{UID: testUID}, expectedResponseCode: http.StatusNoContent, expectedAudits: 1},
+		// completed erasures can not be cancelled
+		{erasure: &model.Erasure{UID: testUID, CompletedAt: &time.Time{}}, expectedResponseCode: http.StatusNotFound},
+		{expectedResponseCode: http.StatusNotFound},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("DELETE", "/v1/users/"+testUID+"/erasure", nil)
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		rootRequest = withURLParams(rootRequest, map[string]string{"uid": testUID})
+		rootRequest = withClaims(rootRequest, security.Claims{UID: testUID})
+
+		dbh := &erasureTestDbHandler{erasure: c.erasure}
+		ctrl := &apiController{dbh: dbh}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.CancelErasure)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match")
+		assert.Equal(t, c.expectedAudits, len(dbh.audits))
+	}
+}
+
+func TestEraseDueUsers(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	dbh := &erasureTestDbHandler{erasure: &model.Erasure{UID: testUID}, due: true}
+	(&apiController{dbh: dbh}).EraseDueUsers()
+
+	assert.True(t, dbh.erased)
+	assert.Equal(t, 1, len(dbh.audits))
+	assert.Equal(t, "user.erase", dbh.audits[0].Action)
+	assert.Equal(t, testUID, dbh.audits[0].TargetUID)
+	assert.Nil(t, dbh.audits[0].Details)
+}
+
+// erasureTestDbHandler holds a single erasure of testUID
+type erasureTestDbHandler struct {
+	roleTestDbHandler
+	erasure *model.Erasure
+	due     bool
+	erased  bool
+}
+
+func (d *erasureTestDbHandler) WithTenant(orgID string) db.DbHandler {
+	return d
+}
+
+func (d *erasureTestDbHandler) ScheduleErasure(uid string, requestedBy string, eraseAfter time.Time) (*model.Erasure, error) {
+	if uid != testUID {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("user does not exist")}
+	}
+	d.erasure = &model.Erasure{UID: uid, RequestedBy: requestedBy, RequestedAt: time.Now(), EraseAfter: eraseAfter}
+	return d.erasure, nil
+}
+
+func (d *erasureTestDbHandler) GetErasure(uid string) (*model.Erasure, error) {
+	if d.erasure == nil || uid != d.erasure.UID {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("erasure has not been requested")}
+	}
+	return d.erasure, nil
+}
+
+func (d *erasureTestDbHandler) CancelErasure(uid string) error {
+	if d.erasure == nil || uid != d.erasure.UID || d.erasure.CompletedAt != nil {
+		return &model.ResourceDoesNotExistError{Err: errors.New("there is no pending erasure")}
+	}
+	d.erasure = nil
+	return nil
+}
+
+func (d *erasureTestDbHandler) GetDueErasures() ([]string, error) {
+	if d.due && d.erasure != nil {
+		return []string{d.erasure.UID}, nil
+	}
+	return []string{}, nil
+}
+
+func (d *erasureTestDbHandler) EraseUser(uid string) error {
+	if d.erasure == nil || uid != d.erasure.UID || d.erasure.CompletedAt != nil {
+		return &model.ResourceDoesNotExistError{Err: errors.New("there is no pending erasure")}
+	}
+	now := time.Now()
+	d.erasure.CompletedAt = &now
+	d.erased = true
+	return nil
+}
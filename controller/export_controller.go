@@ -0,0 +1,141 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/security"
+	"github.com/gkontos/goapi/util"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// exportWait is how long a request waits for an export before answering with its status instead
+var exportWait = 2 * time.Second
+
+// ExportCurrentUser generates an archive of everything stored about the authenticated user.  The archive is returned
+// when it is ready within exportWait, otherwise the pending export is returned with its status url in Location.
+func (api *apiController) ExportCurrentUser(w http.ResponseWriter, r *http.Request) {
+
+	claims := r.Context().Value(security.UserContextKey).(security.Claims)
+
+	// an export which is still being generated is not started again
+	export, err := api.dbh.GetPendingUserExport(claims.UID)
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error getting pending export")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	if export == nil {
+		if export, err = api.dbh.InsertUserExport(claims.UID); err != nil {
+			logger.Logger.Error().Err(err).Msg("error starting export")
+			util.ReturnErrorJSON(w, err)
+			return
+		}
+		api.audit(r, "user.export", claims.UID, model.JSONMap{"export_id": export.ID})
+		done := api.generateExport(export)
+		select {
+		case <-done:
+			if export, err = api.dbh.GetUserExport(claims.UID, export.ID); err != nil {
+				logger.Logger.Error().Err(err).Msg("error getting export")
+				util.ReturnErrorJSON(w, err)
+				return
+			}
+		case <-time.After(exportWait):
+		}
+	}
+
+	if export.Status == model.ExportStatusComplete {
+		api.writeExportArchive(w, claims.UID, export.ID)
+		return
+	}
+	w.Header().Set("Location", "/v1/users/me/export/"+export.ID)
+	util.ReturnBodyJSON(w, export, http.StatusAccepted)
+
+}
+
+// GetCurrentUserExport returns the status of one of the authenticated user's exports
+func (api *apiController) GetCurrentUserExport(w http.ResponseWriter, r *http.Request) {
+
+	claims := r.Context().Value(security.UserContextKey).(security.Claims)
+	id, err := exportParam(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	export, err := api.dbh.GetUserExport(claims.UID, id)
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error getting export")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	util.ReturnBodyJSON(w, export, http.StatusOK)
+
+}
+
+// DownloadCurrentUserExport returns the archive of one of the authenticated user's completed exports
+func (api *apiController) DownloadCurrentUserExport(w http.ResponseWriter, r *http.Request) {
+
+	claims := r.Context().Value(security.UserContextKey).(security.Claims)
+	id, err := exportParam(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	api.writeExportArchive(w, claims.UID, id)
+
+}
+
+// generateExport assembles and stores the export's archive in the background.  The channel is closed when the export
+// is complete or has failed.
+func (api *apiController) generateExport(export *model.UserExport) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		archive, err := api.dbh.GetUserArchive(export.UID)
+		var doc []byte
+		if err == nil {
+			doc, err = json.Marshal(archive)
+		}
+		if err != nil {
+			logger.Logger.Error().Err(err).Str("export_id", export.ID).Msg("unable to generate export")
+			err = errors.New("unable to generate export")
+		}
+		if err := api.dbh.CompleteUserExport(export.ID, doc, err); err != nil {
+			logger.Logger.Error().Err(err).Str("export_id", export.ID).Msg("unable to store export")
+		}
+	}()
+	return done
+}
+
+func (api *apiController) writeExportArchive(w http.ResponseWriter, uid string, id string) {
+	archive, err := api.dbh.GetUserExportArchive(uid, id)
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error getting export archive")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="user-export-%s.json"`, id))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(archive); err != nil {
+		logger.Logger.Error().Err(err).Msg("error writing export archive")
+	}
+}
+
+// exportParam returns the export url parameter.  An id which is not a uuid can not exist.
+func exportParam(r *http.Request) (string, error) {
+	id := chi.URLParam(r, "export")
+	if _, err := uuid.Parse(id); err != nil {
+		return "", &model.ResourceDoesNotExistError{Err: errors.New("export does not exist")}
+	}
+	return id, nil
+}
@@ -0,0 +1,185 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/security"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportCurrentUser(t *testing.T) {
+	logger.InitLogger(true, true)
+	defer func(wait time.Duration) { exportWait = wait }(exportWait)
+	exportWait = 50 * time.Millisecond
+
+	export := func(dbh *exportTestDbHandler) *httptest.ResponseRecorder {
+		rootRequest, err := http.NewRequest("GET", "/v1/users/me/export", nil)
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		rootRequest = withClaims(rootRequest, security.Claims{UID: testUID, Username: "tom"})
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc((&apiController{dbh: dbh}).ExportCurrentUser)
+		handler.ServeHTTP(rr, rootRequest)
+		return rr
+	}
+
+	// a small account is downloaded straight away
+	dbh := &exportTestDbHandler{exports: map[string]*model.UserExport{}, archives: map[string][]byte{}}
+	rr := export(dbh)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Header().Get("Content-Disposition"), "attachment; filename=\"user-export-")
+	var archive model.UserArchive
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &archive))
+	assert.Equal(t, testUID, archive.User.UID)
+	assert.Equal(t, 1, len(dbh.audits))
+	assert.Equal(t, "user.export", dbh.audits[0].Action)
+
+	// a large account is generated in the background
+	dbh = &exportTestDbHandler{exports: map[string]*model.UserExport{}, archives: map[string][]byte{}, release: make(chan struct{})}
+	rr = export(dbh)
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	var pending model.UserExport
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &pending))
+	assert.Equal(t, model.ExportStatusPending, pending.Status)
+	assert.Equal(t, "/v1/users/me/export/"+pending.ID, rr.Header().Get("Location"))
+
+	// asking again while it is pending does not start another export
+	rr = export(dbh)
+	assert.Equal(t, http.StatusAccepted, rr.Code)
+	assert.Equal(t, 1, len(dbh.audits))
+
+	close(dbh.release)
+	assert.Eventually(t, func() bool {
+		return dbh.status(pending.ID) == model.ExportStatusComplete
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestGetCurrentUserExport(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	completeID := uuid.NewString()
+	otherID := uuid.NewString()
+	dbh := &exportTestDbHandler{
+		exports: map[string]*model.UserExport{
+			completeID: {ID: completeID, UID: testUID, Status: model.ExportStatusComplete},
+			otherID:    {ID: otherID, UID: "someotheruid", Status: model.ExportStatusComplete},
+		},
+		archives: map[string][]byte{completeID: []byte(`{"user":{}}`), otherID: []byte(`{"user":{}}`)},
+	}
+	ctrl := &apiController{dbh: dbh}
+
+	cases := []struct {
+		id                   string
+		handler              http.HandlerFunc
+		expectedResponseCode int
+		expectedResponseBody string
+	}{
+		{id: completeID, handler: ctrl.GetCurrentUserExport, expectedResponseCode: http.StatusOK},
+		{id: completeID, handler: ctrl.DownloadCurrentUserExport, expectedResponseCode: http.StatusOK, expectedResponseBody: `{"user":{}}`},
+		// exports of other users can not be seen
+		{id: otherID, handler: ctrl.GetCurrentUserExport, expectedResponseCode: http.StatusNotFound},
+		{id: otherID, handler: ctrl.DownloadCurrentUserExport, expectedResponseCode: http.StatusNotFound},
+		{id: "garbage", handler: ctrl.GetCurrentUserExport, expectedResponseCode: http.StatusNotFound},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("GET", "/v1/users/me/export/"+c.id, nil)
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		rootRequest = withURLParams(rootRequest, map[string]string{"export": c.id})
+		rootRequest = withClaims(rootRequest, security.Claims{UID: testUID, Username: "tom"})
+
+		rr := httptest.NewRecorder()
+		c.handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match %s", c.id)
+		if c.expectedResponseBody != "" {
+			assert.Equal(t, c.expectedResponseBody, string(bytes.TrimSpace(rr.Body.Bytes())))
+		}
+	}
+}
+
+// exportTestDbHandler stores exports in memory.  When release is set the archive is not assembled until it is closed.
+type exportTestDbHandler struct {
+	roleTestDbHandler
+	mu       sync.Mutex
+	exports  map[string]*model.UserExport
+	archives map[string][]byte
+	release  chan struct{}
+}
+
+func (d *exportTestDbHandler) status(id string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.exports[id].Status
+}
+
+func (d *exportTestDbHandler) InsertUserExport(uid string) (*model.UserExport, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e := &model.UserExport{ID: uuid.NewString(), UID: uid, Status: model.ExportStatusPending}
+	d.exports[e.ID] = e
+	copied := *e
+	return &copied, nil
+}
+
+func (d *exportTestDbHandler) GetPendingUserExport(uid string) (*model.UserExport, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, e := range d.exports {
+		if e.UID == uid && e.Status == model.ExportStatusPending {
+			copied := *e
+			return &copied, nil
+		}
+	}
+	return nil, nil
+}
+
+func (d *exportTestDbHandler) GetUserExport(uid string, id string) (*model.UserExport, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.exports[id]; ok && e.UID == uid {
+		copied := *e
+		return &copied, nil
+	}
+	return nil, &model.ResourceDoesNotExistError{Err: errors.New("export does not exist")}
+}
+
+func (d *exportTestDbHandler) GetUserExportArchive(uid string, id string) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.exports[id]; ok && e.UID == uid && e.Status == model.ExportStatusComplete {
+		return d.archives[id], nil
+	}
+	return nil, &model.ResourceDoesNotExistError{Err: errors.New("export does not exist or is not complete")}
+}
+
+func (d *exportTestDbHandler) CompleteUserExport(id string, archive []byte, exportErr error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.exports[id].Status = model.ExportStatusComplete
+	if exportErr != nil {
+		d.exports[id].Status = model.ExportStatusFailed
+	}
+	d.archives[id] = archive
+	return nil
+}
+
+func (d *exportTestDbHandler) GetUserArchive(uid string) (*model.UserArchive, error) {
+	if d.release != nil {
+		<-d.release
+	}
+	return &model.UserArchive{User: &model.User{UID: uid}}, nil
+}
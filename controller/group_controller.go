@@ -0,0 +1,220 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/security"
+	"github.com/gkontos/goapi/util"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+type GroupRequest struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Roles       []string `json:"roles"`
+}
+
+func (api *apiController) GetGroups(w http.ResponseWriter, r *http.Request) {
+
+	groups, err := api.tenantDbh(r).GetGroups()
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error getting groups")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	util.ReturnBodyJSON(w, groups, http.StatusOK)
+
+}
+
+func (api *apiController) GetGroup(w http.ResponseWriter, r *http.Request) {
+
+	id, err := groupParam(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	group, err := api.tenantDbh(r).GetGroup(id)
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error getting group")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	util.ReturnBodyJSON(w, group, http.StatusOK)
+
+}
+
+func (api *apiController) CreateGroup(w http.ResponseWriter, r *http.Request) {
+
+	group, err := api.parseGroupRequest(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	if err := api.tenantDbh(r).InsertGroup(group); err != nil {
+		logger.Logger.Error().Err(err).Msg("error creating group")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	api.audit(r, "group.create", "", model.JSONMap{"group_id": group.ID, "name": group.Name, "roles": group.Roles})
+
+	util.ReturnBodyJSON(w, group, http.StatusCreated)
+
+}
+
+func (api *apiController) UpdateGroup(w http.ResponseWriter, r *http.Request) {
+
+	id, err := groupParam(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	group, err := api.parseGroupRequest(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	group.ID = id
+
+	if err := api.tenantDbh(r).UpdateGroup(group); err != nil {
+		logger.Logger.Error().Err(err).Msg("error updating group")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	security.InvalidateUsers()
+	api.audit(r, "group.update", "", model.JSONMap{"group_id": group.ID, "name": group.Name, "roles": group.Roles})
+
+	util.ReturnBodyJSON(w, group, http.StatusOK)
+
+}
+
+func (api *apiController) DeleteGroup(w http.ResponseWriter, r *http.Request) {
+
+	id, err := groupParam(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	if err := api.tenantDbh(r).DeleteGroup(id); err != nil {
+		logger.Logger.Error().Err(err).Msg("error deleting group")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	security.InvalidateUsers()
+	api.audit(r, "group.delete", "", model.JSONMap{"group_id": id})
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
+
+func (api *apiController) GetGroupMembers(w http.ResponseWriter, r *http.Request) {
+
+	id, err := groupParam(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	uids, err := api.tenantDbh(r).GetGroupMembers(id)
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error getting group members")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	util.ReturnBodyJSON(w, uids, http.StatusOK)
+
+}
+
+func (api *apiController) AddGroupMember(w http.ResponseWriter, r *http.Request) {
+
+	id, err := groupParam(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	uid, err := uidParam(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	dbh := api.tenantDbh(r)
+	// only members of the organization can join its groups
+	if _, err := dbh.GetUserByUID(uid); err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	if err := dbh.AddGroupMember(id, uid); err != nil {
+		logger.Logger.Error().Err(err).Msg("error adding group member")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	security.InvalidateUser(uid)
+	api.audit(r, "group.member.add", uid, model.JSONMap{"group_id": id})
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
+
+func (api *apiController) RemoveGroupMember(w http.ResponseWriter, r *http.Request) {
+
+	id, err := groupParam(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	uid, err := uidParam(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	if err := api.tenantDbh(r).RemoveGroupMember(id, uid); err != nil {
+		logger.Logger.Error().Err(err).Msg("error removing group member")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	security.InvalidateUser(uid)
+	api.audit(r, "group.member.remove", uid, model.JSONMap{"group_id": id})
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
+
+func (api *apiController) parseGroupRequest(r *http.Request) (*model.Group, error) {
+	groupRequest := &GroupRequest{}
+	if parseErr := util.ParseJsonRequest(r, &groupRequest); parseErr != nil {
+		return nil, parseErr
+	}
+	if groupRequest.Name == "" {
+		return nil, &model.ValidationError{Err: errors.New("name is required")}
+	}
+	for _, role := range groupRequest.Roles {
+		if err := api.validateRole(role); err != nil {
+			return nil, err
+		}
+	}
+	return &model.Group{
+		Name:        groupRequest.Name,
+		Description: groupRequest.Description,
+		Roles:       groupRequest.Roles,
+	}, nil
+}
+
+// groupParam returns the group url parameter.  A group id which is not a uuid can not exist.
+func groupParam(r *http.Request) (string, error) {
+	id := chi.URLParam(r, "group")
+	if _, err := uuid.Parse(id); err != nil {
+		return "", &model.ResourceDoesNotExistError{Err: errors.New("group does not exist")}
+	}
+	return id, nil
+}
@@ -0,0 +1,136 @@
+package controller
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gkontos/goapi/db"
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/security"
+	"github.com/stretchr/testify/assert"
+)
+
+const testGroupID = "2f4b6d8a-1c3e-4a5b-9c7d-8e9f0a1b2c3d"
+
+func TestCreateGroup(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	cases := []struct {
+		requestBody          []byte
+		expectedResponseCode int
+		expectedResponseBody []byte
+		expectedGroups       int
+	}{
+		// ok
+		{
+			requestBody:          []byte(`{"name":"support","roles":["ROLE_ADMIN"]}`),
+			expectedResponseCode: http.StatusCreated,
+			expectedGroups:       1,
+		},
+		// name is required
+		{
+			requestBody:          []byte(`{"roles":["ROLE_ADMIN"]}`),
+			expectedResponseCode: http.StatusBadRequest,
+			expectedResponseBody: []byte(`{"error":"name is required"}`),
+		},
+		// role which is not defined
+		{
+			requestBody:          []byte(`{"name":"support","roles":["ROLE_KING"]}`),
+			expectedResponseCode: http.StatusBadRequest,
+			expectedResponseBody: []byte(`{"error":"role ROLE_KING does not exist"}`),
+		},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("POST", "/v1/groups", bytes.NewBuffer(c.requestBody))
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		rootRequest = withClaims(rootRequest, security.Claims{UID: "someadminuid", Username: "admin", Org: testOrgID})
+
+		dbh := &groupTestDbHandler{}
+		ctrl := &apiController{dbh: dbh}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.CreateGroup)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match")
+		if c.expectedResponseBody != nil {
+			assert.Equal(t, string(c.expectedResponseBody), string(bytes.TrimSpace(rr.Body.Bytes())), "body didn't match")
+		}
+		assert.Equal(t, c.expectedGroups, len(dbh.groups))
+		for _, g := range dbh.groups {
+			assert.Equal(t, testOrgID, g.OrgID)
+		}
+	}
+}
+
+func TestAddGroupMember(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	cases := []struct {
+		group                string
+		uid                  string
+		expectedResponseCode int
+		expectedMembers      int
+	}{
+		{group: testGroupID, uid: testUID, expectedResponseCode: http.StatusNoContent, expectedMembers: 1},
+		// user is not a member of the organization
+		{group: testGroupID, uid: "8a4f1f16-5e44-4f55-8a44-5d6b0c7e9d21", expectedResponseCode: http.StatusNotFound},
+		// group id is not a uuid
+		{group: "support", uid: testUID, expectedResponseCode: http.StatusNotFound},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("PUT", "/v1/groups/"+c.group+"/members/"+c.uid, nil)
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		rootRequest = withURLParams(rootRequest, map[string]string{"group": c.group, "uid": c.uid})
+		rootRequest = withClaims(rootRequest, security.Claims{UID: "someadminuid", Username: "admin", Org: testOrgID})
+
+		dbh := &groupTestDbHandler{}
+		ctrl := &apiController{dbh: dbh}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.AddGroupMember)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match")
+		assert.Equal(t, c.expectedMembers, len(dbh.members))
+	}
+}
+
+type groupTestDbHandler struct {
+	roleTestDbHandler
+	tenant  string
+	groups  []*model.Group
+	members []string
+}
+
+func (d *groupTestDbHandler) WithTenant(orgID string) db.DbHandler {
+	d.tenant = orgID
+	return d
+}
+
+func (d *groupTestDbHandler) GetUserByUID(uid string) (*model.User, error) {
+	if uid != testUID {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("user does not exist")}
+	}
+	return &model.User{UID: uid}, nil
+}
+
+func (d *groupTestDbHandler) InsertGroup(g *model.Group) error {
+	g.ID = testGroupID
+	g.OrgID = d.tenant
+	d.groups = append(d.groups, g)
+	return nil
+}
+
+func (d *groupTestDbHandler) AddGroupMember(id string, uid string) error {
+	d.members = append(d.members, uid)
+	return nil
+}
@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/security"
+	"github.com/gkontos/goapi/util"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// defaultInvitationExpiry is used when an invitation is created without expires_at
+const defaultInvitationExpiry = 7 * 24 * time.Hour
+
+type InvitationRequest struct {
+	Email     string     `json:"email"`
+	Roles     []string   `json:"roles"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func (api *apiController) GetInvitations(w http.ResponseWriter, r *http.Request) {
+
+	invitations, err := api.dbh.GetInvitations()
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error getting invitations")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	util.ReturnBodyJSON(w, invitations, http.StatusOK)
+
+}
+
+// CreateInvitation invites an email with roles which replace the default role when the email first logs in
+func (api *apiController) CreateInvitation(w http.ResponseWriter, r *http.Request) {
+
+	invitationRequest := &InvitationRequest{}
+	if parseErr := util.ParseJsonRequest(r, &invitationRequest); parseErr != nil {
+		util.ReturnErrorJSON(w, parseErr)
+		return
+	}
+	email := strings.ToLower(strings.TrimSpace(invitationRequest.Email))
+	if _, err := mail.ParseAddress(email); err != nil {
+		util.ReturnErrorJSON(w, &model.ValidationError{Err: errors.New("email is not a valid address")})
+		return
+	}
+	if len(invitationRequest.Roles) == 0 {
+		util.ReturnErrorJSON(w, &model.ValidationError{Err: errors.New("roles are required")})
+		return
+	}
+	for _, role := range invitationRequest.Roles {
+		if err := api.validateRole(role); err != nil {
+			util.ReturnErrorJSON(w, err)
+			return
+		}
+	}
+	if err := api.checkGrantable(r, invitationRequest.Roles); err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	expiresAt := time.Now().Add(defaultInvitationExpiry)
+	if invitationRequest.ExpiresAt != nil {
+		if !invitationRequest.ExpiresAt.After(time.Now()) {
+			util.ReturnErrorJSON(w, &model.ValidationError{Err: errors.New("expires_at must be in the future")})
+			return
+		}
+		expiresAt = *invitationRequest.ExpiresAt
+	}
+
+	claims := r.Context().Value(security.UserContextKey).(security.Claims)
+	invitation := &model.Invitation{
+		Email:     email,
+		Roles:     invitationRequest.Roles,
+		InvitedBy: claims.UID,
+		ExpiresAt: expiresAt,
+	}
+	if err := api.dbh.InsertInvitation(invitation); err != nil {
+		logger.Logger.Error().Err(err).Msg("error creating invitation")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	api.audit(r, "invitation.create", "", model.JSONMap{"invitation_id": invitation.ID, "email": invitation.Email, "roles": invitation.Roles})
+
+	util.ReturnBodyJSON(w, invitation, http.StatusCreated)
+
+}
+
+// DeleteInvitation withdraws an invitation which has not been accepted
+func (api *apiController) DeleteInvitation(w http.ResponseWriter, r *http.Request) {
+
+	id, err := invitationParam(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	if err := api.dbh.DeleteInvitation(id); err != nil {
+		logger.Logger.Error().Err(err).Msg("error deleting invitation")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	api.audit(r, "invitation.delete", "", model.JSONMap{"invitation_id": id})
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
+
+// invitationParam returns the invitation url parameter.  An id which is not a uuid can not exist.
+func invitationParam(r *http.Request) (string, error) {
+	id := chi.URLParam(r, "invitation")
+	if _, err := uuid.Parse(id); err != nil {
+		return "", &model.ResourceDoesNotExistError{Err: errors.New("invitation does not exist")}
+	}
+	return id, nil
+}
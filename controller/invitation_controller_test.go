@@ -0,0 +1,99 @@
+package controller
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/security"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateInvitation(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	cases := []struct {
+		inviterRoles         []string
+		requestBody          []byte
+		expectedResponseCode int
+		expectedResponseBody []byte
+		expectedInvitations  int
+	}{
+		// ok, the email is normalized and the invitation expires in a week
+		{
+			requestBody:          []byte(`{"email":" Anna@Example.com","roles":["ROLE_ADMIN"]}`),
+			expectedResponseCode: http.StatusCreated,
+			expectedInvitations:  1,
+		},
+		{
+			requestBody:          []byte(`{"email":"anna","roles":["ROLE_ADMIN"]}`),
+			expectedResponseCode: http.StatusBadRequest,
+			expectedResponseBody: []byte(`{"error":"email is not a valid address"}`),
+		},
+		{
+			requestBody:          []byte(`{"email":"anna@example.com"}`),
+			expectedResponseCode: http.StatusBadRequest,
+			expectedResponseBody: []byte(`{"error":"roles are required"}`),
+		},
+		{
+			requestBody:          []byte(`{"email":"anna@example.com","roles":["ROLE_KING"]}`),
+			expectedResponseCode: http.StatusBadRequest,
+			expectedResponseBody: []byte(`{"error":"role ROLE_KING does not exist"}`),
+		},
+		{
+			requestBody:          []byte(`{"email":"anna@example.com","roles":["ROLE_ADMIN"],"expires_at":"2020-01-01T00:00:00Z"}`),
+			expectedResponseCode: http.StatusBadRequest,
+			expectedResponseBody: []byte(`{"error":"expires_at must be in the future"}`),
+		},
+		// users can not invite with roles which they do not hold
+		{
+			inviterRoles:         []string{security.UserRole},
+			requestBody:          []byte(`{"email":"anna@example.com","roles":["ROLE_ADMIN"]}`),
+			expectedResponseCode: http.StatusForbidden,
+			expectedResponseBody: []byte(`{"error":"role ROLE_ADMIN can not be granted by a user who does not hold it","code":"permission_denied"}`),
+		},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("POST", "/v1/invitations", bytes.NewBuffer(c.requestBody))
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		if c.inviterRoles == nil {
+			c.inviterRoles = []string{security.AdministratorRole}
+		}
+		rootRequest = withClaims(rootRequest, security.Claims{UID: "someadminuid", Username: "admin", Roles: c.inviterRoles})
+
+		dbh := &invitationTestDbHandler{}
+		ctrl := &apiController{dbh: dbh, th: &testTokenHandler{}}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.CreateInvitation)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match")
+		if c.expectedResponseBody != nil {
+			assert.Equal(t, string(c.expectedResponseBody), string(bytes.TrimSpace(rr.Body.Bytes())), "body didn't match")
+		}
+		assert.Equal(t, c.expectedInvitations, len(dbh.invitations))
+		assert.Equal(t, c.expectedInvitations, len(dbh.audits))
+		for _, i := range dbh.invitations {
+			assert.Equal(t, "anna@example.com", i.Email)
+			assert.Equal(t, "someadminuid", i.InvitedBy)
+			assert.WithinDuration(t, time.Now().Add(defaultInvitationExpiry), i.ExpiresAt, time.Minute)
+		}
+	}
+}
+
+type invitationTestDbHandler struct {
+	roleTestDbHandler
+	invitations []*model.Invitation
+}
+
+func (d *invitationTestDbHandler) InsertInvitation(i *model.Invitation) error {
+	d.invitations = append(d.invitations, i)
+	return nil
+}
@@ -0,0 +1,51 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/util"
+)
+
+// GetUserLogins returns a page of the user's logins and refreshes, newest first.  It takes the limit and cursor
+// parameters of the users listing.
+func (api *apiController) GetUserLogins(w http.ResponseWriter, r *http.Request) {
+
+	uid, err := uidParam(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	params := r.URL.Query()
+	query := model.LoginEventQuery{UID: uid}
+	if query.Limit, err = pageLimit(params); err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	if v := params.Get("cursor"); v != "" {
+		if query.Before, err = strconv.ParseInt(v, 10, 64); err != nil || query.Before <= 0 {
+			util.ReturnErrorJSON(w, &model.ValidationError{Err: errors.New("invalid cursor")})
+			return
+		}
+	}
+
+	// the user must be visible in the active organization
+	if _, err := api.tenantDbh(r).GetUserByUID(uid); err != nil {
+		logger.Logger.Error().Err(err).Msg("error getting user")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	page, err := api.dbh.GetLoginEvents(query)
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error getting logins")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	setPageLinks(w, r, page.NextCursor)
+	util.ReturnBodyJSON(w, page, http.StatusOK)
+
+}
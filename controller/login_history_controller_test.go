@@ -0,0 +1,138 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gkontos/goapi/db"
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/security"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetUserLogins(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	cases := []struct {
+		uid                  string
+		query                string
+		expectedResponseCode int
+		expectedResponseBody []byte
+		expectedQuery        model.LoginEventQuery
+		expectedLink         string
+	}{
+		{uid: testUID, expectedResponseCode: http.StatusOK,
+			expectedQuery: model.LoginEventQuery{UID: testUID, Limit: model.DefaultUserPageSize},
+			expectedLink:  `</v1/users/` + testUID + `/logins>; rel="first"`},
+		{uid: testUID, query: "?limit=1&cursor=42", expectedResponseCode: http.StatusOK,
+			expectedQuery: model.LoginEventQuery{UID: testUID, Limit: 1, Before: 42},
+			expectedLink:  `</v1/users/` + testUID + `/logins?limit=1>; rel="first", </v1/users/` + testUID + `/logins?cursor=41&limit=1>; rel="next"`},
+		{uid: testUID, query: "?cursor=abc", expectedResponseCode: http.StatusBadRequest,
+			expectedResponseBody: []byte(`{"error":"invalid cursor"}`)},
+		{uid: "8a4f1f16-5e44-4f55-8a44-5d6b0c7e9d21", expectedResponseCode: http.StatusNotFound,
+			expectedResponseBody: []byte(`{"error":"user does not exist"}`)},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("GET", "/v1/users/"+c.uid+"/logins"+c.query, nil)
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		rootRequest = withURLParams(rootRequest, map[string]string{"uid": c.uid})
+		rootRequest = withClaims(rootRequest, security.Claims{UID: testUID, Username: "user"})
+
+		dbh := &loginHistoryTestDbHandler{}
+		ctrl := &apiController{dbh: dbh}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.GetUserLogins)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match")
+		if c.expectedResponseBody != nil {
+			assert.Equal(t, string(c.expectedResponseBody), string(bytes.TrimSpace(rr.Body.Bytes())), "body didn't match")
+			continue
+		}
+		assert.Equal(t, c.expectedQuery, dbh.query)
+		assert.Equal(t, c.expectedLink, rr.Header().Get("Link"))
+		var page model.LoginEventPage
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &page))
+		assert.Equal(t, "192.0.2.1", page.Logins[0].IPAddress)
+	}
+}
+
+func TestLoginClient(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	tests := []struct {
+		name            string
+		trustedProxies  []*net.IPNet
+		remoteAddr      string
+		forwarded       []string
+		expectedAddress string
+	}{
+		{name: "direct", remoteAddr: "198.51.100.7:5123", expectedAddress: "198.51.100.7"},
+		{name: "forged header without a trusted proxy", remoteAddr: "198.51.100.7:5123",
+			forwarded: []string{"192.0.2.1"}, expectedAddress: "198.51.100.7"},
+		{name: "behind a trusted proxy", trustedProxies: []*net.IPNet{proxies}, remoteAddr: "10.0.0.2:5123",
+			forwarded: []string{"192.0.2.1"}, expectedAddress: "192.0.2.1"},
+		{name: "forged header behind a trusted proxy", trustedProxies: []*net.IPNet{proxies}, remoteAddr: "10.0.0.2:5123",
+			forwarded: []string{"203.0.113.9, 192.0.2.1"}, expectedAddress: "192.0.2.1"},
+		{name: "behind a chain of trusted proxies", trustedProxies: []*net.IPNet{proxies}, remoteAddr: "10.0.0.2:5123",
+			forwarded: []string{"203.0.113.9, 192.0.2.1", "10.0.0.3"}, expectedAddress: "192.0.2.1"},
+		{name: "request not from the trusted proxy", trustedProxies: []*net.IPNet{proxies}, remoteAddr: "198.51.100.7:5123",
+			forwarded: []string{"192.0.2.1"}, expectedAddress: "198.51.100.7"},
+	}
+	for _, c := range tests {
+		t.Run(c.name, func(t *testing.T) {
+			ctrl := &apiController{trustedProxies: c.trustedProxies}
+			request := httptest.NewRequest("POST", "/v1/login", nil)
+			request.RemoteAddr = c.remoteAddr
+			request.Header.Set("User-Agent", "curl/8.0")
+			for _, forwarded := range c.forwarded {
+				request.Header.Add("X-Forwarded-For", forwarded)
+			}
+			assert.Equal(t, security.LoginClient{IPAddress: c.expectedAddress, UserAgent: "curl/8.0"}, ctrl.loginClient(request))
+		})
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.0.2.10")
+	ctrl := &apiController{trustedProxies: trustedProxies()}
+	assert.True(t, ctrl.isTrustedProxy("10.1.2.3"))
+	assert.True(t, ctrl.isTrustedProxy("192.0.2.10"))
+	assert.False(t, ctrl.isTrustedProxy("192.0.2.11"))
+}
+
+// loginHistoryTestDbHandler has the logins of testUID and returns a next page when the limit is 1
+type loginHistoryTestDbHandler struct {
+	roleTestDbHandler
+	query model.LoginEventQuery
+}
+
+func (d *loginHistoryTestDbHandler) WithTenant(orgID string) db.DbHandler {
+	return d
+}
+
+func (d *loginHistoryTestDbHandler) GetUserByUID(uid string) (*model.User, error) {
+	if uid != testUID {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("user does not exist")}
+	}
+	return &model.User{UID: uid}, nil
+}
+
+func (d *loginHistoryTestDbHandler) GetLoginEvents(query model.LoginEventQuery) (*model.LoginEventPage, error) {
+	d.query = query
+	page := &model.LoginEventPage{Logins: []model.LoginEvent{
+		{ID: 41, UID: query.UID, Type: model.LoginTypeLogin, IPAddress: "192.0.2.1", Outcome: model.LoginOutcomeSuccess},
+	}}
+	if query.Limit == 1 {
+		page.NextCursor = "41"
+	}
+	return page, nil
+}
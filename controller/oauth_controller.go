@@ -0,0 +1,132 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/security"
+	"github.com/gkontos/goapi/util"
+)
+
+type authorizeRedirect struct {
+	RedirectTo string `json:"redirect_to"`
+}
+
+// OAuthAuthorize issues an authorization code to a registered client for the authenticated user.
+// A consent page calling this endpoint with an Accept: application/json header will receive the redirect in the body.
+func (api *apiController) OAuthAuthorize(w http.ResponseWriter, r *http.Request) {
+
+	claims := r.Context().Value(security.UserContextKey).(security.Claims)
+	query := r.URL.Query()
+	authRequest := &security.AuthorizationRequest{
+		ResponseType:        query.Get("response_type"),
+		ClientID:            query.Get("client_id"),
+		RedirectURI:         query.Get("redirect_uri"),
+		Scope:               query.Get("scope"),
+		State:               query.Get("state"),
+		Nonce:               query.Get("nonce"),
+		CodeChallenge:       query.Get("code_challenge"),
+		CodeChallengeMethod: query.Get("code_challenge_method"),
+	}
+
+	redirect, err := api.as.Authorize(authRequest, claims)
+	if err != nil {
+		var oauthErr *security.OAuthError
+		if errors.As(err, &oauthErr) {
+			if oauthErr.RedirectURI != "" {
+				authorizeRespond(w, r, oauthErr.RedirectURI)
+				return
+			}
+			util.ReturnBodyJSON(w, oauthErr, oauthErr.Status)
+			return
+		}
+		logger.Logger.Error().Err(err).Msg("unable to authorize client")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	authorizeRespond(w, r, redirect)
+
+}
+
+func authorizeRespond(w http.ResponseWriter, r *http.Request, redirect string) {
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		util.ReturnBodyJSON(w, authorizeRedirect{RedirectTo: redirect}, http.StatusOK)
+		return
+	}
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// OAuthToken is the token endpoint for registered clients
+func (api *apiController) OAuthToken(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Cache-Control", "no-store")
+	if err := r.ParseForm(); err != nil {
+		util.ReturnBodyJSON(w, &security.OAuthError{Code: "invalid_request", Description: "unable to parse request"}, http.StatusBadRequest)
+		return
+	}
+
+	exchangeRequest := &security.TokenExchangeRequest{
+		GrantType:    r.PostForm.Get("grant_type"),
+		Code:         r.PostForm.Get("code"),
+		RedirectURI:  r.PostForm.Get("redirect_uri"),
+		CodeVerifier: r.PostForm.Get("code_verifier"),
+		RefreshToken: r.PostForm.Get("refresh_token"),
+		DeviceCode:   r.PostForm.Get("device_code"),
+		Client:       api.loginClient(r),
+	}
+	exchangeRequest.ClientID, exchangeRequest.ClientSecret = clientCredentials(r, r.PostForm.Get("client_id"), r.PostForm.Get("client_secret"))
+
+	token, err := api.as.ExchangeToken(exchangeRequest)
+	if err != nil {
+		returnOAuthError(w, err, "unable to exchange token")
+		return
+	}
+
+	util.ReturnBodyJSON(w, token, http.StatusOK)
+
+}
+
+// clientCredentials returns the client id and secret of a request, from basic auth (client_secret_basic) when it is
+// present and otherwise the values of the body (client_secret_post)
+func clientCredentials(r *http.Request, clientID string, clientSecret string) (string, string) {
+	if id, secret, ok := r.BasicAuth(); ok {
+		return id, secret
+	}
+	return clientID, clientSecret
+}
+
+// returnOAuthError writes rfc 6749 error responses.  Any other error is logged and returned as a server_error.
+func returnOAuthError(w http.ResponseWriter, err error, msg string) {
+	var oauthErr *security.OAuthError
+	if errors.As(err, &oauthErr) {
+		if oauthErr.Status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", "Basic")
+		}
+		util.ReturnBodyJSON(w, oauthErr, oauthErr.Status)
+		return
+	}
+	logger.Logger.Error().Err(err).Msg(msg)
+	util.ReturnBodyJSON(w, &security.OAuthError{Code: "server_error"}, http.StatusInternalServerError)
+}
+
+func (api *apiController) OAuthUserInfo(w http.ResponseWriter, r *http.Request) {
+
+	claims := r.Context().Value(security.UserContextKey).(security.Claims)
+	util.ReturnBodyJSON(w, api.as.UserInfo(claims), http.StatusOK)
+
+}
+
+func (api *apiController) OpenIDConfiguration(w http.ResponseWriter, r *http.Request) {
+
+	util.ReturnBodyJSON(w, api.as.Discovery(), http.StatusOK)
+
+}
+
+func (api *apiController) OAuthJWKS(w http.ResponseWriter, r *http.Request) {
+
+	util.ReturnBodyJSON(w, api.as.JWKS(), http.StatusOK)
+
+}
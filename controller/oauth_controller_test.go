@@ -0,0 +1,230 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/security"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOAuthAuthorize(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	cases := []struct {
+		query                string
+		accept               string
+		expectedResponseCode int
+		expectedLocation     string
+		expectedResponseBody []byte
+	}{
+		// ok
+		{
+			query:                "client_id=someclient&redirect_uri=https://app.example.com/cb&state=xyz",
+			expectedResponseCode: http.StatusFound,
+			expectedLocation:     "https://app.example.com/cb?code=somecode&state=xyz",
+		},
+		// ok for a consent page
+		{
+			query:                "client_id=someclient&redirect_uri=https://app.example.com/cb&state=xyz",
+			accept:               "application/json",
+			expectedResponseCode: http.StatusOK,
+			expectedResponseBody: []byte(`{"redirect_to":"https://app.example.com/cb?code=somecode\u0026state=xyz"}`),
+		},
+		// unknown client is not redirected
+		{
+			query:                "client_id=unknown&redirect_uri=https://app.example.com/cb",
+			expectedResponseCode: http.StatusBadRequest,
+			expectedResponseBody: []byte(`{"error":"invalid_request","error_description":"unknown client"}`),
+		},
+		// request error is returned through the redirect uri
+		{
+			query:                "client_id=nopkce&redirect_uri=https://app.example.com/cb&state=xyz",
+			expectedResponseCode: http.StatusFound,
+			expectedLocation:     "https://app.example.com/cb?error=invalid_request&state=xyz",
+		},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("GET", "/oauth2/authorize?"+c.query, nil)
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		if c.accept != "" {
+			rootRequest.Header.Set("Accept", c.accept)
+		}
+		claims := security.Claims{UID: "someuid", Username: "tom"}
+		rootRequest = rootRequest.WithContext(context.WithValue(rootRequest.Context(), security.UserContextKey, claims))
+
+		ctrl := &apiController{as: &testAuthorizationServer{}}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.OAuthAuthorize)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match")
+		if c.expectedLocation != "" {
+			assert.Equal(t, c.expectedLocation, rr.Header().Get("Location"))
+		}
+		if c.expectedResponseBody != nil {
+			assert.Equal(t, string(c.expectedResponseBody), string(bytes.TrimSpace(rr.Body.Bytes())), "body didn't match")
+		}
+	}
+}
+
+func TestOAuthToken(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	cases := []struct {
+		form                 url.Values
+		basicAuth            []string
+		expectedResponseCode int
+		expectedResponseBody []byte
+	}{
+		// ok with client_secret_post
+		{
+			form:                 url.Values{"grant_type": {"authorization_code"}, "code": {"somecode"}, "client_id": {"someclient"}, "client_secret": {"secret"}},
+			expectedResponseCode: http.StatusOK,
+		},
+		// ok with client_secret_basic
+		{
+			form:                 url.Values{"grant_type": {"authorization_code"}, "code": {"somecode"}},
+			basicAuth:            []string{"someclient", "secret"},
+			expectedResponseCode: http.StatusOK,
+		},
+		// bad client secret
+		{
+			form:                 url.Values{"grant_type": {"authorization_code"}, "code": {"somecode"}, "client_id": {"someclient"}, "client_secret": {"wrong"}},
+			expectedResponseCode: http.StatusUnauthorized,
+			expectedResponseBody: []byte(`{"error":"invalid_client"}`),
+		},
+		// unsupported grant
+		{
+			form:                 url.Values{"grant_type": {"password"}, "client_id": {"someclient"}, "client_secret": {"secret"}},
+			expectedResponseCode: http.StatusBadRequest,
+			expectedResponseBody: []byte(`{"error":"unsupported_grant_type"}`),
+		},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("POST", "/oauth2/token", strings.NewReader(c.form.Encode()))
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		rootRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if c.basicAuth != nil {
+			rootRequest.SetBasicAuth(c.basicAuth[0], c.basicAuth[1])
+		}
+
+		ctrl := &apiController{as: &testAuthorizationServer{}}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.OAuthToken)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match")
+		assert.Equal(t, "no-store", rr.Header().Get("Cache-Control"))
+		if c.expectedResponseBody != nil {
+			assert.Equal(t, string(c.expectedResponseBody), string(bytes.TrimSpace(rr.Body.Bytes())), "body didn't match")
+		} else {
+			var resp security.OAuthTokenResponse
+			json.Unmarshal(rr.Body.Bytes(), &resp)
+			assert.Equal(t, "Bearer", resp.TokenType)
+			assert.True(t, resp.AccessToken != "")
+			assert.True(t, resp.IDToken != "")
+		}
+	}
+}
+
+type testAuthorizationServer struct{}
+
+// AuthorizationServer implementation
+func (s *testAuthorizationServer) Authorize(req *security.AuthorizationRequest, claims security.Claims) (string, error) {
+	switch req.ClientID {
+	case "unknown":
+		return "", &security.OAuthError{Code: "invalid_request", Description: "unknown client", Status: http.StatusBadRequest}
+	case "nopkce":
+		return "", &security.OAuthError{Code: "invalid_request", Status: http.StatusFound, RedirectURI: req.RedirectURI + "?error=invalid_request&state=" + req.State}
+	}
+	return req.RedirectURI + "?code=somecode&state=" + req.State, nil
+}
+
+func (s *testAuthorizationServer) ExchangeToken(req *security.TokenExchangeRequest) (*security.OAuthTokenResponse, error) {
+	if req.ClientID != "someclient" || req.ClientSecret != "secret" {
+		return nil, &security.OAuthError{Code: "invalid_client", Status: http.StatusUnauthorized}
+	}
+	if req.GrantType != "authorization_code" {
+		return nil, &security.OAuthError{Code: "unsupported_grant_type", Status: http.StatusBadRequest}
+	}
+	return &security.OAuthTokenResponse{
+		AccessToken:  "sometokenstring",
+		TokenType:    "Bearer",
+		ExpiresIn:    300,
+		RefreshToken: "somerefreshtokenstring",
+		IDToken:      "someidtoken",
+	}, nil
+}
+
+func (s *testAuthorizationServer) UserInfo(claims security.Claims) *security.UserInfo {
+	return &security.UserInfo{Subject: claims.UID}
+}
+
+func (s *testAuthorizationServer) Discovery() *security.OpenIDConfiguration {
+	return &security.OpenIDConfiguration{}
+}
+
+func (s *testAuthorizationServer) JWKS() *security.JSONWebKeySet {
+	return &security.JSONWebKeySet{}
+}
+
+func (s *testAuthorizationServer) StartDeviceAuthorization(clientID, scope string) (*security.DeviceAuthorizationResponse, error) {
+	if clientID != "somecli" {
+		return nil, &security.OAuthError{Code: "invalid_client", Status: http.StatusUnauthorized}
+	}
+	return &security.DeviceAuthorizationResponse{
+		DeviceCode:      "somedevicecode",
+		UserCode:        "BCDF-GHJK",
+		VerificationURI: "http://localhost/device",
+		ExpiresIn:       600,
+		Interval:        5,
+	}, nil
+}
+
+func (s *testAuthorizationServer) GetDeviceApprovalRequest(userCode string) (*security.DeviceApprovalRequest, error) {
+	if userCode != "BCDF-GHJK" {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("device code does not exist or has expired")}
+	}
+	return &security.DeviceApprovalRequest{UserCode: userCode, ClientID: "somecli", ClientName: "some cli"}, nil
+}
+
+func (s *testAuthorizationServer) DecideDeviceAuthorization(userCode string, approve bool, claims security.Claims) error {
+	if userCode != "BCDF-GHJK" {
+		return &model.ResourceDoesNotExistError{Err: errors.New("device code does not exist or has expired")}
+	}
+	return nil
+}
+
+func (s *testAuthorizationServer) PollDeviceToken(clientID, clientSecret, deviceCode string) (*model.Token, string, error) {
+	if clientID != "somecli" || clientSecret != "secret" {
+		return nil, "", &security.OAuthError{Code: "invalid_client", Status: http.StatusUnauthorized}
+	}
+	switch deviceCode {
+	case "pendingcode":
+		return nil, "", &security.OAuthError{Code: "authorization_pending", Status: http.StatusBadRequest}
+	case "somedevicecode":
+		return &model.Token{
+			Token:        "sometokenstring",
+			RefreshToken: "somerefreshtokenstring",
+			ExpiresAt:    time.Now(),
+		}, "", nil
+	}
+	return nil, "", errors.New("db error")
+}
@@ -0,0 +1,183 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gkontos/goapi/db"
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/security"
+	"github.com/gkontos/goapi/util"
+	"github.com/go-chi/chi/v5"
+)
+
+type OrganizationRequest struct {
+	Name string `json:"name"`
+}
+
+type MembershipRequest struct {
+	Roles []string `json:"roles"`
+}
+
+type SwitchOrganizationRequest struct {
+	OrganizationID string `json:"organization_id"`
+}
+
+// ListOrganizations returns the organizations the authenticated user belongs to
+func (api *apiController) ListOrganizations(w http.ResponseWriter, r *http.Request) {
+
+	claims := r.Context().Value(security.UserContextKey).(security.Claims)
+	memberships, err := api.dbh.GetMemberships(claims.UID)
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error getting memberships")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	util.ReturnBodyJSON(w, memberships, http.StatusOK)
+
+}
+
+// CreateOrganization creates an organization with the authenticated user as its first administrator
+func (api *apiController) CreateOrganization(w http.ResponseWriter, r *http.Request) {
+
+	claims := r.Context().Value(security.UserContextKey).(security.Claims)
+	orgRequest := &OrganizationRequest{}
+	if parseErr := util.ParseJsonRequest(r, &orgRequest); parseErr != nil {
+		util.ReturnErrorJSON(w, parseErr)
+		return
+	}
+	if orgRequest.Name == "" {
+		util.ReturnErrorJSON(w, &model.ValidationError{Err: errors.New("name is required")})
+		return
+	}
+
+	org := &model.Organization{Name: orgRequest.Name}
+	if err := api.dbh.InsertOrganization(org); err != nil {
+		logger.Logger.Error().Err(err).Msg("error creating organization")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	membership := &model.Membership{OrgID: org.ID, UID: claims.UID, Roles: model.StringList{security.AdministratorRole}}
+	if err := api.dbh.UpsertMembership(membership); err != nil {
+		logger.Logger.Error().Err(err).Msg("error adding organization administrator")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	api.audit(r, "organization.create", claims.UID, model.JSONMap{"organization_id": org.ID})
+
+	util.ReturnBodyJSON(w, org, http.StatusCreated)
+
+}
+
+// PutMember adds a user to the active organization or replaces their organization roles
+func (api *apiController) PutMember(w http.ResponseWriter, r *http.Request) {
+
+	orgID, err := activeOrgParam(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	uid, err := uidParam(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	memberRequest := &MembershipRequest{}
+	if parseErr := util.ParseJsonRequest(r, &memberRequest); parseErr != nil {
+		util.ReturnErrorJSON(w, parseErr)
+		return
+	}
+	for _, role := range memberRequest.Roles {
+		if err := api.validateRole(role); err != nil {
+			util.ReturnErrorJSON(w, err)
+			return
+		}
+	}
+
+	// the user must exist before they can join, they do not need to belong to another organization
+	if _, err := api.dbh.GetUserByUID(uid); err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	membership := &model.Membership{OrgID: orgID, UID: uid, Roles: memberRequest.Roles}
+	if err := api.dbh.UpsertMembership(membership); err != nil {
+		logger.Logger.Error().Err(err).Msg("error updating membership")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	security.InvalidateUser(uid)
+	api.audit(r, "organization.member.put", uid, model.JSONMap{"organization_id": orgID, "roles": membership.Roles})
+
+	util.ReturnBodyJSON(w, membership, http.StatusOK)
+
+}
+
+// DeleteMember removes a user from the active organization
+func (api *apiController) DeleteMember(w http.ResponseWriter, r *http.Request) {
+
+	orgID, err := activeOrgParam(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	uid, err := uidParam(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	if err := api.dbh.DeleteMembership(orgID, uid); err != nil {
+		logger.Logger.Error().Err(err).Msg("error deleting membership")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	security.InvalidateUser(uid)
+	api.audit(r, "organization.member.delete", uid, model.JSONMap{"organization_id": orgID})
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
+
+// SwitchOrganization issues new tokens with another of the user's organizations active
+func (api *apiController) SwitchOrganization(w http.ResponseWriter, r *http.Request) {
+
+	claims := r.Context().Value(security.UserContextKey).(security.Claims)
+	switchRequest := &SwitchOrganizationRequest{}
+	if parseErr := util.ParseJsonRequest(r, &switchRequest); parseErr != nil {
+		util.ReturnErrorJSON(w, parseErr)
+		return
+	}
+
+	token, err := api.th.SwitchOrganization(claims, switchRequest.OrganizationID)
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("unable to switch organization")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	util.ReturnBodyJSON(w, token, http.StatusOK)
+
+}
+
+// tenantDbh returns a DbHandler scoped to the authenticated user's active organization
+func (api *apiController) tenantDbh(r *http.Request) db.DbHandler {
+	orgID := ""
+	if claims, ok := r.Context().Value(security.UserContextKey).(security.Claims); ok {
+		orgID = claims.Org
+	}
+	return api.dbh.WithTenant(orgID)
+}
+
+// activeOrgParam returns the org url parameter.  Organizations can only be managed while they are active.
+func activeOrgParam(r *http.Request) (string, error) {
+	orgID := chi.URLParam(r, "org")
+	claims, ok := r.Context().Value(security.UserContextKey).(security.Claims)
+	if !ok || orgID == "" || orgID != claims.Org {
+		return "", &model.ResourceDoesNotExistError{Err: errors.New("organization does not exist")}
+	}
+	return orgID, nil
+}
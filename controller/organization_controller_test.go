@@ -0,0 +1,161 @@
+package controller
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gkontos/goapi/db"
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/security"
+	"github.com/stretchr/testify/assert"
+)
+
+const testOrgID = "5d0c8e0e-3f1a-4b7e-9d55-6c1b2a3f4e5d"
+
+func TestPutMember(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	cases := []struct {
+		org                  string
+		uid                  string
+		requestBody          []byte
+		expectedResponseCode int
+		expectedResponseBody []byte
+		expectedMemberships  int
+	}{
+		// ok
+		{
+			org:                  testOrgID,
+			uid:                  testUID,
+			requestBody:          []byte(`{"roles":["ROLE_ADMIN"]}`),
+			expectedResponseCode: http.StatusOK,
+			expectedResponseBody: []byte(`{"organization_id":"` + testOrgID + `","uid":"` + testUID + `","roles":["ROLE_ADMIN"]}`),
+			expectedMemberships:  1,
+		},
+		// organization is not the active organization
+		{
+			org:                  "9e8d7c6b-5a4f-4e3d-8c2b-1a0f9e8d7c6b",
+			uid:                  testUID,
+			requestBody:          []byte(`{"roles":["ROLE_ADMIN"]}`),
+			expectedResponseCode: http.StatusNotFound,
+			expectedResponseBody: []byte(`{"error":"organization does not exist"}`),
+		},
+		// role which is not defined
+		{
+			org:                  testOrgID,
+			uid:                  testUID,
+			requestBody:          []byte(`{"roles":["ROLE_KING"]}`),
+			expectedResponseCode: http.StatusBadRequest,
+			expectedResponseBody: []byte(`{"error":"role ROLE_KING does not exist"}`),
+		},
+		// user does not exist
+		{
+			org:                  testOrgID,
+			uid:                  "8a4f1f16-5e44-4f55-8a44-5d6b0c7e9d21",
+			requestBody:          []byte(`{"roles":[]}`),
+			expectedResponseCode: http.StatusNotFound,
+			expectedResponseBody: []byte(`{"error":"user does not exist"}`),
+		},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("PUT", "/v1/organizations/"+c.org+"/members/"+c.uid, bytes.NewBuffer(c.requestBody))
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		rootRequest = withURLParams(rootRequest, map[string]string{"org": c.org, "uid": c.uid})
+		rootRequest = withClaims(rootRequest, security.Claims{UID: "someadminuid", Username: "admin", Org: testOrgID})
+
+		dbh := &organizationTestDbHandler{}
+		ctrl := &apiController{dbh: dbh}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.PutMember)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match")
+		assert.Equal(t, string(c.expectedResponseBody), string(bytes.TrimSpace(rr.Body.Bytes())), "body didn't match")
+		assert.Equal(t, c.expectedMemberships, len(dbh.memberships))
+		assert.Equal(t, c.expectedMemberships, len(dbh.audits))
+	}
+}
+
+func TestSwitchOrganization(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	cases := []struct {
+		requestBody          []byte
+		expectedResponseCode int
+	}{
+		{requestBody: []byte(`{"organization_id":"` + testOrgID + `"}`), expectedResponseCode: http.StatusOK},
+		// not a member
+		{requestBody: []byte(`{"organization_id":"9e8d7c6b-5a4f-4e3d-8c2b-1a0f9e8d7c6b"}`), expectedResponseCode: http.StatusNotFound},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("POST", "/v1/login/organization", bytes.NewBuffer(c.requestBody))
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		rootRequest = withClaims(rootRequest, security.Claims{UID: testUID, Username: "tom"})
+
+		ctrl := &apiController{th: &testTokenHandler{}}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.SwitchOrganization)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match")
+	}
+}
+
+func TestGetUsersIsScopedToTenant(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	rootRequest, err := http.NewRequest("GET", "/v1/users", nil)
+	if err != nil {
+		t.Errorf("Root request error: %s", err)
+	}
+	rootRequest = withClaims(rootRequest, security.Claims{UID: "someadminuid", Username: "admin", Org: testOrgID})
+
+	dbh := &organizationTestDbHandler{}
+	ctrl := &apiController{dbh: dbh}
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(ctrl.GetUsers)
+	handler.ServeHTTP(rr, rootRequest)
+
+	assert.Equal(t, http.StatusOK, rr.Code, "status code didn't match")
+	assert.Equal(t, testOrgID, dbh.tenant)
+}
+
+type organizationTestDbHandler struct {
+	roleTestDbHandler
+	tenant      string
+	memberships []*model.Membership
+}
+
+func (d *organizationTestDbHandler) WithTenant(orgID string) db.DbHandler {
+	d.tenant = orgID
+	return d
+}
+
+func (d *organizationTestDbHandler) GetUsers(query model.UserQuery) (*model.UserPage, error) {
+	if d.tenant == "" {
+		return nil, errors.New("query was not scoped to a tenant")
+	}
+	return &model.UserPage{Users: []model.User{}}, nil
+}
+
+func (d *organizationTestDbHandler) GetUserByUID(uid string) (*model.User, error) {
+	if uid != testUID {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("user does not exist")}
+	}
+	return &model.User{UID: uid}, nil
+}
+
+func (d *organizationTestDbHandler) UpsertMembership(m *model.Membership) error {
+	d.memberships = append(d.memberships, m)
+	return nil
+}
@@ -0,0 +1,161 @@
+package controller
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/security"
+	"github.com/gkontos/goapi/util"
+)
+
+// defaultPreferencesSchema is used when PREFERENCES_SCHEMA_FILE is not set
+//
+//go:embed preferences_schema.json
+var defaultPreferencesSchema []byte
+
+// GetCurrentUserPreferences returns the authenticated user's preferences with their version as the ETag
+func (api *apiController) GetCurrentUserPreferences(w http.ResponseWriter, r *http.Request) {
+
+	claims := r.Context().Value(security.UserContextKey).(security.Claims)
+	preferences, err := api.dbh.GetPreferences(claims.UID)
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error getting preferences")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	writePreferences(w, preferences)
+
+}
+
+// PutCurrentUserPreferences replaces the authenticated user's preferences
+func (api *apiController) PutCurrentUserPreferences(w http.ResponseWriter, r *http.Request) {
+
+	doc, err := util.GetRequestBody(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	api.updatePreferences(w, r, func(current []byte) ([]byte, error) {
+		return doc, nil
+	})
+
+}
+
+// PatchCurrentUserPreferences changes the authenticated user's preferences with a JSON patch (RFC 6902), or a JSON
+// merge patch (RFC 7386) when the content type is application/merge-patch+json
+func (api *apiController) PatchCurrentUserPreferences(w http.ResponseWriter, r *http.Request) {
+
+	patch, err := util.GetRequestBody(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	applyPatch := util.JSONPatch
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/merge-patch+json" {
+		applyPatch = util.MergePatch
+	}
+	api.updatePreferences(w, r, func(current []byte) ([]byte, error) {
+		return applyPatch(current, patch)
+	})
+
+}
+
+// updatePreferences stores the preferences changed from the current ones.  The change is made to the version in
+// If-Match, or to the current version when the header is not sent.
+func (api *apiController) updatePreferences(w http.ResponseWriter, r *http.Request, change func(current []byte) ([]byte, error)) {
+	claims := r.Context().Value(security.UserContextKey).(security.Claims)
+	preferences, err := api.dbh.GetPreferences(claims.UID)
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error getting preferences")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	version := preferences.Version
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if version, err = parseVersionTag(ifMatch); err != nil {
+			util.ReturnErrorJSON(w, err)
+			return
+		}
+	}
+
+	current, err := json.Marshal(preferences.Values)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	doc, err := change(current)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	values, err := api.validatePreferences(doc)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	if preferences, err = api.dbh.UpdatePreferences(claims.UID, values, version); err != nil {
+		logger.Logger.Error().Err(err).Msg("error updating preferences")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	writePreferences(w, preferences)
+}
+
+// validatePreferences decodes the preferences document and checks it against the preferences schema
+func (api *apiController) validatePreferences(doc []byte) (model.JSONMap, error) {
+	var value interface{}
+	if err := json.Unmarshal(doc, &value); err != nil {
+		return nil, &util.RequestParseError{Message: "unable to parse request", Err: err}
+	}
+	values, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, &model.ValidationError{Err: errors.New("preferences must be a JSON object")}
+	}
+	if api.preferencesSchema != nil {
+		if fields := api.preferencesSchema.Validate(value); len(fields) > 0 {
+			return nil, &model.ValidationError{Err: errors.New("invalid preferences"), Fields: fields}
+		}
+	}
+	return values, nil
+}
+
+func writePreferences(w http.ResponseWriter, preferences *model.Preferences) {
+	values := preferences.Values
+	if values == nil {
+		values = model.JSONMap{}
+	}
+	w.Header().Set("ETag", fmt.Sprintf(`"%d"`, preferences.Version))
+	util.ReturnBodyJSON(w, values, http.StatusOK)
+}
+
+// parseVersionTag returns the version of an ETag sent by a client
+func parseVersionTag(tag string) (int, error) {
+	version, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(strings.TrimSpace(tag), "W/"), `"`))
+	if err != nil {
+		return 0, &model.VersionConflictError{Err: errors.New("If-Match is not a version of the preferences")}
+	}
+	return version, nil
+}
+
+// loadPreferencesSchema will read the preferences schema from PREFERENCES_SCHEMA_FILE or use the embedded default
+func loadPreferencesSchema() (*util.JSONSchema, error) {
+	doc := defaultPreferencesSchema
+	if schemaFile := os.Getenv("PREFERENCES_SCHEMA_FILE"); schemaFile != "" {
+		var err error
+		if doc, err = os.ReadFile(schemaFile); err != nil {
+			return nil, err
+		}
+	}
+	return util.ParseJSONSchema(doc)
+}
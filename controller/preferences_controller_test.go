@@ -0,0 +1,126 @@
+package controller
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/security"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetCurrentUserPreferences(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	rootRequest, err := http.NewRequest("GET", "/v1/users/me/preferences", nil)
+	if err != nil {
+		t.Errorf("Root request error: %s", err)
+	}
+	rootRequest = withClaims(rootRequest, security.Claims{UID: testUID, Username: "user"})
+
+	dbh := &preferencesTestDbHandler{version: 3, values: model.JSONMap{"theme": "dark"}}
+	ctrl := &apiController{dbh: dbh}
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(ctrl.GetCurrentUserPreferences)
+	handler.ServeHTTP(rr, rootRequest)
+
+	assert.Equal(t, http.StatusOK, rr.Code, "status code didn't match")
+	assert.Equal(t, `"3"`, rr.Header().Get("ETag"))
+	assert.Equal(t, `{"theme":"dark"}`, string(bytes.TrimSpace(rr.Body.Bytes())), "body didn't match")
+}
+
+func TestUpdateCurrentUserPreferences(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	schema, err := loadPreferencesSchema()
+	if err != nil {
+		t.Fatalf("preferences schema error: %s", err)
+	}
+
+	cases := []struct {
+		method               string
+		contentType          string
+		ifMatch              string
+		requestBody          []byte
+		expectedResponseCode int
+		expectedResponseBody []byte
+		expectedETag         string
+	}{
+		{method: "PUT", requestBody: []byte(`{"theme":"light","notifications":{"email":false}}`), expectedResponseCode: http.StatusOK,
+			expectedResponseBody: []byte(`{"notifications":{"email":false},"theme":"light"}`), expectedETag: `"4"`},
+		{method: "PUT", ifMatch: `"3"`, requestBody: []byte(`{"theme":"light"}`), expectedResponseCode: http.StatusOK,
+			expectedResponseBody: []byte(`{"theme":"light"}`), expectedETag: `"4"`},
+		// the preferences were changed since they were read
+		{method: "PUT", ifMatch: `"2"`, requestBody: []byte(`{"theme":"light"}`), expectedResponseCode: http.StatusPreconditionFailed,
+			expectedResponseBody: []byte(`{"error":"preferences are at version 3","code":"version_conflict"}`)},
+		{method: "PUT", ifMatch: `*`, requestBody: []byte(`{"theme":"light"}`), expectedResponseCode: http.StatusPreconditionFailed,
+			expectedResponseBody: []byte(`{"error":"If-Match is not a version of the preferences","code":"version_conflict"}`)},
+		{method: "PUT", requestBody: []byte(`{"theme":"blue","colour":"red","page_size":1.5}`), expectedResponseCode: http.StatusBadRequest,
+			expectedResponseBody: []byte(`{"error":"invalid preferences","fields":[{"field":"colour","message":"is not allowed"},{"field":"page_size","message":"must be an integer"},{"field":"theme","message":"must be one of light, dark, system"}]}`)},
+		{method: "PUT", requestBody: []byte(`["dark"]`), expectedResponseCode: http.StatusBadRequest,
+			expectedResponseBody: []byte(`{"error":"preferences must be a JSON object"}`)},
+		{method: "PATCH", requestBody: []byte(`[{"op":"replace","path":"/theme","value":"system"},{"op":"add","path":"/pinned","value":["a"]}]`),
+			expectedResponseCode: http.StatusOK, expectedResponseBody: []byte(`{"pinned":["a"],"theme":"system"}`), expectedETag: `"4"`},
+		{method: "PATCH", requestBody: []byte(`[{"op":"test","path":"/theme","value":"light"}]`), expectedResponseCode: http.StatusBadRequest,
+			expectedResponseBody: []byte(`{"error":"operation 0 (test /theme): test failed"}`)},
+		{method: "PATCH", requestBody: []byte(`[{"op":"add","path":"/notifications/sms","value":true}]`), expectedResponseCode: http.StatusBadRequest,
+			expectedResponseBody: []byte(`{"error":"operation 0 (add /notifications/sms): path does not exist"}`)},
+		{method: "PATCH", contentType: "application/merge-patch+json", requestBody: []byte(`{"theme":null,"locale":"en-GB"}`),
+			expectedResponseCode: http.StatusOK, expectedResponseBody: []byte(`{"locale":"en-GB"}`), expectedETag: `"4"`},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest(c.method, "/v1/users/me/preferences", bytes.NewBuffer(c.requestBody))
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		if c.contentType != "" {
+			rootRequest.Header.Set("Content-Type", c.contentType)
+		}
+		if c.ifMatch != "" {
+			rootRequest.Header.Set("If-Match", c.ifMatch)
+		}
+		rootRequest = withClaims(rootRequest, security.Claims{UID: testUID, Username: "user"})
+
+		dbh := &preferencesTestDbHandler{version: 3, values: model.JSONMap{"theme": "dark"}}
+		ctrl := &apiController{dbh: dbh, preferencesSchema: schema}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.PutCurrentUserPreferences)
+		if c.method == "PATCH" {
+			handler = ctrl.PatchCurrentUserPreferences
+		}
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match")
+		assert.Equal(t, string(c.expectedResponseBody), string(bytes.TrimSpace(rr.Body.Bytes())), "body didn't match")
+		assert.Equal(t, c.expectedETag, rr.Header().Get("ETag"))
+	}
+}
+
+// preferencesTestDbHandler holds the preferences of testUID
+type preferencesTestDbHandler struct {
+	roleTestDbHandler
+	version int
+	values  model.JSONMap
+}
+
+func (d *preferencesTestDbHandler) GetPreferences(uid string) (*model.Preferences, error) {
+	if uid != testUID {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("user does not exist")}
+	}
+	return &model.Preferences{Version: d.version, Values: d.values}, nil
+}
+
+func (d *preferencesTestDbHandler) UpdatePreferences(uid string, values model.JSONMap, version int) (*model.Preferences, error) {
+	if version != d.version {
+		return nil, &model.VersionConflictError{Err: fmt.Errorf("preferences are at version %d", d.version)}
+	}
+	d.version++
+	d.values = values
+	return &model.Preferences{Version: d.version, Values: d.values}, nil
+}
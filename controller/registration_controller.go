@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/security"
+	"github.com/gkontos/goapi/util"
+)
+
+const (
+	registrationApprove = "approve"
+	registrationReject  = "reject"
+)
+
+// RegistrationDecision approves a pending user with roles, ROLE_USER when none are given, or rejects them with a reason
+type RegistrationDecision struct {
+	Decision string   `json:"decision"`
+	Roles    []string `json:"roles"`
+	Reason   string   `json:"reason"`
+}
+
+// GetRegistrations returns a page of the users waiting for approval, oldest first.  It takes the paging parameters of
+// the users listing.
+func (api *apiController) GetRegistrations(w http.ResponseWriter, r *http.Request) {
+
+	query, err := userQueryParams(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	query.Status = model.UserStatusPending
+	// pending users are not members of any organization
+	page, err := api.dbh.GetUsers(query)
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error getting registrations")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	setPageLinks(w, r, page.NextCursor)
+	util.ReturnBodyJSON(w, page, http.StatusOK)
+
+}
+
+// DecideRegistration approves or rejects a user waiting for approval.  Pending users are not members of any
+// organization so deciding requires global permissions, and the approver can only grant roles which they hold.
+func (api *apiController) DecideRegistration(w http.ResponseWriter, r *http.Request) {
+
+	uid, err := uidParam(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	decision := &RegistrationDecision{}
+	if parseErr := util.ParseJsonRequest(r, &decision); parseErr != nil {
+		util.ReturnErrorJSON(w, parseErr)
+		return
+	}
+	decision.Reason = strings.TrimSpace(decision.Reason)
+	approve := decision.Decision == registrationApprove
+	switch {
+	case approve:
+		if len(decision.Roles) == 0 {
+			decision.Roles = []string{security.UserRole}
+		}
+		for _, role := range decision.Roles {
+			if err := api.validateRole(role); err != nil {
+				util.ReturnErrorJSON(w, err)
+				return
+			}
+		}
+		if err := api.checkGrantable(r, decision.Roles); err != nil {
+			util.ReturnErrorJSON(w, err)
+			return
+		}
+	case decision.Decision == registrationReject:
+		if decision.Reason == "" {
+			util.ReturnErrorJSON(w, &model.ValidationError{Err: errors.New("a reason is required")})
+			return
+		}
+		decision.Roles = nil
+	default:
+		util.ReturnErrorJSON(w, &model.ValidationError{Err: errors.New("decision must be approve or reject")})
+		return
+	}
+
+	if err := api.dbh.DecideRegistration(uid, approve, decision.Roles, decision.Reason); err != nil {
+		logger.Logger.Error().Err(err).Msg("error deciding registration")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	security.InvalidateUser(uid)
+	if approve {
+		api.audit(r, "user.registration.approve", uid, model.JSONMap{"roles": decision.Roles})
+	} else {
+		api.audit(r, "user.registration.reject", uid, model.JSONMap{"reason": decision.Reason})
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
@@ -0,0 +1,98 @@
+package controller
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/security"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecideRegistration(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	cases := []struct {
+		approverRoles        []string
+		uid                  string
+		requestBody          []byte
+		expectedResponseCode int
+		expectedResponseBody []byte
+		expectedStatus       string
+		expectedRoles        []string
+		expectedAudit        string
+	}{
+		// approved users get ROLE_USER unless roles are given
+		{uid: testUID, requestBody: []byte(`{"decision":"approve"}`), expectedResponseCode: http.StatusNoContent,
+			expectedStatus: model.UserStatusActive, expectedRoles: []string{security.UserRole}, expectedAudit: "user.registration.approve"},
+		{uid: testUID, requestBody: []byte(`{"decision":"approve","roles":["ROLE_ADMIN"]}`), expectedResponseCode: http.StatusNoContent,
+			expectedStatus: model.UserStatusActive, expectedRoles: []string{security.AdministratorRole}, expectedAudit: "user.registration.approve"},
+		{uid: testUID, requestBody: []byte(`{"decision":"reject","reason":"not an employee"}`), expectedResponseCode: http.StatusNoContent,
+			expectedStatus: model.UserStatusRejected, expectedAudit: "user.registration.reject"},
+		{uid: testUID, requestBody: []byte(`{"decision":"reject"}`), expectedResponseCode: http.StatusBadRequest,
+			expectedResponseBody: []byte(`{"error":"a reason is required"}`)},
+		{uid: testUID, requestBody: []byte(`{"decision":"approve","roles":["ROLE_KING"]}`), expectedResponseCode: http.StatusBadRequest,
+			expectedResponseBody: []byte(`{"error":"role ROLE_KING does not exist"}`)},
+		{uid: testUID, requestBody: []byte(`{"decision":"maybe"}`), expectedResponseCode: http.StatusBadRequest,
+			expectedResponseBody: []byte(`{"error":"decision must be approve or reject"}`)},
+		// approvers can not grant roles which they do not hold
+		{approverRoles: []string{security.UserRole}, uid: testUID, requestBody: []byte(`{"decision":"approve","roles":["ROLE_ADMIN"]}`),
+			expectedResponseCode: http.StatusForbidden,
+			expectedResponseBody: []byte(`{"error":"role ROLE_ADMIN can not be granted by a user who does not hold it","code":"permission_denied"}`)},
+		// a user who is not waiting for approval
+		{uid: "8a4f1f16-5e44-4f55-8a44-5d6b0c7e9d21", requestBody: []byte(`{"decision":"approve"}`), expectedResponseCode: http.StatusNotFound},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("PUT", "/v1/users/"+c.uid+"/registration", bytes.NewBuffer(c.requestBody))
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		rootRequest = withURLParams(rootRequest, map[string]string{"uid": c.uid})
+		if c.approverRoles == nil {
+			c.approverRoles = []string{security.AdministratorRole, security.UserRole}
+		}
+		rootRequest = withClaims(rootRequest, security.Claims{UID: "someadminuid", Username: "admin", Roles: c.approverRoles})
+
+		dbh := &registrationTestDbHandler{}
+		ctrl := &apiController{dbh: dbh, th: &testTokenHandler{}}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.DecideRegistration)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match")
+		if c.expectedResponseBody != nil {
+			assert.Equal(t, string(c.expectedResponseBody), string(bytes.TrimSpace(rr.Body.Bytes())), "body didn't match")
+		}
+		assert.Equal(t, c.expectedStatus, dbh.status)
+		assert.Equal(t, c.expectedRoles, dbh.roles)
+		if c.expectedAudit != "" {
+			assert.Equal(t, 1, len(dbh.audits))
+			assert.Equal(t, c.expectedAudit, dbh.audits[0].Action)
+		} else {
+			assert.Empty(t, dbh.audits)
+		}
+	}
+}
+
+// registrationTestDbHandler records the decision on testUID, the only user waiting for approval
+type registrationTestDbHandler struct {
+	roleTestDbHandler
+	status string
+	roles  []string
+}
+
+func (d *registrationTestDbHandler) DecideRegistration(uid string, approve bool, roles []string, reason string) error {
+	if uid != testUID {
+		return &model.ResourceDoesNotExistError{Err: errors.New("user is not waiting for approval")}
+	}
+	d.status, d.roles = model.UserStatusRejected, roles
+	if approve {
+		d.status = model.UserStatusActive
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/security"
+	"github.com/gkontos/goapi/util"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+type RoleRequest struct {
+	Role string `json:"role"`
+}
+
+func (api *apiController) GetUserRoles(w http.ResponseWriter, r *http.Request) {
+
+	uid, err := uidParam(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	user, err := api.tenantDbh(r).GetUserByUID(uid)
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error getting user")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	roles := user.UserDetails.Roles
+	if roles == nil {
+		roles = make([]string, 0)
+	}
+	util.ReturnBodyJSON(w, roles, http.StatusOK)
+
+}
+
+func (api *apiController) AddUserRole(w http.ResponseWriter, r *http.Request) {
+
+	uid, err := uidParam(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	roleRequest := &RoleRequest{}
+	if parseErr := util.ParseJsonRequest(r, &roleRequest); parseErr != nil {
+		util.ReturnErrorJSON(w, parseErr)
+		return
+	}
+	if err := api.validateRole(roleRequest.Role); err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	if err := api.checkGrantable(r, []string{roleRequest.Role}); err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	roles, err := api.tenantDbh(r).AddUserRole(uid, roleRequest.Role)
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error adding role")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	security.InvalidateUser(uid)
+	api.audit(r, "user.role.add", uid, model.JSONMap{"role": roleRequest.Role})
+
+	util.ReturnBodyJSON(w, roles, http.StatusOK)
+
+}
+
+func (api *apiController) RemoveUserRole(w http.ResponseWriter, r *http.Request) {
+
+	uid, err := uidParam(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	role := chi.URLParam(r, "role")
+
+	roles, err := api.tenantDbh(r).RemoveUserRole(uid, role)
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error removing role")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	security.InvalidateUser(uid)
+	api.audit(r, "user.role.remove", uid, model.JSONMap{"role": role})
+
+	util.ReturnBodyJSON(w, roles, http.StatusOK)
+
+}
+
+// validateRole returns a ValidationError unless the role is defined in the roles table
+func (api *apiController) validateRole(role string) error {
+	if role == "" {
+		return &model.ValidationError{Err: errors.New("role is required")}
+	}
+	roles, err := api.dbh.GetRoles()
+	if err != nil {
+		return err
+	}
+	for _, r := range roles {
+		if r.Name == role {
+			return nil
+		}
+	}
+	return &model.ValidationError{Err: fmt.Errorf("role %s does not exist", role)}
+}
+
+// checkGrantable returns an error unless the authenticated user holds each of the roles, directly or through an
+// inherited role, so that nobody grants more than they have.  Only global roles count as the roles are granted globally.
+func (api *apiController) checkGrantable(r *http.Request, roles []string) error {
+	claims := r.Context().Value(security.UserContextKey).(security.Claims)
+	user := security.CreateUserFromClaims(claims)
+	for _, role := range roles {
+		held, err := api.th.HasRole(user, role)
+		if err != nil {
+			return err
+		}
+		if !held {
+			return &model.PermissionDeniedError{Err: fmt.Errorf("role %s can not be granted by a user who does not hold it", role)}
+		}
+	}
+	return nil
+}
+
+// audit will record a change made by the authenticated user.  Failures are logged but do not fail the request.
+func (api *apiController) audit(r *http.Request, action string, targetUID string, details model.JSONMap) {
+	actorUID := ""
+	if claims, ok := r.Context().Value(security.UserContextKey).(security.Claims); ok {
+		actorUID = claims.UID
+	} else if client, ok := r.Context().Value(security.ProvisioningClientContextKey).(*model.ProvisioningClient); ok {
+		actorUID = "scim:" + client.ID
+	}
+	entry := &model.AuditEntry{
+		ActorUID:  actorUID,
+		Action:    action,
+		TargetUID: targetUID,
+		Details:   details,
+	}
+	if err := api.dbh.InsertAuditEntry(entry); err != nil {
+		logger.Logger.Error().Err(err).Str("action", action).Str("target_uid", targetUID).Msg("unable to write audit entry")
+	}
+}
+
+// uidParam returns the uid url parameter.  A uid which is not a uuid can not exist.
+func uidParam(r *http.Request) (string, error) {
+	uid := chi.URLParam(r, "uid")
+	if _, err := uuid.Parse(uid); err != nil {
+		return "", &model.ResourceDoesNotExistError{Err: errors.New("user does not exist")}
+	}
+	return uid, nil
+}
@@ -0,0 +1,157 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gkontos/goapi/db"
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/security"
+	"github.com/stretchr/testify/assert"
+)
+
+const testUID = "0b6c2c3e-6f7a-4a36-9a3f-2f1d8a9f3c11"
+
+func TestAddUserRole(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	cases := []struct {
+		uid                  string
+		roles                []string
+		requestBody          []byte
+		expectedResponseCode int
+		expectedResponseBody []byte
+		expectedAudits       int
+	}{
+		// ok
+		{
+			uid:                  testUID,
+			requestBody:          []byte(`{"role":"ROLE_ADMIN"}`),
+			expectedResponseCode: http.StatusOK,
+			expectedResponseBody: []byte(`["ROLE_USER","ROLE_ADMIN"]`),
+			expectedAudits:       1,
+		},
+		// role which is not defined
+		{
+			uid:                  testUID,
+			requestBody:          []byte(`{"role":"ROLE_KING"}`),
+			expectedResponseCode: http.StatusBadRequest,
+			expectedResponseBody: []byte(`{"error":"role ROLE_KING does not exist"}`),
+		},
+		// a user with users:roles:write who is not an admin can not make anyone an admin
+		{
+			uid:                  testUID,
+			roles:                []string{security.UserRole},
+			requestBody:          []byte(`{"role":"ROLE_ADMIN"}`),
+			expectedResponseCode: http.StatusForbidden,
+			expectedResponseBody: []byte(`{"error":"role ROLE_ADMIN can not be granted by a user who does not hold it","code":"permission_denied"}`),
+		},
+		// user does not exist
+		{
+			uid:                  "8a4f1f16-5e44-4f55-8a44-5d6b0c7e9d21",
+			requestBody:          []byte(`{"role":"ROLE_ADMIN"}`),
+			expectedResponseCode: http.StatusNotFound,
+			expectedResponseBody: []byte(`{"error":"user does not exist"}`),
+		},
+		// uid is not a uuid
+		{
+			uid:                  "tom",
+			requestBody:          []byte(`{"role":"ROLE_ADMIN"}`),
+			expectedResponseCode: http.StatusNotFound,
+			expectedResponseBody: []byte(`{"error":"user does not exist"}`),
+		},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("POST", "/v1/users/"+c.uid+"/roles", bytes.NewBuffer(c.requestBody))
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		if c.roles == nil {
+			c.roles = []string{security.AdministratorRole}
+		}
+		rootRequest = withURLParams(rootRequest, map[string]string{"uid": c.uid})
+		rootRequest = withClaims(rootRequest, security.Claims{UID: "someadminuid", Username: "admin", Roles: c.roles})
+
+		dbh := &roleTestDbHandler{}
+		ctrl := &apiController{dbh: dbh, th: &testTokenHandler{}}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.AddUserRole)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match")
+		assert.Equal(t, string(c.expectedResponseBody), string(bytes.TrimSpace(rr.Body.Bytes())), "body didn't match")
+		assert.Equal(t, c.expectedAudits, len(dbh.audits))
+		for _, entry := range dbh.audits {
+			assert.Equal(t, "someadminuid", entry.ActorUID)
+			assert.Equal(t, "user.role.add", entry.Action)
+		}
+	}
+}
+
+func TestRemoveUserRole(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	rootRequest, err := http.NewRequest("DELETE", "/v1/users/"+testUID+"/roles/ROLE_USER", nil)
+	if err != nil {
+		t.Errorf("Root request error: %s", err)
+	}
+	rootRequest = withURLParams(rootRequest, map[string]string{"uid": testUID, "role": "ROLE_USER"})
+	rootRequest = withClaims(rootRequest, security.Claims{UID: "someadminuid", Username: "admin"})
+
+	dbh := &roleTestDbHandler{}
+	ctrl := &apiController{dbh: dbh}
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(ctrl.RemoveUserRole)
+	handler.ServeHTTP(rr, rootRequest)
+
+	assert.Equal(t, http.StatusOK, rr.Code, "status code didn't match")
+	assert.Equal(t, `[]`, string(bytes.TrimSpace(rr.Body.Bytes())), "body didn't match")
+	assert.Equal(t, 1, len(dbh.audits))
+	assert.Equal(t, "user.role.remove", dbh.audits[0].Action)
+}
+
+// withClaims will add the authenticated user to a request for handlers which are called outside of the router
+func withClaims(r *http.Request, claims security.Claims) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), security.UserContextKey, claims))
+}
+
+type roleTestDbHandler struct {
+	db.DbHandler
+	audits []*model.AuditEntry
+}
+
+func (d *roleTestDbHandler) WithTenant(orgID string) db.DbHandler {
+	return d
+}
+
+func (d *roleTestDbHandler) GetRoles() ([]model.Role, error) {
+	return []model.Role{
+		{Name: security.AdministratorRole},
+		{Name: security.UserRole},
+	}, nil
+}
+
+func (d *roleTestDbHandler) AddUserRole(uid string, role string) ([]string, error) {
+	if uid != testUID {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("user does not exist")}
+	}
+	return []string{security.UserRole, role}, nil
+}
+
+func (d *roleTestDbHandler) RemoveUserRole(uid string, role string) ([]string, error) {
+	if uid != testUID {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("user does not exist")}
+	}
+	return []string{}, nil
+}
+
+func (d *roleTestDbHandler) InsertAuditEntry(e *model.AuditEntry) error {
+	d.audits = append(d.audits, e)
+	return nil
+}
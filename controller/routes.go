@@ -19,13 +19,29 @@ func (api *apiRouter) SetupRouter() *chi.Mux {
 	r.Use(render.SetContentType(render.ContentTypeJSON))
 	// add Cors Headers
 	r.Use(api.rs.CorsHeaders)
+	// authentication and authorization are enforced from the route policy document, see security/policy.yaml
+	r.Use(api.rs.EnforcePolicy(r))
 
 	r.Route("/v1", func(r chi.Router) {
 		r.Use(apiVersionCtx("v1"))
-		r.Mount("/users", userRouter(api.rs, api.ctrl))
+		r.Mount("/users", userRouter(api.ctrl))
 		r.Mount("/login", tokenRouter(api.ctrl))
+		r.Mount("/device", deviceRouter(api.ctrl))
+		r.Mount("/organizations", organizationRouter(api.ctrl))
+		r.Mount("/groups", groupRouter(api.ctrl))
+		r.Mount("/invitations", invitationRouter(api.ctrl))
 	})
 
+	r.Get("/.well-known/openid-configuration", api.ctrl.OpenIDConfiguration)
+	r.Mount("/oauth2", oauthRouter(api.ctrl))
+	r.Mount("/scim/v2", scimRouter(api.ctrl, api.rs))
+
+	// refuse to start if a route could be reached without a policy
+	if err := api.rs.ValidatePolicy(r); err != nil {
+		logger.Logger.Error().Err(err).Msg("route policy is incomplete")
+		panic(err)
+	}
+
 	return r
 }
 
@@ -38,26 +54,125 @@ func apiVersionCtx(version string) func(next http.Handler) http.Handler {
 	}
 }
 
-// use authenticate and authorize middleware
-func userRouter(rs security.RouterSecurity, ctrl *apiController) chi.Router {
+// any authenticated user can read their own record and permissions, other routes require users permissions
+// unless the owner model allows users to manage their own record
+func userRouter(ctrl *apiController) chi.Router {
 	r := chi.NewRouter()
-
-	r.Use(rs.AuthenticateAuthHeader)
-	r.Get("/",
-		AddMiddleware(
-			http.HandlerFunc(ctrl.GetUsers),
-			rs.Authorize(security.Permission("admin"))))
+	r.Get("/", ctrl.GetUsers)
+	r.Get("/search", ctrl.SearchUsers)
+	r.Get("/registrations", ctrl.GetRegistrations)
+	r.Post("/import", ctrl.ImportUsers)
+	r.Get("/export", ctrl.ExportUsers)
+	r.Get("/me", ctrl.GetCurrentUser)
+	r.Get("/me/permissions", ctrl.GetCurrentUserPermissions)
+	r.Get("/me/preferences", ctrl.GetCurrentUserPreferences)
+	r.Put("/me/preferences", ctrl.PutCurrentUserPreferences)
+	r.Patch("/me/preferences", ctrl.PatchCurrentUserPreferences)
+	r.Get("/me/export", ctrl.ExportCurrentUser)
+	r.Get("/me/export/{export}", ctrl.GetCurrentUserExport)
+	r.Get("/me/export/{export}/download", ctrl.DownloadCurrentUserExport)
+	r.Get("/{uid}", ctrl.GetUser)
+	r.Patch("/{uid}", ctrl.PatchUser)
+	r.Delete("/{uid}", ctrl.DeleteUser)
+	r.Put("/{uid}/status", ctrl.SetUserStatus)
+	r.Put("/{uid}/registration", ctrl.DecideRegistration)
+	r.Post("/{uid}/erasure", ctrl.RequestErasure)
+	r.Get("/{uid}/erasure", ctrl.GetErasure)
+	r.Delete("/{uid}/erasure", ctrl.CancelErasure)
+	r.Get("/{uid}/logins", ctrl.GetUserLogins)
+	r.Get("/{uid}/roles", ctrl.GetUserRoles)
+	r.Post("/{uid}/roles", ctrl.AddUserRole)
+	r.Delete("/{uid}/roles/{role}", ctrl.RemoveUserRole)
 	return r
 }
 
-// use no auth middleware
+// public, except switching organization which requires an authenticated user
 func tokenRouter(ctrl *apiController) chi.Router {
 	r := chi.NewRouter()
 	r.Post("/refresh", ctrl.TokenRefresh)
+	r.Post("/magic", ctrl.MagicLinkCreate)
+	r.Post("/magic/verify", ctrl.MagicLinkVerify)
+	r.Post("/device", ctrl.DeviceAuthorizationCreate)
+	r.Post("/device/token", ctrl.DeviceTokenPoll)
+	r.Get("/{provider}/start", ctrl.ProviderLoginStart)
+	r.Get("/{provider}/callback", ctrl.ProviderLoginCallback)
+	r.Post("/organization", ctrl.SwitchOrganization)
 	r.Post("/", ctrl.TokenCreate)
 	return r
 }
 
+// members are managed by administrators of the active organization
+func organizationRouter(ctrl *apiController) chi.Router {
+	r := chi.NewRouter()
+	r.Get("/", ctrl.ListOrganizations)
+	r.Post("/", ctrl.CreateOrganization)
+	r.Put("/{org}/members/{uid}", ctrl.PutMember)
+	r.Delete("/{org}/members/{uid}", ctrl.DeleteMember)
+	return r
+}
+
+// groups of the active organization are managed by its administrators
+func groupRouter(ctrl *apiController) chi.Router {
+	r := chi.NewRouter()
+	r.Get("/", ctrl.GetGroups)
+	r.Post("/", ctrl.CreateGroup)
+	r.Get("/{group}", ctrl.GetGroup)
+	r.Put("/{group}", ctrl.UpdateGroup)
+	r.Delete("/{group}", ctrl.DeleteGroup)
+	r.Get("/{group}/members", ctrl.GetGroupMembers)
+	r.Put("/{group}/members/{uid}", ctrl.AddGroupMember)
+	r.Delete("/{group}/members/{uid}", ctrl.RemoveGroupMember)
+	return r
+}
+
+// invitations grant roles to users who have not logged in yet and are managed by administrators
+func invitationRouter(ctrl *apiController) chi.Router {
+	r := chi.NewRouter()
+	r.Get("/", ctrl.GetInvitations)
+	r.Post("/", ctrl.CreateInvitation)
+	r.Delete("/{invitation}", ctrl.DeleteInvitation)
+	return r
+}
+
+// the user approving a device request must be logged in
+func deviceRouter(ctrl *apiController) chi.Router {
+	r := chi.NewRouter()
+	r.Get("/", ctrl.DeviceApprovalGet)
+	r.Post("/", ctrl.DeviceApprovalDecide)
+	return r
+}
+
+// authorize and userinfo require an authenticated user, the token endpoint authenticates the client
+func oauthRouter(ctrl *apiController) chi.Router {
+	r := chi.NewRouter()
+	r.Post("/token", ctrl.OAuthToken)
+	r.Get("/jwks", ctrl.OAuthJWKS)
+	r.Get("/authorize", ctrl.OAuthAuthorize)
+	r.Get("/userinfo", ctrl.OAuthUserInfo)
+	return r
+}
+
+// the scim routes are public in the policy, provisioning clients authenticate with their bearer token
+func scimRouter(ctrl *apiController, rs security.RouterSecurity) chi.Router {
+	r := chi.NewRouter()
+	r.Use(rs.AuthenticateProvisioningClient)
+	r.Get("/ServiceProviderConfig", ctrl.SCIMServiceProviderConfig)
+	r.Get("/ResourceTypes", ctrl.SCIMResourceTypes)
+	r.Get("/Users", ctrl.SCIMGetUsers)
+	r.Post("/Users", ctrl.SCIMCreateUser)
+	r.Get("/Users/{id}", ctrl.SCIMGetUser)
+	r.Put("/Users/{id}", ctrl.SCIMReplaceUser)
+	r.Patch("/Users/{id}", ctrl.SCIMPatchUser)
+	r.Delete("/Users/{id}", ctrl.SCIMDeleteUser)
+	r.Get("/Groups", ctrl.SCIMGetGroups)
+	r.Post("/Groups", ctrl.SCIMCreateGroup)
+	r.Get("/Groups/{id}", ctrl.SCIMGetGroup)
+	r.Put("/Groups/{id}", ctrl.SCIMReplaceGroup)
+	r.Patch("/Groups/{id}", ctrl.SCIMPatchGroup)
+	r.Delete("/Groups/{id}", ctrl.SCIMDeleteGroup)
+	return r
+}
+
 // AddMiddleware will add functions before processing the main request
 // NOTE : The middleware functions run in reverse order ... at least functionally.  eg If you want to authenticate a
 // request and then authorize the principle, load the middleware functions in the order authorize, authenticate
@@ -1,11 +1,14 @@
 package controller
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
+	"github.com/gkontos/goapi/db"
 	"github.com/gkontos/goapi/model"
+	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -19,9 +22,22 @@ func TestPingRoute(t *testing.T) {
 	assert.Equal(t, http.StatusNotFound, w.Code)
 }
 
-type routerTestDbHandler struct{}
+// withURLParams will add chi url parameters to a request for handlers which are called outside of the router
+func withURLParams(r *http.Request, params map[string]string) *http.Request {
+	rctx := chi.NewRouteContext()
+	for k, v := range params {
+		rctx.URLParams.Add(k, v)
+	}
+	return r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+}
+
+// routerTestDbHandler embeds the DbHandler interface so that methods which are not needed by the router tests
+// do not need to be stubbed.  Calling one of them will panic.
+type routerTestDbHandler struct {
+	db.DbHandler
+}
 
-func (d *routerTestDbHandler) GetUsers() ([]model.User, error) {
+func (d *routerTestDbHandler) GetUsers(query model.UserQuery) (*model.UserPage, error) {
 	panic("not implemented") // TODO: Implement
 }
 
@@ -0,0 +1,879 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gkontos/goapi/db"
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/security"
+	"github.com/gkontos/goapi/util"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// scimBasePath is where the SCIM endpoints are mounted, it is the base of the resource locations
+const scimBasePath = "/scim/v2"
+
+// scimAuthProvider returns the login provider of provisioned users from SCIM_AUTH_PROVIDER.  Users log in with the
+// email provider by default, another provider identifies them by their externalId.
+func scimAuthProvider() string {
+	if provider := os.Getenv("SCIM_AUTH_PROVIDER"); provider != "" {
+		return provider
+	}
+	return security.EmailProvider
+}
+
+// scimAllowedRoles returns the roles which provisioning clients can give users from SCIM_ROLES, a comma separated
+// list which defaults to ROLE_USER.  An identity provider should not decide who administers the app, so the list can
+// not have ROLE_ADMIN.
+func scimAllowedRoles() []string {
+	roles := []string{}
+	for _, role := range strings.Split(os.Getenv("SCIM_ROLES"), ",") {
+		role = strings.TrimSpace(role)
+		if role == "" || containsStatus(roles, role) {
+			continue
+		}
+		if role == security.AdministratorRole {
+			err := fmt.Errorf("SCIM_ROLES can not have %s", role)
+			logger.Logger.Error().Err(err).Msg("SCIM_ROLES is invalid")
+			panic(err)
+		}
+		roles = append(roles, role)
+	}
+	if len(roles) == 0 {
+		roles = append(roles, security.UserRole)
+	}
+	return roles
+}
+
+// SCIMServiceProviderConfig describes the SCIM features which are supported
+func (api *apiController) SCIMServiceProviderConfig(w http.ResponseWriter, r *http.Request) {
+	supported := func(supported bool) model.JSONMap {
+		return model.JSONMap{"supported": supported}
+	}
+	writeSCIM(w, model.JSONMap{
+		"schemas":        []string{model.SCIMServiceProviderConfigSchema},
+		"patch":          supported(true),
+		"bulk":           model.JSONMap{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         model.JSONMap{"supported": true, "maxResults": model.MaxUserPageSize},
+		"changePassword": supported(false),
+		"sort":           supported(false),
+		"etag":           supported(false),
+		"authenticationSchemes": []model.JSONMap{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer token",
+			"description": "the token issued to the provisioning client",
+		}},
+		"meta": model.JSONMap{"resourceType": "ServiceProviderConfig", "location": scimBasePath + "/ServiceProviderConfig"},
+	}, http.StatusOK)
+}
+
+// SCIMResourceTypes lists the User and Group resource types
+func (api *apiController) SCIMResourceTypes(w http.ResponseWriter, r *http.Request) {
+	resourceType := func(name string, endpoint string, schema string) interface{} {
+		return model.JSONMap{
+			"schemas":  []string{model.SCIMResourceTypeSchema},
+			"id":       name,
+			"name":     name,
+			"endpoint": endpoint,
+			"schema":   schema,
+			"meta":     model.JSONMap{"resourceType": "ResourceType", "location": scimBasePath + "/ResourceTypes/" + name},
+		}
+	}
+	resources := []interface{}{
+		resourceType("User", "/Users", model.SCIMUserSchema),
+		resourceType("Group", "/Groups", model.SCIMGroupSchema),
+	}
+	writeSCIM(w, scimList(resources, len(resources), 1), http.StatusOK)
+}
+
+// SCIMGetUsers returns a page of the users which have not been deleted, selected by an equality filter
+func (api *apiController) SCIMGetUsers(w http.ResponseWriter, r *http.Request) {
+
+	startIndex, count, err := scimPaging(r)
+	if err != nil {
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	query := model.ProvisionedUserQuery{Offset: startIndex - 1, Limit: count}
+	if filter := r.URL.Query().Get("filter"); filter != "" {
+		f, err := parseSCIMFilter(filter)
+		if err == nil {
+			err = provisionedUserQuery(f, &query)
+		}
+		if err != nil {
+			util.ReturnSCIMError(w, err)
+			return
+		}
+	}
+	page, err := api.dbh.GetProvisionedUsers(query)
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error getting provisioned users")
+		util.ReturnSCIMError(w, err)
+		return
+	}
+
+	resources := make([]interface{}, 0, len(page.Users))
+	for _, u := range page.Users {
+		resources = append(resources, scimUser(u))
+	}
+	writeSCIM(w, scimList(resources, page.Total, startIndex), http.StatusOK)
+
+}
+
+// SCIMGetUser returns a user who has not been deleted
+func (api *apiController) SCIMGetUser(w http.ResponseWriter, r *http.Request) {
+
+	u, err := api.provisionedUser(chi.URLParam(r, "id"))
+	if err != nil {
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	writeSCIM(w, scimUser(*u), http.StatusOK)
+
+}
+
+// SCIMCreateUser creates a user.  A user who was deleted is provisioned again when the identity matches.
+func (api *apiController) SCIMCreateUser(w http.ResponseWriter, r *http.Request) {
+
+	s := &model.SCIMUser{}
+	if err := util.ParseJsonRequest(r, s); err != nil {
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	uid, err := api.saveProvisionedUser(r, nil, s)
+	if err != nil {
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	api.writeProvisionedUser(w, uid, http.StatusCreated)
+
+}
+
+// SCIMReplaceUser replaces the user's attributes.  The roles are kept when the request does not have any.
+func (api *apiController) SCIMReplaceUser(w http.ResponseWriter, r *http.Request) {
+
+	existing, err := api.writableProvisionedUser(chi.URLParam(r, "id"))
+	if err != nil {
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	s := &model.SCIMUser{}
+	if err := util.ParseJsonRequest(r, s); err != nil {
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	if _, err := api.saveProvisionedUser(r, existing, s); err != nil {
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	api.writeProvisionedUser(w, existing.UID, http.StatusOK)
+
+}
+
+// SCIMPatchUser changes the user with patch operations.  Setting active to false deprovisions the user.
+func (api *apiController) SCIMPatchUser(w http.ResponseWriter, r *http.Request) {
+
+	existing, err := api.writableProvisionedUser(chi.URLParam(r, "id"))
+	if err != nil {
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	patch := &model.SCIMPatchRequest{}
+	if err := util.ParseJsonRequest(r, patch); err != nil {
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	s := &model.SCIMUser{}
+	if err := patchSCIMResource(scimUser(*existing), patch, s); err != nil {
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	if _, err := api.saveProvisionedUser(r, existing, s); err != nil {
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	api.writeProvisionedUser(w, existing.UID, http.StatusOK)
+
+}
+
+// SCIMDeleteUser deprovisions the user.  The user is kept with the deleted status, so their history is kept, and is no
+// longer a SCIM resource.
+func (api *apiController) SCIMDeleteUser(w http.ResponseWriter, r *http.Request) {
+
+	u, err := api.writableProvisionedUser(chi.URLParam(r, "id"))
+	if err != nil {
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	reason := "deleted by " + provisioningClient(r).Name
+	err = api.dbh.WithTransaction(func(tx db.DbHandler) error {
+		if err := tx.UpdateUserStatus(u.UID, model.UserStatusDeleted, reason); err != nil {
+			return err
+		}
+		// the external id can be given to a new user
+		return tx.SetExternalID(u.UID, "")
+	})
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error deleting provisioned user")
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	security.InvalidateUser(u.UID)
+	api.audit(r, "user.status", u.UID, model.JSONMap{"status": model.UserStatusDeleted, "reason": reason})
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
+
+// SCIMGetGroups returns a page of the global groups selected by the filter
+func (api *apiController) SCIMGetGroups(w http.ResponseWriter, r *http.Request) {
+
+	startIndex, count, err := scimPaging(r)
+	if err != nil {
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	var filter scimFilter
+	if f := r.URL.Query().Get("filter"); f != "" {
+		if filter, err = parseSCIMFilter(f); err != nil {
+			util.ReturnSCIMError(w, err)
+			return
+		}
+	}
+	withMembers := !strings.Contains(strings.ToLower(r.URL.Query().Get("excludedAttributes")), "members")
+	groups, err := api.dbh.GetGroups()
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error getting groups")
+		util.ReturnSCIMError(w, err)
+		return
+	}
+
+	// groups are few, so they are filtered and paged in memory
+	matches := []interface{}{}
+	for _, g := range groups {
+		var members []string
+		if withMembers {
+			if members, err = api.dbh.GetGroupMembers(g.ID); err != nil {
+				logger.Logger.Error().Err(err).Msg("error getting group members")
+				util.ReturnSCIMError(w, err)
+				return
+			}
+		}
+		group := scimGroup(g, members)
+		if filter != nil {
+			doc, err := scimDocument(group)
+			if err != nil {
+				util.ReturnSCIMError(w, err)
+				return
+			}
+			if !filter.match(doc) {
+				continue
+			}
+		}
+		matches = append(matches, group)
+	}
+	resources := []interface{}{}
+	if startIndex <= len(matches) {
+		resources = matches[startIndex-1:]
+		if len(resources) > count {
+			resources = resources[:count]
+		}
+	}
+	writeSCIM(w, scimList(resources, len(matches), startIndex), http.StatusOK)
+
+}
+
+// SCIMGetGroup returns a global group with its members
+func (api *apiController) SCIMGetGroup(w http.ResponseWriter, r *http.Request) {
+
+	g, members, err := api.provisionedGroup(chi.URLParam(r, "id"))
+	if err != nil {
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	writeSCIM(w, scimGroup(*g, members), http.StatusOK)
+
+}
+
+// SCIMCreateGroup creates a global group without roles, admins decide what the group grants
+func (api *apiController) SCIMCreateGroup(w http.ResponseWriter, r *http.Request) {
+
+	s := &model.SCIMGroup{}
+	if err := util.ParseJsonRequest(r, s); err != nil {
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	id, err := api.saveProvisionedGroup(r, nil, nil, s)
+	if err != nil {
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	api.writeProvisionedGroup(w, id, http.StatusCreated)
+
+}
+
+// SCIMReplaceGroup replaces the group's name and members, its roles and description are kept
+func (api *apiController) SCIMReplaceGroup(w http.ResponseWriter, r *http.Request) {
+
+	g, members, err := api.provisionedGroup(chi.URLParam(r, "id"))
+	if err != nil {
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	s := &model.SCIMGroup{}
+	if err := util.ParseJsonRequest(r, s); err != nil {
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	if _, err := api.saveProvisionedGroup(r, g, members, s); err != nil {
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	api.writeProvisionedGroup(w, g.ID, http.StatusOK)
+
+}
+
+// SCIMPatchGroup changes the group's name and members with patch operations
+func (api *apiController) SCIMPatchGroup(w http.ResponseWriter, r *http.Request) {
+
+	g, members, err := api.provisionedGroup(chi.URLParam(r, "id"))
+	if err != nil {
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	patch := &model.SCIMPatchRequest{}
+	if err := util.ParseJsonRequest(r, patch); err != nil {
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	s := &model.SCIMGroup{}
+	if err := patchSCIMResource(scimGroup(*g, members), patch, s); err != nil {
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	if _, err := api.saveProvisionedGroup(r, g, members, s); err != nil {
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	api.writeProvisionedGroup(w, g.ID, http.StatusOK)
+
+}
+
+// SCIMDeleteGroup deletes the group, its members lose the roles it granted
+func (api *apiController) SCIMDeleteGroup(w http.ResponseWriter, r *http.Request) {
+
+	g, members, err := api.provisionedGroup(chi.URLParam(r, "id"))
+	if err != nil {
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	if err := api.dbh.DeleteGroup(g.ID); err != nil {
+		logger.Logger.Error().Err(err).Msg("error deleting group")
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	for _, uid := range members {
+		security.InvalidateUser(uid)
+	}
+	api.audit(r, "scim.group.delete", "", model.JSONMap{"group_id": g.ID, "name": g.Name})
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
+
+// saveProvisionedUser creates the user, or updates the existing user, from their SCIM representation and returns their
+// uid.  The login identity of a user created by a provisioning client follows their email, or externalId when
+// SCIM_AUTH_PROVIDER is a login provider.  Changing active moves the user between the active and deactivated status.
+func (api *apiController) saveProvisionedUser(r *http.Request, existing *model.ProvisionedUser, s *model.SCIMUser) (string, error) {
+	s.UserName = strings.TrimSpace(s.UserName)
+	s.ExternalID = strings.TrimSpace(s.ExternalID)
+	if s.UserName == "" {
+		return "", invalidSCIMValue("userName is required")
+	}
+	if len(s.UserName) > maxUserFieldLength || len(s.ExternalID) > maxUserFieldLength {
+		return "", invalidSCIMValue("userName and externalId must be at most %d characters", maxUserFieldLength)
+	}
+	email := scimPrimaryEmail(s.Emails)
+	if email != "" {
+		if address, err := mail.ParseAddress(email); err != nil || address.Address != email {
+			return "", invalidSCIMValue("%s is not an email address", email)
+		}
+	}
+	roles, err := api.scimRoles(s.Roles)
+	if err != nil {
+		return "", err
+	}
+
+	uid := ""
+	if existing != nil {
+		uid = existing.UID
+	}
+	if err := api.checkSCIMUnique(uid, model.ProvisionedUserQuery{UserName: s.UserName}, "userName"); err != nil {
+		return "", err
+	}
+	if s.ExternalID != "" {
+		if err := api.checkSCIMUnique(uid, model.ProvisionedUserQuery{ExternalID: s.ExternalID}, "externalId"); err != nil {
+			return "", err
+		}
+	}
+
+	u := &model.User{UID: uid, UserName: s.UserName, UserDetails: model.UserDetails{Email: email}}
+	if s.Name != nil {
+		u.UserDetails.FirstName, u.UserDetails.LastName, u.UserDetails.FullName = s.Name.GivenName, s.Name.FamilyName, s.Name.Formatted
+	}
+	if u.UserDetails.FullName == "" {
+		u.UserDetails.FullName = s.DisplayName
+	}
+	// users who log in with another provider keep their identity
+	if existing == nil || existing.AuthProvider == api.scimAuthProvider {
+		u.AuthProvider = api.scimAuthProvider
+		if u.AuthProvider == security.EmailProvider {
+			u.ProviderID = strings.ToLower(email)
+		} else {
+			u.ProviderID = s.ExternalID
+		}
+		if u.ProviderID == "" && u.AuthProvider == security.EmailProvider {
+			return "", invalidSCIMValue("an email is required")
+		}
+		if u.ProviderID == "" {
+			return "", invalidSCIMValue("externalId is required")
+		}
+	} else {
+		u.AuthProvider, u.ProviderID = existing.AuthProvider, existing.ProviderID
+	}
+	status := model.UserStatusActive
+	if s.Active != nil && !bool(*s.Active) {
+		status = model.UserStatusDeactivated
+	}
+	previous := ""
+	if existing != nil {
+		previous = existing.Status
+	}
+	reason := ""
+	if status != model.UserStatusActive {
+		reason = "deprovisioned by " + provisioningClient(r).Name
+	}
+
+	err = api.dbh.WithTransaction(func(tx db.DbHandler) error {
+		if existing == nil {
+			stored, err := tx.GetUserByProvider(u.AuthProvider, u.ProviderID)
+			if err != nil {
+				return err
+			}
+			switch {
+			case stored.UID == "":
+				u.Status = status
+			case stored.Status == model.UserStatusDeleted:
+				// a deleted user is provisioned again
+				u.UID, previous = stored.UID, stored.Status
+			default:
+				return &model.SCIMRequestError{Status: http.StatusConflict, ScimType: "uniqueness",
+					Err: fmt.Errorf("another user has the identity %s of %s", u.ProviderID, u.AuthProvider)}
+			}
+			if roles == nil {
+				roles = []string{security.UserRole}
+			}
+		} else if roles == nil {
+			roles = existing.UserDetails.Roles
+		}
+		if existing != nil {
+			u.UserDetails.KeepEmailVerified(existing.UserDetails)
+		}
+		u.UserDetails.Roles = roles
+		if _, err := tx.UpsertUser(u); err != nil {
+			var validation *model.ValidationError
+			if errors.As(err, &validation) {
+				return &model.SCIMRequestError{Status: http.StatusConflict, ScimType: "uniqueness", Err: err}
+			}
+			return err
+		}
+		if err := tx.SetExternalID(u.UID, s.ExternalID); err != nil {
+			return err
+		}
+		if previous != "" && previous != status {
+			return tx.UpdateUserStatus(u.UID, status, reason)
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error saving provisioned user")
+		return "", err
+	}
+
+	// the user's roles or status may have changed, a deactivated user's tokens stop working on their next request
+	security.InvalidateUser(u.UID)
+	action := "scim.user.update"
+	if existing == nil {
+		action = "scim.user.create"
+	}
+	api.audit(r, action, u.UID, model.JSONMap{"user_name": u.UserName, "external_id": s.ExternalID, "roles": u.UserDetails.Roles})
+	if previous != "" && previous != status {
+		api.audit(r, "user.status", u.UID, model.JSONMap{"status": status, "reason": reason})
+	}
+	return u.UID, nil
+}
+
+// saveProvisionedGroup creates the global group, or updates the existing group, from its SCIM representation and
+// returns its id.  The members must be users who have not been deleted.
+func (api *apiController) saveProvisionedGroup(r *http.Request, existing *model.Group, members []string, s *model.SCIMGroup) (string, error) {
+	s.DisplayName = strings.TrimSpace(s.DisplayName)
+	if s.DisplayName == "" {
+		return "", invalidSCIMValue("displayName is required")
+	}
+	groups, err := api.dbh.GetGroups()
+	if err != nil {
+		return "", err
+	}
+	for _, g := range groups {
+		if g.Name == s.DisplayName && (existing == nil || g.ID != existing.ID) {
+			return "", &model.SCIMRequestError{Status: http.StatusConflict, ScimType: "uniqueness", Err: fmt.Errorf("the group %s already exists", s.DisplayName)}
+		}
+	}
+	wanted := []string{}
+	for _, member := range s.Members {
+		if containsStatus(wanted, member.Value) {
+			continue
+		}
+		page, err := api.dbh.GetProvisionedUsers(model.ProvisionedUserQuery{UID: member.Value})
+		if err != nil {
+			return "", err
+		}
+		if page.Total == 0 {
+			return "", invalidSCIMValue("member %s does not exist", member.Value)
+		}
+		wanted = append(wanted, member.Value)
+	}
+
+	g := &model.Group{Name: s.DisplayName}
+	if existing != nil {
+		g.ID, g.Description, g.Roles = existing.ID, existing.Description, existing.Roles
+	}
+	added, removed := []string{}, []string{}
+	err = api.dbh.WithTransaction(func(tx db.DbHandler) error {
+		var err error
+		if existing == nil {
+			err = tx.InsertGroup(g)
+		} else {
+			err = tx.UpdateGroup(g)
+		}
+		if err != nil {
+			return err
+		}
+		for _, uid := range wanted {
+			if !containsStatus(members, uid) {
+				if err := tx.AddGroupMember(g.ID, uid); err != nil {
+					return err
+				}
+				added = append(added, uid)
+			}
+		}
+		for _, uid := range members {
+			if !containsStatus(wanted, uid) {
+				if err := tx.RemoveGroupMember(g.ID, uid); err != nil {
+					return err
+				}
+				removed = append(removed, uid)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error saving provisioned group")
+		return "", err
+	}
+
+	// members gain or lose the group's roles
+	for _, uid := range append(added, removed...) {
+		security.InvalidateUser(uid)
+	}
+	action := "scim.group.update"
+	if existing == nil {
+		action = "scim.group.create"
+	}
+	api.audit(r, action, "", model.JSONMap{"group_id": g.ID, "name": g.Name, "added": added, "removed": removed})
+	return g.ID, nil
+}
+
+// provisionedUser returns a user who has not been deleted
+func (api *apiController) provisionedUser(uid string) (*model.ProvisionedUser, error) {
+	notFound := &model.ResourceDoesNotExistError{Err: errors.New("user does not exist")}
+	if _, err := uuid.Parse(uid); err != nil {
+		return nil, notFound
+	}
+	page, err := api.dbh.GetProvisionedUsers(model.ProvisionedUserQuery{UID: uid, Limit: 1})
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error getting provisioned user")
+		return nil, err
+	}
+	if len(page.Users) == 0 {
+		return nil, notFound
+	}
+	return &page.Users[0], nil
+}
+
+// writableProvisionedUser returns a user who has not been deleted and who was provisioned, they log in with the
+// provider of provisioned users or have an externalId.  Provisioning clients can read every user but can not change
+// the users who registered with another provider, such as the admins.
+func (api *apiController) writableProvisionedUser(uid string) (*model.ProvisionedUser, error) {
+	u, err := api.provisionedUser(uid)
+	if err != nil {
+		return nil, err
+	}
+	if u.AuthProvider != api.scimAuthProvider && u.ExternalID == "" {
+		return nil, &model.PermissionDeniedError{Err: errors.New("the user was not provisioned and can not be changed by a provisioning client")}
+	}
+	return u, nil
+}
+
+// provisionedGroup returns a global group and the uids of its members
+func (api *apiController) provisionedGroup(id string) (*model.Group, []string, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, nil, &model.ResourceDoesNotExistError{Err: errors.New("group does not exist")}
+	}
+	g, err := api.dbh.GetGroup(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	members, err := api.dbh.GetGroupMembers(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return g, members, nil
+}
+
+func (api *apiController) writeProvisionedUser(w http.ResponseWriter, uid string, httpStatus int) {
+	u, err := api.provisionedUser(uid)
+	if err != nil {
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	user := scimUser(*u)
+	if httpStatus == http.StatusCreated {
+		w.Header().Set("Location", user.Meta.Location)
+	}
+	writeSCIM(w, user, httpStatus)
+}
+
+func (api *apiController) writeProvisionedGroup(w http.ResponseWriter, id string, httpStatus int) {
+	g, members, err := api.provisionedGroup(id)
+	if err != nil {
+		util.ReturnSCIMError(w, err)
+		return
+	}
+	group := scimGroup(*g, members)
+	if httpStatus == http.StatusCreated {
+		w.Header().Set("Location", group.Meta.Location)
+	}
+	writeSCIM(w, group, httpStatus)
+}
+
+// checkSCIMUnique returns a uniqueness error when a user other than uid matches the query
+func (api *apiController) checkSCIMUnique(uid string, query model.ProvisionedUserQuery, attribute string) error {
+	query.Limit = 2
+	page, err := api.dbh.GetProvisionedUsers(query)
+	if err != nil {
+		return err
+	}
+	for _, u := range page.Users {
+		if u.UID != uid {
+			return &model.SCIMRequestError{Status: http.StatusConflict, ScimType: "uniqueness", Err: fmt.Errorf("another user has the %s", attribute)}
+		}
+	}
+	return nil
+}
+
+// scimRoles returns the values of the roles, or nil when there are none.  The roles must be in SCIM_ROLES, exist and
+// not inherit ROLE_ADMIN.
+func (api *apiController) scimRoles(values []model.SCIMMultiValue) ([]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	roles := []string{}
+	for _, v := range values {
+		if !containsStatus(roles, v.Value) {
+			roles = append(roles, v.Value)
+		}
+	}
+	defined, err := api.dbh.GetRoles()
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string]model.Role{}
+	for _, role := range defined {
+		byName[role.Name] = role
+	}
+	for _, role := range roles {
+		if _, ok := byName[role]; !ok {
+			return nil, invalidSCIMValue("role %s does not exist", role)
+		}
+		if !containsStatus(api.scimAllowedRoles, role) || inheritsRole(byName, role, security.AdministratorRole, map[string]bool{}) {
+			return nil, invalidSCIMValue("role %s can not be provisioned", role)
+		}
+	}
+	return roles, nil
+}
+
+// inheritsRole returns true when the role is the other role or inherits it.  A role which has already been visited is
+// skipped, so an inheritance cycle can not recurse forever.
+func inheritsRole(byName map[string]model.Role, name string, other string, visited map[string]bool) bool {
+	if name == other {
+		return true
+	}
+	if visited[name] {
+		return false
+	}
+	visited[name] = true
+	for _, inherited := range byName[name].Inherits {
+		if inheritsRole(byName, inherited, other, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+func scimUser(u model.ProvisionedUser) model.SCIMUser {
+	active := model.SCIMBool(u.Status == model.UserStatusActive)
+	created := u.CreatedDate
+	s := model.SCIMUser{
+		Schemas:     []string{model.SCIMUserSchema},
+		ID:          u.UID,
+		ExternalID:  u.ExternalID,
+		UserName:    u.UserName,
+		DisplayName: u.UserDetails.FullName,
+		Active:      &active,
+		Roles:       []model.SCIMMultiValue{},
+		Meta:        &model.SCIMMeta{ResourceType: "User", Created: &created, Location: scimBasePath + "/Users/" + u.UID},
+	}
+	details := u.UserDetails
+	if details.FirstName != "" || details.LastName != "" || details.FullName != "" {
+		s.Name = &model.SCIMName{Formatted: details.FullName, GivenName: details.FirstName, FamilyName: details.LastName}
+	}
+	if details.Email != "" {
+		s.Emails = []model.SCIMMultiValue{{Value: details.Email, Type: "work", Primary: true}}
+	}
+	for _, role := range details.Roles {
+		s.Roles = append(s.Roles, model.SCIMMultiValue{Value: role})
+	}
+	return s
+}
+
+func scimGroup(g model.Group, members []string) model.SCIMGroup {
+	created := g.CreatedDate
+	s := model.SCIMGroup{
+		Schemas:     []string{model.SCIMGroupSchema},
+		ID:          g.ID,
+		DisplayName: g.Name,
+		Meta:        &model.SCIMMeta{ResourceType: "Group", Created: &created, Location: scimBasePath + "/Groups/" + g.ID},
+	}
+	for _, uid := range members {
+		s.Members = append(s.Members, model.SCIMMultiValue{Value: uid, Ref: scimBasePath + "/Users/" + uid})
+	}
+	return s
+}
+
+// scimPrimaryEmail returns the primary email, or the work email, or the first email
+func scimPrimaryEmail(emails []model.SCIMMultiValue) string {
+	email := ""
+	for i, e := range emails {
+		if e.Primary {
+			return strings.TrimSpace(e.Value)
+		}
+		if i == 0 || strings.EqualFold(e.Type, "work") {
+			email = strings.TrimSpace(e.Value)
+		}
+	}
+	return email
+}
+
+// patchSCIMResource applies the patch to the SCIM representation of a resource and decodes the result into patched
+func patchSCIMResource(resource interface{}, patch *model.SCIMPatchRequest, patched interface{}) error {
+	doc, err := scimDocument(resource)
+	if err != nil {
+		return err
+	}
+	if err := applySCIMPatch(doc, patch.Operations); err != nil {
+		return err
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, patched); err != nil {
+		return invalidSCIMValue("the patched resource is invalid: %s", err.Error())
+	}
+	return nil
+}
+
+// scimDocument returns the JSON object of a SCIM resource
+func scimDocument(resource interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(resource)
+	if err != nil {
+		return nil, err
+	}
+	doc := map[string]interface{}{}
+	return doc, json.Unmarshal(b, &doc)
+}
+
+// scimPaging returns the one based startIndex and the count of a listing
+func scimPaging(r *http.Request) (int, int, error) {
+	params := r.URL.Query()
+	startIndex, count := 1, model.MaxUserPageSize
+	if v := params.Get("startIndex"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, 0, invalidSCIMValue("startIndex must be a number")
+		}
+		if i > 1 {
+			startIndex = i
+		}
+	}
+	if v := params.Get("count"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, 0, invalidSCIMValue("count must be a number")
+		}
+		if i < 0 {
+			i = 0
+		}
+		if i < count {
+			count = i
+		}
+	}
+	return startIndex, count, nil
+}
+
+func scimList(resources []interface{}, total int, startIndex int) *model.SCIMListResponse {
+	return &model.SCIMListResponse{
+		Schemas:      []string{model.SCIMListResponseSchema},
+		TotalResults: total,
+		StartIndex:   startIndex,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	}
+}
+
+func invalidSCIMValue(format string, args ...interface{}) error {
+	return &model.SCIMRequestError{Status: http.StatusBadRequest, ScimType: "invalidValue", Err: fmt.Errorf(format, args...)}
+}
+
+// provisioningClient returns the client which made a SCIM request
+func provisioningClient(r *http.Request) *model.ProvisioningClient {
+	if client, ok := r.Context().Value(security.ProvisioningClientContextKey).(*model.ProvisioningClient); ok {
+		return client
+	}
+	return &model.ProvisioningClient{}
+}
+
+func writeSCIM(w http.ResponseWriter, body interface{}, httpStatus int) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	util.ReturnBodyJSON(w, body, httpStatus)
+}
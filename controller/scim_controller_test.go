@@ -0,0 +1,609 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gkontos/goapi/db"
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/security"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testSCIMUserUID    = "5b1c6f0e-8d2a-4c3b-9e4f-0a1b2c3d4e5f"
+	testSCIMDeletedUID = "7d9e1f2a-3b4c-4d5e-8f6a-7b8c9d0e1f2a"
+)
+
+// testSCIMAllowedRoles has ROLE_SUPPORT, which inherits ROLE_ADMIN, to check that it still can not be provisioned
+var testSCIMAllowedRoles = []string{security.UserRole, "ROLE_EDITOR", "ROLE_SUPPORT"}
+
+func TestSCIMCreateUser(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	cases := []struct {
+		requestBody          string
+		expectedResponseCode int
+		expectedScimType     string
+		expectedUID          string
+		expectedStatus       string
+	}{
+		// ok
+		{
+			requestBody:          `{"userName":"anna","externalId":"e-anna","emails":[{"value":"anna@example.com","primary":true}],"active":true}`,
+			expectedResponseCode: http.StatusCreated,
+			expectedStatus:       model.UserStatusActive,
+		},
+		// created inactive
+		{
+			requestBody:          `{"userName":"anna","emails":[{"value":"anna@example.com"}],"active":"False"}`,
+			expectedResponseCode: http.StatusCreated,
+			expectedStatus:       model.UserStatusDeactivated,
+		},
+		// a deleted user is provisioned again
+		{
+			requestBody:          `{"userName":"gone","emails":[{"value":"gone@example.com"}]}`,
+			expectedResponseCode: http.StatusCreated,
+			expectedUID:          testSCIMDeletedUID,
+			expectedStatus:       model.UserStatusActive,
+		},
+		// userName is required
+		{
+			requestBody:          `{"emails":[{"value":"anna@example.com"}]}`,
+			expectedResponseCode: http.StatusBadRequest,
+			expectedScimType:     "invalidValue",
+		},
+		// the email is the login identity
+		{
+			requestBody:          `{"userName":"anna"}`,
+			expectedResponseCode: http.StatusBadRequest,
+			expectedScimType:     "invalidValue",
+		},
+		// userName is taken
+		{
+			requestBody:          `{"userName":"Tom","emails":[{"value":"anna@example.com"}]}`,
+			expectedResponseCode: http.StatusConflict,
+			expectedScimType:     "uniqueness",
+		},
+		// the login identity is taken
+		{
+			requestBody:          `{"userName":"anna","emails":[{"value":"tom@example.com"}]}`,
+			expectedResponseCode: http.StatusConflict,
+			expectedScimType:     "uniqueness",
+		},
+		// role which is not defined
+		{
+			requestBody:          `{"userName":"anna","emails":[{"value":"anna@example.com"}],"roles":[{"value":"ROLE_KING"}]}`,
+			expectedResponseCode: http.StatusBadRequest,
+			expectedScimType:     "invalidValue",
+		},
+		// invalid json
+		{
+			requestBody:          `{"userName":`,
+			expectedResponseCode: http.StatusBadRequest,
+			expectedScimType:     "invalidSyntax",
+		},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("POST", "/scim/v2/Users", bytes.NewBufferString(c.requestBody))
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		rootRequest = withProvisioningClient(rootRequest)
+
+		dbh := newSCIMTestDbHandler()
+		ctrl := &apiController{dbh: dbh, scimAuthProvider: security.EmailProvider, scimAllowedRoles: testSCIMAllowedRoles}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.SCIMCreateUser)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match for %s", c.requestBody)
+		assert.Equal(t, "application/scim+json", rr.Header().Get("Content-Type"))
+		if c.expectedScimType != "" {
+			scimErr := model.SCIMError{}
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &scimErr))
+			assert.Equal(t, c.expectedScimType, scimErr.ScimType, "scimType didn't match for %s", c.requestBody)
+			assert.Equal(t, 3, len(dbh.users), "users were changed for %s", c.requestBody)
+			continue
+		}
+		user := model.SCIMUser{}
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &user))
+		if c.expectedUID != "" {
+			assert.Equal(t, c.expectedUID, user.ID)
+		}
+		assert.Equal(t, "/scim/v2/Users/"+user.ID, rr.Header().Get("Location"))
+		stored := dbh.users[user.ID]
+		if assert.NotNil(t, stored) {
+			assert.Equal(t, c.expectedStatus, stored.Status)
+			assert.Equal(t, security.EmailProvider, stored.AuthProvider)
+			assert.Equal(t, []string{security.UserRole}, stored.UserDetails.Roles)
+		}
+		if assert.NotEmpty(t, dbh.audits) {
+			assert.Equal(t, "scim:test-client", dbh.audits[0].ActorUID)
+			assert.Equal(t, "scim.user.create", dbh.audits[0].Action)
+		}
+	}
+}
+
+func TestSCIMPatchUser(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	cases := []struct {
+		uid                  string
+		requestBody          string
+		expectedResponseCode int
+		expectedStatus       string
+		expectedEmail        string
+		expectedRoles        []string
+	}{
+		// deprovisioned
+		{
+			uid:                  testSCIMUserUID,
+			requestBody:          `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[{"op":"Replace","path":"active","value":false}]}`,
+			expectedResponseCode: http.StatusOK,
+			expectedStatus:       model.UserStatusDeactivated,
+			expectedEmail:        "tom@example.com",
+			expectedRoles:        []string{security.UserRole},
+		},
+		// azure sends the attributes without a path
+		{
+			uid:                  testSCIMUserUID,
+			requestBody:          `{"Operations":[{"op":"replace","value":{"active":"False","name.givenName":"Thomas"}}]}`,
+			expectedResponseCode: http.StatusOK,
+			expectedStatus:       model.UserStatusDeactivated,
+			expectedEmail:        "tom@example.com",
+			expectedRoles:        []string{security.UserRole},
+		},
+		// the work email changes the login identity
+		{
+			uid:                  testSCIMUserUID,
+			requestBody:          `{"Operations":[{"op":"replace","path":"emails[type eq \"work\"].value","value":"thomas@example.com"}]}`,
+			expectedResponseCode: http.StatusOK,
+			expectedStatus:       model.UserStatusActive,
+			expectedEmail:        "thomas@example.com",
+			expectedRoles:        []string{security.UserRole},
+		},
+		// roles are added
+		{
+			uid:                  testSCIMUserUID,
+			requestBody:          `{"Operations":[{"op":"add","path":"roles","value":[{"value":"ROLE_EDITOR"}]}]}`,
+			expectedResponseCode: http.StatusOK,
+			expectedStatus:       model.UserStatusActive,
+			expectedEmail:        "tom@example.com",
+			expectedRoles:        []string{security.UserRole, "ROLE_EDITOR"},
+		},
+		// the admin role can not be provisioned
+		{
+			uid:                  testSCIMUserUID,
+			requestBody:          `{"Operations":[{"op":"add","path":"roles","value":[{"value":"ROLE_ADMIN"}]}]}`,
+			expectedResponseCode: http.StatusBadRequest,
+			expectedStatus:       model.UserStatusActive,
+			expectedEmail:        "tom@example.com",
+			expectedRoles:        []string{security.UserRole},
+		},
+		// nor a role which inherits it
+		{
+			uid:                  testSCIMUserUID,
+			requestBody:          `{"Operations":[{"op":"add","path":"roles","value":[{"value":"ROLE_SUPPORT"}]}]}`,
+			expectedResponseCode: http.StatusBadRequest,
+			expectedStatus:       model.UserStatusActive,
+			expectedEmail:        "tom@example.com",
+			expectedRoles:        []string{security.UserRole},
+		},
+		// nor a role which is not in the allowed roles
+		{
+			uid:                  testSCIMUserUID,
+			requestBody:          `{"Operations":[{"op":"add","path":"roles","value":[{"value":"ROLE_AUDITOR"}]}]}`,
+			expectedResponseCode: http.StatusBadRequest,
+			expectedStatus:       model.UserStatusActive,
+			expectedEmail:        "tom@example.com",
+			expectedRoles:        []string{security.UserRole},
+		},
+		// a user who was not provisioned can not be changed
+		{
+			uid:                  testUID,
+			requestBody:          `{"Operations":[{"op":"replace","path":"active","value":false}]}`,
+			expectedResponseCode: http.StatusForbidden,
+		},
+		// unknown operation
+		{
+			uid:                  testSCIMUserUID,
+			requestBody:          `{"Operations":[{"op":"move","path":"active","value":false}]}`,
+			expectedResponseCode: http.StatusBadRequest,
+			expectedStatus:       model.UserStatusActive,
+			expectedEmail:        "tom@example.com",
+			expectedRoles:        []string{security.UserRole},
+		},
+		// deleted users are not resources
+		{
+			uid:                  testSCIMDeletedUID,
+			requestBody:          `{"Operations":[{"op":"replace","path":"active","value":true}]}`,
+			expectedResponseCode: http.StatusNotFound,
+		},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("PATCH", "/scim/v2/Users/"+c.uid, bytes.NewBufferString(c.requestBody))
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		rootRequest = withURLParams(rootRequest, map[string]string{"id": c.uid})
+		rootRequest = withProvisioningClient(rootRequest)
+
+		dbh := newSCIMTestDbHandler()
+		ctrl := &apiController{dbh: dbh, scimAuthProvider: security.EmailProvider, scimAllowedRoles: testSCIMAllowedRoles}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.SCIMPatchUser)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match for %s", c.requestBody)
+		if c.expectedStatus == "" {
+			continue
+		}
+		stored := dbh.users[c.uid]
+		assert.Equal(t, c.expectedStatus, stored.Status, "status didn't match for %s", c.requestBody)
+		assert.Equal(t, c.expectedEmail, stored.UserDetails.Email)
+		assert.Equal(t, c.expectedEmail, stored.ProviderID)
+		assert.Equal(t, c.expectedRoles, stored.UserDetails.Roles)
+		if c.expectedStatus == model.UserStatusDeactivated {
+			assert.Equal(t, "deprovisioned by Corporate IdP", stored.StatusReason)
+		}
+	}
+}
+
+func TestSCIMDeleteUser(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	rootRequest, err := http.NewRequest("DELETE", "/scim/v2/Users/"+testSCIMUserUID, nil)
+	if err != nil {
+		t.Errorf("Root request error: %s", err)
+	}
+	rootRequest = withURLParams(rootRequest, map[string]string{"id": testSCIMUserUID})
+	rootRequest = withProvisioningClient(rootRequest)
+
+	dbh := newSCIMTestDbHandler()
+	ctrl := &apiController{dbh: dbh, scimAuthProvider: security.EmailProvider, scimAllowedRoles: testSCIMAllowedRoles}
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(ctrl.SCIMDeleteUser)
+	handler.ServeHTTP(rr, rootRequest)
+
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Equal(t, model.UserStatusDeleted, dbh.users[testSCIMUserUID].Status)
+	assert.Equal(t, "", dbh.users[testSCIMUserUID].ExternalID)
+
+	// a deleted user can not be read
+	rr = httptest.NewRecorder()
+	handler = http.HandlerFunc(ctrl.SCIMGetUser)
+	handler.ServeHTTP(rr, rootRequest)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	// a user who was not provisioned can not be deleted
+	rootRequest, _ = http.NewRequest("DELETE", "/scim/v2/Users/"+testUID, nil)
+	rootRequest = withURLParams(rootRequest, map[string]string{"id": testUID})
+	rootRequest = withProvisioningClient(rootRequest)
+	rr = httptest.NewRecorder()
+	handler = http.HandlerFunc(ctrl.SCIMDeleteUser)
+	handler.ServeHTTP(rr, rootRequest)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, model.UserStatusActive, dbh.users[testUID].Status)
+}
+
+func TestSCIMAllowedRoles(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	t.Setenv("SCIM_ROLES", "")
+	assert.Equal(t, []string{security.UserRole}, scimAllowedRoles())
+	t.Setenv("SCIM_ROLES", " ROLE_EDITOR, ROLE_USER,ROLE_EDITOR")
+	assert.Equal(t, []string{"ROLE_EDITOR", security.UserRole}, scimAllowedRoles())
+	t.Setenv("SCIM_ROLES", "ROLE_USER,ROLE_ADMIN")
+	assert.Panics(t, func() { scimAllowedRoles() })
+}
+
+func TestSCIMGetUsers(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	cases := []struct {
+		query                string
+		expectedResponseCode int
+		expectedTotal        int
+	}{
+		{query: "", expectedResponseCode: http.StatusOK, expectedTotal: 2},
+		{query: `?filter=userName eq "TOM"`, expectedResponseCode: http.StatusOK, expectedTotal: 1},
+		{query: `?filter=userName eq "anna"`, expectedResponseCode: http.StatusOK, expectedTotal: 0},
+		{query: `?filter=emails[type eq "work" and value eq "tom@example.com"]`, expectedResponseCode: http.StatusBadRequest},
+		{query: `?filter=externalId eq "e-tom" and active eq true`, expectedResponseCode: http.StatusOK, expectedTotal: 1},
+		{query: `?filter=userName sw "t"`, expectedResponseCode: http.StatusBadRequest},
+		{query: `?filter=userName eq`, expectedResponseCode: http.StatusBadRequest},
+		{query: `?startIndex=2&count=5`, expectedResponseCode: http.StatusOK, expectedTotal: 2},
+		{query: `?count=0`, expectedResponseCode: http.StatusOK, expectedTotal: 2},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("GET", "/scim/v2/Users"+strings.ReplaceAll(c.query, " ", "%20"), nil)
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		rootRequest = withProvisioningClient(rootRequest)
+
+		dbh := newSCIMTestDbHandler()
+		ctrl := &apiController{dbh: dbh}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.SCIMGetUsers)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match for %s", c.query)
+		if rr.Code != http.StatusOK {
+			continue
+		}
+		list := model.SCIMListResponse{}
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &list))
+		assert.Equal(t, c.expectedTotal, list.TotalResults, "total didn't match for %s", c.query)
+		assert.Equal(t, len(list.Resources), list.ItemsPerPage)
+	}
+}
+
+func TestSCIMPatchGroup(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	cases := []struct {
+		requestBody          string
+		expectedResponseCode int
+		expectedMembers      []string
+		expectedName         string
+	}{
+		// members are added
+		{
+			requestBody:          `{"Operations":[{"op":"add","path":"members","value":[{"value":"` + testSCIMUserUID + `"}]}]}`,
+			expectedResponseCode: http.StatusOK,
+			expectedMembers:      []string{testUID, testSCIMUserUID},
+			expectedName:         "support",
+		},
+		// members are removed by a filter
+		{
+			requestBody:          `{"Operations":[{"op":"remove","path":"members[value eq \"` + testUID + `\"]"}]}`,
+			expectedResponseCode: http.StatusOK,
+			expectedMembers:      []string{},
+			expectedName:         "support",
+		},
+		// the group is renamed
+		{
+			requestBody:          `{"Operations":[{"op":"replace","value":{"displayName":"helpdesk"}}]}`,
+			expectedResponseCode: http.StatusOK,
+			expectedMembers:      []string{testUID},
+			expectedName:         "helpdesk",
+		},
+		// deleted users can not be members
+		{
+			requestBody:          `{"Operations":[{"op":"add","path":"members","value":[{"value":"` + testSCIMDeletedUID + `"}]}]}`,
+			expectedResponseCode: http.StatusBadRequest,
+			expectedMembers:      []string{testUID},
+			expectedName:         "support",
+		},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("PATCH", "/scim/v2/Groups/"+testGroupID, bytes.NewBufferString(c.requestBody))
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		rootRequest = withURLParams(rootRequest, map[string]string{"id": testGroupID})
+		rootRequest = withProvisioningClient(rootRequest)
+
+		dbh := newSCIMTestDbHandler()
+		ctrl := &apiController{dbh: dbh}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.SCIMPatchGroup)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match for %s", c.requestBody)
+		assert.Equal(t, c.expectedMembers, dbh.members)
+		assert.Equal(t, c.expectedName, dbh.group.Name)
+		// roles are kept, admins assign them
+		assert.Equal(t, model.StringList{security.AdministratorRole}, dbh.group.Roles)
+	}
+}
+
+func TestParseSCIMFilter(t *testing.T) {
+	resource := map[string]interface{}{
+		"userName": "Tom",
+		"active":   true,
+		"name":     map[string]interface{}{"givenName": "Thomas"},
+		"emails": []interface{}{
+			map[string]interface{}{"value": "tom@example.com", "type": "work"},
+			map[string]interface{}{"value": "tom@home.example", "type": "home"},
+		},
+	}
+
+	cases := []struct {
+		filter        string
+		expectedMatch bool
+		expectedError bool
+	}{
+		{filter: `userName eq "tom"`, expectedMatch: true},
+		{filter: `urn:ietf:params:scim:schemas:core:2.0:User:userName eq "tom"`, expectedMatch: true},
+		{filter: `name.givenName sw "Tho"`, expectedMatch: true},
+		{filter: `emails co "home"`, expectedMatch: true},
+		{filter: `emails[type eq "work" and value ew "example.com"]`, expectedMatch: true},
+		{filter: `emails[type eq "other"]`, expectedMatch: false},
+		{filter: `active eq false or not (title pr)`, expectedMatch: true},
+		{filter: `(userName eq "anna" or userName eq "tom") and active eq true`, expectedMatch: true},
+		{filter: `userName eq "anna" or userName eq "bob"`, expectedMatch: false},
+		{filter: `userName is "tom"`, expectedError: true},
+		{filter: `userName eq "tom`, expectedError: true},
+		{filter: `(userName eq "tom"`, expectedError: true},
+	}
+
+	for _, c := range cases {
+		f, err := parseSCIMFilter(c.filter)
+		if c.expectedError {
+			assert.Error(t, err, c.filter)
+			continue
+		}
+		if assert.NoError(t, err, c.filter) {
+			assert.Equal(t, c.expectedMatch, f.match(resource), c.filter)
+		}
+	}
+}
+
+func withProvisioningClient(r *http.Request) *http.Request {
+	client := &model.ProvisioningClient{ID: "test-client", Name: "Corporate IdP"}
+	return r.WithContext(context.WithValue(r.Context(), security.ProvisioningClientContextKey, client))
+}
+
+// scimTestDbHandler has active users, a deleted user who had the same provider as new users, and a global group
+type scimTestDbHandler struct {
+	roleTestDbHandler
+	users   map[string]*model.ProvisionedUser
+	group   model.Group
+	members []string
+}
+
+func newSCIMTestDbHandler() *scimTestDbHandler {
+	return &scimTestDbHandler{
+		users: map[string]*model.ProvisionedUser{
+			testSCIMUserUID: {ExternalID: "e-tom", User: model.User{UID: testSCIMUserUID, AuthProvider: security.EmailProvider,
+				ProviderID: "tom@example.com", UserName: "tom", Status: model.UserStatusActive,
+				UserDetails: model.UserDetails{Email: "tom@example.com", FirstName: "Tom", Roles: []string{security.UserRole}}}},
+			testSCIMDeletedUID: {User: model.User{UID: testSCIMDeletedUID, AuthProvider: security.EmailProvider,
+				ProviderID: "gone@example.com", UserName: "gone", Status: model.UserStatusDeleted}},
+			testUID: {User: model.User{UID: testUID, AuthProvider: "google", ProviderID: "anna", UserName: "anna-google",
+				Status: model.UserStatusActive, UserDetails: model.UserDetails{Roles: []string{security.UserRole}}}},
+		},
+		group:   model.Group{ID: testGroupID, Name: "support", Roles: []string{security.AdministratorRole}},
+		members: []string{testUID},
+	}
+}
+
+func (d *scimTestDbHandler) WithTransaction(fn func(tx db.DbHandler) error) error {
+	saved := map[string]model.ProvisionedUser{}
+	for uid, u := range d.users {
+		saved[uid] = *u
+	}
+	group, members := d.group, append([]string{}, d.members...)
+	if err := fn(d); err != nil {
+		d.users = map[string]*model.ProvisionedUser{}
+		for uid, u := range saved {
+			u := u
+			d.users[uid] = &u
+		}
+		d.group, d.members = group, members
+		return err
+	}
+	return nil
+}
+
+func (d *scimTestDbHandler) GetProvisionedUsers(query model.ProvisionedUserQuery) (*model.ProvisionedUserPage, error) {
+	page := &model.ProvisionedUserPage{Users: []model.ProvisionedUser{}}
+	uids := []string{}
+	for uid := range d.users {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+	for _, uid := range uids {
+		u := d.users[uid]
+		if u.Status == model.UserStatusDeleted ||
+			(query.UID != "" && query.UID != uid) ||
+			(query.UserName != "" && !strings.EqualFold(query.UserName, u.UserName)) ||
+			(query.ExternalID != "" && query.ExternalID != u.ExternalID) ||
+			(query.Email != "" && !strings.EqualFold(query.Email, u.UserDetails.Email)) ||
+			(query.Active != nil && *query.Active != (u.Status == model.UserStatusActive)) {
+			continue
+		}
+		page.Total++
+		if page.Total > query.Offset && len(page.Users) < query.Limit {
+			page.Users = append(page.Users, *u)
+		}
+	}
+	return page, nil
+}
+
+func (d *scimTestDbHandler) GetUserByProvider(authProvider string, providerID string) (*model.User, error) {
+	for _, u := range d.users {
+		if u.AuthProvider == authProvider && u.ProviderID == providerID {
+			found := u.User
+			return &found, nil
+		}
+	}
+	return &model.User{}, nil
+}
+
+func (d *scimTestDbHandler) UpsertUser(u *model.User) (*model.User, error) {
+	for uid, other := range d.users {
+		if uid != u.UID && other.AuthProvider == u.AuthProvider && other.ProviderID == u.ProviderID {
+			return nil, &model.ValidationError{Err: errors.New("another user has the provider id")}
+		}
+	}
+	stored, ok := d.users[u.UID]
+	if !ok {
+		u.UID = "9c2d4e6f-1a3b-4c5d-8e7f-9a0b1c2d3e4f"
+		stored = &model.ProvisionedUser{User: model.User{UID: u.UID, Status: u.Status}}
+		d.users[u.UID] = stored
+	}
+	stored.AuthProvider, stored.ProviderID, stored.UserName, stored.UserDetails = u.AuthProvider, u.ProviderID, u.UserName, u.UserDetails
+	return u, nil
+}
+
+func (d *scimTestDbHandler) SetExternalID(uid string, externalID string) error {
+	d.users[uid].ExternalID = externalID
+	return nil
+}
+
+func (d *scimTestDbHandler) UpdateUserStatus(uid string, status string, reason string) error {
+	d.users[uid].Status, d.users[uid].StatusReason = status, reason
+	return nil
+}
+
+func (d *scimTestDbHandler) GetRoles() ([]model.Role, error) {
+	return []model.Role{
+		{Name: security.AdministratorRole},
+		{Name: security.UserRole},
+		{Name: "ROLE_EDITOR"},
+		{Name: "ROLE_AUDITOR"},
+		{Name: "ROLE_SUPPORT", Inherits: model.StringList{"ROLE_EDITOR", security.AdministratorRole}},
+	}, nil
+}
+
+func (d *scimTestDbHandler) GetGroups() ([]model.Group, error) {
+	return []model.Group{d.group}, nil
+}
+
+func (d *scimTestDbHandler) GetGroup(id string) (*model.Group, error) {
+	if id != d.group.ID {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("group does not exist")}
+	}
+	g := d.group
+	return &g, nil
+}
+
+func (d *scimTestDbHandler) UpdateGroup(g *model.Group) error {
+	d.group = *g
+	return nil
+}
+
+func (d *scimTestDbHandler) GetGroupMembers(id string) ([]string, error) {
+	return append([]string{}, d.members...), nil
+}
+
+func (d *scimTestDbHandler) AddGroupMember(id string, uid string) error {
+	d.members = append(d.members, uid)
+	return nil
+}
+
+func (d *scimTestDbHandler) RemoveGroupMember(id string, uid string) error {
+	for i, member := range d.members {
+		if member == uid {
+			d.members = append(d.members[:i], d.members[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
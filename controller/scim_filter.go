@@ -0,0 +1,425 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gkontos/goapi/model"
+)
+
+// scimFilter is a parsed SCIM filter expression (RFC 7644 section 3.4.2.2) which is evaluated against the JSON
+// representation of a resource
+type scimFilter interface {
+	match(resource map[string]interface{}) bool
+}
+
+// scimCompare compares an attribute with a value, or tests that it is present when op is pr
+type scimCompare struct {
+	attr  string
+	sub   string
+	op    string
+	value interface{}
+}
+
+type scimLogical struct {
+	and         bool
+	left, right scimFilter
+}
+
+type scimNot struct {
+	filter scimFilter
+}
+
+// scimValuePath matches a resource when an element of the multi-valued attribute matches the filter
+type scimValuePath struct {
+	attr   string
+	filter scimFilter
+}
+
+var scimCompareOps = map[string]bool{"eq": true, "ne": true, "co": true, "sw": true, "ew": true, "gt": true, "ge": true, "lt": true, "le": true}
+
+func invalidFilter(format string, args ...interface{}) error {
+	return &model.SCIMRequestError{Status: http.StatusBadRequest, ScimType: "invalidFilter", Err: fmt.Errorf(format, args...)}
+}
+
+// parseSCIMFilter parses a filter with the comparison, logical and grouping operators.  Attribute names are not case
+// sensitive and the core schema urn is removed from them.
+func parseSCIMFilter(filter string) (scimFilter, error) {
+	tokens, err := scimTokens(filter)
+	if err != nil {
+		return nil, err
+	}
+	p := &scimFilterParser{tokens: tokens}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, invalidFilter("unexpected %s in filter", p.tokens[p.pos])
+	}
+	return f, nil
+}
+
+// scimTokens splits a filter into brackets, quoted strings, which keep their quotes, and words
+func scimTokens(filter string) ([]string, error) {
+	tokens := []string{}
+	for i := 0; i < len(filter); {
+		c := filter[i]
+		switch {
+		case c == ' ':
+			i++
+		case strings.IndexByte("()[]", c) >= 0:
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			end := i + 1
+			for ; end < len(filter) && filter[end] != '"'; end++ {
+				if filter[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(filter) {
+				return nil, invalidFilter("unterminated string in filter")
+			}
+			tokens = append(tokens, filter[i:end+1])
+			i = end + 1
+		default:
+			end := i
+			for end < len(filter) && strings.IndexByte(` ()[]"`, filter[end]) < 0 {
+				end++
+			}
+			tokens = append(tokens, filter[i:end])
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+type scimFilterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *scimFilterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *scimFilterParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *scimFilterParser) expect(token string) error {
+	if next := p.next(); next != token {
+		return invalidFilter("expected %s in filter", token)
+	}
+	return nil
+}
+
+func (p *scimFilterParser) parseOr() (scimFilter, error) {
+	left, err := p.parseAnd()
+	for err == nil && strings.EqualFold(p.peek(), "or") {
+		p.next()
+		var right scimFilter
+		if right, err = p.parseAnd(); err == nil {
+			left = &scimLogical{left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *scimFilterParser) parseAnd() (scimFilter, error) {
+	left, err := p.parseFactor()
+	for err == nil && strings.EqualFold(p.peek(), "and") {
+		p.next()
+		var right scimFilter
+		if right, err = p.parseFactor(); err == nil {
+			left = &scimLogical{and: true, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *scimFilterParser) parseFactor() (scimFilter, error) {
+	token := p.next()
+	switch {
+	case token == "":
+		return nil, invalidFilter("filter is incomplete")
+	case strings.EqualFold(token, "not"):
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return &scimNot{filter: f}, p.expect(")")
+	case token == "(":
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return f, p.expect(")")
+	case strings.IndexAny(token, `()[]"`) >= 0:
+		return nil, invalidFilter("unexpected %s in filter", token)
+	}
+
+	if p.peek() == "[" {
+		p.next()
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return &scimValuePath{attr: scimAttributeName(token), filter: f}, p.expect("]")
+	}
+	attr, sub := splitSCIMAttribute(token)
+	op := strings.ToLower(p.next())
+	if op == "pr" {
+		return &scimCompare{attr: attr, sub: sub, op: op}, nil
+	}
+	if !scimCompareOps[op] {
+		return nil, invalidFilter("unknown operator %s in filter", op)
+	}
+	value, err := scimFilterValue(p.next())
+	if err != nil {
+		return nil, err
+	}
+	return &scimCompare{attr: attr, sub: sub, op: op, value: value}, nil
+}
+
+// scimFilterValue parses a string, boolean, null or number
+func scimFilterValue(token string) (interface{}, error) {
+	if token == "" {
+		return nil, invalidFilter("filter is missing a value")
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(token), &value); err != nil {
+		return nil, invalidFilter("invalid value %s in filter", token)
+	}
+	return value, nil
+}
+
+// scimAttributeName removes the core schema urn from an attribute name
+func scimAttributeName(name string) string {
+	for _, schema := range []string{model.SCIMUserSchema, model.SCIMGroupSchema} {
+		if len(name) > len(schema) && strings.EqualFold(name[:len(schema)+1], schema+":") {
+			return name[len(schema)+1:]
+		}
+	}
+	return name
+}
+
+// splitSCIMAttribute returns the attribute and sub-attribute of a path such as name.givenName.  The attributes of
+// schema extensions are named by their urn, which is not split.
+func splitSCIMAttribute(path string) (string, string) {
+	path = scimAttributeName(path)
+	if strings.HasPrefix(strings.ToLower(path), "urn:") {
+		return path, ""
+	}
+	attr, sub, _ := strings.Cut(path, ".")
+	return attr, sub
+}
+
+// scimAttribute returns the value of an attribute, ignoring the case of its name
+func scimAttribute(resource map[string]interface{}, name string) (interface{}, bool) {
+	if value, ok := resource[name]; ok {
+		return value, true
+	}
+	for key, value := range resource {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// scimAttributeKey returns the key of an attribute in the resource, or the name when it is not set
+func scimAttributeKey(resource map[string]interface{}, name string) string {
+	for key := range resource {
+		if strings.EqualFold(key, name) {
+			return key
+		}
+	}
+	return name
+}
+
+func (f *scimLogical) match(resource map[string]interface{}) bool {
+	if f.and {
+		return f.left.match(resource) && f.right.match(resource)
+	}
+	return f.left.match(resource) || f.right.match(resource)
+}
+
+func (f *scimNot) match(resource map[string]interface{}) bool {
+	return !f.filter.match(resource)
+}
+
+func (f *scimValuePath) match(resource map[string]interface{}) bool {
+	value, _ := scimAttribute(resource, f.attr)
+	elements, _ := value.([]interface{})
+	for _, element := range elements {
+		if object, ok := element.(map[string]interface{}); ok && f.filter.match(object) {
+			return true
+		}
+	}
+	return false
+}
+
+// match is true when any value of the attribute matches.  A multi-valued attribute without a sub-attribute is compared
+// by the value of its elements.
+func (f *scimCompare) match(resource map[string]interface{}) bool {
+	value, ok := scimAttribute(resource, f.attr)
+	if !ok {
+		return f.op == "ne" && f.value != nil
+	}
+	values := []interface{}{value}
+	if elements, ok := value.([]interface{}); ok {
+		values = elements
+	}
+	for _, v := range values {
+		if object, ok := v.(map[string]interface{}); ok {
+			sub := f.sub
+			if sub == "" {
+				sub = "value"
+			}
+			v, _ = scimAttribute(object, sub)
+		}
+		if f.compare(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// compare tests a single value, strings are compared ignoring case
+func (f *scimCompare) compare(value interface{}) bool {
+	if f.op == "pr" {
+		return value != nil && value != ""
+	}
+	switch expected := f.value.(type) {
+	case string:
+		actual, ok := value.(string)
+		if !ok {
+			return f.op == "ne"
+		}
+		actual, expected = strings.ToLower(actual), strings.ToLower(expected)
+		switch f.op {
+		case "eq":
+			return actual == expected
+		case "ne":
+			return actual != expected
+		case "co":
+			return strings.Contains(actual, expected)
+		case "sw":
+			return strings.HasPrefix(actual, expected)
+		case "ew":
+			return strings.HasSuffix(actual, expected)
+		case "gt":
+			return actual > expected
+		case "ge":
+			return actual >= expected
+		case "lt":
+			return actual < expected
+		case "le":
+			return actual <= expected
+		}
+	case float64:
+		actual, ok := value.(float64)
+		if !ok {
+			return f.op == "ne"
+		}
+		switch f.op {
+		case "eq":
+			return actual == expected
+		case "ne":
+			return actual != expected
+		case "gt":
+			return actual > expected
+		case "ge":
+			return actual >= expected
+		case "lt":
+			return actual < expected
+		case "le":
+			return actual <= expected
+		}
+	default:
+		// booleans and null can only be tested for equality
+		switch f.op {
+		case "eq":
+			return value == f.value
+		case "ne":
+			return value != f.value
+		}
+	}
+	return false
+}
+
+// provisionedUserQuery translates a users filter to a query.  Only the equality filters provisioning clients use to
+// find a user are supported: id, userName, externalId, emails and active combined with and.
+func provisionedUserQuery(f scimFilter, query *model.ProvisionedUserQuery) error {
+	switch f := f.(type) {
+	case *scimLogical:
+		if !f.and {
+			return invalidFilter("or is not supported in a users filter")
+		}
+		if err := provisionedUserQuery(f.left, query); err != nil {
+			return err
+		}
+		return provisionedUserQuery(f.right, query)
+	case *scimValuePath:
+		if compare, ok := f.filter.(*scimCompare); ok && strings.EqualFold(f.attr, "emails") && compare.sub == "" {
+			return provisionedUserQuery(&scimCompare{attr: "emails", sub: compare.attr, op: compare.op, value: compare.value}, query)
+		}
+	case *scimCompare:
+		if f.op != "eq" {
+			break
+		}
+		value, isString := f.value.(string)
+		attr := strings.ToLower(f.attr)
+		if f.sub != "" {
+			attr += "." + strings.ToLower(f.sub)
+		}
+		set := func(field *string) error {
+			if !isString {
+				return invalidFilter("%s must be compared with a string", f.attr)
+			}
+			if *field != "" && !strings.EqualFold(*field, value) {
+				return invalidFilter("%s is compared more than once", f.attr)
+			}
+			*field = value
+			return nil
+		}
+		switch attr {
+		case "id":
+			return set(&query.UID)
+		case "username":
+			return set(&query.UserName)
+		case "externalid":
+			return set(&query.ExternalID)
+		case "emails", "emails.value":
+			return set(&query.Email)
+		case "active":
+			active, ok := f.value.(bool)
+			if !ok {
+				if active, ok = scimBoolString(value); !ok || !isString {
+					return invalidFilter("active must be compared with a boolean")
+				}
+			}
+			query.Active = &active
+			return nil
+		}
+	}
+	return invalidFilter("the users filter only supports eq on id, userName, externalId, emails and active")
+}
+
+func scimBoolString(value string) (bool, bool) {
+	b, err := strconv.ParseBool(value)
+	return b, err == nil
+}
@@ -0,0 +1,256 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gkontos/goapi/model"
+)
+
+// scimPath is the target of a patch operation: an attribute, a sub-attribute of it, and a filter selecting the
+// elements of a multi-valued attribute, eg emails[type eq "work"].value
+type scimPath struct {
+	attr   string
+	filter scimFilter
+	sub    string
+}
+
+func invalidPath(format string, args ...interface{}) error {
+	return &model.SCIMRequestError{Status: http.StatusBadRequest, ScimType: "invalidPath", Err: fmt.Errorf(format, args...)}
+}
+
+func parseSCIMPath(path string) (*scimPath, error) {
+	open := strings.IndexByte(path, '[')
+	if open < 0 {
+		attr, sub := splitSCIMAttribute(path)
+		if attr == "" {
+			return nil, invalidPath("invalid path %s", path)
+		}
+		return &scimPath{attr: attr, sub: sub}, nil
+	}
+	closing := strings.LastIndexByte(path, ']')
+	if closing < open {
+		return nil, invalidPath("invalid path %s", path)
+	}
+	filter, err := parseSCIMFilter(path[open+1 : closing])
+	if err != nil {
+		return nil, err
+	}
+	p := &scimPath{attr: scimAttributeName(path[:open]), filter: filter}
+	if rest := path[closing+1:]; rest != "" {
+		if !strings.HasPrefix(rest, ".") || len(rest) == 1 {
+			return nil, invalidPath("invalid path %s", path)
+		}
+		p.sub = rest[1:]
+	}
+	return p, nil
+}
+
+// applySCIMPatch applies the operations of a patch request in order to the JSON representation of a resource
+func applySCIMPatch(resource map[string]interface{}, operations []model.SCIMPatchOperation) error {
+	if len(operations) == 0 {
+		return &model.SCIMRequestError{Status: http.StatusBadRequest, ScimType: "invalidValue", Err: errors.New("a patch requires operations")}
+	}
+	for _, operation := range operations {
+		op := strings.ToLower(operation.Op)
+		if op != "add" && op != "replace" && op != "remove" {
+			return &model.SCIMRequestError{Status: http.StatusBadRequest, ScimType: "invalidSyntax", Err: fmt.Errorf("unknown patch operation %s", operation.Op)}
+		}
+		var value interface{}
+		if len(operation.Value) > 0 {
+			if err := json.Unmarshal(operation.Value, &value); err != nil {
+				return &model.SCIMRequestError{Status: http.StatusBadRequest, ScimType: "invalidSyntax", Err: err}
+			}
+		}
+		if err := applySCIMOperation(resource, op, operation.Path, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applySCIMOperation(resource map[string]interface{}, op string, path string, value interface{}) error {
+	if path == "" {
+		// without a path the value holds the attributes to add or replace
+		attributes, ok := value.(map[string]interface{})
+		if op == "remove" || !ok {
+			return invalidPath("%s without a path requires an object value", op)
+		}
+		for name, v := range attributes {
+			if err := applySCIMOperation(resource, op, name, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if op != "remove" && value == nil {
+		return &model.SCIMRequestError{Status: http.StatusBadRequest, ScimType: "invalidValue", Err: fmt.Errorf("%s of %s requires a value", op, path)}
+	}
+
+	p, err := parseSCIMPath(path)
+	if err != nil {
+		return err
+	}
+	key := scimAttributeKey(resource, p.attr)
+	current, exists := resource[key]
+
+	if p.filter != nil {
+		return applySCIMFilteredOperation(resource, key, p, op, value)
+	}
+	if p.sub != "" {
+		object, _ := current.(map[string]interface{})
+		if object == nil {
+			if exists && current != nil {
+				return invalidPath("%s does not have sub-attributes", p.attr)
+			}
+			if op == "remove" {
+				return nil
+			}
+			object = map[string]interface{}{}
+			resource[key] = object
+		}
+		subKey := scimAttributeKey(object, p.sub)
+		if op == "remove" {
+			delete(object, subKey)
+		} else {
+			object[subKey] = value
+		}
+		return nil
+	}
+
+	elements, isList := current.([]interface{})
+	values, valueIsList := value.([]interface{})
+	switch op {
+	case "remove":
+		if isList && valueIsList {
+			// some clients remove members by listing them instead of with a filter
+			resource[key] = withoutSCIMValues(elements, values)
+		} else {
+			delete(resource, key)
+		}
+	case "add":
+		if isList || valueIsList {
+			if !valueIsList {
+				values = []interface{}{value}
+			}
+			resource[key] = appendSCIMValues(elements, values)
+			return nil
+		}
+		fallthrough
+	case "replace":
+		object, isObject := current.(map[string]interface{})
+		if update, ok := value.(map[string]interface{}); ok && isObject {
+			for name, v := range update {
+				object[scimAttributeKey(object, name)] = v
+			}
+			return nil
+		}
+		resource[key] = value
+	}
+	return nil
+}
+
+// applySCIMFilteredOperation changes the elements of a multi-valued attribute which match the path's filter.  When no
+// element matches an add or replace of an equality filter creates the element, eg emails[type eq "work"].value.
+func applySCIMFilteredOperation(resource map[string]interface{}, key string, p *scimPath, op string, value interface{}) error {
+	current := resource[key]
+	elements, ok := current.([]interface{})
+	if current != nil && !ok {
+		return invalidPath("%s is not multi-valued", p.attr)
+	}
+	kept := []interface{}{}
+	matched := false
+	for _, element := range elements {
+		object, isObject := element.(map[string]interface{})
+		if !isObject || !p.filter.match(object) {
+			kept = append(kept, element)
+			continue
+		}
+		matched = true
+		switch {
+		case op == "remove" && p.sub == "":
+			continue
+		case op == "remove":
+			delete(object, scimAttributeKey(object, p.sub))
+		case p.sub != "":
+			object[scimAttributeKey(object, p.sub)] = value
+		default:
+			update, ok := value.(map[string]interface{})
+			if !ok {
+				return &model.SCIMRequestError{Status: http.StatusBadRequest, ScimType: "invalidValue", Err: fmt.Errorf("%s requires an object value", p.attr)}
+			}
+			if op == "replace" {
+				object = map[string]interface{}{}
+			}
+			for name, v := range update {
+				object[scimAttributeKey(object, name)] = v
+			}
+		}
+		kept = append(kept, object)
+	}
+	if !matched && op != "remove" {
+		compare, ok := p.filter.(*scimCompare)
+		if !ok || compare.op != "eq" || compare.sub != "" {
+			return &model.SCIMRequestError{Status: http.StatusBadRequest, ScimType: "noTarget", Err: fmt.Errorf("no value of %s matches the filter", p.attr)}
+		}
+		object := map[string]interface{}{compare.attr: compare.value}
+		if p.sub != "" {
+			object[p.sub] = value
+		} else if update, ok := value.(map[string]interface{}); ok {
+			for name, v := range update {
+				object[name] = v
+			}
+		}
+		kept = append(kept, object)
+	}
+	resource[key] = kept
+	return nil
+}
+
+// scimValueOf returns the value sub-attribute of an element of a multi-valued attribute
+func scimValueOf(element interface{}) interface{} {
+	if object, ok := element.(map[string]interface{}); ok {
+		value, _ := scimAttribute(object, "value")
+		return value
+	}
+	return element
+}
+
+// appendSCIMValues adds the values which are not already in the list
+func appendSCIMValues(elements []interface{}, values []interface{}) []interface{} {
+	result := append([]interface{}{}, elements...)
+	for _, v := range values {
+		duplicate := false
+		for _, element := range result {
+			if scimValueOf(element) == scimValueOf(v) && scimValueOf(v) != nil {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// withoutSCIMValues removes the elements with the values
+func withoutSCIMValues(elements []interface{}, values []interface{}) []interface{} {
+	result := []interface{}{}
+	for _, element := range elements {
+		removed := false
+		for _, v := range values {
+			if scimValueOf(element) == scimValueOf(v) {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			result = append(result, element)
+		}
+	}
+	return result
+}
@@ -3,13 +3,22 @@ package controller
 import (
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/mail"
+	"os"
+	"strings"
 
 	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/mailer"
 	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/security"
 	"github.com/gkontos/goapi/util"
+	"github.com/go-chi/chi/v5"
 )
 
+const oauthFlowCookie = "oauth_flow"
+
 type AuthenticationError struct {
 	Err error
 }
@@ -18,6 +27,10 @@ type TokenRequest struct {
 	Token string `json:"token"`
 }
 
+type MagicLinkRequest struct {
+	Email string `json:"email"`
+}
+
 func (e *AuthenticationError) Error() string {
 	return e.Err.Error()
 }
@@ -30,14 +43,11 @@ func (api *apiController) TokenCreate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := api.th.ValidateLoginAndCreateAccessToken(loginRequestToken.Token)
+	token, err := api.th.ValidateLoginAndCreateAccessToken(loginRequestToken.Token, api.loginClient(r))
 
 	if err != nil {
 		logger.Logger.Error().Msg(fmt.Sprintf("unable to get auth token : %v", err))
-		loginErr := &AuthenticationError{
-			Err: errors.New("unable to process login request"),
-		}
-		util.ReturnErrorJSONWithCode(w, loginErr, http.StatusForbidden)
+		loginFailed(w, err, "unable to process login request")
 
 		return
 	}
@@ -53,18 +63,217 @@ func (api *apiController) TokenRefresh(w http.ResponseWriter, r *http.Request) {
 		util.ReturnErrorJSON(w, parseErr)
 		return
 	}
-	token, err := api.th.RefreshToken(assertedUser.RefreshToken)
+	token, err := api.th.RefreshToken(assertedUser.RefreshToken, api.loginClient(r))
 	if err != nil {
 		logger.Logger.Error().Err(err).Msg("unable to get refresh token")
+		loginFailed(w, err, "unable to process refresh request")
+
+		return
+	}
+
+	logger.Logger.Debug().Msg("new token issued.")
+	util.ReturnBodyJSON(w, token, http.StatusOK)
+
+}
+
+// loginFailed responds to a failed login or refresh without revealing why, unless the user is not active or needs an
+// invitation
+func loginFailed(w http.ResponseWriter, err error, message string) {
+	var inactive *model.UserInactiveError
+	if errors.As(err, &inactive) {
+		util.ReturnErrorJSON(w, inactive)
+		return
+	}
+	var uninvited *model.InvitationRequiredError
+	if errors.As(err, &uninvited) {
+		util.ReturnErrorJSON(w, uninvited)
+		return
+	}
+	loginErr := &AuthenticationError{
+		Err: errors.New(message),
+	}
+	util.ReturnErrorJSONWithCode(w, loginErr, http.StatusForbidden)
+}
+
+// loginClient returns the address and user agent a login request came from.  When the request comes from a trusted
+// proxy the address is the right-most X-Forwarded-For entry which is not a trusted proxy, entries to its left are set by
+// the client and can be forged.
+func (api *apiController) loginClient(r *http.Request) security.LoginClient {
+	address := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	if api.isTrustedProxy(address) {
+		forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(forwarded) - 1; i >= 0; i-- {
+			entry := strings.TrimSpace(forwarded[i])
+			if entry == "" {
+				continue
+			}
+			address = entry
+			if !api.isTrustedProxy(entry) {
+				break
+			}
+		}
+	}
+	return security.LoginClient{IPAddress: address, UserAgent: r.UserAgent()}
+}
+
+func (api *apiController) isTrustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range api.trustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// trustedProxies returns the addresses or cidr ranges of the proxies in TRUSTED_PROXIES.  X-Forwarded-For is ignored
+// when it is not set.
+func trustedProxies() []*net.IPNet {
+	proxies := make([]*net.IPNet, 0)
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			logger.Logger.Error().Err(err).Msg("TRUSTED_PROXIES entry is invalid")
+			panic(err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies
+}
+
+// MagicLinkCreate will send a single use login link to the requested email address.
+// The response is the same whether or not the address belongs to an existing user.
+func (api *apiController) MagicLinkCreate(w http.ResponseWriter, r *http.Request) {
+
+	linkRequest := &MagicLinkRequest{}
+	if parseErr := util.ParseJsonRequest(r, &linkRequest); parseErr != nil {
+		util.ReturnErrorJSON(w, parseErr)
+		return
+	}
+
+	address, err := mail.ParseAddress(linkRequest.Email)
+	if err != nil {
+		util.ReturnErrorJSON(w, &model.ValidationError{Err: err, Message: "invalid email address"})
+		return
+	}
+
+	link, err := api.th.CreateMagicLink(address.Address)
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("unable to create magic link")
+		util.ReturnErrorJSON(w, errors.New("unable to process login request"))
+		return
+	}
+
+	msg := &mailer.Message{
+		To:      address.Address,
+		Subject: "Your login link",
+		Body:    fmt.Sprintf("Use the following link to log in. The link can only be used once.\n\n%s\n", link),
+	}
+	if err := api.mailer.Send(msg); err != nil {
+		logger.Logger.Error().Err(err).Msg("unable to send magic link")
+		util.ReturnErrorJSON(w, errors.New("unable to process login request"))
+		return
+	}
+
+	util.ReturnBlankJSON(w, http.StatusAccepted)
+
+}
+
+func (api *apiController) MagicLinkVerify(w http.ResponseWriter, r *http.Request) {
+
+	linkToken := &TokenRequest{}
+	if parseErr := util.ParseJsonRequest(r, &linkToken); parseErr != nil {
+		util.ReturnErrorJSON(w, parseErr)
+		return
+	}
+
+	token, err := api.th.ValidateMagicLinkAndCreateAccessToken(linkToken.Token, api.loginClient(r))
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("unable to verify magic link")
+		loginFailed(w, err, "unable to process login request")
+
+		return
+	}
+
+	util.ReturnBodyJSON(w, token, http.StatusOK)
+
+}
+
+// ProviderLoginStart will redirect the user agent to the upstream provider's authorization endpoint.
+// The flow state is kept in a signed cookie which is checked on callback.
+func (api *apiController) ProviderLoginStart(w http.ResponseWriter, r *http.Request) {
+
+	login, err := api.th.StartProviderLogin(chi.URLParam(r, "provider"))
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("unable to start provider login")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthFlowCookie,
+		Value:    login.FlowToken,
+		Path:     "/v1/login",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, login.AuthURL, http.StatusFound)
+
+}
+
+// ProviderLoginCallback will exchange the authorization code returned by the provider for local access tokens
+func (api *apiController) ProviderLoginCallback(w http.ResponseWriter, r *http.Request) {
+
+	// the flow cookie is single use
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthFlowCookie,
+		Value:    "",
+		Path:     "/v1/login",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		logger.Logger.Error().Msg(fmt.Sprintf("provider login failed : %s %s", providerErr, query.Get("error_description")))
 		loginErr := &AuthenticationError{
-			Err: errors.New("unable to process refresh request"),
+			Err: errors.New("unable to process login request"),
 		}
 		util.ReturnErrorJSONWithCode(w, loginErr, http.StatusForbidden)
+		return
+	}
+
+	flowToken := ""
+	if cookie, err := r.Cookie(oauthFlowCookie); err == nil {
+		flowToken = cookie.Value
+	}
 
+	token, err := api.th.CompleteProviderLogin(chi.URLParam(r, "provider"), query.Get("code"), query.Get("state"), flowToken, api.loginClient(r))
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("unable to complete provider login")
+		loginFailed(w, err, "unable to process login request")
 		return
 	}
 
-	logger.Logger.Debug().Msg("new token issued.")
 	util.ReturnBodyJSON(w, token, http.StatusOK)
 
 }
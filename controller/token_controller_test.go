@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/mailer"
 	"github.com/gkontos/goapi/model"
 	"github.com/gkontos/goapi/security"
 	"github.com/stretchr/testify/assert"
@@ -115,6 +116,15 @@ func TestRefreshToken(t *testing.T) {
 			expectedResponseCode: http.StatusForbidden,
 			expectedResponseBody: []byte(`{"error":"unable to process refresh request"}`),
 		},
+		// the user was suspended after the token was issued
+		{
+			ctrl: &apiController{
+				th: &testTokenHandler{inactiveStatus: model.UserStatusSuspended},
+			},
+			requestBody:          []byte(`{"token":"sometoken", "refresh_token":"somerefreshvalue", "expires_at":"2006-03-17T15:04:05Z"}`),
+			expectedResponseCode: http.StatusForbidden,
+			expectedResponseBody: []byte(`{"error":"user is suspended","code":"user_inactive"}`),
+		},
 	}
 
 	for _, c := range cases {
@@ -143,12 +153,250 @@ func TestRefreshToken(t *testing.T) {
 	}
 }
 
+func TestMagicLinkCreate(t *testing.T) {
+	logger.InitLogger(true, true)
+	path := "/v1/login/magic"
+
+	cases := []struct {
+		expectedResponseCode int
+		expectedResponseBody []byte
+		expectedSent         int
+		th                   *testTokenHandler
+		mailer               *testMailer
+		requestBody          []byte
+	}{
+		// bad format
+		{
+			th:                   &testTokenHandler{returnError: false},
+			mailer:               &testMailer{},
+			requestBody:          []byte(`{"badformat"}`),
+			expectedResponseCode: http.StatusBadRequest,
+			expectedResponseBody: []byte(`{"error":"unable to parse request invalid character '}' after object key"}`),
+		},
+		// invalid email
+		{
+			th:                   &testTokenHandler{returnError: false},
+			mailer:               &testMailer{},
+			requestBody:          []byte(`{"email":"not an email"}`),
+			expectedResponseCode: http.StatusBadRequest,
+			expectedResponseBody: []byte(`{"error":"invalid email address. mail: no angle-addr"}`),
+		},
+		// ok
+		{
+			th:                   &testTokenHandler{returnError: false},
+			mailer:               &testMailer{},
+			requestBody:          []byte(`{"email":"tom@example.com"}`),
+			expectedResponseCode: http.StatusAccepted,
+			expectedResponseBody: []byte(``),
+			expectedSent:         1,
+		},
+		// mail failure
+		{
+			th:                   &testTokenHandler{returnError: false},
+			mailer:               &testMailer{returnError: true},
+			requestBody:          []byte(`{"email":"tom@example.com"}`),
+			expectedResponseCode: http.StatusInternalServerError,
+			expectedResponseBody: []byte(`{"error":"unable to process login request"}`),
+		},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("POST", path, bytes.NewBuffer(c.requestBody))
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+
+		ctrl := &apiController{th: c.th, mailer: c.mailer}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.MagicLinkCreate)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match")
+		assert.Equal(t, string(c.expectedResponseBody), string(bytes.TrimSpace(rr.Body.Bytes())), "body didn't match")
+		assert.Equal(t, c.expectedSent, len(c.mailer.sent))
+		for _, msg := range c.mailer.sent {
+			assert.Equal(t, "tom@example.com", msg.To)
+			assert.Contains(t, msg.Body, "token=somelinktoken")
+		}
+	}
+}
+
+func TestMagicLinkVerify(t *testing.T) {
+	logger.InitLogger(true, true)
+	path := "/v1/login/magic/verify"
+
+	cases := []struct {
+		expectedResponseCode int
+		expectedResponseBody []byte
+		ctrl                 *apiController
+		requestBody          []byte
+	}{
+		// ok
+		{
+			ctrl: &apiController{
+				th: &testTokenHandler{returnError: false},
+			},
+			requestBody:          []byte(`{"token":"somelinktoken"}`),
+			expectedResponseCode: http.StatusOK,
+		},
+		// used or invalid link
+		{
+			ctrl: &apiController{
+				th: &testTokenHandler{returnError: true},
+			},
+			requestBody:          []byte(`{"token":"somelinktoken"}`),
+			expectedResponseCode: http.StatusForbidden,
+			expectedResponseBody: []byte(`{"error":"unable to process login request"}`),
+		},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("POST", path, bytes.NewBuffer(c.requestBody))
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(c.ctrl.MagicLinkVerify)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match")
+
+		if c.expectedResponseBody != nil {
+			assert.Equal(t, string(c.expectedResponseBody), string(bytes.TrimSpace(rr.Body.Bytes())), "body didn't match")
+		} else {
+			var resp model.Token
+			json.Unmarshal(rr.Body.Bytes(), &resp)
+			assert.True(t, resp.RefreshToken != "")
+			assert.True(t, resp.Token != "")
+		}
+	}
+}
+
+func TestProviderLoginStart(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	cases := []struct {
+		provider             string
+		expectedResponseCode int
+		expectedLocation     string
+	}{
+		// ok
+		{
+			provider:             "github",
+			expectedResponseCode: http.StatusFound,
+			expectedLocation:     "https://github.com/login/oauth/authorize?state=somestate",
+		},
+		// provider not configured
+		{
+			provider:             "myspace",
+			expectedResponseCode: http.StatusNotFound,
+		},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("GET", "/v1/login/"+c.provider+"/start", nil)
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		rootRequest = withURLParams(rootRequest, map[string]string{"provider": c.provider})
+
+		ctrl := &apiController{th: &testTokenHandler{}}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.ProviderLoginStart)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match")
+		if c.expectedLocation != "" {
+			assert.Equal(t, c.expectedLocation, rr.Header().Get("Location"))
+			cookies := rr.Result().Cookies()
+			assert.Equal(t, 1, len(cookies))
+			assert.Equal(t, oauthFlowCookie, cookies[0].Name)
+			assert.Equal(t, "someflowtoken", cookies[0].Value)
+			assert.True(t, cookies[0].HttpOnly)
+		}
+	}
+}
+
+func TestProviderLoginCallback(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	cases := []struct {
+		query                string
+		flowToken            string
+		th                   *testTokenHandler
+		expectedResponseCode int
+		expectedResponseBody []byte
+	}{
+		// ok
+		{
+			query:                "code=somecode&state=somestate",
+			flowToken:            "someflowtoken",
+			th:                   &testTokenHandler{returnError: false},
+			expectedResponseCode: http.StatusOK,
+		},
+		// missing flow cookie
+		{
+			query:                "code=somecode&state=somestate",
+			th:                   &testTokenHandler{returnError: false},
+			expectedResponseCode: http.StatusForbidden,
+			expectedResponseBody: []byte(`{"error":"unable to process login request"}`),
+		},
+		// provider returned an error
+		{
+			query:                "error=access_denied&state=somestate",
+			flowToken:            "someflowtoken",
+			th:                   &testTokenHandler{returnError: false},
+			expectedResponseCode: http.StatusForbidden,
+			expectedResponseBody: []byte(`{"error":"unable to process login request"}`),
+		},
+		// exchange failure
+		{
+			query:                "code=somecode&state=somestate",
+			flowToken:            "someflowtoken",
+			th:                   &testTokenHandler{returnError: true},
+			expectedResponseCode: http.StatusForbidden,
+			expectedResponseBody: []byte(`{"error":"unable to process login request"}`),
+		},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("GET", "/v1/login/github/callback?"+c.query, nil)
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		if c.flowToken != "" {
+			rootRequest.AddCookie(&http.Cookie{Name: oauthFlowCookie, Value: c.flowToken})
+		}
+		rootRequest = withURLParams(rootRequest, map[string]string{"provider": "github"})
+
+		ctrl := &apiController{th: c.th}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.ProviderLoginCallback)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match")
+		if c.expectedResponseBody != nil {
+			assert.Equal(t, string(c.expectedResponseBody), string(bytes.TrimSpace(rr.Body.Bytes())), "body didn't match")
+		} else {
+			var resp model.Token
+			json.Unmarshal(rr.Body.Bytes(), &resp)
+			assert.True(t, resp.Token != "")
+		}
+	}
+}
+
 type testTokenHandler struct {
 	returnError bool
+	// inactiveStatus is the status of a user who is not allowed to refresh
+	inactiveStatus string
+	// client is the client of the last login or refresh
+	client security.LoginClient
 }
 
 // tokenHandler implementation
-func (h *testTokenHandler) ValidateLoginAndCreateAccessToken(t string) (*model.Token, error) {
+func (h *testTokenHandler) ValidateLoginAndCreateAccessToken(t string, client security.LoginClient) (*model.Token, error) {
+	h.client = client
 	if h.returnError {
 		return nil, errors.New("some error")
 	}
@@ -159,7 +407,11 @@ func (h *testTokenHandler) ValidateLoginAndCreateAccessToken(t string) (*model.T
 	}, nil
 }
 
-func (h *testTokenHandler) RefreshToken(t string) (*model.Token, error) {
+func (h *testTokenHandler) RefreshToken(t string, client security.LoginClient) (*model.Token, error) {
+	h.client = client
+	if h.inactiveStatus != "" {
+		return nil, &model.UserInactiveError{Status: h.inactiveStatus}
+	}
 	if h.returnError {
 		return nil, errors.New("refresh error")
 	}
@@ -173,3 +425,86 @@ func (h *testTokenHandler) RefreshToken(t string) (*model.Token, error) {
 func (h *testTokenHandler) ValidateAccessToken(tokenString string) (security.Claims, error) {
 	return security.Claims{}, nil
 }
+
+func (h *testTokenHandler) CreateMagicLink(email string) (string, error) {
+	if h.returnError {
+		return "", errors.New("magic link error")
+	}
+	return "http://localhost/login/magic?token=somelinktoken", nil
+}
+
+func (h *testTokenHandler) ValidateMagicLinkAndCreateAccessToken(t string, client security.LoginClient) (*model.Token, error) {
+	h.client = client
+	if h.returnError {
+		return nil, errors.New("magic link error")
+	}
+	return &model.Token{
+		Token:        "sometokenstring",
+		RefreshToken: "somerefreshtokenstring",
+		ExpiresAt:    time.Now(),
+	}, nil
+}
+
+func (h *testTokenHandler) StartProviderLogin(provider string) (*security.ProviderLogin, error) {
+	if provider != "github" {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("login provider is not configured")}
+	}
+	return &security.ProviderLogin{
+		AuthURL:   "https://github.com/login/oauth/authorize?state=somestate",
+		FlowToken: "someflowtoken",
+	}, nil
+}
+
+func (h *testTokenHandler) CompleteProviderLogin(provider, code, state, flowToken string, client security.LoginClient) (*model.Token, error) {
+	h.client = client
+	if h.returnError || flowToken != "someflowtoken" {
+		return nil, errors.New("provider login error")
+	}
+	return &model.Token{
+		Token:        "sometokenstring",
+		RefreshToken: "somerefreshtokenstring",
+		ExpiresAt:    time.Now(),
+	}, nil
+}
+
+func (h *testTokenHandler) SwitchOrganization(claims security.Claims, orgID string) (*model.Token, error) {
+	if h.returnError || orgID != testOrgID {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("organization does not exist")}
+	}
+	return &model.Token{
+		Token:        "sometokenstring",
+		RefreshToken: "somerefreshtokenstring",
+		ExpiresAt:    time.Now(),
+	}, nil
+}
+
+func (h *testTokenHandler) GetEffectivePermissions(user *model.User) (*security.EffectivePermissions, error) {
+	if h.returnError {
+		return nil, errors.New("some error")
+	}
+	return &security.EffectivePermissions{
+		Roles:       user.UserDetails.Roles,
+		Grants:      []string{"app:*"},
+		Permissions: []string{"app:read", "app:write"},
+	}, nil
+}
+
+func (h *testTokenHandler) HasRole(user *model.User, role string) (bool, error) {
+	if h.returnError {
+		return false, errors.New("some error")
+	}
+	return user.HasRole(role), nil
+}
+
+type testMailer struct {
+	returnError bool
+	sent        []*mailer.Message
+}
+
+func (m *testMailer) Send(msg *mailer.Message) error {
+	if m.returnError {
+		return errors.New("mail error")
+	}
+	m.sent = append(m.sent, msg)
+	return nil
+}
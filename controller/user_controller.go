@@ -1,25 +1,399 @@
 package controller
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gkontos/goapi/logger"
 	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/security"
 	"github.com/gkontos/goapi/util"
 )
 
+// GetUsers returns a page of users.  The next page is linked by the next_cursor of the response and the Link header.
 func (api *apiController) GetUsers(w http.ResponseWriter, r *http.Request) {
 
-	users, err := api.dbh.GetUsers()
+	query, err := userQueryParams(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	page, err := api.tenantDbh(r).GetUsers(query)
 	if err != nil {
 		logger.Logger.Error().Err(err).Msg("error getting users")
 		util.ReturnErrorJSON(w, err)
 		return
 	}
-	if users == nil {
-		users = make([]model.User, 0)
+	if page.Users == nil {
+		page.Users = make([]model.User, 0)
+	}
+
+	setPageLinks(w, r, page.NextCursor)
+	util.ReturnBodyJSON(w, page, http.StatusOK)
+
+}
+
+// SearchUsers returns a page of the users whose names or email best match the q parameter
+func (api *apiController) SearchUsers(w http.ResponseWriter, r *http.Request) {
+
+	params := r.URL.Query()
+	search := model.UserSearch{Q: strings.TrimSpace(params.Get("q"))}
+	if len([]rune(search.Q)) < 3 {
+		util.ReturnErrorJSON(w, &model.ValidationError{Err: errors.New("q must be at least 3 characters")})
+		return
+	}
+	limit, err := pageLimit(params)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	search.Limit = limit
+	if v := params.Get("cursor"); v != "" {
+		cursor, err := model.DecodeUserSearchCursor(v)
+		if err != nil {
+			util.ReturnErrorJSON(w, err)
+			return
+		}
+		search.After = cursor
+	}
+
+	page, err := api.tenantDbh(r).SearchUsers(search)
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error searching users")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	if page.Users == nil {
+		page.Users = make([]model.User, 0)
+	}
+
+	setPageLinks(w, r, page.NextCursor)
+	util.ReturnBodyJSON(w, page, http.StatusOK)
+
+}
+
+// userQueryParams reads the paging, sorting and filtering parameters of a user listing
+func userQueryParams(r *http.Request) (model.UserQuery, error) {
+	params := r.URL.Query()
+	query := model.UserQuery{
+		Sort:        "created_date",
+		Role:        params.Get("role"),
+		EmailDomain: params.Get("email_domain"),
+		Provider:    params.Get("provider"),
+		Status:      params.Get("status"),
+	}
+	// users waiting for approval can be listed but not given their status
+	statuses := append(append([]string{}, model.UserStatuses...), model.RegistrationStatuses...)
+	if query.Status != "" && !containsStatus(statuses, query.Status) {
+		return query, &model.ValidationError{Err: fmt.Errorf("status must be one of %s", strings.Join(statuses, ", "))}
+	}
+	limit, err := pageLimit(params)
+	if err != nil {
+		return query, err
+	}
+	query.Limit = limit
+	if v := params.Get("sort"); v != "" {
+		sortable := false
+		for _, field := range model.UserSortFields {
+			sortable = sortable || field == v
+		}
+		if !sortable {
+			return query, &model.ValidationError{Err: fmt.Errorf("sort must be one of %s", strings.Join(model.UserSortFields, ", "))}
+		}
+		query.Sort = v
+	}
+	switch params.Get("order") {
+	case "", "asc":
+	case "desc":
+		query.Desc = true
+	default:
+		return query, &model.ValidationError{Err: errors.New("order must be asc or desc")}
+	}
+	if v := params.Get("cursor"); v != "" {
+		cursor, err := model.DecodeUserCursor(v)
+		if err != nil {
+			return query, err
+		}
+		query.After = cursor
+	}
+	dates := map[string]*time.Time{
+		"created_after":  &query.CreatedAfter,
+		"created_before": &query.CreatedBefore,
+		"updated_after":  &query.UpdatedAfter,
+		"updated_before": &query.UpdatedBefore,
+	}
+	for name, date := range dates {
+		if v := params.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return query, &model.ValidationError{Err: fmt.Errorf("%s must be an RFC 3339 date", name)}
+			}
+			*date = t
+		}
+	}
+	return query, nil
+}
+
+// pageLimit reads the page size of a listing
+func pageLimit(params url.Values) (int, error) {
+	v := params.Get("limit")
+	if v == "" {
+		return model.DefaultUserPageSize, nil
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit < 1 || limit > model.MaxUserPageSize {
+		return 0, &model.ValidationError{Err: fmt.Errorf("limit must be between 1 and %d", model.MaxUserPageSize)}
+	}
+	return limit, nil
+}
+
+// setPageLinks sets the Link header of a listing to its first page and, when there is one, its next page
+func setPageLinks(w http.ResponseWriter, r *http.Request, nextCursor string) {
+	links := []string{pageLink(r, "", "first")}
+	if nextCursor != "" {
+		links = append(links, pageLink(r, nextCursor, "next"))
+	}
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
+
+// pageLink returns a Link header value for the request's listing at the cursor
+func pageLink(r *http.Request, cursor string, rel string) string {
+	params := r.URL.Query()
+	params.Del("cursor")
+	if cursor != "" {
+		params.Set("cursor", cursor)
+	}
+	u := url.URL{Path: r.URL.Path, RawQuery: params.Encode()}
+	return fmt.Sprintf(`<%s>; rel="%s"`, u.String(), rel)
+}
+
+// GetCurrentUser returns the stored record of the authenticated user
+func (api *apiController) GetCurrentUser(w http.ResponseWriter, r *http.Request) {
+
+	claims := r.Context().Value(security.UserContextKey).(security.Claims)
+	user, err := api.dbh.GetUserByUID(claims.UID)
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error getting current user")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	util.ReturnBodyJSON(w, user, http.StatusOK)
+
+}
+
+// GetCurrentUserPermissions returns the roles and permissions authorization will use for the authenticated user, and
+// those of the active organization
+func (api *apiController) GetCurrentUserPermissions(w http.ResponseWriter, r *http.Request) {
+
+	claims := r.Context().Value(security.UserContextKey).(security.Claims)
+	permissions, err := api.th.GetEffectivePermissions(security.CreateUserFromClaims(claims))
+	if err == nil && claims.Org != "" {
+		user := security.CreateUserFromClaims(claims)
+		user.UserDetails.Roles = claims.TenantRoles()
+		permissions.Organization, err = api.th.GetEffectivePermissions(user)
+	}
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error getting effective permissions")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	util.ReturnBodyJSON(w, permissions, http.StatusOK)
+
+}
+
+// GetUser returns a user.  Users can read their own record and admins any record in their organization.
+func (api *apiController) GetUser(w http.ResponseWriter, r *http.Request) {
+
+	uid, err := uidParam(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	user, err := api.tenantDbh(r).GetUserByUID(uid)
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error getting user")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	util.ReturnBodyJSON(w, user, http.StatusOK)
+
+}
+
+// PatchUser applies a JSON merge patch to the user's details.  Roles can not be changed with a patch.
+func (api *apiController) PatchUser(w http.ResponseWriter, r *http.Request) {
+
+	uid, err := uidParam(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	patch, err := util.GetRequestBody(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	dbh := api.tenantDbh(r)
+	user, err := dbh.GetUserByUID(uid)
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error getting user")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	details, err := patchUserDetails(user.UserDetails, patch)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	if err := dbh.UpdateUserDetails(uid, *details); err != nil {
+		logger.Logger.Error().Err(err).Msg("error updating user")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	api.audit(r, "user.update", uid, model.JSONMap{"patch": json.RawMessage(patch)})
+
+	user.UserDetails = *details
+	util.ReturnBodyJSON(w, user, http.StatusOK)
+
+}
+
+// DeleteUser deletes a user.  Users can delete themselves and admins any user in their organization.  The user is kept
+// with the deleted status, as SCIMDeleteUser does, so that they can not log in again as a new user; erasure removes them.
+func (api *apiController) DeleteUser(w http.ResponseWriter, r *http.Request) {
+
+	uid, err := uidParam(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	claims := r.Context().Value(security.UserContextKey).(security.Claims)
+	reason := "deleted by " + claims.Username
+	if err := api.tenantDbh(r).UpdateUserStatus(uid, model.UserStatusDeleted, reason); err != nil {
+		logger.Logger.Error().Err(err).Msg("error deleting user")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	security.InvalidateUser(uid)
+	api.audit(r, "user.status", uid, model.JSONMap{"status": model.UserStatusDeleted, "reason": reason})
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
+
+// UserStatusRequest moves a user to a status of the user lifecycle
+type UserStatusRequest struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+// SetUserStatus changes the status of a user.  A reason is required for every status except active and users can
+// not change their own status.  Users whose registration is pending or was rejected are not changed here.
+func (api *apiController) SetUserStatus(w http.ResponseWriter, r *http.Request) {
+
+	uid, err := uidParam(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	statusRequest := &UserStatusRequest{}
+	if parseErr := util.ParseJsonRequest(r, &statusRequest); parseErr != nil {
+		util.ReturnErrorJSON(w, parseErr)
+		return
+	}
+	if !containsStatus(model.UserStatuses, statusRequest.Status) {
+		util.ReturnErrorJSON(w, &model.ValidationError{Err: fmt.Errorf("status must be one of %s", strings.Join(model.UserStatuses, ", "))})
+		return
+	}
+	statusRequest.Reason = strings.TrimSpace(statusRequest.Reason)
+	if statusRequest.Status != model.UserStatusActive && statusRequest.Reason == "" {
+		util.ReturnErrorJSON(w, &model.ValidationError{Err: errors.New("a reason is required")})
+		return
+	}
+	claims := r.Context().Value(security.UserContextKey).(security.Claims)
+	if claims.UID == uid {
+		util.ReturnErrorJSON(w, &model.ValidationError{Err: errors.New("users can not change their own status")})
+		return
+	}
+	// a registration is approved or rejected with its roles through the registration decision
+	user, err := api.tenantDbh(r).GetUserByUID(uid)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	if containsStatus(model.RegistrationStatuses, user.Status) {
+		util.ReturnErrorJSON(w, &model.ValidationError{Err: fmt.Errorf("the registration of the user is %s, registrations are decided with PUT /v1/users/%s/registration", user.Status, uid)})
+		return
+	}
+
+	if err := api.tenantDbh(r).UpdateUserStatus(uid, statusRequest.Status, statusRequest.Reason); err != nil {
+		logger.Logger.Error().Err(err).Msg("error updating user status")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	security.InvalidateUser(uid)
+	api.audit(r, "user.status", uid, model.JSONMap{"status": statusRequest.Status, "reason": statusRequest.Reason})
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
+
+func containsStatus(statuses []string, status string) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// patchUserDetails returns the details with the merge patch applied.  The patched document must still be valid details.
+func patchUserDetails(details model.UserDetails, patch []byte) (*model.UserDetails, error) {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &members); err != nil {
+		return nil, &util.RequestParseError{Message: "unable to parse request", Err: err}
+	}
+	if _, ok := members["roles"]; ok {
+		return nil, &model.ValidationError{Err: errors.New("roles can not be changed with a patch, use the roles endpoints")}
+	}
+	if _, ok := members["email_verified"]; ok {
+		return nil, &model.ValidationError{Err: errors.New("email_verified is set by the identity provider")}
 	}
 
-	util.ReturnBodyJSON(w, users, http.StatusOK)
+	doc, err := json.Marshal(details)
+	if err != nil {
+		return nil, err
+	}
+	patched, err := util.MergePatch(doc, patch)
+	if err != nil {
+		return nil, err
+	}
 
+	decoder := json.NewDecoder(bytes.NewReader(patched))
+	decoder.DisallowUnknownFields()
+	result := &model.UserDetails{}
+	if err := decoder.Decode(result); err != nil {
+		return nil, &model.ValidationError{Err: err, Message: "invalid user details"}
+	}
+	result.Roles = details.Roles
+	result.KeepEmailVerified(details)
+	if result.Email != "" {
+		if _, err := mail.ParseAddress(result.Email); err != nil {
+			return nil, &model.ValidationError{Err: errors.New("email is not a valid address")}
+		}
+	}
+	return result, nil
 }
@@ -9,8 +9,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/gkontos/goapi/db"
 	"github.com/gkontos/goapi/logger"
 	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/security"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -18,13 +20,14 @@ func TestGetUsers(t *testing.T) {
 	logger.InitLogger(true, true)
 	path := "/v1/users"
 
+	lastLogin := time.Now()
 	userListResponse := []model.User{
 		{
 			UID:          "someuid",
 			AuthProvider: "myspace",
 			ProviderID:   "tom",
 			UserName:     "butler",
-			LastLogin:    time.Now(),
+			LastLogin:    &lastLogin,
 			UserDetails: model.UserDetails{
 				Roles: []string{"ROLE_USER"},
 			},
@@ -46,7 +49,7 @@ func TestGetUsers(t *testing.T) {
 				},
 			},
 			expectedResponseCode: http.StatusOK,
-			expectedResponseBody: []byte(`[]`),
+			expectedResponseBody: []byte(`{"users":[]}`),
 		},
 		// ok
 		{
@@ -88,25 +91,32 @@ func TestGetUsers(t *testing.T) {
 		if c.expectedResponseBody != nil {
 			assert.Equal(t, string(c.expectedResponseBody), string(bytes.TrimSpace(rr.Body.Bytes())), "body didn't match")
 		} else {
-			var resp []model.User
+			var resp model.UserPage
 			json.Unmarshal(rr.Body.Bytes(), &resp)
-			assert.True(t, len(resp) == 1)
+			assert.True(t, len(resp.Users) == 1)
 
 		}
 	}
 }
 
+// testDbHandler embeds the DbHandler interface so that methods which are not needed by the controller tests
+// do not need to be stubbed.  Calling one of them will panic.
 type testDbHandler struct {
+	db.DbHandler
 	userResponse []model.User
 	throwDbError bool
 }
 
 // dbHandler implementation
-func (d testDbHandler) GetUsers() ([]model.User, error) {
+func (d testDbHandler) GetUsers(query model.UserQuery) (*model.UserPage, error) {
 	if d.throwDbError {
 		return nil, errors.New("db error")
 	}
-	return d.userResponse, nil
+	return &model.UserPage{Users: d.userResponse}, nil
+}
+
+func (d testDbHandler) WithTenant(orgID string) db.DbHandler {
+	return d
 }
 
 func (d testDbHandler) GetUserByProvider(authProvider string, providerID string) (*model.User, error) {
@@ -116,3 +126,448 @@ func (d testDbHandler) GetUserByProvider(authProvider string, providerID string)
 func (d testDbHandler) UpsertUser(u *model.User) (*model.User, error) {
 	panic("not implemented") // TODO: Implement
 }
+
+func TestGetUsersQueryParams(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	cursor := &model.UserCursor{Sort: "user_name", Desc: true, Value: "sergei", UID: testUID}
+	cases := []struct {
+		query                string
+		expectedResponseCode int
+		expectedQuery        model.UserQuery
+		expectedLink         string
+	}{
+		{
+			query:                "",
+			expectedResponseCode: http.StatusOK,
+			expectedQuery:        model.UserQuery{Limit: model.DefaultUserPageSize, Sort: "created_date"},
+			expectedLink:         `</v1/users>; rel="first", </v1/users?cursor=next>; rel="next"`,
+		},
+		{
+			query:                "limit=10&sort=user_name&order=desc&cursor=" + cursor.Encode() + "&role=ROLE_ADMIN&email_domain=example.com&provider=google&created_after=2023-01-02T00:00:00Z",
+			expectedResponseCode: http.StatusOK,
+			expectedQuery: model.UserQuery{
+				Limit:        10,
+				Sort:         "user_name",
+				Desc:         true,
+				After:        cursor,
+				Role:         "ROLE_ADMIN",
+				EmailDomain:  "example.com",
+				Provider:     "google",
+				CreatedAfter: time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC),
+			},
+			expectedLink: `</v1/users?created_after=2023-01-02T00%3A00%3A00Z&email_domain=example.com&limit=10&order=desc&provider=google&role=ROLE_ADMIN&sort=user_name>; rel="first", ` +
+				`</v1/users?created_after=2023-01-02T00%3A00%3A00Z&cursor=next&email_domain=example.com&limit=10&order=desc&provider=google&role=ROLE_ADMIN&sort=user_name>; rel="next"`,
+		},
+		{query: "limit=0", expectedResponseCode: http.StatusBadRequest},
+		{query: "limit=1000", expectedResponseCode: http.StatusBadRequest},
+		{query: "sort=details", expectedResponseCode: http.StatusBadRequest},
+		{query: "order=sideways", expectedResponseCode: http.StatusBadRequest},
+		{query: "cursor=garbage", expectedResponseCode: http.StatusBadRequest},
+		{query: "updated_before=yesterday", expectedResponseCode: http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("GET", "/v1/users?"+c.query, nil)
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+
+		dbh := &userQueryTestDbHandler{}
+		ctrl := &apiController{dbh: dbh}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.GetUsers)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match %s", c.query)
+		if c.expectedResponseCode == http.StatusOK {
+			assert.Equal(t, c.expectedQuery, *dbh.query)
+			assert.Equal(t, c.expectedLink, rr.Header().Get("Link"))
+			assert.Equal(t, `{"users":[],"next_cursor":"next"}`, string(bytes.TrimSpace(rr.Body.Bytes())))
+		} else {
+			assert.Nil(t, dbh.query)
+		}
+	}
+}
+
+func TestSearchUsers(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	cursor := &model.UserSearchCursor{Q: "butler", Rank: 0.5, UID: testUID}
+	cases := []struct {
+		query                string
+		expectedResponseCode int
+		expectedSearch       model.UserSearch
+	}{
+		{
+			query:                "q=+butler+",
+			expectedResponseCode: http.StatusOK,
+			expectedSearch:       model.UserSearch{Q: "butler", Limit: model.DefaultUserPageSize},
+		},
+		{
+			query:                "q=butler&limit=5&cursor=" + cursor.Encode(),
+			expectedResponseCode: http.StatusOK,
+			expectedSearch:       model.UserSearch{Q: "butler", Limit: 5, After: cursor},
+		},
+		{query: "", expectedResponseCode: http.StatusBadRequest},
+		{query: "q=to", expectedResponseCode: http.StatusBadRequest},
+		{query: "q=butler&limit=-1", expectedResponseCode: http.StatusBadRequest},
+		{query: "q=butler&cursor=garbage", expectedResponseCode: http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("GET", "/v1/users/search?"+c.query, nil)
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+
+		dbh := &userQueryTestDbHandler{}
+		ctrl := &apiController{dbh: dbh}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.SearchUsers)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match %s", c.query)
+		if c.expectedResponseCode == http.StatusOK {
+			assert.Equal(t, c.expectedSearch, *dbh.search)
+			assert.Contains(t, rr.Header().Get("Link"), `?cursor=next&`)
+		} else {
+			assert.Nil(t, dbh.search)
+		}
+	}
+}
+
+type userQueryTestDbHandler struct {
+	testDbHandler
+	query  *model.UserQuery
+	search *model.UserSearch
+}
+
+func (d *userQueryTestDbHandler) WithTenant(orgID string) db.DbHandler {
+	return d
+}
+
+func (d *userQueryTestDbHandler) GetUsers(query model.UserQuery) (*model.UserPage, error) {
+	d.query = &query
+	return &model.UserPage{NextCursor: "next"}, nil
+}
+
+func TestGetCurrentUser(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	cases := []struct {
+		uid                  string
+		expectedResponseCode int
+	}{
+		{uid: testUID, expectedResponseCode: http.StatusOK},
+		// the user was deleted after the token was issued
+		{uid: "8a4f1f16-5e44-4f55-8a44-5d6b0c7e9d21", expectedResponseCode: http.StatusNotFound},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("GET", "/v1/users/me", nil)
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		rootRequest = withClaims(rootRequest, security.Claims{UID: c.uid, Username: "tom"})
+
+		ctrl := &apiController{dbh: &organizationTestDbHandler{}}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.GetCurrentUser)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match")
+	}
+}
+
+func TestGetCurrentUserPermissions(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	rootRequest, err := http.NewRequest("GET", "/v1/users/me/permissions", nil)
+	if err != nil {
+		t.Errorf("Root request error: %s", err)
+	}
+	rootRequest = withClaims(rootRequest, security.Claims{UID: testUID, Username: "tom", Roles: []string{"ROLE_USER"}})
+
+	ctrl := &apiController{th: &testTokenHandler{}}
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(ctrl.GetCurrentUserPermissions)
+	handler.ServeHTTP(rr, rootRequest)
+
+	assert.Equal(t, http.StatusOK, rr.Code, "status code didn't match")
+	assert.Equal(t, `{"roles":["ROLE_USER"],"grants":["app:*"],"permissions":["app:read","app:write"]}`, string(bytes.TrimSpace(rr.Body.Bytes())))
+}
+
+func TestPatchUser(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	cases := []struct {
+		uid                  string
+		requestBody          []byte
+		expectedResponseCode int
+		expectedDetails      *model.UserDetails
+		expectedError        string
+	}{
+		// merge, a null member is removed
+		{
+			uid:                  testUID,
+			requestBody:          []byte(`{"first_name":"Thomas","last_name":null}`),
+			expectedResponseCode: http.StatusOK,
+			expectedDetails:      &model.UserDetails{FirstName: "Thomas", Email: "tom@example.com", FullName: "Tom Butler", Roles: []string{"ROLE_USER"}, EmailVerified: true},
+		},
+		// a new email has not been verified
+		{
+			uid:                  testUID,
+			requestBody:          []byte(`{"email":"thomas@example.com"}`),
+			expectedResponseCode: http.StatusOK,
+			expectedDetails:      &model.UserDetails{FirstName: "Tom", LastName: "Butler", Email: "thomas@example.com", FullName: "Tom Butler", Roles: []string{"ROLE_USER"}},
+		},
+		{
+			uid:                  testUID,
+			requestBody:          []byte(`{"email_verified":true}`),
+			expectedResponseCode: http.StatusBadRequest,
+			expectedError:        `{"error":"email_verified is set by the identity provider"}`,
+		},
+		{
+			uid:                  testUID,
+			requestBody:          []byte(`{"roles":["ROLE_ADMIN"]}`),
+			expectedResponseCode: http.StatusBadRequest,
+			expectedError:        `{"error":"roles can not be changed with a patch, use the roles endpoints"}`,
+		},
+		{
+			uid:                  testUID,
+			requestBody:          []byte(`{"nickname":"tommy"}`),
+			expectedResponseCode: http.StatusBadRequest,
+			expectedError:        `{"error":"invalid user details. json: unknown field \"nickname\""}`,
+		},
+		{
+			uid:                  testUID,
+			requestBody:          []byte(`{"first_name":7}`),
+			expectedResponseCode: http.StatusBadRequest,
+		},
+		{
+			uid:                  testUID,
+			requestBody:          []byte(`{"email":"not an address"}`),
+			expectedResponseCode: http.StatusBadRequest,
+			expectedError:        `{"error":"email is not a valid address"}`,
+		},
+		{
+			uid:                  testUID,
+			requestBody:          []byte(`["first_name"]`),
+			expectedResponseCode: http.StatusBadRequest,
+		},
+		{
+			uid:                  "8a4f1f16-5e44-4f55-8a44-5d6b0c7e9d21",
+			requestBody:          []byte(`{"first_name":"Thomas"}`),
+			expectedResponseCode: http.StatusNotFound,
+			expectedError:        `{"error":"user does not exist"}`,
+		},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("PATCH", "/v1/users/"+c.uid, bytes.NewBuffer(c.requestBody))
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		rootRequest = withURLParams(rootRequest, map[string]string{"uid": c.uid})
+		rootRequest = withClaims(rootRequest, security.Claims{UID: c.uid, Username: "tom"})
+
+		dbh := &userCrudTestDbHandler{}
+		ctrl := &apiController{dbh: dbh}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.PatchUser)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match %s", c.requestBody)
+		if c.expectedError != "" {
+			assert.Equal(t, c.expectedError, string(bytes.TrimSpace(rr.Body.Bytes())), "body didn't match")
+		}
+		if c.expectedDetails != nil {
+			assert.Equal(t, c.expectedDetails, dbh.updated)
+			var resp model.User
+			json.Unmarshal(rr.Body.Bytes(), &resp)
+			assert.Equal(t, *c.expectedDetails, resp.UserDetails)
+		} else {
+			assert.Nil(t, dbh.updated)
+		}
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	cases := []struct {
+		uid                  string
+		expectedResponseCode int
+		expectedAudits       int
+	}{
+		{uid: testUID, expectedResponseCode: http.StatusNoContent, expectedAudits: 1},
+		{uid: "8a4f1f16-5e44-4f55-8a44-5d6b0c7e9d21", expectedResponseCode: http.StatusNotFound},
+		{uid: "tom", expectedResponseCode: http.StatusNotFound},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("DELETE", "/v1/users/"+c.uid, nil)
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		rootRequest = withURLParams(rootRequest, map[string]string{"uid": c.uid})
+		rootRequest = withClaims(rootRequest, security.Claims{UID: "someadminuid", Username: "admin"})
+
+		dbh := &userCrudTestDbHandler{}
+		ctrl := &apiController{dbh: dbh}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.DeleteUser)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match")
+		assert.Equal(t, c.expectedAudits, len(dbh.audits))
+		// the user is kept with the deleted status so that they are not provisioned again
+		if c.expectedAudits > 0 {
+			assert.Equal(t, model.UserStatusDeleted, dbh.status)
+			assert.Equal(t, model.JSONMap{"status": model.UserStatusDeleted, "reason": "deleted by admin"}, dbh.audits[0].Details)
+		}
+	}
+}
+
+type userCrudTestDbHandler struct {
+	roleTestDbHandler
+	updated *model.UserDetails
+	// status is the stored status of testUID, it is replaced by UpdateUserStatus
+	status string
+}
+
+func (d *userCrudTestDbHandler) WithTenant(orgID string) db.DbHandler {
+	return d
+}
+
+func (d *userCrudTestDbHandler) GetUserByUID(uid string) (*model.User, error) {
+	if uid != testUID {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("user does not exist")}
+	}
+	return &model.User{
+		UID:      uid,
+		UserName: "tom",
+		Status:   d.status,
+		UserDetails: model.UserDetails{
+			FirstName:     "Tom",
+			LastName:      "Butler",
+			FullName:      "Tom Butler",
+			Email:         "tom@example.com",
+			Roles:         []string{"ROLE_USER"},
+			EmailVerified: true,
+		},
+	}, nil
+}
+
+func (d *userCrudTestDbHandler) UpdateUserDetails(uid string, details model.UserDetails) error {
+	d.updated = &details
+	return nil
+}
+
+func (d *userQueryTestDbHandler) SearchUsers(search model.UserSearch) (*model.UserPage, error) {
+	d.search = &search
+	return &model.UserPage{NextCursor: "next"}, nil
+}
+
+func TestSetUserStatus(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	cases := []struct {
+		uid                  string
+		actorUID             string
+		status               string
+		requestBody          []byte
+		expectedResponseCode int
+		expectedError        string
+	}{
+		{
+			uid:                  testUID,
+			requestBody:          []byte(`{"status":"suspended","reason":"chargeback"}`),
+			expectedResponseCode: http.StatusNoContent,
+		},
+		// reactivating does not need a reason
+		{
+			uid:                  testUID,
+			requestBody:          []byte(`{"status":"active"}`),
+			expectedResponseCode: http.StatusNoContent,
+		},
+		{
+			uid:                  testUID,
+			requestBody:          []byte(`{"status":"banished","reason":"chargeback"}`),
+			expectedResponseCode: http.StatusBadRequest,
+			expectedError:        `{"error":"status must be one of active, suspended, deactivated, deleted"}`,
+		},
+		{
+			uid:                  testUID,
+			requestBody:          []byte(`{"status":"deactivated","reason":" "}`),
+			expectedResponseCode: http.StatusBadRequest,
+			expectedError:        `{"error":"a reason is required"}`,
+		},
+		{
+			uid:                  testUID,
+			actorUID:             testUID,
+			requestBody:          []byte(`{"status":"deactivated","reason":"leaving"}`),
+			expectedResponseCode: http.StatusBadRequest,
+			expectedError:        `{"error":"users can not change their own status"}`,
+		},
+		{
+			uid:                  "8a4f1f16-5e44-4f55-8a44-5d6b0c7e9d21",
+			requestBody:          []byte(`{"status":"suspended","reason":"chargeback"}`),
+			expectedResponseCode: http.StatusNotFound,
+		},
+		// registrations are decided with their roles, not activated here
+		{
+			uid:                  testUID,
+			status:               model.UserStatusPending,
+			requestBody:          []byte(`{"status":"active"}`),
+			expectedResponseCode: http.StatusBadRequest,
+			expectedError:        `{"error":"the registration of the user is pending, registrations are decided with PUT /v1/users/` + testUID + `/registration"}`,
+		},
+		{
+			uid:                  testUID,
+			status:               model.UserStatusRejected,
+			requestBody:          []byte(`{"status":"active"}`),
+			expectedResponseCode: http.StatusBadRequest,
+			expectedError:        `{"error":"the registration of the user is rejected, registrations are decided with PUT /v1/users/` + testUID + `/registration"}`,
+		},
+	}
+
+	for _, c := range cases {
+		rootRequest, err := http.NewRequest("PUT", "/v1/users/"+c.uid+"/status", bytes.NewBuffer(c.requestBody))
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		actorUID := c.actorUID
+		if actorUID == "" {
+			actorUID = "someadminuid"
+		}
+		rootRequest = withURLParams(rootRequest, map[string]string{"uid": c.uid})
+		rootRequest = withClaims(rootRequest, security.Claims{UID: actorUID, Username: "admin"})
+
+		dbh := &userCrudTestDbHandler{status: c.status}
+		ctrl := &apiController{dbh: dbh}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(ctrl.SetUserStatus)
+		handler.ServeHTTP(rr, rootRequest)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, "status code didn't match %s", c.requestBody)
+		if c.expectedError != "" {
+			assert.Equal(t, c.expectedError, string(bytes.TrimSpace(rr.Body.Bytes())), "body didn't match")
+		}
+		if c.expectedResponseCode == http.StatusNoContent {
+			assert.Equal(t, 1, len(dbh.audits))
+			assert.Equal(t, "user.status", dbh.audits[0].Action)
+		} else {
+			assert.Equal(t, 0, len(dbh.audits))
+		}
+	}
+}
+
+func (d *userCrudTestDbHandler) UpdateUserStatus(uid string, status string, reason string) error {
+	if uid != testUID {
+		return &model.ResourceDoesNotExistError{Err: errors.New("user does not exist")}
+	}
+	d.status = status
+	return nil
+}
@@ -0,0 +1,618 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/gkontos/goapi/db"
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/security"
+	"github.com/gkontos/goapi/util"
+)
+
+const (
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+	// maxUserImportBytes is the largest import body which is read
+	maxUserImportBytes = 32 << 20
+	// maxUserFieldLength is the length of the users columns
+	maxUserFieldLength = 255
+)
+
+// errDryRun rolls back the transaction of a dry run
+var errDryRun = errors.New("dry run")
+
+// importRecord is a record of an import with the line it starts on and the errors found parsing it
+type importRecord struct {
+	line   int
+	record model.UserRecord
+	fields []model.FieldError
+}
+
+// ImportUsers creates and updates users from CSV or NDJSON in a single transaction.  A record updates the user with
+// its auth provider and provider id, a record without a provider the user who logs in with a magic link to its email.
+// With match=email a record updates the user whose verified email it has, and one which matches no user is matched
+// by its provider.  With an active organization only the organization's own members are updated, new users join it and the roles of
+// the records are organization roles.  Every record is validated first and nothing is imported when any record has
+// errors.  A dry run imports the records and rolls the transaction back.
+func (api *apiController) ImportUsers(w http.ResponseWriter, r *http.Request) {
+
+	claims := r.Context().Value(security.UserContextKey).(security.Claims)
+	params := r.URL.Query()
+	result := &model.UserImportResult{Match: params.Get("match"), Errors: []model.UserImportError{}}
+	switch result.Match {
+	case "":
+		result.Match = model.ImportMatchProviderID
+	case model.ImportMatchProviderID, model.ImportMatchEmail:
+	default:
+		util.ReturnErrorJSON(w, &model.ValidationError{Err: errors.New("match must be provider_id or email")})
+		return
+	}
+	if v := params.Get("dry_run"); v != "" {
+		dryRun, err := strconv.ParseBool(v)
+		if err != nil {
+			util.ReturnErrorJSON(w, &model.ValidationError{Err: errors.New("dry_run must be true or false")})
+			return
+		}
+		result.DryRun = dryRun
+	}
+	format, err := importFormat(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	records, err := readUserRecords(http.MaxBytesReader(w, r.Body, maxUserImportBytes), format)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	roles, err := api.dbh.GetRoles()
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error getting roles")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	// the importer can only grant the roles which they hold
+	importer := security.CreateUserFromClaims(claims)
+	grantable := map[string]bool{}
+	for _, role := range roles {
+		held, err := api.th.HasRole(importer, role.Name)
+		if err != nil {
+			util.ReturnErrorJSON(w, err)
+			return
+		}
+		grantable[role.Name] = held
+	}
+	keys := map[string]int{}
+	for _, rec := range records {
+		fields := rec.fields
+		if len(fields) == 0 {
+			fields = validateUserRecord(rec.record, result.Match, grantable)
+			key, keyField := importKey(rec.record, result.Match)
+			if line, ok := keys[key]; ok && key != "" {
+				fields = append(fields, model.FieldError{Field: keyField, Message: fmt.Sprintf("duplicates line %d", line)})
+			} else {
+				keys[key] = rec.line
+			}
+		}
+		if len(fields) > 0 {
+			result.Errors = append(result.Errors, model.UserImportError{Line: rec.line, Fields: fields})
+		}
+	}
+	if len(result.Errors) > 0 {
+		util.ReturnBodyJSON(w, result, http.StatusBadRequest)
+		return
+	}
+
+	updated := []string{}
+	err = api.tenantDbh(r).WithTransaction(func(tx db.DbHandler) error {
+		for _, rec := range records {
+			user, created, err := importUser(tx, claims.Org, result.Match, rec.record)
+			var validation *model.ValidationError
+			if errors.As(err, &validation) {
+				result.Errors = append(result.Errors, model.UserImportError{Line: rec.line, Fields: []model.FieldError{{Message: err.Error()}}})
+				return err
+			}
+			if err != nil {
+				return err
+			}
+			if created {
+				result.Created++
+			} else {
+				result.Updated++
+				updated = append(updated, user.UID)
+			}
+		}
+		if result.DryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if len(result.Errors) > 0 {
+		result.Created, result.Updated = 0, 0
+		util.ReturnBodyJSON(w, result, http.StatusBadRequest)
+		return
+	}
+	if err != nil && !errors.Is(err, errDryRun) {
+		logger.Logger.Error().Err(err).Msg("error importing users")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	if !result.DryRun {
+		for _, uid := range updated {
+			security.InvalidateUser(uid)
+		}
+		api.audit(r, "users.import", "", model.JSONMap{"match": result.Match, "created": result.Created, "updated": result.Updated})
+	}
+
+	util.ReturnBodyJSON(w, result, http.StatusOK)
+
+}
+
+// ExportUsers streams the users selected by the filters and sort of the users listing as CSV or NDJSON.  The export
+// can be imported again.
+func (api *apiController) ExportUsers(w http.ResponseWriter, r *http.Request) {
+
+	query, err := userQueryParams(r)
+	if err != nil {
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+	query.Limit = model.MaxUserPageSize
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "":
+		format = formatCSV
+	case formatCSV, formatNDJSON:
+	default:
+		util.ReturnErrorJSON(w, &model.ValidationError{Err: errors.New("format must be csv or ndjson")})
+		return
+	}
+	dbh := api.tenantDbh(r)
+	page, err := dbh.GetUsers(query)
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("error getting users")
+		util.ReturnErrorJSON(w, err)
+		return
+	}
+
+	contentType := "text/csv"
+	if format == formatNDJSON {
+		contentType = "application/x-ndjson"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="users.%s"`, format))
+	w.WriteHeader(http.StatusOK)
+
+	// the status has been sent, so a failure part way through can only end the stream
+	writer := newUserRecordWriter(w, format)
+	count := 0
+	for {
+		for _, u := range page.Users {
+			if err := writer.Write(userRecord(u)); err != nil {
+				logger.Logger.Error().Err(err).Msg("error writing users export")
+				return
+			}
+			count++
+		}
+		if err := writer.Flush(); err != nil {
+			logger.Logger.Error().Err(err).Msg("error writing users export")
+			return
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		if query.After, err = model.DecodeUserCursor(page.NextCursor); err != nil {
+			logger.Logger.Error().Err(err).Msg("error paging users export")
+			return
+		}
+		if page, err = dbh.GetUsers(query); err != nil {
+			logger.Logger.Error().Err(err).Msg("error getting users")
+			return
+		}
+	}
+	api.audit(r, "users.export", "", model.JSONMap{"format": format, "count": count})
+
+}
+
+// importUser creates the user of the record, or updates the user it matches.  Blank columns keep the stored values
+// of an existing user.  With an organization the user has to belong to it and no other organization, and the roles
+// of the record replace the user's organization roles instead of their global roles.
+func importUser(tx db.DbHandler, org string, match string, rec model.UserRecord) (*model.User, bool, error) {
+	authProvider, providerID := importProvider(rec)
+	existing, err := matchImportUser(tx, match, rec)
+	if err != nil {
+		return nil, false, err
+	}
+
+	u := &model.User{
+		AuthProvider: authProvider,
+		ProviderID:   providerID,
+		UserName:     rec.UserName,
+		UserDetails: model.UserDetails{
+			Email:     rec.Email,
+			FirstName: rec.FirstName,
+			LastName:  rec.LastName,
+			FullName:  rec.FullName,
+			Roles:     rec.Roles,
+		},
+	}
+	roles := rec.Roles
+	if existing.UID == "" {
+		if u.UserName == "" {
+			u.UserName = rec.Email
+		}
+		if len(roles) == 0 {
+			roles = []string{security.UserRole}
+		}
+		u.UserDetails.Roles = roles
+		if org != "" {
+			u.UserDetails.Roles = []string{security.UserRole}
+		}
+		u.Status = model.UserStatusActive
+		user, err := tx.UpsertUser(u)
+		if err != nil || org == "" {
+			return user, true, err
+		}
+		return user, true, tx.UpsertMembership(&model.Membership{OrgID: org, UID: user.UID, Roles: roles})
+	}
+
+	if org != "" {
+		if err := checkImportMember(tx, org, existing.UID); err != nil {
+			return nil, false, err
+		}
+	}
+	u.UID = existing.UID
+	u.AuthProvider, u.ProviderID = existing.AuthProvider, existing.ProviderID
+	u.UserName = valueOr(u.UserName, existing.UserName)
+	stored := existing.UserDetails
+	u.UserDetails.Email = valueOr(u.UserDetails.Email, stored.Email)
+	u.UserDetails.FirstName = valueOr(u.UserDetails.FirstName, stored.FirstName)
+	u.UserDetails.LastName = valueOr(u.UserDetails.LastName, stored.LastName)
+	u.UserDetails.FullName = valueOr(u.UserDetails.FullName, stored.FullName)
+	u.UserDetails.KeepEmailVerified(stored)
+	if len(u.UserDetails.Roles) == 0 || org != "" {
+		u.UserDetails.Roles = stored.Roles
+	}
+	user, err := tx.UpsertUser(u)
+	if err != nil || org == "" || len(roles) == 0 {
+		return user, false, err
+	}
+	return user, false, tx.UpsertMembership(&model.Membership{OrgID: org, UID: user.UID, Roles: roles})
+}
+
+// matchImportUser returns the user a record updates, or a user without a uid when the record creates one.  An email
+// only matches a user whose identity provider verified it, and a record which gives a provider has to match a user
+// who logs in with it.
+func matchImportUser(tx db.DbHandler, match string, rec model.UserRecord) (*model.User, error) {
+	if match == model.ImportMatchEmail {
+		users, err := tx.GetUsersByEmail(rec.Email)
+		if err != nil {
+			return nil, err
+		}
+		if len(users) > 1 {
+			return nil, &model.ValidationError{Err: fmt.Errorf("%d users have the verified email %s", len(users), rec.Email)}
+		}
+		if len(users) == 1 {
+			user := users[0]
+			if rec.AuthProvider != "" && (rec.AuthProvider != user.AuthProvider || rec.ProviderID != user.ProviderID) {
+				return nil, &model.ValidationError{Err: fmt.Errorf("user %s with the email %s logs in with another provider", user.UID, rec.Email)}
+			}
+			return &user, nil
+		}
+	}
+	return tx.GetUserByProvider(importProvider(rec))
+}
+
+// checkImportMember returns an error unless the user is a member of the organization and no other, an import would
+// otherwise change a user of another organization
+func checkImportMember(tx db.DbHandler, org string, uid string) error {
+	memberships, err := tx.GetMemberships(uid)
+	if err != nil {
+		return err
+	}
+	for _, m := range memberships {
+		if m.OrgID != org {
+			return &model.ValidationError{Err: fmt.Errorf("user %s belongs to another organization", uid)}
+		}
+	}
+	if len(memberships) == 0 {
+		return &model.ValidationError{Err: fmt.Errorf("user %s is not a member of this organization", uid)}
+	}
+	return nil
+}
+
+// importProvider returns the login the record is matched by, its provider or a magic link to its email
+func importProvider(rec model.UserRecord) (string, string) {
+	if rec.AuthProvider == "" {
+		return security.EmailProvider, strings.ToLower(rec.Email)
+	}
+	return rec.AuthProvider, rec.ProviderID
+}
+
+func valueOr(value string, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+// validateUserRecord returns the problems with a record which can be found without the stored users.  grantable has
+// the defined roles and whether the importer holds them.
+func validateUserRecord(rec model.UserRecord, match string, grantable map[string]bool) []model.FieldError {
+	fields := []model.FieldError{}
+	invalid := func(field string, message string) {
+		fields = append(fields, model.FieldError{Field: field, Message: message})
+	}
+	if rec.Email == "" {
+		if match == model.ImportMatchEmail {
+			invalid("email", "is required")
+		} else if rec.AuthProvider == "" && rec.ProviderID == "" {
+			invalid("email", "is required without a provider id")
+		}
+	} else if address, err := mail.ParseAddress(rec.Email); err != nil || address.Address != rec.Email {
+		invalid("email", "must be an email address")
+	}
+	if rec.ProviderID != "" || rec.AuthProvider != "" {
+		if rec.AuthProvider == "" {
+			invalid("auth_provider", "is required")
+		}
+		if rec.ProviderID == "" {
+			invalid("provider_id", "is required")
+		}
+	}
+	if rec.UserName == "" && rec.Email == "" {
+		invalid("user_name", "is required without an email")
+	}
+	for _, column := range []struct{ field, value string }{{"auth_provider", rec.AuthProvider},
+		{"provider_id", rec.ProviderID}, {"user_name", rec.UserName}, {"email", rec.Email}} {
+		if len(column.value) > maxUserFieldLength {
+			invalid(column.field, fmt.Sprintf("must be at most %d characters", maxUserFieldLength))
+		}
+	}
+	for _, role := range rec.Roles {
+		held, defined := grantable[role]
+		switch {
+		case !defined:
+			invalid("roles", fmt.Sprintf("role %s does not exist", role))
+		case !held:
+			invalid("roles", fmt.Sprintf("role %s can not be granted by a user who does not hold it", role))
+		}
+	}
+	return fields
+}
+
+// importKey returns the value a record is matched by and the field it is in
+func importKey(rec model.UserRecord, match string) (string, string) {
+	if match == model.ImportMatchEmail {
+		return strings.ToLower(rec.Email), "email"
+	}
+	field := "provider_id"
+	if rec.AuthProvider == "" {
+		field = "email"
+	}
+	authProvider, providerID := importProvider(rec)
+	if providerID == "" {
+		return "", field
+	}
+	return authProvider + "/" + providerID, field
+}
+
+// importFormat returns the format of an import from the format parameter or the content type
+func importFormat(r *http.Request) (string, error) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case "text/csv":
+			format = formatCSV
+		case "application/x-ndjson", "application/ndjson":
+			format = formatNDJSON
+		}
+	}
+	if format != formatCSV && format != formatNDJSON {
+		return "", &model.ValidationError{Err: errors.New("format must be csv or ndjson")}
+	}
+	return format, nil
+}
+
+// readUserRecords parses the records of an import.  A record which can not be parsed is returned with its errors, an
+// error is only returned when the import as a whole can not be read.
+func readUserRecords(body io.Reader, format string) ([]importRecord, error) {
+	var records []importRecord
+	var err error
+	if format == formatCSV {
+		records, err = readCSVUserRecords(body)
+	} else {
+		records, err = readNDJSONUserRecords(body)
+	}
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, &model.ValidationError{Err: fmt.Errorf("an import can be at most %d bytes", tooLarge.Limit)}
+		}
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, &model.ValidationError{Err: errors.New("the import has no users")}
+	}
+	if len(records) > model.MaxUserImportRecords {
+		return nil, &model.ValidationError{Err: fmt.Errorf("an import can have at most %d users", model.MaxUserImportRecords)}
+	}
+	return records, nil
+}
+
+// readCSVUserRecords parses CSV with a header row naming the columns.  Roles are separated by semicolons or spaces.
+func readCSVUserRecords(body io.Reader) ([]importRecord, error) {
+	reader := csv.NewReader(body)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, csvError(err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\uFEFF")))
+		known := false
+		for _, field := range model.UserRecordFields {
+			known = known || field == name
+		}
+		if !known {
+			return nil, &model.ValidationError{Err: fmt.Errorf("unknown column %s, columns are %s", name, strings.Join(model.UserRecordFields, ", "))}
+		}
+		columns[name] = i
+	}
+
+	records := []importRecord{}
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		line, _ := reader.FieldPos(0)
+		rec := importRecord{line: line}
+		if errors.Is(err, csv.ErrFieldCount) {
+			rec.fields = []model.FieldError{{Message: fmt.Sprintf("must have %d columns", len(header))}}
+			records = append(records, rec)
+			continue
+		}
+		if err != nil {
+			return nil, csvError(err)
+		}
+		value := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return strings.TrimSpace(row[i])
+			}
+			return ""
+		}
+		rec.record = model.UserRecord{
+			AuthProvider: value("auth_provider"),
+			ProviderID:   value("provider_id"),
+			UserName:     value("user_name"),
+			Email:        value("email"),
+			FirstName:    value("first_name"),
+			LastName:     value("last_name"),
+			FullName:     value("full_name"),
+			Roles: strings.FieldsFunc(value("roles"), func(c rune) bool {
+				return c == ';' || c == ' '
+			}),
+		}
+		records = append(records, rec)
+	}
+}
+
+func csvError(err error) error {
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return &model.ValidationError{Err: fmt.Errorf("line %d is not valid csv: %w", parseErr.Line, parseErr.Err)}
+	}
+	return err
+}
+
+// readNDJSONUserRecords parses one JSON object per line.  Blank lines are skipped.
+func readNDJSONUserRecords(body io.Reader) ([]importRecord, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	records := []importRecord{}
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		rec := importRecord{line: line}
+		decoder := json.NewDecoder(bytes.NewReader(text))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&rec.record); err != nil {
+			rec.fields = []model.FieldError{{Message: "is not valid json: " + err.Error()}}
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return nil, &model.ValidationError{Err: fmt.Errorf("line %d is longer than 1MB", line+1)}
+		}
+		return nil, err
+	}
+	return records, nil
+}
+
+// userRecordWriter streams records as CSV, with a header row, or NDJSON
+type userRecordWriter struct {
+	w      io.Writer
+	csv    *csv.Writer
+	json   *json.Encoder
+	header bool
+}
+
+func newUserRecordWriter(w io.Writer, format string) *userRecordWriter {
+	if format == formatCSV {
+		return &userRecordWriter{w: w, csv: csv.NewWriter(w)}
+	}
+	return &userRecordWriter{w: w, json: json.NewEncoder(w)}
+}
+
+func (uw *userRecordWriter) Write(rec model.UserRecord) error {
+	if uw.json != nil {
+		return uw.json.Encode(rec)
+	}
+	if !uw.header {
+		uw.header = true
+		if err := uw.csv.Write(model.UserRecordFields); err != nil {
+			return err
+		}
+	}
+	return uw.csv.Write([]string{rec.UID, rec.AuthProvider, rec.ProviderID, rec.UserName, rec.Email, rec.FirstName,
+		rec.LastName, rec.FullName, strings.Join(rec.Roles, ";"), rec.Status})
+}
+
+// Flush sends the records written so far to the client
+func (uw *userRecordWriter) Flush() error {
+	if uw.csv != nil {
+		if !uw.header {
+			uw.header = true
+			if err := uw.csv.Write(model.UserRecordFields); err != nil {
+				return err
+			}
+		}
+		uw.csv.Flush()
+		if err := uw.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if flusher, ok := uw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+func userRecord(u model.User) model.UserRecord {
+	return model.UserRecord{
+		UID:          u.UID,
+		AuthProvider: u.AuthProvider,
+		ProviderID:   u.ProviderID,
+		UserName:     u.UserName,
+		Email:        u.UserDetails.Email,
+		FirstName:    u.UserDetails.FirstName,
+		LastName:     u.UserDetails.LastName,
+		FullName:     u.UserDetails.FullName,
+		Roles:        u.UserDetails.Roles,
+		Status:       u.Status,
+	}
+}
@@ -0,0 +1,399 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gkontos/goapi/db"
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/security"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImportUsers(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	cases := []struct {
+		name                 string
+		query                string
+		contentType          string
+		body                 string
+		claims               security.Claims
+		expectedResponseCode int
+		expectedResponseBody string
+		expectedResult       model.UserImportResult
+		expectedUsers        int
+	}{
+		{name: "csv", contentType: "text/csv",
+			body: "auth_provider,provider_id,email,first_name,roles\n" +
+				"google,tom,Tom@example.com,Thomas,ROLE_ADMIN;ROLE_USER\n" +
+				",,anna@example.com,Anna,\n",
+			expectedResponseCode: http.StatusOK,
+			expectedResult:       model.UserImportResult{Match: model.ImportMatchProviderID, Created: 1, Updated: 1, Errors: []model.UserImportError{}},
+			expectedUsers:        3},
+		// without match=email an email does not match tom's google login
+		{name: "email", contentType: "text/csv",
+			body:                 "email\ntom@example.com\n",
+			expectedResponseCode: http.StatusOK,
+			expectedResult:       model.UserImportResult{Match: model.ImportMatchProviderID, Created: 1, Errors: []model.UserImportError{}},
+			expectedUsers:        3},
+		// tom's email is verified by google, so it matches tom
+		{name: "match email", query: "?match=email", contentType: "text/csv",
+			body:                 "email,last_name\nTOM@example.com,Smith\n",
+			expectedResponseCode: http.StatusOK,
+			expectedResult:       model.UserImportResult{Match: model.ImportMatchEmail, Updated: 1, Errors: []model.UserImportError{}},
+			expectedUsers:        2},
+		// anna's email is not verified, so a new user logs in with a magic link to it
+		{name: "match unverified email", query: "?match=email", contentType: "text/csv",
+			body:                 "email\nanna@example.com\n",
+			expectedResponseCode: http.StatusOK,
+			expectedResult:       model.UserImportResult{Match: model.ImportMatchEmail, Created: 1, Errors: []model.UserImportError{}},
+			expectedUsers:        3},
+		{name: "match email with another provider", query: "?match=email", contentType: "text/csv",
+			body:                 "auth_provider,provider_id,email\ngithub,tom,tom@example.com\n",
+			expectedResponseCode: http.StatusBadRequest,
+			expectedResult: model.UserImportResult{Match: model.ImportMatchEmail, Errors: []model.UserImportError{
+				{Line: 2, Fields: []model.FieldError{{Message: "user tom-uid with the email tom@example.com logs in with another provider"}}},
+			}},
+			expectedUsers: 2},
+		{name: "match email without email", query: "?match=email", contentType: "text/csv",
+			body:                 "auth_provider,provider_id,user_name\ngoogle,tom,tom\n",
+			expectedResponseCode: http.StatusBadRequest,
+			expectedResult: model.UserImportResult{Match: model.ImportMatchEmail, Errors: []model.UserImportError{
+				{Line: 2, Fields: []model.FieldError{{Field: "email", Message: "is required"}}},
+			}},
+			expectedUsers: 2},
+		{name: "unknown match", query: "?match=uid", contentType: "text/csv", body: "email\n",
+			expectedResponseCode: http.StatusBadRequest,
+			expectedResponseBody: `{"error":"match must be provider_id or email"}`},
+		{name: "ndjson", contentType: "application/x-ndjson",
+			body: `{"auth_provider":"google","provider_id":"tom","user_name":"tom"}` + "\n\n" +
+				`{"auth_provider":"google","provider_id":"sergei","email":"sergei@example.com"}` + "\n",
+			expectedResponseCode: http.StatusOK,
+			expectedResult:       model.UserImportResult{Match: model.ImportMatchProviderID, Created: 1, Updated: 1, Errors: []model.UserImportError{}},
+			expectedUsers:        3},
+		{name: "dry run", query: "?dry_run=true&format=csv",
+			body:                 "email\nanna@example.com\n",
+			expectedResponseCode: http.StatusOK,
+			expectedResult:       model.UserImportResult{DryRun: true, Match: model.ImportMatchProviderID, Created: 1, Errors: []model.UserImportError{}},
+			expectedUsers:        2},
+		{name: "row errors", contentType: "text/csv",
+			body: "email,roles\n" +
+				"anna@example.com,ROLE_OWNER\n" +
+				"not an email,\n" +
+				"\"ANNA@example.com\",\n" +
+				"a,b,c\n",
+			expectedResponseCode: http.StatusBadRequest,
+			expectedResult: model.UserImportResult{Match: model.ImportMatchProviderID, Errors: []model.UserImportError{
+				{Line: 2, Fields: []model.FieldError{{Field: "roles", Message: "role ROLE_OWNER does not exist"}}},
+				{Line: 3, Fields: []model.FieldError{{Field: "email", Message: "must be an email address"}}},
+				{Line: 4, Fields: []model.FieldError{{Field: "email", Message: "duplicates line 2"}}},
+				{Line: 5, Fields: []model.FieldError{{Message: "must have 2 columns"}}},
+			}},
+			expectedUsers: 2},
+		{name: "ndjson errors", query: "?format=ndjson",
+			body:                 `{"auth_provider":"google"}` + "\n" + `{"uid":"x","unknown":1}` + "\n" + `not json`,
+			expectedResponseCode: http.StatusBadRequest,
+			expectedResult: model.UserImportResult{Match: model.ImportMatchProviderID, Errors: []model.UserImportError{
+				{Line: 1, Fields: []model.FieldError{{Field: "provider_id", Message: "is required"}, {Field: "user_name", Message: "is required without an email"}}},
+				{Line: 2, Fields: []model.FieldError{{Message: `is not valid json: json: unknown field "unknown"`}}},
+				{Line: 3, Fields: []model.FieldError{{Message: "is not valid json: invalid character 'o' in literal null (expecting 'u')"}}},
+			}},
+			expectedUsers: 2},
+		{name: "roles not held", contentType: "text/csv", claims: security.Claims{Roles: []string{security.UserRole}},
+			body:                 "email,roles\nanna@example.com,ROLE_ADMIN;ROLE_USER\n",
+			expectedResponseCode: http.StatusBadRequest,
+			expectedResult: model.UserImportResult{Match: model.ImportMatchProviderID, Errors: []model.UserImportError{
+				{Line: 2, Fields: []model.FieldError{{Field: "roles", Message: "role ROLE_ADMIN can not be granted by a user who does not hold it"}}},
+			}},
+			expectedUsers: 2},
+		{name: "unknown column", contentType: "text/csv", body: "email,password\n",
+			expectedResponseCode: http.StatusBadRequest,
+			expectedResponseBody: `{"error":"unknown column password, columns are uid, auth_provider, provider_id, user_name, email, first_name, last_name, full_name, roles, status"}`},
+		{name: "empty", contentType: "text/csv", body: "email\n",
+			expectedResponseCode: http.StatusBadRequest,
+			expectedResponseBody: `{"error":"the import has no users"}`},
+		{name: "unknown format", contentType: "application/json", body: "[]",
+			expectedResponseCode: http.StatusBadRequest,
+			expectedResponseBody: `{"error":"format must be csv or ndjson"}`},
+	}
+
+	for _, c := range cases {
+		request, err := http.NewRequest("POST", "/v1/users/import"+c.query, strings.NewReader(c.body))
+		if err != nil {
+			t.Errorf("Root request error: %s", err)
+		}
+		request.Header.Set("Content-Type", c.contentType)
+		claims := c.claims
+		claims.UID, claims.Username = testUID, "admin"
+		if claims.Roles == nil {
+			claims.Roles = []string{security.AdministratorRole, security.UserRole}
+		}
+		request = withClaims(request, claims)
+
+		dbh := newImportTestDbHandler()
+		ctrl := &apiController{dbh: dbh, th: &testTokenHandler{}}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(ctrl.ImportUsers).ServeHTTP(rr, request)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code, c.name)
+		if c.expectedResponseBody != "" {
+			assert.Equal(t, c.expectedResponseBody, strings.TrimSpace(rr.Body.String()), c.name)
+			continue
+		}
+		var result model.UserImportResult
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result), c.name)
+		assert.Equal(t, c.expectedResult, result, c.name)
+		assert.Equal(t, c.expectedUsers, len(dbh.users), c.name)
+		if rr.Code == http.StatusOK && !result.DryRun {
+			assert.Equal(t, 1, len(dbh.audits), c.name)
+		} else {
+			assert.Empty(t, dbh.audits, c.name)
+		}
+	}
+}
+
+func TestImportUsersMerge(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	request, _ := http.NewRequest("POST", "/v1/users/import?format=csv",
+		strings.NewReader("auth_provider,provider_id,user_name,email,last_name\ngoogle,tom,tom,,Smith\n,,,sergei@example.com,\n"))
+	request = withClaims(request, security.Claims{UID: testUID, Username: "admin", Roles: []string{security.AdministratorRole}})
+	dbh := newImportTestDbHandler()
+	ctrl := &apiController{dbh: dbh, th: &testTokenHandler{}}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(ctrl.ImportUsers).ServeHTTP(rr, request)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// blank columns keep the stored values
+	tom := dbh.users["tom-uid"]
+	assert.Equal(t, "google", tom.AuthProvider)
+	assert.Equal(t, "Tom", tom.UserDetails.FirstName)
+	assert.Equal(t, "Smith", tom.UserDetails.LastName)
+	assert.Equal(t, []string{security.UserRole}, tom.UserDetails.Roles)
+
+	// a new user logs in with a magic link to their email
+	var sergei *model.User
+	for _, u := range dbh.users {
+		if u.UserName == "sergei@example.com" {
+			sergei = u
+		}
+	}
+	if assert.NotNil(t, sergei) {
+		assert.Equal(t, security.EmailProvider, sergei.AuthProvider)
+		assert.Equal(t, "sergei@example.com", sergei.ProviderID)
+		assert.Equal(t, model.UserStatusActive, sergei.Status)
+		assert.Equal(t, []string{security.UserRole}, sergei.UserDetails.Roles)
+	}
+}
+
+func TestImportUsersOrganization(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	cases := []struct {
+		body                 string
+		expectedResponseCode int
+		expectedResult       model.UserImportResult
+	}{
+		{body: "auth_provider,provider_id,user_name,email,roles\ngoogle,tom,tom,,ROLE_ADMIN\n,,,anna@example.com,\n",
+			expectedResponseCode: http.StatusOK,
+			expectedResult:       model.UserImportResult{Match: model.ImportMatchProviderID, Created: 1, Updated: 1, Errors: []model.UserImportError{}}},
+		// sergei is also a member of org-b
+		{body: "auth_provider,provider_id,user_name\ngoogle,sergei,sergei\n",
+			expectedResponseCode: http.StatusBadRequest,
+			expectedResult: model.UserImportResult{Match: model.ImportMatchProviderID, Errors: []model.UserImportError{
+				{Line: 2, Fields: []model.FieldError{{Message: "user sergei-uid belongs to another organization"}}},
+			}}},
+		// a user who is not a member
+		{body: "auth_provider,provider_id,user_name\ngoogle,boris,boris\n",
+			expectedResponseCode: http.StatusBadRequest,
+			expectedResult: model.UserImportResult{Match: model.ImportMatchProviderID, Errors: []model.UserImportError{
+				{Line: 2, Fields: []model.FieldError{{Message: "user boris-uid is not a member of this organization"}}},
+			}}},
+	}
+
+	for _, c := range cases {
+		request, _ := http.NewRequest("POST", "/v1/users/import?format=csv", strings.NewReader(c.body))
+		request = withClaims(request, security.Claims{UID: testUID, Username: "admin", Org: "org-a",
+			Roles: []string{security.AdministratorRole, security.UserRole}})
+		dbh := newImportTestDbHandler()
+		dbh.users["tom-uid"].UserDetails.Roles = []string{security.UserRole}
+		dbh.users["sergei-uid"] = &model.User{UID: "sergei-uid", AuthProvider: "google", ProviderID: "sergei", UserName: "sergei"}
+		dbh.users["boris-uid"] = &model.User{UID: "boris-uid", AuthProvider: "google", ProviderID: "boris", UserName: "boris"}
+		dbh.memberships = map[string][]model.Membership{
+			"tom-uid":    {{OrgID: "org-a", UID: "tom-uid", Roles: model.StringList{security.UserRole}}},
+			"sergei-uid": {{OrgID: "org-a", UID: "sergei-uid"}, {OrgID: "org-b", UID: "sergei-uid"}},
+		}
+		ctrl := &apiController{dbh: dbh, th: &testTokenHandler{}}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(ctrl.ImportUsers).ServeHTTP(rr, request)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code)
+		var result model.UserImportResult
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+		assert.Equal(t, c.expectedResult, result)
+		if rr.Code != http.StatusOK {
+			continue
+		}
+
+		// the roles are organization roles, the global roles are kept
+		tom := dbh.users["tom-uid"]
+		assert.Equal(t, []string{security.UserRole}, tom.UserDetails.Roles)
+		assert.Equal(t, model.StringList{security.AdministratorRole}, dbh.memberships["tom-uid"][0].Roles)
+		var anna *model.User
+		for _, u := range dbh.users {
+			if u.UserName == "anna@example.com" {
+				anna = u
+			}
+		}
+		if assert.NotNil(t, anna) {
+			assert.Equal(t, []string{security.UserRole}, anna.UserDetails.Roles)
+			assert.Equal(t, []model.Membership{{OrgID: "org-a", UID: anna.UID, Roles: model.StringList{security.UserRole}}}, dbh.memberships[anna.UID])
+		}
+	}
+}
+
+func TestExportUsers(t *testing.T) {
+	logger.InitLogger(true, true)
+
+	cases := []struct {
+		query                string
+		expectedResponseCode int
+		expectedContentType  string
+		expectedDisposition  string
+		expectedResponseBody string
+	}{
+		{expectedResponseCode: http.StatusOK, expectedContentType: "text/csv", expectedDisposition: `attachment; filename="users.csv"`,
+			expectedResponseBody: "uid,auth_provider,provider_id,user_name,email,first_name,last_name,full_name,roles,status\n" +
+				"tom-uid,google,tom,tom,tom@example.com,Tom,,,ROLE_ADMIN;ROLE_USER,active\n" +
+				"anna-uid,email,anna@example.com,anna@example.com,anna@example.com,,,,ROLE_USER,suspended\n"},
+		{query: "?format=ndjson", expectedResponseCode: http.StatusOK, expectedContentType: "application/x-ndjson",
+			expectedDisposition: `attachment; filename="users.ndjson"`,
+			expectedResponseBody: `{"uid":"tom-uid","auth_provider":"google","provider_id":"tom","user_name":"tom","email":"tom@example.com","first_name":"Tom","roles":["ROLE_ADMIN","ROLE_USER"],"status":"active"}` + "\n" +
+				`{"uid":"anna-uid","auth_provider":"email","provider_id":"anna@example.com","user_name":"anna@example.com","email":"anna@example.com","roles":["ROLE_USER"],"status":"suspended"}` + "\n"},
+		{query: "?format=xml", expectedResponseCode: http.StatusBadRequest,
+			expectedResponseBody: `{"error":"format must be csv or ndjson"}` + "\n"},
+	}
+
+	for _, c := range cases {
+		request, _ := http.NewRequest("GET", "/v1/users/export"+c.query, nil)
+		request = withClaims(request, security.Claims{UID: testUID, Username: "admin"})
+		dbh := &usersExportTestDbHandler{}
+		ctrl := &apiController{dbh: dbh}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(ctrl.ExportUsers).ServeHTTP(rr, request)
+
+		assert.Equal(t, c.expectedResponseCode, rr.Code)
+		assert.Equal(t, c.expectedContentType, rr.Header().Get("Content-Type"))
+		assert.Equal(t, c.expectedResponseBody, rr.Body.String())
+		if rr.Code == http.StatusOK {
+			assert.Equal(t, 2, dbh.pages)
+			assert.Equal(t, c.expectedDisposition, rr.Header().Get("Content-Disposition"))
+		}
+	}
+}
+
+// importTestDbHandler stores users in memory.  A transaction which fails restores the users it started with.
+type importTestDbHandler struct {
+	roleTestDbHandler
+	users       map[string]*model.User
+	memberships map[string][]model.Membership
+}
+
+func newImportTestDbHandler() *importTestDbHandler {
+	return &importTestDbHandler{users: map[string]*model.User{
+		"tom-uid": {UID: "tom-uid", AuthProvider: "google", ProviderID: "tom", UserName: "tom", Status: model.UserStatusActive,
+			UserDetails: model.UserDetails{Email: "tom@example.com", EmailVerified: true, FirstName: "Tom", Roles: []string{security.UserRole}}},
+		"anna-uid": {UID: "anna-uid", AuthProvider: "github", ProviderID: "anna", UserName: "anna", Status: model.UserStatusActive,
+			UserDetails: model.UserDetails{Email: "anna@example.com", Roles: []string{security.UserRole}}},
+	}}
+}
+
+func (d *importTestDbHandler) WithTenant(orgID string) db.DbHandler {
+	return d
+}
+
+func (d *importTestDbHandler) WithTransaction(fn func(tx db.DbHandler) error) error {
+	saved := map[string]*model.User{}
+	for uid, u := range d.users {
+		saved[uid] = u
+	}
+	if err := fn(d); err != nil {
+		d.users = saved
+		return err
+	}
+	return nil
+}
+
+func (d *importTestDbHandler) GetMemberships(uid string) ([]model.Membership, error) {
+	return d.memberships[uid], nil
+}
+
+func (d *importTestDbHandler) UpsertMembership(m *model.Membership) error {
+	if d.memberships == nil {
+		d.memberships = map[string][]model.Membership{}
+	}
+	d.memberships[m.UID] = []model.Membership{*m}
+	return nil
+}
+
+func (d *importTestDbHandler) GetUserByProvider(authProvider string, providerID string) (*model.User, error) {
+	for _, u := range d.users {
+		if u.AuthProvider == authProvider && u.ProviderID == providerID {
+			found := *u
+			return &found, nil
+		}
+	}
+	return &model.User{}, nil
+}
+
+func (d *importTestDbHandler) GetUsersByEmail(email string) ([]model.User, error) {
+	users := []model.User{}
+	for _, u := range d.users {
+		if strings.EqualFold(u.UserDetails.Email, email) && u.UserDetails.EmailVerified {
+			users = append(users, *u)
+		}
+	}
+	return users, nil
+}
+
+func (d *importTestDbHandler) UpsertUser(u *model.User) (*model.User, error) {
+	if u.UID == "" {
+		u.UID = fmt.Sprintf("user-%d", len(d.users))
+	}
+	d.users[u.UID] = u
+	return u, nil
+}
+
+// usersExportTestDbHandler returns the users on two pages
+type usersExportTestDbHandler struct {
+	roleTestDbHandler
+	pages int
+}
+
+func (d *usersExportTestDbHandler) WithTenant(orgID string) db.DbHandler {
+	return d
+}
+
+func (d *usersExportTestDbHandler) GetUsers(query model.UserQuery) (*model.UserPage, error) {
+	d.pages++
+	if query.Limit != model.MaxUserPageSize {
+		return nil, errors.New("unexpected page size")
+	}
+	if query.After == nil {
+		return &model.UserPage{
+			Users: []model.User{{UID: "tom-uid", AuthProvider: "google", ProviderID: "tom", UserName: "tom", Status: model.UserStatusActive,
+				UserDetails: model.UserDetails{Email: "tom@example.com", FirstName: "Tom", Roles: []string{security.AdministratorRole, security.UserRole}}}},
+			NextCursor: (&model.UserCursor{Sort: "created_at", Value: "2024-01-01", UID: "tom-uid"}).Encode(),
+		}, nil
+	}
+	return &model.UserPage{Users: []model.User{{UID: "anna-uid", AuthProvider: security.EmailProvider, ProviderID: "anna@example.com",
+		UserName: "anna@example.com", Status: model.UserStatusSuspended,
+		UserDetails: model.UserDetails{Email: "anna@example.com", Roles: []string{security.UserRole}}}}}, nil
+}
@@ -0,0 +1,13 @@
+package db
+
+import (
+	"github.com/gkontos/goapi/model"
+)
+
+func (db *dbHandler) InsertAuditEntry(e *model.AuditEntry) error {
+	sqlStatement := `
+		INSERT INTO audit_log (actor_uid, action, target_uid, details)
+		VALUES ($1, $2, $3, $4)`
+	_, err := db.getConnection().Exec(sqlStatement, e.ActorUID, e.Action, e.TargetUID, e.Details)
+	return err
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/gkontos/goapi/logger"
 	"github.com/gkontos/goapi/model"
@@ -11,9 +12,73 @@ import (
 )
 
 type DbHandler interface {
-	GetUsers() ([]model.User, error)
+	GetUsers(query model.UserQuery) (*model.UserPage, error)
+	SearchUsers(search model.UserSearch) (*model.UserPage, error)
 	GetUserByProvider(authProvider string, providerID string) (*model.User, error)
+	GetUserByUID(uid string) (*model.User, error)
+	GetUsersByEmail(email string) ([]model.User, error)
 	UpsertUser(u *model.User) (*model.User, error)
+	UpdateUserDetails(uid string, details model.UserDetails) error
+	UpdateUserStatus(uid string, status string, reason string) error
+	DecideRegistration(uid string, approve bool, roles []string, reason string) error
+	GetPreferences(uid string) (*model.Preferences, error)
+	UpdatePreferences(uid string, values model.JSONMap, version int) (*model.Preferences, error)
+	InsertUserExport(uid string) (*model.UserExport, error)
+	GetPendingUserExport(uid string) (*model.UserExport, error)
+	GetUserExport(uid string, id string) (*model.UserExport, error)
+	GetUserExportArchive(uid string, id string) ([]byte, error)
+	CompleteUserExport(id string, archive []byte, exportErr error) error
+	GetUserArchive(uid string) (*model.UserArchive, error)
+	ScheduleErasure(uid string, requestedBy string, eraseAfter time.Time) (*model.Erasure, error)
+	GetErasure(uid string) (*model.Erasure, error)
+	CancelErasure(uid string) error
+	GetDueErasures() ([]string, error)
+	EraseUser(uid string) error
+	InsertInvitation(i *model.Invitation) error
+	GetInvitations() ([]model.Invitation, error)
+	DeleteInvitation(id string) error
+	GetPendingInvitation(email string) (*model.Invitation, error)
+	AcceptInvitation(id string, uid string) error
+	InsertMagicLink(l *model.MagicLink) error
+	ConsumeMagicLink(id string) (*model.MagicLink, error)
+	GetOAuthClient(clientID string) (*model.OAuthClient, error)
+	InsertAuthorizationCode(c *model.AuthorizationCode) error
+	ConsumeAuthorizationCode(codeHash string) (*model.AuthorizationCode, error)
+	InsertDeviceAuthorization(d *model.DeviceAuthorization) error
+	GetPendingDeviceAuthorization(userCode string) (*model.DeviceAuthorization, error)
+	DecideDeviceAuthorization(userCode string, uid string, status string) error
+	PollDeviceAuthorization(deviceCodeHash string) (*model.DeviceAuthorization, error)
+	ConsumeDeviceAuthorization(deviceCodeHash string) (*model.DeviceAuthorization, error)
+	GetRoles() ([]model.Role, error)
+	GetPermissions() ([]string, error)
+	AddUserRole(uid string, role string) ([]string, error)
+	RemoveUserRole(uid string, role string) ([]string, error)
+	InsertAuditEntry(e *model.AuditEntry) error
+	InsertLoginEvent(e *model.LoginEvent) error
+	GetLoginEvents(query model.LoginEventQuery) (*model.LoginEventPage, error)
+	InsertOrganization(o *model.Organization) error
+	GetMemberships(uid string) ([]model.Membership, error)
+	UpsertMembership(m *model.Membership) error
+	DeleteMembership(orgID string, uid string) error
+	GetGroups() ([]model.Group, error)
+	GetGroup(id string) (*model.Group, error)
+	InsertGroup(g *model.Group) error
+	UpdateGroup(g *model.Group) error
+	DeleteGroup(id string) error
+	GetGroupMembers(id string) ([]string, error)
+	AddGroupMember(id string, uid string) error
+	RemoveGroupMember(id string, uid string) error
+	GetGroupRoles(uid string) ([]string, error)
+	GetProvisioningClient(tokenHash string) (*model.ProvisioningClient, error)
+	GetProvisionedUsers(query model.ProvisionedUserQuery) (*model.ProvisionedUserPage, error)
+	SetExternalID(uid string, externalID string) error
+	// WithTenant returns a handler whose user queries are scoped to the members of the organization, whose
+	// role changes apply to the organization membership and whose groups belong to the organization.
+	// An empty orgID returns an unscoped handler.
+	WithTenant(orgID string) DbHandler
+	// WithTransaction calls fn with a handler whose statements run in a single transaction.  The transaction is
+	// committed when fn returns nil and rolled back when it returns an error, which is returned.
+	WithTransaction(fn func(tx DbHandler) error) error
 }
 
 type dbHandler struct {
@@ -22,6 +87,16 @@ type dbHandler struct {
 	unixSocketPath string
 	dbName         string
 	pool           *sql.DB
+	tenant         string
+	// tx is the transaction of a handler passed to a WithTransaction function
+	tx *sql.Tx
+}
+
+// connection runs the statements of a handler, the connection pool or the handler's transaction
+type connection interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
 }
 
 /*
@@ -51,12 +126,55 @@ func NewDbHandler() *dbHandler {
 	}
 }
 
+func (db *dbHandler) WithTenant(orgID string) DbHandler {
+	// share the connection pool with the tenant handler
+	db.getPool()
+	scoped := *db
+	scoped.tenant = orgID
+	return &scoped
+}
+
+func (db *dbHandler) WithTransaction(fn func(tx DbHandler) error) error {
+	if db.tx != nil {
+		return fn(db)
+	}
+	tx, err := db.getPool().Begin()
+	if err != nil {
+		return err
+	}
+	scoped := *db
+	scoped.tx = tx
+	if err := fn(&scoped); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			logger.Logger.Error().Err(rollbackErr).Msg("unable to roll back transaction")
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+/*
+*
+get a sql connection, the handler's transaction when it has one
+*
+*/
+func (db *dbHandler) getConnection() connection {
+	if db.tx != nil {
+		return db.tx
+	}
+	pool := db.getPool()
+	if pool == nil {
+		return nil
+	}
+	return pool
+}
+
 /*
 *
-get a sql connection
+get the sql connection pool
 *
 */
-func (db *dbHandler) getConnection() *sql.DB {
+func (db *dbHandler) getPool() *sql.DB {
 	var err error
 	pool, err := db.connectUnixSocket()
 	if err != nil {
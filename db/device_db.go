@@ -0,0 +1,115 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/gkontos/goapi/model"
+)
+
+func (db *dbHandler) InsertDeviceAuthorization(d *model.DeviceAuthorization) error {
+	sqlStatement := `
+		INSERT INTO device_authorizations (device_code_hash, user_code, client_id, scope, status, poll_interval, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	_, err := db.getConnection().Exec(sqlStatement, d.DeviceCodeHash, d.UserCode, d.ClientID, d.Scope, d.Status, d.Interval, d.ExpiresAt)
+	return err
+}
+
+// GetPendingDeviceAuthorization returns the request for the user code if it is still waiting for approval
+func (db *dbHandler) GetPendingDeviceAuthorization(userCode string) (*model.DeviceAuthorization, error) {
+
+	d := model.DeviceAuthorization{}
+	sqlStatement := `
+		SELECT device_code_hash, user_code, client_id, scope, status, poll_interval, expires_at FROM device_authorizations
+		WHERE user_code = $1 AND status = 'pending' AND expires_at > NOW()`
+	err := db.getConnection().QueryRow(sqlStatement, userCode).
+		Scan(&d.DeviceCodeHash,
+			&d.UserCode,
+			&d.ClientID,
+			&d.Scope,
+			&d.Status,
+			&d.Interval,
+			&d.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("device code does not exist or has expired")}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// DecideDeviceAuthorization will approve or deny a pending request on behalf of the user
+func (db *dbHandler) DecideDeviceAuthorization(userCode string, uid string, status string) error {
+	sqlStatement := `
+		UPDATE device_authorizations
+		SET status = $3, uid = $2
+		WHERE user_code = $1 AND status = 'pending' AND expires_at > NOW()`
+	result, err := db.getConnection().Exec(sqlStatement, userCode, uid, status)
+	if err != nil {
+		return err
+	}
+	if count, err := result.RowsAffected(); err == nil && count == 0 {
+		return &model.ResourceDoesNotExistError{Err: errors.New("device code does not exist or has expired")}
+	}
+	return nil
+}
+
+// PollDeviceAuthorization records the poll and returns the request with the time of the previous poll
+func (db *dbHandler) PollDeviceAuthorization(deviceCodeHash string) (*model.DeviceAuthorization, error) {
+
+	d := model.DeviceAuthorization{}
+	sqlStatement := `
+		WITH previous AS (
+			SELECT last_polled_at FROM device_authorizations WHERE device_code_hash = $1 FOR UPDATE
+		)
+		UPDATE device_authorizations d
+		SET last_polled_at = NOW()
+		FROM previous
+		WHERE d.device_code_hash = $1
+		RETURNING d.device_code_hash, d.user_code, d.client_id, d.scope, COALESCE(d.uid::text, ''), d.status,
+			d.poll_interval, d.expires_at, previous.last_polled_at`
+	err := db.getConnection().QueryRow(sqlStatement, deviceCodeHash).
+		Scan(&d.DeviceCodeHash,
+			&d.UserCode,
+			&d.ClientID,
+			&d.Scope,
+			&d.UID,
+			&d.Status,
+			&d.Interval,
+			&d.ExpiresAt,
+			&d.LastPolledAt)
+	if err == sql.ErrNoRows {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("device code does not exist")}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// ConsumeDeviceAuthorization removes an approved request so that tokens are only issued once
+func (db *dbHandler) ConsumeDeviceAuthorization(deviceCodeHash string) (*model.DeviceAuthorization, error) {
+
+	d := model.DeviceAuthorization{}
+	sqlStatement := `
+		DELETE FROM device_authorizations
+		WHERE device_code_hash = $1 AND status = 'approved'
+		RETURNING device_code_hash, user_code, client_id, scope, uid, status, poll_interval, expires_at`
+	err := db.getConnection().QueryRow(sqlStatement, deviceCodeHash).
+		Scan(&d.DeviceCodeHash,
+			&d.UserCode,
+			&d.ClientID,
+			&d.Scope,
+			&d.UID,
+			&d.Status,
+			&d.Interval,
+			&d.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("device code does not exist or has not been approved")}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
@@ -0,0 +1,164 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gkontos/goapi/model"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInsertDeviceAuthorization(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	expiresAt := time.Now().Add(10 * time.Minute)
+	mock.ExpectExec("INSERT INTO device_authorizations (.+)").
+		WithArgs("somehash", "BCDF-GHJK", "someclient", "openid", model.DeviceAuthorizationPending, 5, expiresAt).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := db.InsertDeviceAuthorization(&model.DeviceAuthorization{DeviceCodeHash: "somehash", UserCode: "BCDF-GHJK",
+		ClientID: "someclient", Scope: "openid", Status: model.DeviceAuthorizationPending, Interval: 5, ExpiresAt: expiresAt})
+	if err != nil {
+		t.Errorf("error '%s' was not expected, while inserting device authorization", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetPendingDeviceAuthorizationExpired(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	// expired requests are filtered out by the query
+	rows := sqlmock.NewRows([]string{"device_code_hash", "user_code", "client_id", "scope", "status", "poll_interval", "expires_at"})
+	mock.ExpectQuery("SELECT (.+) FROM device_authorizations WHERE (.+) AND expires_at > NOW\\(\\)").
+		WithArgs("BCDF-GHJK").WillReturnRows(rows)
+
+	_, err := db.GetPendingDeviceAuthorization("BCDF-GHJK")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.IsType(t, &model.ResourceDoesNotExistError{}, err)
+}
+
+func TestDecideDeviceAuthorization(t *testing.T) {
+	uid := uuid.NewString()
+	tests := []struct {
+		name     string
+		status   string
+		affected int64
+		wantErr  bool
+	}{
+		{name: "approve", status: model.DeviceAuthorizationApproved, affected: 1},
+		{name: "deny", status: model.DeviceAuthorizationDenied, affected: 1},
+		{name: "expired or already decided", status: model.DeviceAuthorizationApproved, affected: 0, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := getTestHandler()
+			defer db.pool.Close()
+
+			mock.ExpectExec("UPDATE device_authorizations SET status = \\$3, uid = \\$2 WHERE user_code = \\$1 AND status = 'pending' AND expires_at > NOW\\(\\)").
+				WithArgs("BCDF-GHJK", uid, tt.status).
+				WillReturnResult(sqlmock.NewResult(0, tt.affected))
+
+			err := db.DecideDeviceAuthorization("BCDF-GHJK", uid, tt.status)
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+
+			if tt.wantErr {
+				assert.IsType(t, &model.ResourceDoesNotExistError{}, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestPollDeviceAuthorization(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	// the previous poll time is returned so that a client polling too fast can be told to slow down
+	polledAt := time.Now().Add(-2 * time.Second)
+	expiresAt := time.Now().Add(10 * time.Minute)
+	rows := sqlmock.NewRows([]string{"device_code_hash", "user_code", "client_id", "scope", "uid", "status",
+		"poll_interval", "expires_at", "last_polled_at"}).
+		AddRow("somehash", "BCDF-GHJK", "someclient", "openid", "", model.DeviceAuthorizationPending, 5, expiresAt, polledAt)
+	mock.ExpectQuery("WITH previous AS (.+) UPDATE device_authorizations d SET last_polled_at = NOW\\(\\) (.+) RETURNING (.+)").
+		WithArgs("somehash").WillReturnRows(rows)
+
+	d, err := db.PollDeviceAuthorization("somehash")
+	if err != nil {
+		t.Errorf("error '%s' was not expected, while polling device authorization", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, model.DeviceAuthorizationPending, d.Status)
+	assert.Equal(t, 5, d.Interval)
+	if assert.NotNil(t, d.LastPolledAt) {
+		assert.True(t, polledAt.Equal(*d.LastPolledAt))
+	}
+}
+
+func TestPollDeviceAuthorizationFirstPoll(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	rows := sqlmock.NewRows([]string{"device_code_hash", "user_code", "client_id", "scope", "uid", "status",
+		"poll_interval", "expires_at", "last_polled_at"}).
+		AddRow("somehash", "BCDF-GHJK", "someclient", "openid", "", model.DeviceAuthorizationPending, 5, time.Now(), nil)
+	mock.ExpectQuery("WITH previous AS (.+)").WithArgs("somehash").WillReturnRows(rows)
+
+	d, err := db.PollDeviceAuthorization("somehash")
+	if err != nil {
+		t.Errorf("error '%s' was not expected, while polling device authorization", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Nil(t, d.LastPolledAt)
+}
+
+func TestConsumeDeviceAuthorization(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	uid := uuid.NewString()
+	rows := sqlmock.NewRows([]string{"device_code_hash", "user_code", "client_id", "scope", "uid", "status",
+		"poll_interval", "expires_at"}).
+		AddRow("somehash", "BCDF-GHJK", "someclient", "openid", uid, model.DeviceAuthorizationApproved, 5, time.Now())
+	mock.ExpectQuery("DELETE FROM device_authorizations WHERE device_code_hash = \\$1 AND status = 'approved' RETURNING (.+)").
+		WithArgs("somehash").WillReturnRows(rows)
+	mock.ExpectQuery("DELETE FROM device_authorizations (.+)").
+		WithArgs("somehash").WillReturnRows(sqlmock.NewRows([]string{"device_code_hash", "user_code", "client_id", "scope",
+		"uid", "status", "poll_interval", "expires_at"}))
+
+	d, err := db.ConsumeDeviceAuthorization("somehash")
+	if err != nil {
+		t.Errorf("error '%s' was not expected, while consuming device authorization", err)
+	}
+	assert.Equal(t, uid, d.UID)
+
+	// the request can only be consumed once
+	_, err = db.ConsumeDeviceAuthorization("somehash")
+	assert.IsType(t, &model.ResourceDoesNotExistError{}, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
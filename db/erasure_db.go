@@ -0,0 +1,145 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/gkontos/goapi/model"
+)
+
+// ScheduleErasure requests that the user is erased after eraseAfter.  A tenant handler can only erase a member of
+// the tenant who does not belong to another organization.
+func (db *dbHandler) ScheduleErasure(uid string, requestedBy string, eraseAfter time.Time) (*model.Erasure, error) {
+	if err := db.checkTenantOwnsUser(uid); err != nil {
+		return nil, err
+	}
+	e := &model.Erasure{UID: uid, RequestedBy: requestedBy, EraseAfter: eraseAfter}
+	sqlStatement := `
+		INSERT INTO user_erasures (uid, requested_by, erase_after)
+		SELECT uid, $2, $3 FROM users WHERE uid = $1
+		RETURNING requested_at`
+	err := db.getConnection().QueryRow(sqlStatement, uid, requestedBy, eraseAfter).Scan(&e.RequestedAt)
+	if err == sql.ErrNoRows {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("user does not exist")}
+	}
+	if isUniqueViolation(err) {
+		return nil, &model.ValidationError{Err: errors.New("erasure has already been requested")}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// GetErasure returns the erasure requested for the user
+func (db *dbHandler) GetErasure(uid string) (*model.Erasure, error) {
+	if err := db.checkTenantOwnsUser(uid); err != nil {
+		return nil, err
+	}
+	e := model.Erasure{}
+	sqlStatement := `
+		SELECT uid, requested_by, requested_at, erase_after, completed_at FROM user_erasures
+		WHERE uid = $1`
+	err := db.getConnection().QueryRow(sqlStatement, uid).
+		Scan(&e.UID,
+			&e.RequestedBy,
+			&e.RequestedAt,
+			&e.EraseAfter,
+			&e.CompletedAt)
+	if err == sql.ErrNoRows {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("erasure has not been requested")}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// CancelErasure withdraws an erasure which has not been completed
+func (db *dbHandler) CancelErasure(uid string) error {
+	if err := db.checkTenantOwnsUser(uid); err != nil {
+		return err
+	}
+	sqlStatement := `
+		DELETE FROM user_erasures
+		WHERE uid = $1 AND completed_at IS NULL`
+	return db.execOne(errors.New("there is no pending erasure"), sqlStatement, uid)
+}
+
+// GetDueErasures returns the users whose erasure is due
+func (db *dbHandler) GetDueErasures() ([]string, error) {
+	uids := make([]string, 0)
+	sqlStatement := `
+		SELECT uid FROM user_erasures
+		WHERE completed_at IS NULL AND erase_after <= NOW()
+		ORDER BY erase_after`
+	rows, err := db.getConnection().Query(sqlStatement)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uid string
+		if err := rows.Scan(&uid); err != nil {
+			return nil, err
+		}
+		uids = append(uids, uid)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return uids, nil
+}
+
+// erasureStatements remove the user's personal data.  The user's row is kept with a deleted status so that the uid
+// in audit entries does not identify anyone, and the details of entries about the user are cleared.
+var erasureStatements = []string{
+	`DELETE FROM magic_links WHERE email = (SELECT details->>'email' FROM users WHERE uid = $1)`,
+	`DELETE FROM invitations WHERE accepted_uid = $1 OR email = (SELECT details->>'email' FROM users WHERE uid = $1)`,
+	`DELETE FROM device_authorizations WHERE uid = $1`,
+	`DELETE FROM oauth_authorization_codes WHERE uid = $1`,
+	`DELETE FROM user_exports WHERE uid = $1`,
+	`DELETE FROM login_events WHERE uid = $1`,
+	`DELETE FROM group_members WHERE uid = $1`,
+	`DELETE FROM organization_members WHERE uid = $1`,
+	`UPDATE audit_log SET details = '{}' WHERE target_uid = $1::text`,
+}
+
+// EraseUser irreversibly anonymizes the user whose erasure has been requested.  Their provider link, sessions,
+// memberships, exports and login history are removed and their details and preferences are replaced.
+func (db *dbHandler) EraseUser(uid string) error {
+	tx, err := db.getPool().Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE user_erasures SET completed_at = NOW()
+		WHERE uid = $1 AND completed_at IS NULL`, uid)
+	if err != nil {
+		return err
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		return err
+	} else if count == 0 {
+		return &model.ResourceDoesNotExistError{Err: errors.New("there is no pending erasure")}
+	}
+
+	for _, sqlStatement := range erasureStatements {
+		if _, err := tx.Exec(sqlStatement, uid); err != nil {
+			return err
+		}
+	}
+	sqlStatement := `
+		UPDATE users
+		SET auth_provider = 'erased', provider_id = uid::text, user_name = 'erased',
+			details = '{"full_name": "", "roles": []}', preferences = '{}', status = $2, status_reason = 'erased',
+			external_id = NULL, status_changed_at = NOW(), updated_at = NOW(), last_login_at = NULL
+		WHERE uid = $1`
+	if _, err := tx.Exec(sqlStatement, uid, model.UserStatusDeleted); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
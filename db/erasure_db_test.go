@@ -0,0 +1,47 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gkontos/goapi/model"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEraseUser(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	uid := uuid.NewString()
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE user_erasures SET completed_at = NOW\\(\\) WHERE uid = \\$1 AND completed_at IS NULL").WithArgs(uid).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM magic_links (.+)").WithArgs(uid).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM invitations (.+)").WithArgs(uid).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM device_authorizations (.+)").WithArgs(uid).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM oauth_authorization_codes (.+)").WithArgs(uid).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM user_exports (.+)").WithArgs(uid).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("DELETE FROM login_events (.+)").WithArgs(uid).WillReturnResult(sqlmock.NewResult(0, 4))
+	mock.ExpectExec("DELETE FROM group_members (.+)").WithArgs(uid).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM organization_members (.+)").WithArgs(uid).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE audit_log SET details = '{}' (.+)").WithArgs(uid).WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec("UPDATE users SET auth_provider = 'erased', provider_id = uid::text, user_name = 'erased', (.+) preferences = '{}', (.+) last_login_at = NULL (.+)").
+		WithArgs(uid, model.UserStatusDeleted).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, db.EraseUser(uid))
+
+	// nothing is erased without a pending request
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE user_erasures (.+)").WithArgs(uid).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	err := db.EraseUser(uid)
+	assert.IsType(t, &model.ResourceDoesNotExistError{}, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
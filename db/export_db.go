@@ -0,0 +1,229 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/gkontos/goapi/model"
+	"github.com/google/uuid"
+)
+
+// exportStatus reports an export which has been pending for too long as failed, the instance generating it has gone
+const exportStatus = `CASE WHEN status = 'pending' AND created_at < NOW() - interval '10 minutes' THEN 'failed' ELSE status END`
+
+// InsertUserExport starts a pending export of the user's data which can be downloaded for a day once complete
+func (db *dbHandler) InsertUserExport(uid string) (*model.UserExport, error) {
+	e := &model.UserExport{ID: uuid.NewString(), UID: uid, Status: model.ExportStatusPending}
+	sqlStatement := `
+		INSERT INTO user_exports (id, uid, status, expires_at)
+		VALUES ($1, $2, $3, NOW() + interval '1 day')
+		RETURNING created_at, expires_at`
+	if err := db.getConnection().QueryRow(sqlStatement, e.ID, e.UID, e.Status).Scan(&e.CreatedAt, &e.ExpiresAt); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// GetPendingUserExport returns the user's export which is still being generated, or nil when there is none
+func (db *dbHandler) GetPendingUserExport(uid string) (*model.UserExport, error) {
+	e, err := db.getUserExport(`uid = $1 AND `+exportStatus+` = 'pending'`, uid)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return e, err
+}
+
+// GetUserExport returns one of the user's exports which has not expired
+func (db *dbHandler) GetUserExport(uid string, id string) (*model.UserExport, error) {
+	e, err := db.getUserExport(`uid = $1 AND id = $2`, uid, id)
+	if err == sql.ErrNoRows {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("export does not exist")}
+	}
+	return e, err
+}
+
+func (db *dbHandler) getUserExport(condition string, args ...interface{}) (*model.UserExport, error) {
+	e := model.UserExport{}
+	sqlStatement := `
+		SELECT id, uid, ` + exportStatus + `, COALESCE(error, ''), created_at, completed_at, expires_at
+		FROM user_exports
+		WHERE ` + condition + ` AND expires_at > NOW()
+		ORDER BY created_at DESC
+		LIMIT 1`
+	err := db.getConnection().QueryRow(sqlStatement, args...).
+		Scan(&e.ID,
+			&e.UID,
+			&e.Status,
+			&e.Error,
+			&e.CreatedAt,
+			&e.CompletedAt,
+			&e.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// GetUserExportArchive returns the json archive of one of the user's completed exports
+func (db *dbHandler) GetUserExportArchive(uid string, id string) ([]byte, error) {
+	var archive []byte
+	sqlStatement := `
+		SELECT archive FROM user_exports
+		WHERE uid = $1 AND id = $2 AND status = 'complete' AND expires_at > NOW()`
+	err := db.getConnection().QueryRow(sqlStatement, uid, id).Scan(&archive)
+	if err == sql.ErrNoRows {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("export does not exist or is not complete")}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return archive, nil
+}
+
+// CompleteUserExport stores the archive of an export, or the reason it could not be generated
+func (db *dbHandler) CompleteUserExport(id string, archive []byte, exportErr error) error {
+	status, message := model.ExportStatusComplete, ""
+	if exportErr != nil {
+		status, message, archive = model.ExportStatusFailed, exportErr.Error(), nil
+	}
+	sqlStatement := `
+		UPDATE user_exports
+		SET status = $2, archive = $3, error = NULLIF($4, ''), completed_at = NOW()
+		WHERE id = $1`
+	return db.execOne(errors.New("export does not exist"), sqlStatement, id, status, archive, message)
+}
+
+// GetUserArchive assembles everything stored about the user
+func (db *dbHandler) GetUserArchive(uid string) (*model.UserArchive, error) {
+	user, err := db.GetUserByUID(uid)
+	if err != nil {
+		return nil, err
+	}
+	archive := &model.UserArchive{
+		ExportedAt: time.Now().UTC(),
+		User:       user,
+		Identities: []model.Identity{{Provider: user.AuthProvider, ProviderID: user.ProviderID}},
+	}
+	preferences, err := db.GetPreferences(uid)
+	if err != nil {
+		return nil, err
+	}
+	archive.Preferences = preferences.Values
+	if archive.Sessions, err = db.getUserSessions(uid); err != nil {
+		return nil, err
+	}
+	if archive.Organizations, err = db.GetMemberships(uid); err != nil {
+		return nil, err
+	}
+	if archive.Groups, err = db.getUserGroups(uid); err != nil {
+		return nil, err
+	}
+	if archive.AuditEntries, err = db.getUserAuditEntries(uid); err != nil {
+		return nil, err
+	}
+	if archive.Logins, err = db.getUserLoginEvents(uid); err != nil {
+		return nil, err
+	}
+	return archive, nil
+}
+
+// getUserSessions returns the devices and authorization codes the user has approved for clients
+func (db *dbHandler) getUserSessions(uid string) ([]model.Session, error) {
+	sessions := make([]model.Session, 0)
+	sqlStatement := `
+		SELECT 'device', client_id, scope, status, NULL::timestamp, expires_at
+		FROM device_authorizations WHERE uid = $1
+		UNION ALL
+		SELECT 'authorization_code', client_id, scope, '', auth_time, expires_at
+		FROM oauth_authorization_codes WHERE uid = $1
+		ORDER BY 6`
+	rows, err := db.getConnection().Query(sqlStatement, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s model.Session
+		if err := rows.Scan(&s.Type,
+			&s.ClientID,
+			&s.Scope,
+			&s.Status,
+			&s.AuthTime,
+			&s.ExpiresAt,
+		); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// getUserGroups returns every group the user is a member of, in any organization
+func (db *dbHandler) getUserGroups(uid string) ([]model.Group, error) {
+	groups := make([]model.Group, 0)
+	sqlStatement := `
+		SELECT g.id, COALESCE(g.org_id::text, ''), g.name, g.description, g.roles, g.created_at
+		FROM group_members gm
+		JOIN groups g ON g.id = gm.group_id
+		WHERE gm.uid = $1
+		ORDER BY g.name`
+	rows, err := db.getConnection().Query(sqlStatement, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var g model.Group
+		if err := rows.Scan(&g.ID,
+			&g.OrgID,
+			&g.Name,
+			&g.Description,
+			&g.Roles,
+			&g.CreatedDate,
+		); err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// getUserAuditEntries returns the changes made by and to the user, oldest first.  The details of changes the user made
+// to someone else are about that user, so only the action, target and time are returned for them.
+func (db *dbHandler) getUserAuditEntries(uid string) ([]model.AuditEntry, error) {
+	entries := make([]model.AuditEntry, 0)
+	sqlStatement := `
+		SELECT id, actor_uid, action, target_uid, CASE WHEN target_uid = $1 THEN details ELSE '{}'::jsonb END, created_at
+		FROM audit_log
+		WHERE actor_uid = $1 OR target_uid = $1
+		ORDER BY created_at, id`
+	rows, err := db.getConnection().Query(sqlStatement, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e model.AuditEntry
+		if err := rows.Scan(&e.ID,
+			&e.ActorUID,
+			&e.Action,
+			&e.TargetUID,
+			&e.Details,
+			&e.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
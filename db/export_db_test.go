@@ -0,0 +1,118 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gkontos/goapi/model"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetUserArchive(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	uid := uuid.NewString()
+	orgID := uuid.NewString()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE uid = \\$1").WithArgs(uid).
+		WillReturnRows(sqlmock.NewRows([]string{"uid", "auth_provider", "provider_id", "user_name", "created_at", "last_login_at", "details", "status", "status_reason"}).
+			AddRow(uid, "google", "12345", "tom", time.Now(), time.Now(), []byte(`{"email":"tom@example.com"}`), "active", ""))
+	mock.ExpectQuery("SELECT preferences, preferences_version FROM users WHERE uid = \\$1").WithArgs(uid).
+		WillReturnRows(sqlmock.NewRows([]string{"preferences", "preferences_version"}).AddRow([]byte(`{"theme":"dark"}`), 2))
+	mock.ExpectQuery("SELECT 'device', (.+) FROM device_authorizations WHERE uid = \\$1 UNION ALL (.+) FROM oauth_authorization_codes (.+)").WithArgs(uid).
+		WillReturnRows(sqlmock.NewRows([]string{"type", "client_id", "scope", "status", "auth_time", "expires_at"}).
+			AddRow("device", "cli", "openid", "approved", nil, time.Now()))
+	mock.ExpectQuery("SELECT (.+) FROM organization_members m (.+)").WithArgs(uid).
+		WillReturnRows(sqlmock.NewRows([]string{"org_id", "name", "uid", "roles"}).
+			AddRow(orgID, "acme", uid, []byte(`["ROLE_ADMIN"]`)))
+	mock.ExpectQuery("SELECT (.+) FROM group_members gm JOIN groups g (.+) WHERE gm.uid = \\$1").WithArgs(uid).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "org_id", "name", "description", "roles", "created_at"}))
+	mock.ExpectQuery("SELECT (.+) CASE WHEN target_uid = \\$1 THEN details ELSE '{}'::jsonb END, (.+) FROM audit_log WHERE actor_uid = \\$1 OR target_uid = \\$1").WithArgs(uid).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "actor_uid", "action", "target_uid", "details", "created_at"}).
+			AddRow(1, uid, "user.update", uid, []byte(`{}`), time.Now()).
+			AddRow(2, uid, "user.export", uid, []byte(`{}`), time.Now()))
+	mock.ExpectQuery("SELECT (.+) FROM login_events WHERE uid = \\$1 ORDER BY id").WithArgs(uid).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "uid", "event_type", "provider", "ip_address", "user_agent", "outcome", "reason", "created_at"}).
+			AddRow(1, uid, model.LoginTypeLogin, "google", "192.0.2.1", "curl/8.0", model.LoginOutcomeSuccess, "", time.Now()))
+
+	archive, err := db.GetUserArchive(uid)
+	assert.NoError(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, uid, archive.User.UID)
+	assert.Equal(t, []model.Identity{{Provider: "google", ProviderID: "12345"}}, archive.Identities)
+	assert.Equal(t, model.JSONMap{"theme": "dark"}, archive.Preferences)
+	assert.Equal(t, 1, len(archive.Sessions))
+	assert.Nil(t, archive.Sessions[0].AuthTime)
+	assert.Equal(t, "acme", archive.Organizations[0].OrgName)
+	assert.Equal(t, 0, len(archive.Groups))
+	assert.Equal(t, 2, len(archive.AuditEntries))
+	assert.Equal(t, "192.0.2.1", archive.Logins[0].IPAddress)
+}
+
+func TestGetUserAuditEntriesOmitsOtherUsersDetails(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	uid := uuid.NewString()
+	other := uuid.NewString()
+	// the details of the change tom made to another user are replaced in the query
+	mock.ExpectQuery("SELECT id, actor_uid, action, target_uid, CASE WHEN target_uid = \\$1 THEN details ELSE '{}'::jsonb END, created_at FROM audit_log WHERE actor_uid = \\$1 OR target_uid = \\$1").
+		WithArgs(uid).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "actor_uid", "action", "target_uid", "details", "created_at"}).
+			AddRow(1, other, "user.update", uid, []byte(`{"email":"tom@example.com"}`), time.Now()).
+			AddRow(2, uid, "user.update", other, []byte(`{}`), time.Now()))
+
+	entries, err := db.getUserAuditEntries(uid)
+	assert.NoError(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, model.JSONMap{"email": "tom@example.com"}, entries[0].Details)
+	assert.Equal(t, other, entries[1].TargetUID)
+	assert.Empty(t, entries[1].Details)
+}
+
+func TestCompleteUserExport(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	id := uuid.NewString()
+	mock.ExpectExec("UPDATE user_exports (.+)").WithArgs(id, model.ExportStatusComplete, []byte(`{}`), "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// a failed export does not keep a partial archive
+	mock.ExpectExec("UPDATE user_exports (.+)").WithArgs(id, model.ExportStatusFailed, []byte(nil), "unable to generate export").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(t, db.CompleteUserExport(id, []byte(`{}`), nil))
+	assert.NoError(t, db.CompleteUserExport(id, []byte(`{}`), errors.New("unable to generate export")))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetPendingUserExport(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	uid := uuid.NewString()
+	mock.ExpectQuery("SELECT (.+) FROM user_exports WHERE uid = \\$1 AND CASE (.+) END = 'pending' AND expires_at > NOW\\(\\)").WithArgs(uid).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "uid", "status", "error", "created_at", "completed_at", "expires_at"}))
+
+	export, err := db.GetPendingUserExport(uid)
+	assert.NoError(t, err)
+	assert.Nil(t, export)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,194 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/gkontos/goapi/model"
+	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
+)
+
+// groups created through a tenant handler belong to the tenant, otherwise they are global.
+// $1 is always the tenant so that one statement serves both.
+const groupTenantCondition = `org_id IS NOT DISTINCT FROM NULLIF($1, '')::uuid`
+
+func (db *dbHandler) GetGroups() ([]model.Group, error) {
+	groups := make([]model.Group, 0)
+	sqlStatement := `
+		SELECT id, COALESCE(org_id::text, ''), name, description, roles, created_at FROM groups
+		WHERE ` + groupTenantCondition + `
+		ORDER BY name`
+	rows, err := db.getConnection().Query(sqlStatement, db.tenant)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var g model.Group
+		if err := rows.Scan(&g.ID,
+			&g.OrgID,
+			&g.Name,
+			&g.Description,
+			&g.Roles,
+			&g.CreatedDate,
+		); err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func (db *dbHandler) GetGroup(id string) (*model.Group, error) {
+	g := model.Group{}
+	sqlStatement := `
+		SELECT id, COALESCE(org_id::text, ''), name, description, roles, created_at FROM groups
+		WHERE ` + groupTenantCondition + ` AND id = $2`
+	err := db.getConnection().QueryRow(sqlStatement, db.tenant, id).
+		Scan(&g.ID,
+			&g.OrgID,
+			&g.Name,
+			&g.Description,
+			&g.Roles,
+			&g.CreatedDate)
+	if err == sql.ErrNoRows {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("group does not exist")}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (db *dbHandler) InsertGroup(g *model.Group) error {
+	if g.ID == "" {
+		g.ID = uuid.NewString()
+	}
+	if g.Roles == nil {
+		g.Roles = model.StringList{}
+	}
+	g.OrgID = db.tenant
+	sqlStatement := `
+		INSERT INTO groups (id, org_id, name, description, roles)
+		VALUES ($2, NULLIF($1, '')::uuid, $3, $4, $5)
+		RETURNING created_at`
+	err := db.getConnection().QueryRow(sqlStatement, db.tenant, g.ID, g.Name, g.Description, g.Roles).Scan(&g.CreatedDate)
+	if isUniqueViolation(err) {
+		return &model.ValidationError{Err: errors.New("group name already exists")}
+	}
+	return err
+}
+
+// UpdateGroup will replace the name, description and roles of the group
+func (db *dbHandler) UpdateGroup(g *model.Group) error {
+	if g.Roles == nil {
+		g.Roles = model.StringList{}
+	}
+	sqlStatement := `
+		UPDATE groups
+		SET name = $3, description = $4, roles = $5
+		WHERE ` + groupTenantCondition + ` AND id = $2
+		RETURNING COALESCE(org_id::text, ''), created_at`
+	err := db.getConnection().QueryRow(sqlStatement, db.tenant, g.ID, g.Name, g.Description, g.Roles).Scan(&g.OrgID, &g.CreatedDate)
+	if err == sql.ErrNoRows {
+		return &model.ResourceDoesNotExistError{Err: errors.New("group does not exist")}
+	}
+	if isUniqueViolation(err) {
+		return &model.ValidationError{Err: errors.New("group name already exists")}
+	}
+	return err
+}
+
+func (db *dbHandler) DeleteGroup(id string) error {
+	sqlStatement := `
+		DELETE FROM groups
+		WHERE ` + groupTenantCondition + ` AND id = $2`
+	return db.execOne(errors.New("group does not exist"), sqlStatement, db.tenant, id)
+}
+
+// GetGroupMembers returns the uids of the group's members
+func (db *dbHandler) GetGroupMembers(id string) ([]string, error) {
+	if _, err := db.GetGroup(id); err != nil {
+		return nil, err
+	}
+	uids := make([]string, 0)
+	sqlStatement := `
+		SELECT uid FROM group_members
+		WHERE group_id = $1
+		ORDER BY created_at, uid`
+	rows, err := db.getConnection().Query(sqlStatement, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uid string
+		if err := rows.Scan(&uid); err != nil {
+			return nil, err
+		}
+		uids = append(uids, uid)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return uids, nil
+}
+
+// AddGroupMember will add the user to the group if they are not already a member
+func (db *dbHandler) AddGroupMember(id string, uid string) error {
+	if _, err := db.GetGroup(id); err != nil {
+		return err
+	}
+	sqlStatement := `
+		INSERT INTO group_members (group_id, uid)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING`
+	_, err := db.getConnection().Exec(sqlStatement, id, uid)
+	return err
+}
+
+func (db *dbHandler) RemoveGroupMember(id string, uid string) error {
+	sqlStatement := `
+		DELETE FROM group_members gm
+		USING groups g
+		WHERE g.id = gm.group_id AND g.` + groupTenantCondition + ` AND gm.group_id = $2 AND gm.uid = $3`
+	return db.execOne(errors.New("group member does not exist"), sqlStatement, db.tenant, id, uid)
+}
+
+// GetGroupRoles returns the roles the user inherits from global groups and the tenant's groups
+func (db *dbHandler) GetGroupRoles(uid string) ([]string, error) {
+	var roles model.StringList
+	sqlStatement := `
+		SELECT COALESCE(jsonb_agg(DISTINCT r.role), '[]'::jsonb)
+		FROM group_members gm
+		JOIN groups g ON g.id = gm.group_id
+		CROSS JOIN jsonb_array_elements_text(g.roles) AS r(role)
+		WHERE gm.uid = $1 AND (g.org_id IS NULL OR g.org_id = NULLIF($2, '')::uuid)`
+	if err := db.getConnection().QueryRow(sqlStatement, uid, db.tenant).Scan(&roles); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// execOne runs a statement which must change one row, otherwise notFound is returned as a ResourceDoesNotExistError
+func (db *dbHandler) execOne(notFound error, sqlStatement string, args ...interface{}) error {
+	result, err := db.getConnection().Exec(sqlStatement, args...)
+	if err != nil {
+		return err
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		return err
+	} else if count == 0 {
+		return &model.ResourceDoesNotExistError{Err: notFound}
+	}
+	return nil
+}
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
@@ -0,0 +1,41 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gkontos/goapi/model"
+	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetGroupRoles(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	orgID := uuid.NewString()
+	uid := uuid.NewString()
+	mock.ExpectQuery("SELECT (.+) FROM group_members gm (.+)").
+		WithArgs(uid, orgID).
+		WillReturnRows(sqlmock.NewRows([]string{"roles"}).AddRow([]byte(`["ROLE_ADMIN","ROLE_AUDITOR"]`)))
+
+	roles, err := db.WithTenant(orgID).GetGroupRoles(uid)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ROLE_ADMIN", "ROLE_AUDITOR"}, roles)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestInsertGroupNameExists(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	mock.ExpectQuery("INSERT INTO groups (.+)").WillReturnError(&pgconn.PgError{Code: "23505"})
+
+	err := db.InsertGroup(&model.Group{Name: "support"})
+	assert.EqualError(t, err, "group name already exists")
+	assert.IsType(t, &model.ValidationError{}, err)
+}
@@ -0,0 +1,99 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/gkontos/goapi/model"
+	"github.com/google/uuid"
+)
+
+// InsertInvitation stores a new invitation.  When an email has several pending invitations the latest is accepted.
+func (db *dbHandler) InsertInvitation(i *model.Invitation) error {
+	if i.ID == "" {
+		i.ID = uuid.NewString()
+	}
+	if i.Roles == nil {
+		i.Roles = model.StringList{}
+	}
+	sqlStatement := `
+		INSERT INTO invitations (id, email, roles, invited_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING created_at`
+	return db.getConnection().QueryRow(sqlStatement, i.ID, i.Email, i.Roles, i.InvitedBy, i.ExpiresAt).Scan(&i.CreatedDate)
+}
+
+// GetInvitations returns every invitation, newest first
+func (db *dbHandler) GetInvitations() ([]model.Invitation, error) {
+	invitations := make([]model.Invitation, 0)
+	sqlStatement := `
+		SELECT id, email, roles, invited_by, created_at, expires_at, accepted_at, COALESCE(accepted_uid::text, '')
+		FROM invitations
+		ORDER BY created_at DESC, id`
+	rows, err := db.getConnection().Query(sqlStatement)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var i model.Invitation
+		if err := rows.Scan(&i.ID,
+			&i.Email,
+			&i.Roles,
+			&i.InvitedBy,
+			&i.CreatedDate,
+			&i.ExpiresAt,
+			&i.AcceptedAt,
+			&i.AcceptedUID,
+		); err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return invitations, nil
+}
+
+// DeleteInvitation withdraws an invitation which has not been accepted
+func (db *dbHandler) DeleteInvitation(id string) error {
+	sqlStatement := `
+		DELETE FROM invitations
+		WHERE id = $1 AND accepted_at IS NULL`
+	return db.execOne(errors.New("invitation does not exist or has been accepted"), sqlStatement, id)
+}
+
+// GetPendingInvitation returns the latest invitation for the email which has not been accepted or expired, or nil
+// when there is none
+func (db *dbHandler) GetPendingInvitation(email string) (*model.Invitation, error) {
+	i := model.Invitation{}
+	sqlStatement := `
+		SELECT id, email, roles, invited_by, created_at, expires_at FROM invitations
+		WHERE email = $1 AND accepted_at IS NULL AND expires_at > NOW()
+		ORDER BY created_at DESC
+		LIMIT 1`
+	err := db.getConnection().QueryRow(sqlStatement, email).
+		Scan(&i.ID,
+			&i.Email,
+			&i.Roles,
+			&i.InvitedBy,
+			&i.CreatedDate,
+			&i.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &i, nil
+}
+
+// AcceptInvitation consumes the invitation for the user created with its roles
+func (db *dbHandler) AcceptInvitation(id string, uid string) error {
+	sqlStatement := `
+		UPDATE invitations
+		SET accepted_at = NOW(), accepted_uid = $2
+		WHERE id = $1 AND accepted_at IS NULL`
+	return db.execOne(errors.New("invitation does not exist or has been accepted"), sqlStatement, id, uid)
+}
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"strconv"
+
+	"github.com/gkontos/goapi/model"
+)
+
+// InsertLoginEvent records a login or refresh.  A successful login also becomes the user's last login.
+func (db *dbHandler) InsertLoginEvent(e *model.LoginEvent) error {
+	sqlStatement := `
+		WITH event AS (
+			INSERT INTO login_events (uid, event_type, provider, ip_address, user_agent, outcome, reason)
+			VALUES (NULLIF($1, '')::uuid, $2, $3, $4, $5, $6, $7)
+			RETURNING id, uid, event_type, outcome, created_at
+		), last_login AS (
+			UPDATE users u SET last_login_at = event.created_at
+			FROM event
+			WHERE u.uid = event.uid AND event.event_type = 'login' AND event.outcome = 'success'
+		)
+		SELECT id, created_at FROM event`
+	return db.getConnection().QueryRow(sqlStatement, e.UID, e.Type, e.Provider, e.IPAddress, e.UserAgent, e.Outcome, e.Reason).
+		Scan(&e.ID, &e.CreatedAt)
+}
+
+// GetLoginEvents returns a page of the user's login events, newest first
+func (db *dbHandler) GetLoginEvents(query model.LoginEventQuery) (*model.LoginEventPage, error) {
+	if query.Limit <= 0 || query.Limit > model.MaxUserPageSize {
+		query.Limit = model.DefaultUserPageSize
+	}
+	// one more row than the page tells us if there is a next page
+	events, err := db.queryLoginEvents(`
+		SELECT id, uid::text, event_type, provider, ip_address, user_agent, outcome, reason, created_at
+		FROM login_events
+		WHERE uid = $1 AND ($2 = 0 OR id < $2)
+		ORDER BY id DESC
+		LIMIT $3`, query.UID, query.Before, query.Limit+1)
+	if err != nil {
+		return nil, err
+	}
+	page := &model.LoginEventPage{Logins: events}
+	if len(page.Logins) > query.Limit {
+		page.Logins = page.Logins[:query.Limit]
+		page.NextCursor = strconv.FormatInt(page.Logins[query.Limit-1].ID, 10)
+	}
+	return page, nil
+}
+
+// getUserLoginEvents returns every login event of the user, oldest first
+func (db *dbHandler) getUserLoginEvents(uid string) ([]model.LoginEvent, error) {
+	return db.queryLoginEvents(`
+		SELECT id, uid::text, event_type, provider, ip_address, user_agent, outcome, reason, created_at
+		FROM login_events
+		WHERE uid = $1
+		ORDER BY id`, uid)
+}
+
+func (db *dbHandler) queryLoginEvents(sqlStatement string, args ...interface{}) ([]model.LoginEvent, error) {
+	events := make([]model.LoginEvent, 0)
+	rows, err := db.getConnection().Query(sqlStatement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e model.LoginEvent
+		if err := rows.Scan(&e.ID,
+			&e.UID,
+			&e.Type,
+			&e.Provider,
+			&e.IPAddress,
+			&e.UserAgent,
+			&e.Outcome,
+			&e.Reason,
+			&e.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
@@ -0,0 +1,67 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gkontos/goapi/model"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInsertLoginEvent(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	uid := uuid.NewString()
+	now := time.Now()
+	// a successful login becomes the user's last login
+	mock.ExpectQuery("WITH event AS \\( INSERT INTO login_events (.+) \\), last_login AS \\( UPDATE users u SET last_login_at = event.created_at (.+) event.outcome = 'success' \\) SELECT id, created_at FROM event").
+		WithArgs(uid, model.LoginTypeLogin, "google", "192.0.2.1", "curl/8.0", model.LoginOutcomeSuccess, "").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(7, now))
+
+	event := &model.LoginEvent{UID: uid, Type: model.LoginTypeLogin, Provider: "google", IPAddress: "192.0.2.1",
+		UserAgent: "curl/8.0", Outcome: model.LoginOutcomeSuccess}
+	assert.NoError(t, db.InsertLoginEvent(event))
+	assert.Equal(t, int64(7), event.ID)
+	assert.Equal(t, now, event.CreatedAt)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetLoginEvents(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	uid := uuid.NewString()
+	columns := []string{"id", "uid", "event_type", "provider", "ip_address", "user_agent", "outcome", "reason", "created_at"}
+	// one more row than the limit means there is a next page
+	mock.ExpectQuery("SELECT (.+) FROM login_events WHERE uid = \\$1 AND \\(\\$2 = 0 OR id < \\$2\\) ORDER BY id DESC LIMIT \\$3").
+		WithArgs(uid, 0, 3).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(9, uid, model.LoginTypeRefresh, "google", "192.0.2.1", "", model.LoginOutcomeSuccess, "", time.Now()).
+			AddRow(8, uid, model.LoginTypeLogin, "google", "192.0.2.1", "", model.LoginOutcomeFailure, "user is suspended", time.Now()).
+			AddRow(7, uid, model.LoginTypeLogin, "google", "192.0.2.1", "", model.LoginOutcomeSuccess, "", time.Now()))
+	mock.ExpectQuery("SELECT (.+) FROM login_events (.+)").
+		WithArgs(uid, 8, 3).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(7, uid, model.LoginTypeLogin, "google", "192.0.2.1", "", model.LoginOutcomeSuccess, "", time.Now()))
+
+	page, err := db.GetLoginEvents(model.LoginEventQuery{UID: uid, Limit: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(page.Logins))
+	assert.Equal(t, "user is suspended", page.Logins[1].Reason)
+	assert.Equal(t, "8", page.NextCursor)
+
+	page, err = db.GetLoginEvents(model.LoginEventQuery{UID: uid, Limit: 2, Before: 8})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(page.Logins))
+	assert.Equal(t, "", page.NextCursor)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
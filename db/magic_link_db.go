@@ -0,0 +1,38 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/gkontos/goapi/model"
+)
+
+func (db *dbHandler) InsertMagicLink(l *model.MagicLink) error {
+	sqlStatement := `
+		INSERT INTO magic_links (id, email, expires_at)
+		VALUES ($1, $2, $3)`
+	_, err := db.getConnection().Exec(sqlStatement, l.ID, l.Email, l.ExpiresAt)
+	return err
+}
+
+// ConsumeMagicLink will mark the link as used.  A link which has expired or has already been used can not be consumed.
+func (db *dbHandler) ConsumeMagicLink(id string) (*model.MagicLink, error) {
+	l := model.MagicLink{}
+	sqlStatement := `
+		UPDATE magic_links
+		SET consumed_at = NOW()
+		WHERE id = $1 AND consumed_at IS NULL AND expires_at > NOW()
+		RETURNING id, email, expires_at, consumed_at`
+	err := db.getConnection().QueryRow(sqlStatement, id).
+		Scan(&l.ID,
+			&l.Email,
+			&l.ExpiresAt,
+			&l.ConsumedAt)
+	if err == sql.ErrNoRows {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("magic link does not exist or has already been used")}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
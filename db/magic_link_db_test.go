@@ -0,0 +1,52 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gkontos/goapi/model"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsumeMagicLink(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	id := uuid.NewString()
+	rows := sqlmock.NewRows([]string{"id", "email", "expires_at", "consumed_at"}).
+		AddRow(id, "tom@example.com", time.Now().Add(time.Minute), time.Now())
+
+	mock.ExpectQuery("UPDATE magic_links (.+) RETURNING (.+)").WithArgs(id).WillReturnRows(rows)
+
+	link, err := db.ConsumeMagicLink(id)
+	if err != nil {
+		t.Errorf("error '%s' was not expected, while consuming magic link", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, "tom@example.com", link.Email)
+	assert.NotNil(t, link.ConsumedAt)
+}
+
+func TestConsumeMagicLinkAlreadyUsed(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	id := uuid.NewString()
+	rows := sqlmock.NewRows([]string{"id", "email", "expires_at", "consumed_at"})
+
+	mock.ExpectQuery("UPDATE magic_links (.+) RETURNING (.+)").WithArgs(id).WillReturnRows(rows)
+
+	_, err := db.ConsumeMagicLink(id)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.IsType(t, &model.ResourceDoesNotExistError{}, err)
+}
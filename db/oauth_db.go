@@ -0,0 +1,67 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/gkontos/goapi/model"
+)
+
+func (db *dbHandler) GetOAuthClient(clientID string) (*model.OAuthClient, error) {
+
+	c := model.OAuthClient{}
+	sqlStatement := `
+		SELECT client_id, secret_hash, name, redirect_uris, confidential FROM oauth_clients
+		WHERE client_id = $1`
+	err := db.getConnection().QueryRow(sqlStatement, clientID).
+		Scan(&c.ClientID,
+			&c.SecretHash,
+			&c.Name,
+			&c.RedirectURIs,
+			&c.Confidential)
+	if err == sql.ErrNoRows {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("client does not exist")}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (db *dbHandler) InsertAuthorizationCode(c *model.AuthorizationCode) error {
+	sqlStatement := `
+		INSERT INTO oauth_authorization_codes (code_hash, client_id, uid, redirect_uri, scope, nonce,
+			code_challenge, code_challenge_method, auth_time, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+	_, err := db.getConnection().Exec(sqlStatement, c.CodeHash, c.ClientID, c.UID, c.RedirectURI, c.Scope, c.Nonce,
+		c.CodeChallenge, c.CodeChallengeMethod, c.AuthTime, c.ExpiresAt)
+	return err
+}
+
+// ConsumeAuthorizationCode will remove and return the code.  A code which has expired can not be consumed.
+func (db *dbHandler) ConsumeAuthorizationCode(codeHash string) (*model.AuthorizationCode, error) {
+
+	c := model.AuthorizationCode{}
+	sqlStatement := `
+		DELETE FROM oauth_authorization_codes
+		WHERE code_hash = $1 AND expires_at > NOW()
+		RETURNING code_hash, client_id, uid, redirect_uri, scope, nonce, code_challenge, code_challenge_method, auth_time, expires_at`
+	err := db.getConnection().QueryRow(sqlStatement, codeHash).
+		Scan(&c.CodeHash,
+			&c.ClientID,
+			&c.UID,
+			&c.RedirectURI,
+			&c.Scope,
+			&c.Nonce,
+			&c.CodeChallenge,
+			&c.CodeChallengeMethod,
+			&c.AuthTime,
+			&c.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("authorization code does not exist or has expired")}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
@@ -0,0 +1,74 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gkontos/goapi/model"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetOAuthClient(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	rows := sqlmock.NewRows([]string{"client_id", "secret_hash", "name", "redirect_uris", "confidential"}).
+		AddRow("someclient", "somehash", "some app", []byte(`["https://app.example.com/cb"]`), true)
+
+	mock.ExpectQuery("SELECT (.+) FROM oauth_clients (.+)").WithArgs("someclient").WillReturnRows(rows)
+
+	client, err := db.GetOAuthClient("someclient")
+	if err != nil {
+		t.Errorf("error '%s' was not expected, while getting client", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.True(t, client.AllowsRedirect("https://app.example.com/cb"))
+	assert.False(t, client.AllowsRedirect("https://evil.example.com/cb"))
+}
+
+func TestGetOAuthClientNotFound(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	rows := sqlmock.NewRows([]string{"client_id", "secret_hash", "name", "redirect_uris", "confidential"})
+	mock.ExpectQuery("SELECT (.+) FROM oauth_clients (.+)").WithArgs("unknown").WillReturnRows(rows)
+
+	_, err := db.GetOAuthClient("unknown")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.IsType(t, &model.ResourceDoesNotExistError{}, err)
+}
+
+func TestConsumeAuthorizationCode(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	uid := uuid.NewString()
+	rows := sqlmock.NewRows([]string{"code_hash", "client_id", "uid", "redirect_uri", "scope", "nonce",
+		"code_challenge", "code_challenge_method", "auth_time", "expires_at"}).
+		AddRow("somehash", "someclient", uid, "https://app.example.com/cb", "openid", "somenonce",
+			"somechallenge", "S256", time.Now(), time.Now().Add(time.Minute))
+
+	mock.ExpectQuery("DELETE FROM oauth_authorization_codes (.+) RETURNING (.+)").WithArgs("somehash").WillReturnRows(rows)
+
+	code, err := db.ConsumeAuthorizationCode("somehash")
+	if err != nil {
+		t.Errorf("error '%s' was not expected, while consuming code", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, uid, code.UID)
+	assert.Equal(t, "S256", code.CodeChallengeMethod)
+}
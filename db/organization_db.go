@@ -0,0 +1,70 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/gkontos/goapi/model"
+	"github.com/google/uuid"
+)
+
+func (db *dbHandler) InsertOrganization(o *model.Organization) error {
+	if o.ID == "" {
+		o.ID = uuid.NewString()
+	}
+	sqlStatement := `
+		INSERT INTO organizations (id, name)
+		VALUES ($1, $2)
+		RETURNING created_at`
+	return db.getConnection().QueryRow(sqlStatement, o.ID, o.Name).Scan(&o.CreatedDate)
+}
+
+// GetMemberships returns the user's organizations in the order they joined
+func (db *dbHandler) GetMemberships(uid string) ([]model.Membership, error) {
+	memberships := make([]model.Membership, 0)
+	sqlStatement := `
+		SELECT m.org_id, o.name, m.uid, m.roles
+		FROM organization_members m
+		JOIN organizations o ON o.id = m.org_id
+		WHERE m.uid = $1
+		ORDER BY m.created_at, m.org_id`
+	rows, err := db.getConnection().Query(sqlStatement, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m model.Membership
+		if err := rows.Scan(&m.OrgID,
+			&m.OrgName,
+			&m.UID,
+			&m.Roles,
+		); err != nil {
+			return nil, err
+		}
+		memberships = append(memberships, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return memberships, nil
+}
+
+// UpsertMembership adds the user to the organization or replaces their organization roles
+func (db *dbHandler) UpsertMembership(m *model.Membership) error {
+	if m.Roles == nil {
+		m.Roles = model.StringList{}
+	}
+	sqlStatement := `
+		INSERT INTO organization_members (org_id, uid, roles)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (org_id, uid) DO UPDATE SET roles = EXCLUDED.roles`
+	_, err := db.getConnection().Exec(sqlStatement, m.OrgID, m.UID, m.Roles)
+	return err
+}
+
+func (db *dbHandler) DeleteMembership(orgID string, uid string) error {
+	sqlStatement := `
+		DELETE FROM organization_members
+		WHERE org_id = $1 AND uid = $2`
+	return db.execOne(errors.New("membership does not exist"), sqlStatement, orgID, uid)
+}
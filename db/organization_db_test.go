@@ -0,0 +1,89 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gkontos/goapi/model"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetUsersWithTenant(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	orgID := uuid.NewString()
+	rows := sqlmock.NewRows([]string{"uid", "user_name", "created_at", "updated_at", "details", "status", "status_reason"}).
+		AddRow(uuid.NewString(), "sergei", time.Now(), time.Now(), []byte(`{"email":"sergei","roles":["ROLE_ADMIN"]}`), "active", "")
+
+	mock.ExpectQuery("SELECT (.+) FROM users u JOIN organization_members m (.+) WHERE m.org_id = \\$1 AND m.roles @> jsonb_build_array\\(\\$2::text\\) (.+)").
+		WithArgs(orgID, "ROLE_ADMIN", model.DefaultUserPageSize+1).WillReturnRows(rows)
+
+	page, err := db.WithTenant(orgID).GetUsers(model.UserQuery{Role: "ROLE_ADMIN"})
+	if err != nil {
+		t.Errorf("error '%s' was not expected, while getting users", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, 1, len(page.Users))
+	assert.Equal(t, []string{"ROLE_ADMIN"}, page.Users[0].UserDetails.Roles)
+}
+
+func TestAddUserRoleWithTenant(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	orgID := uuid.NewString()
+	uid := uuid.NewString()
+	mock.ExpectQuery("UPDATE organization_members (.+) RETURNING roles").
+		WithArgs(uid, "ROLE_ADMIN", orgID).
+		WillReturnRows(sqlmock.NewRows([]string{"roles"}).AddRow([]byte(`["ROLE_ADMIN"]`)))
+
+	roles, err := db.WithTenant(orgID).AddUserRole(uid, "ROLE_ADMIN")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ROLE_ADMIN"}, roles)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetMemberships(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	uid := uuid.NewString()
+	rows := sqlmock.NewRows([]string{"org_id", "name", "uid", "roles"}).
+		AddRow(uuid.NewString(), "acme", uid, []byte(`["ROLE_ADMIN"]`)).
+		AddRow(uuid.NewString(), "initech", uid, []byte(`[]`))
+
+	mock.ExpectQuery("SELECT (.+) FROM organization_members m (.+)").WithArgs(uid).WillReturnRows(rows)
+
+	var memberships []model.Membership
+	var err error
+	if memberships, err = db.GetMemberships(uid); err != nil {
+		t.Errorf("error '%s' was not expected, while getting memberships", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, 2, len(memberships))
+	assert.Equal(t, "acme", memberships[0].OrgName)
+}
+
+func TestDeleteMembershipNotFound(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	mock.ExpectExec("DELETE FROM organization_members (.+)").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	err := db.DeleteMembership(uuid.NewString(), uuid.NewString())
+	assert.IsType(t, &model.ResourceDoesNotExistError{}, err)
+}
@@ -0,0 +1,48 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/gkontos/goapi/model"
+)
+
+// GetPreferences returns the user's preferences and their version
+func (db *dbHandler) GetPreferences(uid string) (*model.Preferences, error) {
+	p := model.Preferences{}
+	sqlStatement := `
+		SELECT preferences, preferences_version FROM users
+		WHERE uid = $1`
+	err := db.getConnection().QueryRow(sqlStatement, uid).Scan(&p.Values, &p.Version)
+	if err == sql.ErrNoRows {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("user does not exist")}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// UpdatePreferences replaces the user's preferences when they are still at version and returns the new version
+func (db *dbHandler) UpdatePreferences(uid string, values model.JSONMap, version int) (*model.Preferences, error) {
+	p := model.Preferences{Values: values}
+	sqlStatement := `
+		UPDATE users
+		SET preferences = $2, preferences_version = preferences_version + 1
+		WHERE uid = $1 AND preferences_version = $3
+		RETURNING preferences_version`
+	err := db.getConnection().QueryRow(sqlStatement, uid, values, version).Scan(&p.Version)
+	if err == sql.ErrNoRows {
+		// the user does not exist or the preferences have changed
+		current, err := db.GetPreferences(uid)
+		if err != nil {
+			return nil, err
+		}
+		return nil, &model.VersionConflictError{Err: fmt.Errorf("preferences are at version %d", current.Version)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
@@ -0,0 +1,48 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gkontos/goapi/model"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdatePreferences(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	uid := uuid.NewString()
+	values := model.JSONMap{"theme": "dark"}
+	mock.ExpectQuery("UPDATE users SET preferences = \\$2, preferences_version = preferences_version \\+ 1 WHERE uid = \\$1 AND preferences_version = \\$3").
+		WithArgs(uid, sqlmock.AnyArg(), 2).
+		WillReturnRows(sqlmock.NewRows([]string{"preferences_version"}).AddRow(3))
+
+	preferences, err := db.UpdatePreferences(uid, values, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, &model.Preferences{Version: 3, Values: values}, preferences)
+
+	// the preferences were changed since version 2
+	mock.ExpectQuery("UPDATE users (.+)").WithArgs(uid, sqlmock.AnyArg(), 2).
+		WillReturnRows(sqlmock.NewRows([]string{"preferences_version"}))
+	mock.ExpectQuery("SELECT preferences, preferences_version FROM users (.+)").WithArgs(uid).
+		WillReturnRows(sqlmock.NewRows([]string{"preferences", "preferences_version"}).AddRow([]byte(`{"theme":"light"}`), 4))
+
+	_, err = db.UpdatePreferences(uid, values, 2)
+	assert.EqualError(t, err, "preferences are at version 4")
+	assert.IsType(t, &model.VersionConflictError{}, err)
+
+	// the user does not exist
+	mock.ExpectQuery("UPDATE users (.+)").WithArgs(uid, sqlmock.AnyArg(), 2).
+		WillReturnRows(sqlmock.NewRows([]string{"preferences_version"}))
+	mock.ExpectQuery("SELECT preferences, preferences_version FROM users (.+)").WithArgs(uid).
+		WillReturnRows(sqlmock.NewRows([]string{"preferences", "preferences_version"}))
+
+	_, err = db.UpdatePreferences(uid, values, 2)
+	assert.IsType(t, &model.ResourceDoesNotExistError{}, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
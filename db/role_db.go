@@ -0,0 +1,118 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/gkontos/goapi/model"
+)
+
+// GetRoles returns every role with the permissions mapped to it and the roles it directly inherits
+func (db *dbHandler) GetRoles() ([]model.Role, error) {
+	roles := make([]model.Role, 0)
+	sqlStatement := `
+		SELECT r.name, r.description,
+			COALESCE(jsonb_agg(rp.permission_name) FILTER (WHERE rp.permission_name IS NOT NULL), '[]'::jsonb),
+			COALESCE((SELECT jsonb_agg(ri.inherits_role) FROM role_inherits ri WHERE ri.role_name = r.name), '[]'::jsonb)
+		FROM roles r
+		LEFT JOIN role_permissions rp ON rp.role_name = r.name
+		GROUP BY r.name, r.description`
+	rows, err := db.getConnection().Query(sqlStatement)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var role model.Role
+		if err := rows.Scan(&role.Name,
+			&role.Description,
+			&role.Permissions,
+			&role.Inherits,
+		); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// GetPermissions returns the name of every defined permission, including wildcards
+func (db *dbHandler) GetPermissions() ([]string, error) {
+	permissions := make([]string, 0)
+	sqlStatement := `
+		SELECT name FROM permissions
+		ORDER BY name`
+	rows, err := db.getConnection().Query(sqlStatement)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
+
+// AddUserRole will add the role to the user if they do not already have it and return the updated roles
+func (db *dbHandler) AddUserRole(uid string, role string) ([]string, error) {
+	if db.tenant != "" {
+		sqlStatement := `
+			UPDATE organization_members
+			SET roles = (
+				SELECT COALESCE(jsonb_agg(DISTINCT r.role), '[]'::jsonb)
+				FROM jsonb_array_elements_text(roles || to_jsonb($2::text)) AS r(role)
+			)
+			WHERE uid = $1 AND org_id = $3
+			RETURNING roles`
+		return db.updateUserRoles(sqlStatement, uid, role, db.tenant)
+	}
+	sqlStatement := `
+		UPDATE users
+		SET details = jsonb_set(details, '{roles}', (
+			SELECT COALESCE(jsonb_agg(DISTINCT r.role), '[]'::jsonb)
+			FROM jsonb_array_elements_text(COALESCE(details->'roles', '[]'::jsonb) || to_jsonb($2::text)) AS r(role)
+		)), updated_at = NOW()
+		WHERE uid = $1
+		RETURNING details->'roles'`
+	return db.updateUserRoles(sqlStatement, uid, role)
+}
+
+// RemoveUserRole will remove the role from the user and return the updated roles
+func (db *dbHandler) RemoveUserRole(uid string, role string) ([]string, error) {
+	if db.tenant != "" {
+		sqlStatement := `
+			UPDATE organization_members
+			SET roles = roles - $2::text
+			WHERE uid = $1 AND org_id = $3
+			RETURNING roles`
+		return db.updateUserRoles(sqlStatement, uid, role, db.tenant)
+	}
+	sqlStatement := `
+		UPDATE users
+		SET details = jsonb_set(details, '{roles}', COALESCE(details->'roles', '[]'::jsonb) - $2::text), updated_at = NOW()
+		WHERE uid = $1
+		RETURNING details->'roles'`
+	return db.updateUserRoles(sqlStatement, uid, role)
+}
+
+func (db *dbHandler) updateUserRoles(sqlStatement string, args ...interface{}) ([]string, error) {
+	var roles model.StringList
+	err := db.getConnection().QueryRow(sqlStatement, args...).Scan(&roles)
+	if err == sql.ErrNoRows {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("user does not exist")}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
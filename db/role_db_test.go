@@ -0,0 +1,72 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gkontos/goapi/model"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetRoles(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	rows := sqlmock.NewRows([]string{"name", "description", "permissions", "inherits"}).
+		AddRow("ROLE_ADMIN", "administrators", []byte(`["users:*","groups:*","organizations:*"]`), []byte(`["ROLE_USER"]`)).
+		AddRow("ROLE_AUDITOR", "no permissions yet", []byte(`[]`), []byte(`[]`))
+
+	mock.ExpectQuery("SELECT (.+) FROM roles (.+)").WithArgs().WillReturnRows(rows)
+
+	var roles []model.Role
+	var err error
+	if roles, err = db.GetRoles(); err != nil {
+		t.Errorf("error '%s' was not expected, while getting roles", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, 2, len(roles))
+	assert.Equal(t, 3, len(roles[0].Permissions))
+	assert.Equal(t, 0, len(roles[1].Permissions))
+	assert.Equal(t, []string{"ROLE_USER"}, []string(roles[0].Inherits))
+}
+
+func TestAddUserRole(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	uid := uuid.NewString()
+	rows := sqlmock.NewRows([]string{"roles"}).AddRow([]byte(`["ROLE_USER","ROLE_ADMIN"]`))
+	mock.ExpectQuery("UPDATE users (.+) RETURNING (.+)").WithArgs(uid, "ROLE_ADMIN").WillReturnRows(rows)
+
+	roles, err := db.AddUserRole(uid, "ROLE_ADMIN")
+	if err != nil {
+		t.Errorf("error '%s' was not expected, while adding role", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, []string{"ROLE_USER", "ROLE_ADMIN"}, roles)
+}
+
+func TestRemoveUserRoleMissingUser(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	uid := uuid.NewString()
+	mock.ExpectQuery("UPDATE users (.+) RETURNING (.+)").WithArgs(uid, "ROLE_ADMIN").WillReturnRows(sqlmock.NewRows([]string{"roles"}))
+
+	_, err := db.RemoveUserRole(uid, "ROLE_ADMIN")
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.IsType(t, &model.ResourceDoesNotExistError{}, err)
+}
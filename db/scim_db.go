@@ -0,0 +1,111 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gkontos/goapi/model"
+)
+
+// GetProvisioningClient returns the SCIM client with the bearer token hash
+func (db *dbHandler) GetProvisioningClient(tokenHash string) (*model.ProvisioningClient, error) {
+	c := model.ProvisioningClient{}
+	sqlStatement := `
+		SELECT id, name, token_hash, created_at FROM scim_clients
+		WHERE token_hash = $1`
+	err := db.getConnection().QueryRow(sqlStatement, tokenHash).Scan(&c.ID, &c.Name, &c.TokenHash, &c.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("provisioning client does not exist")}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// GetProvisionedUsers returns a page of the users which have not been deleted, oldest first, and the number of users
+// the query selects
+func (db *dbHandler) GetProvisionedUsers(query model.ProvisionedUserQuery) (*model.ProvisionedUserPage, error) {
+	page := &model.ProvisionedUserPage{Users: make([]model.ProvisionedUser, 0)}
+	where := []string{"status <> 'deleted'"}
+	args := []interface{}{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if query.UID != "" {
+		where = append(where, "uid::text = "+arg(query.UID))
+	}
+	if query.UserName != "" {
+		where = append(where, "lower(user_name) = lower("+arg(query.UserName)+")")
+	}
+	if query.ExternalID != "" {
+		where = append(where, "external_id = "+arg(query.ExternalID))
+	}
+	if query.Email != "" {
+		where = append(where, "lower(details->>'email') = lower("+arg(query.Email)+")")
+	}
+	if query.Active != nil {
+		if *query.Active {
+			where = append(where, "status = 'active'")
+		} else {
+			where = append(where, "status <> 'active'")
+		}
+	}
+	condition := strings.Join(where, " AND ")
+
+	if err := db.getConnection().QueryRow(`SELECT COUNT(*) FROM users WHERE `+condition, args...).Scan(&page.Total); err != nil {
+		return nil, err
+	}
+	if query.Limit <= 0 || query.Offset >= page.Total {
+		return page, nil
+	}
+
+	sqlStatement := `
+		SELECT uid, auth_provider, provider_id, user_name, created_at, last_login_at, details,
+			status, COALESCE(status_reason, ''), COALESCE(external_id, '') FROM users
+		WHERE ` + condition + `
+		ORDER BY created_at, uid
+		LIMIT ` + arg(query.Limit) + ` OFFSET ` + arg(query.Offset)
+	rows, err := db.getConnection().Query(sqlStatement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u model.ProvisionedUser
+		if err := rows.Scan(&u.UID,
+			&u.AuthProvider,
+			&u.ProviderID,
+			&u.UserName,
+			&u.CreatedDate,
+			&u.LastLogin,
+			&u.UserDetails,
+			&u.Status,
+			&u.StatusReason,
+			&u.ExternalID,
+		); err != nil {
+			return nil, err
+		}
+		page.Users = append(page.Users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// SetExternalID records the id the provisioning client knows the user by, an empty id removes it
+func (db *dbHandler) SetExternalID(uid string, externalID string) error {
+	sqlStatement := `
+		UPDATE users
+		SET external_id = NULLIF($2, ''), updated_at = NOW()
+		WHERE uid = $1`
+	err := db.execOne(errors.New("user does not exist"), sqlStatement, uid, externalID)
+	if isUniqueViolation(err) {
+		return &model.ValidationError{Err: fmt.Errorf("another user has the external id %s", externalID)}
+	}
+	return err
+}
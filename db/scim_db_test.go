@@ -0,0 +1,77 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gkontos/goapi/model"
+	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetProvisioningClient(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	mock.ExpectQuery("SELECT (.+) FROM scim_clients WHERE token_hash = (.+)").
+		WithArgs("somehash").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	_, err := db.GetProvisioningClient("somehash")
+	assert.IsType(t, &model.ResourceDoesNotExistError{}, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetProvisionedUsers(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	uid := uuid.NewString()
+	active := true
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM users WHERE status <> 'deleted' AND lower\(user_name\) = lower\(\$1\) AND external_id = \$2 AND status = 'active'`).
+		WithArgs("tom", "e-tom").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery("SELECT uid, (.+) FROM users WHERE (.+) ORDER BY created_at, uid LIMIT \\$3 OFFSET \\$4").
+		WithArgs("tom", "e-tom", 10, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"uid", "auth_provider", "provider_id", "user_name", "created_at", "last_login_at", "details", "status", "status_reason", "external_id"}).
+			AddRow(uid, "email", "tom@example.com", "tom", time.Now(), nil, []byte(`{"email":"tom@example.com","roles":["ROLE_USER"]}`), "active", "", "e-tom"))
+
+	page, err := db.GetProvisionedUsers(model.ProvisionedUserQuery{UserName: "tom", ExternalID: "e-tom", Active: &active, Limit: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, page.Total)
+	if assert.Equal(t, 1, len(page.Users)) {
+		assert.Equal(t, uid, page.Users[0].UID)
+		assert.Equal(t, "e-tom", page.Users[0].ExternalID)
+		assert.Equal(t, "tom@example.com", page.Users[0].UserDetails.Email)
+	}
+
+	// the page is past the end
+	mock.ExpectQuery("SELECT COUNT(.+) FROM users (.+)").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	page, err = db.GetProvisionedUsers(model.ProvisionedUserQuery{Offset: 1, Limit: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, page.Total)
+	assert.Equal(t, 0, len(page.Users))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSetExternalIDExists(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	uid := uuid.NewString()
+	mock.ExpectExec("UPDATE users SET external_id = NULLIF(.+)").
+		WithArgs(uid, "e-tom").
+		WillReturnError(&pgconn.PgError{Code: "23505"})
+
+	err := db.SetExternalID(uid, "e-tom")
+	assert.EqualError(t, err, "another user has the external id e-tom")
+	assert.IsType(t, &model.ValidationError{}, err)
+}
@@ -2,6 +2,10 @@ package db
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/gkontos/goapi/model"
 	"github.com/google/uuid"
@@ -10,18 +14,25 @@ import (
 func (db *dbHandler) UpsertUser(u *model.User) (*model.User, error) {
 
 	sqlStatement := ""
+	args := []interface{}{u.UID, u.AuthProvider, u.ProviderID, u.UserName, u.UserDetails}
 	if u.UID == "" {
 		u.UID = uuid.NewString()
+		args[0] = u.UID
+		args = append(args, u.Status)
 		sqlStatement = `
-			INSERT INTO users (uid, auth_provider, provider_id, user_name, details, updated_at)
-			VALUES ($1, $2, $3, $4, $5, NOW())`
+			INSERT INTO users (uid, auth_provider, provider_id, user_name, details, status, updated_at)
+			VALUES ($1, $2, $3, $4, $5, COALESCE(NULLIF($6, ''), 'active'), NOW())`
 	} else {
+		// the status of an existing user is only changed through UpdateUserStatus
 		sqlStatement = `
 		UPDATE users
 		SET auth_provider = $2, provider_id = $3, user_name = $4, details = $5, updated_at = NOW()
 		WHERE uid = $1`
 	}
-	_, err := db.getConnection().Exec(sqlStatement, u.UID, u.AuthProvider, u.ProviderID, u.UserName, u.UserDetails)
+	_, err := db.getConnection().Exec(sqlStatement, args...)
+	if isUniqueViolation(err) {
+		return nil, &model.ValidationError{Err: fmt.Errorf("another user has the provider id %s of %s", u.ProviderID, u.AuthProvider)}
+	}
 	if err != nil {
 		return nil, err
 	} else {
@@ -29,11 +40,47 @@ func (db *dbHandler) UpsertUser(u *model.User) (*model.User, error) {
 	}
 }
 
+// GetUsersByEmail returns the users whose identity provider verified the email, ignoring case, oldest first.  An
+// unverified email can be set by anyone, so it never identifies a user.
+func (db *dbHandler) GetUsersByEmail(email string) ([]model.User, error) {
+	users := make([]model.User, 0)
+	sqlStatement := `
+		SELECT uid, auth_provider, provider_id, user_name, created_at, last_login_at, details,
+			status, COALESCE(status_reason, '') FROM users
+		WHERE lower(details->>'email') = lower($1) AND (details->>'email_verified')::boolean IS TRUE
+		ORDER BY created_at, uid`
+	rows, err := db.getConnection().Query(sqlStatement, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u model.User
+		if err := rows.Scan(&u.UID,
+			&u.AuthProvider,
+			&u.ProviderID,
+			&u.UserName,
+			&u.CreatedDate,
+			&u.LastLogin,
+			&u.UserDetails,
+			&u.Status,
+			&u.StatusReason,
+		); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
 func (db *dbHandler) GetUserByProvider(authProvider string, providerID string) (*model.User, error) {
 
 	u := model.User{}
 	sqlStatement := `
-		SELECT uid, auth_provider, provider_id, user_name, details FROM users
+		SELECT uid, auth_provider, provider_id, user_name, details, status, COALESCE(status_reason, '') FROM users
 		WHERE auth_provider = $1 AND provider_id = $2`
 	err := db.getConnection().QueryRow(sqlStatement,
 		authProvider,
@@ -42,22 +89,155 @@ func (db *dbHandler) GetUserByProvider(authProvider string, providerID string) (
 			&u.AuthProvider,
 			&u.ProviderID,
 			&u.UserName,
-			&u.UserDetails)
+			&u.UserDetails,
+			&u.Status,
+			&u.StatusReason)
 	if err != nil && err != sql.ErrNoRows {
 		return nil, err
 	}
 	return &u, nil
 }
 
-func (db *dbHandler) GetUsers() ([]model.User, error) {
-	userActivity := make([]model.User, 0)
+func (db *dbHandler) GetUserByUID(uid string) (*model.User, error) {
+
+	u := model.User{}
 	sqlStatement := `
-		SELECT uid, user_name, created_at, updated_at, details FROM users u 
-		`
-	rows, err := db.getConnection().Query(sqlStatement)
+		SELECT uid, auth_provider, provider_id, user_name, created_at, last_login_at, details,
+			status, COALESCE(status_reason, '') FROM users
+		WHERE uid = $1`
+	args := []interface{}{uid}
+	if db.tenant != "" {
+		sqlStatement = `
+			SELECT u.uid, u.auth_provider, u.provider_id, u.user_name, u.created_at, u.last_login_at,
+				jsonb_set(u.details, '{roles}', m.roles), u.status, COALESCE(u.status_reason, '')
+			FROM users u
+			JOIN organization_members m ON m.uid = u.uid
+			WHERE u.uid = $1 AND m.org_id = $2`
+		args = append(args, db.tenant)
+	}
+	err := db.getConnection().QueryRow(sqlStatement, args...).
+		Scan(&u.UID,
+			&u.AuthProvider,
+			&u.ProviderID,
+			&u.UserName,
+			&u.CreatedDate,
+			&u.LastLogin,
+			&u.UserDetails,
+			&u.Status,
+			&u.StatusReason)
+	if err == sql.ErrNoRows {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("user does not exist")}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// userRole is the global role every user holds, security.UserRole
+const userRole = "ROLE_USER"
+
+// neverLoggedIn is the last login a user who has never logged in is sorted by
+var neverLoggedIn = time.Unix(0, 0).UTC()
+
+// userSortColumns maps the sort fields of a user listing to their columns.  The last login expression must match the
+// users_last_login_idx index.
+var userSortColumns = map[string]string{
+	"created_date":    "u.created_at",
+	"last_login_date": "COALESCE(u.last_login_at, '1970-01-01'::timestamp)",
+	"user_name":       "u.user_name",
+}
+
+// GetUsers returns a page of users ordered by the query's sort field and then uid, starting after the query's cursor
+func (db *dbHandler) GetUsers(query model.UserQuery) (*model.UserPage, error) {
+	page := &model.UserPage{Users: make([]model.User, 0)}
+	if query.Sort == "" {
+		query.Sort = "created_date"
+	}
+	sortColumn, ok := userSortColumns[query.Sort]
+	if !ok {
+		return nil, &model.ValidationError{Err: fmt.Errorf("can not sort users by %s", query.Sort)}
+	}
+	if query.Limit <= 0 || query.Limit > model.MaxUserPageSize {
+		query.Limit = model.DefaultUserPageSize
+	}
+
+	sqlStatement := `
+		SELECT u.uid, u.user_name, u.created_at, u.last_login_at, u.details, u.status, COALESCE(u.status_reason, '')
+		FROM users u`
+	rolesColumn := "u.details->'roles'"
+	where := []string{}
+	args := []interface{}{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if db.tenant != "" {
+		// members of the tenant with their organization roles
+		sqlStatement = `
+			SELECT u.uid, u.user_name, u.created_at, u.last_login_at, jsonb_set(u.details, '{roles}', m.roles),
+				u.status, COALESCE(u.status_reason, '')
+			FROM users u
+			JOIN organization_members m ON m.uid = u.uid`
+		rolesColumn = "m.roles"
+		where = append(where, "m.org_id = "+arg(db.tenant))
+	}
+	if query.Role != "" {
+		where = append(where, rolesColumn+" @> jsonb_build_array("+arg(query.Role)+"::text)")
+	}
+	if query.EmailDomain != "" {
+		where = append(where, "split_part(lower(u.details->>'email'), '@', 2) = lower("+arg(query.EmailDomain)+")")
+	}
+	if query.Provider != "" {
+		where = append(where, "u.auth_provider = "+arg(query.Provider))
+	}
+	if query.Status != "" {
+		where = append(where, "u.status = "+arg(query.Status))
+	}
+	if !query.CreatedAfter.IsZero() {
+		where = append(where, "u.created_at >= "+arg(query.CreatedAfter))
+	}
+	if !query.CreatedBefore.IsZero() {
+		where = append(where, "u.created_at < "+arg(query.CreatedBefore))
+	}
+	if !query.UpdatedAfter.IsZero() {
+		where = append(where, "u.updated_at >= "+arg(query.UpdatedAfter))
+	}
+	if !query.UpdatedBefore.IsZero() {
+		where = append(where, "u.updated_at < "+arg(query.UpdatedBefore))
+	}
+	direction, comparison := "ASC", ">"
+	if query.Desc {
+		direction, comparison = "DESC", "<"
+	}
+	if query.After != nil {
+		if query.After.Sort != query.Sort || query.After.Desc != query.Desc {
+			return nil, &model.ValidationError{Err: errors.New("cursor does not match the sort order")}
+		}
+		var value interface{} = query.After.Value
+		if query.Sort != "user_name" {
+			t, err := time.Parse(time.RFC3339Nano, query.After.Value)
+			if err != nil {
+				return nil, &model.ValidationError{Err: errors.New("invalid cursor")}
+			}
+			value = t
+		}
+		where = append(where, fmt.Sprintf("(%s, u.uid) %s (%s, %s)", sortColumn, comparison, arg(value), arg(query.After.UID)))
+	}
+	if len(where) > 0 {
+		sqlStatement += `
+			WHERE ` + strings.Join(where, " AND ")
+	}
+	// one more row than the page tells us if there is a next page
+	sqlStatement += fmt.Sprintf(`
+		ORDER BY %s %s, u.uid %s
+		LIMIT %s`, sortColumn, direction, direction, arg(query.Limit+1))
+
+	rows, err := db.getConnection().Query(sqlStatement, args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	for rows.Next() {
 		var u model.User
 		if err := rows.Scan(&u.UID,
@@ -65,14 +245,206 @@ func (db *dbHandler) GetUsers() ([]model.User, error) {
 			&u.CreatedDate,
 			&u.LastLogin,
 			&u.UserDetails,
+			&u.Status,
+			&u.StatusReason,
 		); err != nil {
-			return userActivity, err
+			return nil, err
 		}
 
-		userActivity = append(userActivity, u)
+		page.Users = append(page.Users, u)
 	}
-	if err != nil && err != sql.ErrNoRows {
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(page.Users) > query.Limit {
+		page.Users = page.Users[:query.Limit]
+		last := page.Users[query.Limit-1]
+		cursor := &model.UserCursor{Sort: query.Sort, Desc: query.Desc, UID: last.UID}
+		switch query.Sort {
+		case "user_name":
+			cursor.Value = last.UserName
+		case "created_date":
+			cursor.Value = last.CreatedDate.Format(time.RFC3339Nano)
+		default:
+			lastLogin := neverLoggedIn
+			if last.LastLogin != nil {
+				lastLogin = *last.LastLogin
+			}
+			cursor.Value = lastLogin.Format(time.RFC3339Nano)
+		}
+		page.NextCursor = cursor.Encode()
+	}
+	return page, nil
+}
+
+// userSearchText is the lower cased text a user search matches against.  It must match the expression of the
+// users_search_idx trigram index.
+const userSearchText = `lower(u.user_name || ' ' || COALESCE(u.details->>'full_name', '') || ' ' ||
+	COALESCE(u.details->>'first_name', '') || ' ' || COALESCE(u.details->>'last_name', '') || ' ' ||
+	COALESCE(u.details->>'email', ''))`
+
+// SearchUsers returns a page of the users whose names or email contain or resemble the search term, best match first
+func (db *dbHandler) SearchUsers(search model.UserSearch) (*model.UserPage, error) {
+	page := &model.UserPage{Users: make([]model.User, 0)}
+	if search.Limit <= 0 || search.Limit > model.MaxUserPageSize {
+		search.Limit = model.DefaultUserPageSize
+	}
+	q := strings.ToLower(search.Q)
+	like := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(q) + "%"
+
+	// the subquery ranks the matches so that the page can be taken after the cursor's rank
+	sqlStatement := `
+		SELECT uid, user_name, created_at, last_login_at, details, status, status_reason, rank FROM (
+			SELECT u.uid, u.user_name, u.created_at, u.last_login_at, u.details, u.status, COALESCE(u.status_reason, '') AS status_reason,
+				word_similarity($1, ` + userSearchText + `) AS rank
+			FROM users u
+			WHERE ($1 <% ` + userSearchText + ` OR ` + userSearchText + ` LIKE $2)`
+	args := []interface{}{q, like}
+	if db.tenant != "" {
+		sqlStatement = `
+		SELECT uid, user_name, created_at, last_login_at, details, status, status_reason, rank FROM (
+			SELECT u.uid, u.user_name, u.created_at, u.last_login_at, jsonb_set(u.details, '{roles}', m.roles) AS details,
+				u.status, COALESCE(u.status_reason, '') AS status_reason,
+				word_similarity($1, ` + userSearchText + `) AS rank
+			FROM users u
+			JOIN organization_members m ON m.uid = u.uid
+			WHERE ($1 <% ` + userSearchText + ` OR ` + userSearchText + ` LIKE $2) AND m.org_id = $3`
+		args = append(args, db.tenant)
+	}
+	sqlStatement += `
+		) matches`
+	if search.After != nil {
+		if search.After.Q != search.Q {
+			return nil, &model.ValidationError{Err: errors.New("cursor does not match the search")}
+		}
+		args = append(args, search.After.Rank, search.After.UID)
+		sqlStatement += fmt.Sprintf(`
+		WHERE rank < $%d OR (rank = $%d AND uid > $%d)`, len(args)-1, len(args)-1, len(args))
+	}
+	// one more row than the page tells us if there is a next page
+	args = append(args, search.Limit+1)
+	sqlStatement += fmt.Sprintf(`
+		ORDER BY rank DESC, uid
+		LIMIT $%d`, len(args))
+
+	rows, err := db.getConnection().Query(sqlStatement, args...)
+	if err != nil {
 		return nil, err
 	}
-	return userActivity, nil
+	defer rows.Close()
+	ranks := []float32{}
+	for rows.Next() {
+		var u model.User
+		var rank float32
+		if err := rows.Scan(&u.UID,
+			&u.UserName,
+			&u.CreatedDate,
+			&u.LastLogin,
+			&u.UserDetails,
+			&u.Status,
+			&u.StatusReason,
+			&rank,
+		); err != nil {
+			return nil, err
+		}
+
+		page.Users = append(page.Users, u)
+		ranks = append(ranks, rank)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(page.Users) > search.Limit {
+		page.Users = page.Users[:search.Limit]
+		cursor := &model.UserSearchCursor{Q: search.Q, Rank: ranks[search.Limit-1], UID: page.Users[search.Limit-1].UID}
+		page.NextCursor = cursor.Encode()
+	}
+	return page, nil
+}
+
+// UpdateUserDetails will replace the user's details except for their roles, which are only changed through
+// AddUserRole and RemoveUserRole.  A tenant handler can only update a member of the tenant who does not belong to
+// another organization.
+func (db *dbHandler) UpdateUserDetails(uid string, details model.UserDetails) error {
+	if err := db.checkTenantOwnsUser(uid); err != nil {
+		return err
+	}
+	sqlStatement := `
+		UPDATE users
+		SET details = jsonb_set($2::jsonb, '{roles}', COALESCE(details->'roles', '[]'::jsonb)), updated_at = NOW()
+		WHERE uid = $1`
+	return db.execOne(errors.New("user does not exist"), sqlStatement, uid, details)
+}
+
+// UpdateUserStatus will move the user to a status of the user lifecycle.  A tenant handler can only change the status
+// of a member of the tenant who does not belong to another organization.
+func (db *dbHandler) UpdateUserStatus(uid string, status string, reason string) error {
+	if err := db.checkTenantOwnsUser(uid); err != nil {
+		return err
+	}
+	sqlStatement := `
+		UPDATE users
+		SET status = $2, status_reason = NULLIF($3, ''), status_changed_at = NOW()
+		WHERE uid = $1`
+	return db.execOne(errors.New("user does not exist"), sqlStatement, uid, status, reason)
+}
+
+// DecideRegistration approves a pending user with the roles, or rejects them with the reason
+func (db *dbHandler) DecideRegistration(uid string, approve bool, roles []string, reason string) error {
+	status := model.UserStatusRejected
+	if approve {
+		status = model.UserStatusActive
+	}
+	if roles == nil {
+		roles = []string{}
+	}
+	sqlStatement := `
+		UPDATE users
+		SET status = $2, status_reason = NULLIF($3, ''), status_changed_at = NOW(),
+			details = jsonb_set(details, '{roles}', $4), updated_at = NOW()
+		WHERE uid = $1 AND status = 'pending'`
+	return db.execOne(errors.New("user is not waiting for approval"), sqlStatement, uid, status, reason, model.StringList(roles))
+}
+
+// checkTenantOwnsUser returns an error unless the handler is not scoped to a tenant or the user is a member of the
+// tenant and no other organization, changes to the user would otherwise affect other organizations.  A user who holds
+// global roles other than ROLE_USER is only changed without a tenant, an organization admin does not manage them.
+func (db *dbHandler) checkTenantOwnsUser(uid string) error {
+	if db.tenant == "" {
+		return nil
+	}
+	memberships, err := db.GetMemberships(uid)
+	if err != nil {
+		return err
+	}
+	member := false
+	for _, m := range memberships {
+		if m.OrgID == db.tenant {
+			member = true
+		}
+	}
+	if !member {
+		return &model.ResourceDoesNotExistError{Err: errors.New("user does not exist")}
+	}
+	if len(memberships) > 1 {
+		return &model.ValidationError{Err: errors.New("user belongs to another organization, remove them from this organization instead")}
+	}
+
+	var roles model.StringList
+	sqlStatement := `
+		SELECT COALESCE(details->'roles', '[]'::jsonb) FROM users
+		WHERE uid = $1`
+	err = db.getConnection().QueryRow(sqlStatement, uid).Scan(&roles)
+	if err == sql.ErrNoRows {
+		return &model.ResourceDoesNotExistError{Err: errors.New("user does not exist")}
+	}
+	if err != nil {
+		return err
+	}
+	for _, role := range roles {
+		if role != userRole {
+			return &model.PermissionDeniedError{Err: errors.New("user holds global roles and can not be changed by an organization")}
+		}
+	}
+	return nil
 }
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"errors"
 	"testing"
 	"time"
 
@@ -14,15 +15,16 @@ func TestGetUsers(t *testing.T) {
 	db, mock := getTestHandler()
 	defer db.pool.Close()
 
-	rows := sqlmock.NewRows([]string{"uid", "user_name", "created_at", "updated_at", "details"}).
-		AddRow(uuid.NewString(), "sergei", time.Now(), time.Now(), []byte(`{"email":"sergei"}`)).
-		AddRow(uuid.NewString(), "tom", time.Now(), time.Now(), []byte(`{"email":"tom"}`))
+	rows := sqlmock.NewRows([]string{"uid", "user_name", "created_at", "updated_at", "details", "status", "status_reason"}).
+		AddRow(uuid.NewString(), "sergei", time.Now(), time.Now(), []byte(`{"email":"sergei"}`), "active", "").
+		AddRow(uuid.NewString(), "tom", time.Now(), time.Now(), []byte(`{"email":"tom"}`), "active", "")
 
-	mock.ExpectQuery("SELECT (.+) FROM users (.+)").WithArgs().WillReturnRows(rows)
+	mock.ExpectQuery("SELECT (.+) FROM users u ORDER BY u.created_at ASC, u.uid ASC LIMIT \\$1").
+		WithArgs(model.DefaultUserPageSize + 1).WillReturnRows(rows)
 
-	var users []model.User
+	var page *model.UserPage
 	var err error
-	if users, err = db.GetUsers(); err != nil {
+	if page, err = db.GetUsers(model.UserQuery{}); err != nil {
 		t.Errorf("error '%s' was not expected, while getting users", err)
 	}
 
@@ -31,7 +33,91 @@ func TestGetUsers(t *testing.T) {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
 
-	assert.True(t, len(users) == 2)
+	assert.True(t, len(page.Users) == 2)
+	assert.Equal(t, "", page.NextCursor)
+}
+
+func TestGetUsersPage(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	created := time.Date(2023, 3, 4, 5, 6, 7, 8000, time.UTC)
+	after := &model.UserCursor{Sort: "created_date", Desc: true, Value: created.Format(time.RFC3339Nano), UID: uuid.NewString()}
+	lastUID := uuid.NewString()
+	rows := sqlmock.NewRows([]string{"uid", "user_name", "created_at", "updated_at", "details", "status", "status_reason"}).
+		AddRow(uuid.NewString(), "sergei", created, time.Now(), []byte(`{"email":"sergei@example.com"}`), "active", "").
+		AddRow(lastUID, "tom", created.Add(-time.Hour), time.Now(), []byte(`{"email":"tom@example.com"}`), "active", "").
+		AddRow(uuid.NewString(), "anna", created.Add(-2*time.Hour), time.Now(), []byte(`{"email":"anna@example.com"}`), "active", "")
+
+	mock.ExpectQuery("SELECT (.+) FROM users u "+
+		"WHERE u.details->'roles' @> jsonb_build_array\\(\\$1::text\\) "+
+		"AND split_part\\(lower\\(u.details->>'email'\\), '@', 2\\) = lower\\(\\$2\\) "+
+		"AND u.created_at >= \\$3 "+
+		"AND \\(u.created_at, u.uid\\) < \\(\\$4, \\$5\\) "+
+		"ORDER BY u.created_at DESC, u.uid DESC LIMIT \\$6").
+		WithArgs("ROLE_ADMIN", "example.com", created.Add(-24*time.Hour), created, after.UID, 3).
+		WillReturnRows(rows)
+
+	page, err := db.GetUsers(model.UserQuery{
+		Limit:        2,
+		Sort:         "created_date",
+		Desc:         true,
+		After:        after,
+		Role:         "ROLE_ADMIN",
+		EmailDomain:  "example.com",
+		CreatedAfter: created.Add(-24 * time.Hour),
+	})
+	assert.NoError(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	// the extra row is only used to find the next page
+	assert.Equal(t, 2, len(page.Users))
+	next, err := model.DecodeUserCursor(page.NextCursor)
+	assert.NoError(t, err)
+	assert.Equal(t, &model.UserCursor{Sort: "created_date", Desc: true, Value: created.Add(-time.Hour).Format(time.RFC3339Nano), UID: lastUID}, next)
+
+	// a cursor can only continue the ordering it was issued for
+	_, err = db.GetUsers(model.UserQuery{Sort: "user_name", After: after})
+	assert.IsType(t, &model.ValidationError{}, err)
+}
+
+func TestSearchUsers(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	after := &model.UserSearchCursor{Q: "Tom_B", Rank: 0.75, UID: uuid.NewString()}
+	lastUID := uuid.NewString()
+	rows := sqlmock.NewRows([]string{"uid", "user_name", "created_at", "updated_at", "details", "status", "status_reason", "rank"}).
+		AddRow(uuid.NewString(), "tom_b", time.Now(), time.Now(), []byte(`{"email":"tom@example.com"}`), "active", "", float32(0.75)).
+		AddRow(lastUID, "tom_butler", time.Now(), time.Now(), []byte(`{"email":"butler@example.com"}`), "active", "", float32(0.5)).
+		AddRow(uuid.NewString(), "tomb", time.Now(), time.Now(), []byte(`{"email":"tomb@example.com"}`), "active", "", float32(0.25))
+
+	// the term is lower cased and escaped for LIKE
+	mock.ExpectQuery("SELECT (.+) word_similarity\\(\\$1, (.+)\\) AS rank FROM users u "+
+		"WHERE \\(\\$1 <% (.+) LIKE \\$2\\) \\) matches "+
+		"WHERE rank < \\$3 OR \\(rank = \\$3 AND uid > \\$4\\) "+
+		"ORDER BY rank DESC, uid LIMIT \\$5").
+		WithArgs("tom_b", `%tom\_b%`, float32(0.75), after.UID, 3).
+		WillReturnRows(rows)
+
+	page, err := db.SearchUsers(model.UserSearch{Q: "Tom_B", Limit: 2, After: after})
+	assert.NoError(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	assert.Equal(t, 2, len(page.Users))
+	next, err := model.DecodeUserSearchCursor(page.NextCursor)
+	assert.NoError(t, err)
+	assert.Equal(t, &model.UserSearchCursor{Q: "Tom_B", Rank: 0.5, UID: lastUID}, next)
+
+	// a cursor can only continue the search it was issued for
+	_, err = db.SearchUsers(model.UserSearch{Q: "sergei", After: after})
+	assert.IsType(t, &model.ValidationError{}, err)
 }
 
 func TestGetUsersByProvider(t *testing.T) {
@@ -40,9 +126,9 @@ func TestGetUsersByProvider(t *testing.T) {
 
 	authProvider := "google"
 	providerId := "12345"
-	rows := sqlmock.NewRows([]string{"uid", "auth_provider", "provider_id", "user_name", "details"}).
-		AddRow(uuid.NewString(), "google", "12345", "sergei", []byte(`{"email":"sergei"}`)).
-		AddRow(uuid.NewString(), "myspace", "6789", "tom", []byte(`{"email":"tom"}`))
+	rows := sqlmock.NewRows([]string{"uid", "auth_provider", "provider_id", "user_name", "details", "status", "status_reason"}).
+		AddRow(uuid.NewString(), "google", "12345", "sergei", []byte(`{"email":"sergei"}`), "active", "").
+		AddRow(uuid.NewString(), "myspace", "6789", "tom", []byte(`{"email":"tom"}`), "active", "")
 
 	mock.ExpectQuery("SELECT (.+) FROM users (.+)").WithArgs(authProvider, providerId).WillReturnRows(rows)
 
@@ -67,3 +153,197 @@ func getTestHandler() (*dbHandler, sqlmock.Sqlmock) {
 	}
 	return dbh, mock
 }
+
+func TestUpdateUserDetailsKeepsRoles(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	uid := uuid.NewString()
+	mock.ExpectExec("UPDATE users SET details = jsonb_set\\(\\$2::jsonb, '{roles}', COALESCE\\(details->'roles'(.+)").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := db.UpdateUserDetails(uid, model.UserDetails{FirstName: "Thomas", Roles: []string{"ROLE_ADMIN"}})
+	assert.NoError(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUpdateUserDetailsWithTenant(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	orgID := uuid.NewString()
+	uid := uuid.NewString()
+
+	// the details of a member of another organization are shared with it and are not changed
+	mock.ExpectQuery("SELECT (.+) FROM organization_members m (.+)").WithArgs(uid).
+		WillReturnRows(sqlmock.NewRows([]string{"org_id", "name", "uid", "roles"}).
+			AddRow(orgID, "acme", uid, []byte(`[]`)).
+			AddRow(uuid.NewString(), "initech", uid, []byte(`[]`)))
+
+	err := db.WithTenant(orgID).UpdateUserDetails(uid, model.UserDetails{FirstName: "Thomas"})
+	assert.IsType(t, &model.ValidationError{}, err)
+
+	// a global admin who is only a member of the tenant is not managed by the organization
+	mock.ExpectQuery("SELECT (.+) FROM organization_members m (.+)").WithArgs(uid).
+		WillReturnRows(sqlmock.NewRows([]string{"org_id", "name", "uid", "roles"}).
+			AddRow(orgID, "acme", uid, []byte(`[]`)))
+	mock.ExpectQuery("SELECT COALESCE\\(details->'roles', '\\[\\]'::jsonb\\) FROM users WHERE uid = \\$1").WithArgs(uid).
+		WillReturnRows(sqlmock.NewRows([]string{"roles"}).AddRow([]byte(`["ROLE_USER","ROLE_ADMIN"]`)))
+
+	err = db.WithTenant(orgID).UpdateUserDetails(uid, model.UserDetails{FirstName: "Thomas"})
+	assert.IsType(t, &model.PermissionDeniedError{}, err)
+
+	// a member of the tenant alone
+	mock.ExpectQuery("SELECT (.+) FROM organization_members m (.+)").WithArgs(uid).
+		WillReturnRows(sqlmock.NewRows([]string{"org_id", "name", "uid", "roles"}).
+			AddRow(orgID, "acme", uid, []byte(`[]`)))
+	mock.ExpectQuery("SELECT COALESCE\\(details->'roles', (.+) FROM users WHERE uid = \\$1").WithArgs(uid).
+		WillReturnRows(sqlmock.NewRows([]string{"roles"}).AddRow([]byte(`["ROLE_USER"]`)))
+	mock.ExpectExec("UPDATE users SET details = (.+) WHERE uid = \\$1").WithArgs(uid, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = db.WithTenant(orgID).UpdateUserDetails(uid, model.UserDetails{FirstName: "Thomas"})
+	assert.NoError(t, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUpdateUserStatusWithTenant(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	orgID := uuid.NewString()
+	uid := uuid.NewString()
+
+	// a member of another organization is not deleted by the organization
+	mock.ExpectQuery("SELECT (.+) FROM organization_members m (.+)").WithArgs(uid).
+		WillReturnRows(sqlmock.NewRows([]string{"org_id", "name", "uid", "roles"}).
+			AddRow(orgID, "acme", uid, []byte(`[]`)).
+			AddRow(uuid.NewString(), "initech", uid, []byte(`[]`)))
+
+	err := db.WithTenant(orgID).UpdateUserStatus(uid, model.UserStatusDeleted, "deleted by admin")
+	assert.IsType(t, &model.ValidationError{}, err)
+
+	// a user who is not a member does not exist for the tenant
+	mock.ExpectQuery("SELECT (.+) FROM organization_members m (.+)").WithArgs(uid).
+		WillReturnRows(sqlmock.NewRows([]string{"org_id", "name", "uid", "roles"}))
+
+	err = db.WithTenant(orgID).UpdateUserStatus(uid, model.UserStatusDeleted, "deleted by admin")
+	assert.IsType(t, &model.ResourceDoesNotExistError{}, err)
+
+	// nor is a global admin who is only a member of the tenant
+	mock.ExpectQuery("SELECT (.+) FROM organization_members m (.+)").WithArgs(uid).
+		WillReturnRows(sqlmock.NewRows([]string{"org_id", "name", "uid", "roles"}).
+			AddRow(orgID, "acme", uid, []byte(`[]`)))
+	mock.ExpectQuery("SELECT COALESCE\\(details->'roles', (.+) FROM users WHERE uid = \\$1").WithArgs(uid).
+		WillReturnRows(sqlmock.NewRows([]string{"roles"}).AddRow([]byte(`["ROLE_ADMIN"]`)))
+
+	err = db.WithTenant(orgID).UpdateUserStatus(uid, model.UserStatusDeleted, "deleted by admin")
+	assert.IsType(t, &model.PermissionDeniedError{}, err)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUpdateUserStatus(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	uid := uuid.NewString()
+	mock.ExpectExec("UPDATE users SET status = \\$2, status_reason = NULLIF\\(\\$3, ''\\), status_changed_at = NOW\\(\\) WHERE uid = \\$1").
+		WithArgs(uid, model.UserStatusSuspended, "chargeback").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE users (.+)").
+		WithArgs(uid, model.UserStatusActive, "").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	assert.NoError(t, db.UpdateUserStatus(uid, model.UserStatusSuspended, "chargeback"))
+	assert.IsType(t, &model.ResourceDoesNotExistError{}, db.UpdateUserStatus(uid, model.UserStatusActive, ""))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDecideRegistration(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	uid := uuid.NewString()
+	mock.ExpectExec("UPDATE users SET status = \\$2, (.+) details = jsonb_set\\(details, '{roles}', \\$4\\), (.+) WHERE uid = \\$1 AND status = 'pending'").
+		WithArgs(uid, model.UserStatusActive, "", []byte(`["ROLE_USER"]`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// a user who has already been decided is not changed
+	mock.ExpectExec("UPDATE users (.+)").
+		WithArgs(uid, model.UserStatusRejected, "spam", []byte(`[]`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	assert.NoError(t, db.DecideRegistration(uid, true, []string{"ROLE_USER"}, ""))
+	assert.IsType(t, &model.ResourceDoesNotExistError{}, db.DecideRegistration(uid, false, nil, "spam"))
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestGetUsersByEmail(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	rows := sqlmock.NewRows([]string{"uid", "auth_provider", "provider_id", "user_name", "created_at", "last_login_at", "details", "status", "status_reason"}).
+		AddRow(uuid.NewString(), "google", "tom", "tom", time.Now(), nil, []byte(`{"email":"Tom@example.com","email_verified":true}`), "active", "")
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE lower\\(details->>'email'\\) = lower\\(\\$1\\) AND \\(details->>'email_verified'\\)::boolean IS TRUE ORDER BY created_at, uid").
+		WithArgs("tom@example.com").WillReturnRows(rows)
+
+	users, err := db.GetUsersByEmail("tom@example.com")
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+	assert.Equal(t, 1, len(users))
+	assert.Equal(t, "Tom@example.com", users[0].UserDetails.Email)
+	assert.Nil(t, users[0].LastLogin)
+}
+
+func TestWithTransaction(t *testing.T) {
+	db, mock := getTestHandler()
+	defer db.pool.Close()
+
+	user := &model.User{UID: uuid.NewString(), AuthProvider: "google", ProviderID: "tom", UserName: "tom"}
+	update := "UPDATE users SET auth_provider = \\$2, provider_id = \\$3, user_name = \\$4, details = \\$5, updated_at = NOW\\(\\) WHERE uid = \\$1"
+
+	// statements run in the transaction, which is committed when the function succeeds
+	mock.ExpectBegin()
+	mock.ExpectExec(update).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(update).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	err := db.WithTransaction(func(tx DbHandler) error {
+		if _, err := tx.UpsertUser(user); err != nil {
+			return err
+		}
+		// a nested transaction is part of the outer one
+		return tx.WithTransaction(func(tx DbHandler) error {
+			_, err := tx.UpsertUser(user)
+			return err
+		})
+	})
+	assert.NoError(t, err)
+
+	// and rolled back when it fails
+	mock.ExpectBegin()
+	mock.ExpectExec(update).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectRollback()
+	failed := errors.New("failed")
+	err = db.WithTransaction(func(tx DbHandler) error {
+		if _, err := tx.UpsertUser(user); err != nil {
+			return err
+		}
+		return failed
+	})
+	assert.Equal(t, failed, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -8,3 +8,254 @@ CREATE TABLE IF NOT EXISTS users(
    updated_at               TIMESTAMP DEFAULT now()
    CONSTRAINT provider_unique UNIQUE (auth_provider, provider_id)
 );
+
+-- the user lifecycle, only active users can log in or use their tokens
+ALTER TABLE users ADD COLUMN IF NOT EXISTS status varchar(20) NOT NULL DEFAULT 'active';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS status_reason text;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS status_changed_at TIMESTAMP;
+
+-- settings stored for the user's clients, the version is incremented by every change
+ALTER TABLE users ADD COLUMN IF NOT EXISTS preferences JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS preferences_version INTEGER NOT NULL DEFAULT 0;
+
+-- the time of the latest successful login in login_events
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_login_at TIMESTAMP;
+
+-- the id a SCIM provisioning client knows the user by
+ALTER TABLE users ADD COLUMN IF NOT EXISTS external_id varchar(255);
+CREATE UNIQUE INDEX IF NOT EXISTS users_external_id_idx ON users (external_id);
+
+-- keyset pagination of the users listing
+CREATE INDEX IF NOT EXISTS users_created_at_idx ON users (created_at, uid);
+CREATE INDEX IF NOT EXISTS users_updated_at_idx ON users (updated_at, uid);
+CREATE INDEX IF NOT EXISTS users_user_name_idx ON users (user_name, uid);
+-- the expression must match the last_login_date sort column in db/user_db.go
+CREATE INDEX IF NOT EXISTS users_last_login_idx ON users ((COALESCE(last_login_at, '1970-01-01'::timestamp)), uid);
+CREATE INDEX IF NOT EXISTS users_pending_idx ON users (created_at, uid) WHERE status = 'pending';
+-- bulk imports match users by email
+CREATE INDEX IF NOT EXISTS users_email_idx ON users ((lower(details->>'email')));
+
+-- user search, the expression must match userSearchText in db/user_db.go
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE INDEX IF NOT EXISTS users_search_idx ON users USING gin ((lower(user_name || ' ' || COALESCE(details->>'full_name', '') || ' ' ||
+   COALESCE(details->>'first_name', '') || ' ' || COALESCE(details->>'last_name', '') || ' ' ||
+   COALESCE(details->>'email', ''))) gin_trgm_ops);
+
+CREATE TABLE IF NOT EXISTS magic_links(
+   id                       UUID PRIMARY KEY NOT NULL,
+   email                    varchar(255) NOT NULL,
+   expires_at               TIMESTAMP NOT NULL,
+   consumed_at              TIMESTAMP,
+   created_at               TIMESTAMP DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS oauth_clients(
+   client_id                varchar(255) PRIMARY KEY NOT NULL,
+   secret_hash              varchar(64) NOT NULL DEFAULT '',
+   name                     varchar(255) NOT NULL,
+   redirect_uris            JSONB NOT NULL,
+   confidential             BOOLEAN NOT NULL DEFAULT false,
+   created_at               TIMESTAMP DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS oauth_authorization_codes(
+   code_hash                varchar(64) PRIMARY KEY NOT NULL,
+   client_id                varchar(255) NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE,
+   uid                      UUID NOT NULL REFERENCES users(uid) ON DELETE CASCADE,
+   redirect_uri             TEXT NOT NULL,
+   scope                    TEXT NOT NULL,
+   nonce                    TEXT NOT NULL,
+   code_challenge           varchar(128) NOT NULL,
+   code_challenge_method    varchar(16) NOT NULL,
+   auth_time                TIMESTAMP NOT NULL,
+   expires_at               TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS device_authorizations(
+   device_code_hash         varchar(64) PRIMARY KEY NOT NULL,
+   user_code                varchar(16) NOT NULL UNIQUE,
+   client_id                varchar(255) NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE,
+   scope                    TEXT NOT NULL,
+   uid                      UUID REFERENCES users(uid) ON DELETE CASCADE,
+   status                   varchar(16) NOT NULL,
+   poll_interval            INTEGER NOT NULL,
+   expires_at               TIMESTAMP NOT NULL,
+   last_polled_at           TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS roles(
+   name                     varchar(255) PRIMARY KEY NOT NULL,
+   description              TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS permissions(
+   name                     varchar(255) PRIMARY KEY NOT NULL,
+   description              TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions(
+   role_name                varchar(255) NOT NULL REFERENCES roles(name) ON DELETE CASCADE,
+   permission_name          varchar(255) NOT NULL REFERENCES permissions(name) ON DELETE CASCADE,
+   PRIMARY KEY (role_name, permission_name)
+);
+
+-- a role has every permission of the roles it inherits
+CREATE TABLE IF NOT EXISTS role_inherits(
+   role_name                varchar(255) NOT NULL REFERENCES roles(name) ON DELETE CASCADE,
+   inherits_role            varchar(255) NOT NULL REFERENCES roles(name) ON DELETE CASCADE,
+   PRIMARY KEY (role_name, inherits_role)
+);
+
+INSERT INTO roles (name, description) VALUES
+   ('ROLE_ADMIN', 'administrators'),
+   ('ROLE_USER', 'default role for new users')
+ON CONFLICT DO NOTHING;
+
+-- permissions are namespaced with ':'.  A permission ending in '*' grants every permission with that prefix.
+INSERT INTO permissions (name, description) VALUES
+   ('*', 'every permission'),
+   ('app:read', 'read application data'),
+   ('app:write', 'change application data'),
+   ('users:*', 'administer users'),
+   ('users:read', 'list and read users'),
+   ('users:search', 'search users by name and email'),
+   ('users:write', 'change the details of users'),
+   ('users:delete', 'delete users'),
+   ('users:erase', 'erase the personal data of users'),
+   ('users:invite', 'invite users with roles'),
+   ('users:approve', 'approve and reject the registration of new users'),
+   ('users:logins:read', 'read the login history of users'),
+   ('users:import', 'create and update users in bulk'),
+   ('users:export', 'export users in bulk'),
+   ('users:status:write', 'suspend, deactivate and reactivate users'),
+   ('users:roles:read', 'read the roles of users'),
+   ('users:roles:write', 'grant and revoke roles'),
+   ('organizations:*', 'administer organizations'),
+   ('organizations:create', 'create organizations'),
+   ('organizations:members:write', 'add and remove organization members'),
+   ('groups:*', 'administer groups'),
+   ('groups:read', 'read groups and their members'),
+   ('groups:write', 'change groups and their members')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO role_permissions (role_name, permission_name) VALUES
+   ('ROLE_ADMIN', 'users:*'),
+   ('ROLE_ADMIN', 'organizations:*'),
+   ('ROLE_ADMIN', 'groups:*'),
+   ('ROLE_USER', 'app:read'),
+   ('ROLE_USER', 'app:write')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO role_inherits (role_name, inherits_role) VALUES
+   ('ROLE_ADMIN', 'ROLE_USER')
+ON CONFLICT DO NOTHING;
+
+-- migrate the flat permissions read, write and admin
+INSERT INTO role_permissions (role_name, permission_name)
+   SELECT role_name, CASE permission_name WHEN 'read' THEN 'app:read' WHEN 'write' THEN 'app:write' ELSE '*' END
+   FROM role_permissions
+   WHERE permission_name IN ('read', 'write', 'admin') AND role_name <> 'ROLE_ADMIN'
+ON CONFLICT DO NOTHING;
+DELETE FROM permissions WHERE name IN ('read', 'write', 'admin');
+
+CREATE TABLE IF NOT EXISTS audit_log(
+   id                       BIGSERIAL PRIMARY KEY,
+   actor_uid                varchar(64) NOT NULL,
+   action                   varchar(64) NOT NULL,
+   target_uid               varchar(64) NOT NULL,
+   details                  JSONB NOT NULL DEFAULT '{}',
+   created_at               TIMESTAMP DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS audit_log_target_idx ON audit_log (target_uid, created_at);
+CREATE INDEX IF NOT EXISTS audit_log_actor_idx ON audit_log (actor_uid, created_at);
+
+CREATE TABLE IF NOT EXISTS organizations(
+   id                       UUID PRIMARY KEY NOT NULL,
+   name                     varchar(255) NOT NULL,
+   created_at               TIMESTAMP DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS organization_members(
+   org_id                   UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+   uid                      UUID NOT NULL REFERENCES users(uid) ON DELETE CASCADE,
+   roles                    JSONB NOT NULL DEFAULT '[]',
+   created_at               TIMESTAMP DEFAULT now(),
+   PRIMARY KEY (org_id, uid)
+);
+CREATE INDEX IF NOT EXISTS organization_members_uid_idx ON organization_members (uid);
+
+CREATE TABLE IF NOT EXISTS groups(
+   id                       UUID PRIMARY KEY NOT NULL,
+   org_id                   UUID REFERENCES organizations(id) ON DELETE CASCADE,
+   name                     varchar(255) NOT NULL,
+   description              TEXT NOT NULL DEFAULT '',
+   roles                    JSONB NOT NULL DEFAULT '[]',
+   created_at               TIMESTAMP DEFAULT now()
+);
+CREATE UNIQUE INDEX IF NOT EXISTS groups_name_idx ON groups (COALESCE(org_id, '00000000-0000-0000-0000-000000000000'), name);
+
+CREATE TABLE IF NOT EXISTS group_members(
+   group_id                 UUID NOT NULL REFERENCES groups(id) ON DELETE CASCADE,
+   uid                      UUID NOT NULL REFERENCES users(uid) ON DELETE CASCADE,
+   created_at               TIMESTAMP DEFAULT now(),
+   PRIMARY KEY (group_id, uid)
+);
+CREATE INDEX IF NOT EXISTS group_members_uid_idx ON group_members (uid);
+
+CREATE TABLE IF NOT EXISTS user_exports(
+   id                       UUID PRIMARY KEY NOT NULL,
+   uid                      UUID NOT NULL REFERENCES users(uid) ON DELETE CASCADE,
+   status                   varchar(16) NOT NULL,
+   archive                  JSONB,
+   error                    TEXT,
+   created_at               TIMESTAMP DEFAULT now(),
+   completed_at             TIMESTAMP,
+   expires_at               TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS user_exports_uid_idx ON user_exports (uid, created_at);
+
+-- requests to anonymize users, kept after completion as a record that the user was erased
+CREATE TABLE IF NOT EXISTS user_erasures(
+   uid                      UUID PRIMARY KEY NOT NULL REFERENCES users(uid) ON DELETE CASCADE,
+   requested_by             varchar(64) NOT NULL,
+   requested_at             TIMESTAMP DEFAULT now(),
+   erase_after              TIMESTAMP NOT NULL,
+   completed_at             TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS user_erasures_due_idx ON user_erasures (erase_after) WHERE completed_at IS NULL;
+
+-- invitations pre-assign roles to an email, the latest pending invitation is accepted when the email first logs in
+CREATE TABLE IF NOT EXISTS invitations(
+   id                       UUID PRIMARY KEY NOT NULL,
+   email                    varchar(255) NOT NULL,
+   roles                    JSONB NOT NULL DEFAULT '[]',
+   invited_by               varchar(64) NOT NULL,
+   created_at               TIMESTAMP DEFAULT now(),
+   expires_at               TIMESTAMP NOT NULL,
+   accepted_at              TIMESTAMP,
+   accepted_uid             UUID REFERENCES users(uid) ON DELETE SET NULL
+);
+CREATE INDEX IF NOT EXISTS invitations_email_idx ON invitations (email, created_at) WHERE accepted_at IS NULL;
+
+-- every login and refresh, uid is null when the identity was not recognised
+CREATE TABLE IF NOT EXISTS login_events(
+   id                       BIGSERIAL PRIMARY KEY,
+   uid                      UUID REFERENCES users(uid) ON DELETE CASCADE,
+   event_type               varchar(16) NOT NULL,
+   provider                 varchar(255) NOT NULL DEFAULT '',
+   ip_address               varchar(64) NOT NULL DEFAULT '',
+   user_agent               varchar(512) NOT NULL DEFAULT '',
+   outcome                  varchar(16) NOT NULL,
+   reason                   varchar(255) NOT NULL DEFAULT '',
+   created_at               TIMESTAMP DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS login_events_uid_idx ON login_events (uid, id);
+
+-- identity providers which provision users and groups through the SCIM endpoints, the bearer token is stored as its
+-- sha256 hex digest
+CREATE TABLE IF NOT EXISTS scim_clients(
+   id                       varchar(255) PRIMARY KEY NOT NULL,
+   name                     varchar(255) NOT NULL,
+   token_hash               varchar(64) NOT NULL UNIQUE,
+   created_at               TIMESTAMP DEFAULT now()
+);
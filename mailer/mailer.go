@@ -0,0 +1,93 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"net/smtp"
+	"os"
+	"strings"
+
+	"github.com/gkontos/goapi/logger"
+)
+
+// Message is a plain text email message
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email messages
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+// NewMailer will return the mailer chosen by MAILER, smtp by default or log.  The messages have login links, so they are
+// only written to the log when it is asked for, and the smtp mailer panics when SMTP_HOST is not set rather than
+// falling back to the log.
+func NewMailer() Mailer {
+	switch mailer := os.Getenv("MAILER"); mailer {
+	case "log":
+		logger.Logger.Warn().Msg("MAILER is log, email messages and the login links in them will be written to the log")
+		return NewLogMailer()
+	case "", "smtp":
+	default:
+		err := fmt.Errorf("MAILER must be smtp or log, not %s", mailer)
+		logger.Logger.Error().Err(err).Msg("MAILER is invalid")
+		panic(err)
+	}
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		err := errors.New("SMTP_HOST is required, set MAILER=log to write email messages to the log instead")
+		logger.Logger.Error().Err(err).Msg("SMTP_HOST not set")
+		panic(err)
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	return NewSMTPMailer(host, port, os.Getenv("SMTP_USER"), os.Getenv("SMTP_PASS"), os.Getenv("MAIL_FROM"))
+}
+
+type smtpMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+// NewSMTPMailer creates a mailer which delivers messages through an smtp server
+func NewSMTPMailer(host, port, user, password, from string) Mailer {
+	var auth smtp.Auth
+	if user != "" {
+		auth = smtp.PlainAuth("", user, password, host)
+	}
+	return &smtpMailer{
+		addr: host + ":" + port,
+		auth: auth,
+		from: from,
+	}
+}
+
+func (m *smtpMailer) Send(msg *Message) error {
+	if strings.ContainsAny(msg.To, "\r\n") || strings.ContainsAny(msg.Subject, "\r\n") {
+		return fmt.Errorf("invalid header value in message to %s", msg.To)
+	}
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=\"utf-8\"\r\n\r\n%s\r\n",
+		m.from, msg.To, msg.Subject, msg.Body)
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, []byte(body))
+}
+
+type logMailer struct{}
+
+// NewLogMailer creates a mailer which writes messages to the application log.  Use for local development and tests.
+func NewLogMailer() Mailer {
+	return &logMailer{}
+}
+
+func (m *logMailer) Send(msg *Message) error {
+	logger.Logger.Info().
+		Str("to", msg.To).
+		Str("subject", msg.Subject).
+		Msg(msg.Body)
+	return nil
+}
@@ -5,12 +5,14 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"time"
 
 	"flag"
 
 	"github.com/gkontos/goapi/controller"
 	"github.com/gkontos/goapi/db"
 	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/mailer"
 	"github.com/go-chi/chi/v5"
 )
 
@@ -30,7 +32,11 @@ func initModule() {
 	logger.InitLogger(*debug, *console_log)
 	dbHandler := db.NewDbHandler()
 
-	controlHandler := controller.NewController(dbHandler)
+	erasureCoolingOff := time.Duration(getEnvOrInt("ERASURE_COOLING_OFF_HOURS", 0)) * time.Hour
+	controlHandler := controller.NewController(dbHandler, mailer.NewMailer(), erasureCoolingOff)
+	if erasureCoolingOff > 0 {
+		go controlHandler.RunErasures(time.Hour)
+	}
 	router = controller.NewRouter(allowed_origins, controlHandler, dbHandler).SetupRouter()
 }
 
@@ -68,3 +74,16 @@ func getEnvOrBool(key string, defaultValue bool) bool {
 	}
 	return defaultValue
 }
+
+func getEnvOrInt(key string, defaultValue int) int {
+	envValue, exists := os.LookupEnv(key)
+	if exists {
+		val, err := strconv.Atoi(envValue)
+		if err != nil {
+			logger.Logger.Error().Msg(fmt.Sprintf("failed to parse %s, using default value", key))
+			return defaultValue
+		}
+		return val
+	}
+	return defaultValue
+}
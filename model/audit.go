@@ -0,0 +1,39 @@
+package model
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// AuditEntry records a change made to a user
+type AuditEntry struct {
+	ID        int64     `json:"id"`
+	ActorUID  string    `json:"actor_uid"`
+	Action    string    `json:"action"`
+	TargetUID string    `json:"target_uid"`
+	Details   JSONMap   `json:"details"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// JSONMap is a json object stored as jsonb
+type JSONMap map[string]interface{}
+
+// for pg jsonb value
+func (m JSONMap) Value() (driver.Value, error) {
+	if m == nil {
+		return []byte(`{}`), nil
+	}
+	return json.Marshal(map[string]interface{}(m))
+}
+
+// for pg jsonb value
+func (m *JSONMap) Scan(value interface{}) error {
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("type assertion to []byte failed")
+	}
+
+	return json.Unmarshal(b, m)
+}
@@ -0,0 +1,22 @@
+package model
+
+import "time"
+
+const (
+	DeviceAuthorizationPending  = "pending"
+	DeviceAuthorizationApproved = "approved"
+	DeviceAuthorizationDenied   = "denied"
+)
+
+// DeviceAuthorization is an rfc 8628 device authorization request waiting for a user to approve it
+type DeviceAuthorization struct {
+	DeviceCodeHash string     `json:"-"`
+	UserCode       string     `json:"user_code"`
+	ClientID       string     `json:"client_id"`
+	Scope          string     `json:"scope"`
+	UID            string     `json:"-"`
+	Status         string     `json:"status"`
+	Interval       int        `json:"interval"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+	LastPolledAt   *time.Time `json:"-"`
+}
@@ -0,0 +1,13 @@
+package model
+
+import "time"
+
+// Erasure is a request to anonymize a user.  The user is erased once EraseAfter has passed unless the request is
+// cancelled first.
+type Erasure struct {
+	UID         string     `json:"uid"`
+	RequestedBy string     `json:"requested_by"`
+	RequestedAt time.Time  `json:"requested_at"`
+	EraseAfter  time.Time  `json:"erase_after"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
@@ -11,6 +11,14 @@ func (e *GenericError) Error() string {
 type ValidationError struct {
 	Err     error
 	Message string
+	// Fields lists the invalid fields of a document, they are returned with the error
+	Fields []FieldError
+}
+
+// FieldError is a field which failed validation.  Nested fields are named with dots, eg notifications.email.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
 }
 
 func (e *ValidationError) Error() string {
@@ -35,3 +43,74 @@ type AuthenticationError struct {
 func (e *AuthenticationError) Error() string {
 	return e.Err.Error()
 }
+
+// UserInactiveError is returned when a user who is not active tries to log in or use a token
+type UserInactiveError struct {
+	Status string
+}
+
+func (e *UserInactiveError) Error() string {
+	return "user is " + e.Status
+}
+
+// ErrorCode distinguishes an inactive user from other authentication failures
+func (e *UserInactiveError) ErrorCode() string {
+	return "user_inactive"
+}
+
+// ReauthenticationRequiredError is returned when an action requires the user to have logged in recently
+type ReauthenticationRequiredError struct {
+	Err error
+}
+
+func (e *ReauthenticationRequiredError) Error() string {
+	return e.Err.Error()
+}
+
+// ErrorCode tells clients to send the user through a login before retrying
+func (e *ReauthenticationRequiredError) ErrorCode() string {
+	return "reauthentication_required"
+}
+
+// PermissionDeniedError is returned when an authenticated user asks for more than they are allowed, eg to grant a role
+// which they do not hold
+type PermissionDeniedError struct {
+	Err error
+}
+
+func (e *PermissionDeniedError) Error() string {
+	return e.Err.Error()
+}
+
+// ErrorCode distinguishes a denied change from a request which the route policy forbids
+func (e *PermissionDeniedError) ErrorCode() string {
+	return "permission_denied"
+}
+
+// InvitationRequiredError is returned when a new user logs in without an invitation while registration is invite only
+type InvitationRequiredError struct {
+	Err error
+}
+
+func (e *InvitationRequiredError) Error() string {
+	return e.Err.Error()
+}
+
+// ErrorCode tells clients that the user has to be invited before they can log in
+func (e *InvitationRequiredError) ErrorCode() string {
+	return "invitation_required"
+}
+
+// VersionConflictError is returned when a change is based on a version of a resource which is no longer current
+type VersionConflictError struct {
+	Err error
+}
+
+func (e *VersionConflictError) Error() string {
+	return e.Err.Error()
+}
+
+// ErrorCode tells clients to read the resource again before retrying the change
+func (e *VersionConflictError) ErrorCode() string {
+	return "version_conflict"
+}
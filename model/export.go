@@ -0,0 +1,49 @@
+package model
+
+import "time"
+
+const (
+	ExportStatusPending  = "pending"
+	ExportStatusComplete = "complete"
+	ExportStatusFailed   = "failed"
+)
+
+// UserExport tracks the generation of a user's data archive
+type UserExport struct {
+	ID          string     `json:"id"`
+	UID         string     `json:"uid"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+}
+
+// UserArchive is everything stored about a user
+type UserArchive struct {
+	ExportedAt    time.Time    `json:"exported_at"`
+	User          *User        `json:"user"`
+	Preferences   JSONMap      `json:"preferences"`
+	Identities    []Identity   `json:"identities"`
+	Sessions      []Session    `json:"sessions"`
+	Organizations []Membership `json:"organizations"`
+	Groups        []Group      `json:"groups"`
+	AuditEntries  []AuditEntry `json:"audit_entries"`
+	Logins        []LoginEvent `json:"logins"`
+}
+
+// Identity is an identity provider account the user logs in with
+type Identity struct {
+	Provider   string `json:"provider"`
+	ProviderID string `json:"provider_id"`
+}
+
+// Session is a grant of access to a client, eg an approved device.  Access tokens are not stored.
+type Session struct {
+	Type      string     `json:"type"`
+	ClientID  string     `json:"client_id"`
+	Scope     string     `json:"scope"`
+	Status    string     `json:"status,omitempty"`
+	AuthTime  *time.Time `json:"auth_time,omitempty"`
+	ExpiresAt time.Time  `json:"expires_at"`
+}
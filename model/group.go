@@ -0,0 +1,13 @@
+package model
+
+import "time"
+
+// Group grants its roles to every member.  A group belongs to an organization, or is global when OrgID is empty.
+type Group struct {
+	ID          string     `json:"id"`
+	OrgID       string     `json:"organization_id,omitempty"`
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Roles       StringList `json:"roles"`
+	CreatedDate time.Time  `json:"created_date"`
+}
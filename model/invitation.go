@@ -0,0 +1,16 @@
+package model
+
+import "time"
+
+// Invitation pre-assigns roles to an email address.  The roles replace the default role of the user who first logs
+// in with a verified copy of the email before the invitation expires.
+type Invitation struct {
+	ID          string     `json:"id"`
+	Email       string     `json:"email"`
+	Roles       StringList `json:"roles"`
+	InvitedBy   string     `json:"invited_by"`
+	CreatedDate time.Time  `json:"created_date"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	AcceptedAt  *time.Time `json:"accepted_at,omitempty"`
+	AcceptedUID string     `json:"accepted_uid,omitempty"`
+}
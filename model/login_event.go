@@ -0,0 +1,37 @@
+package model
+
+import "time"
+
+const (
+	LoginTypeLogin   = "login"
+	LoginTypeRefresh = "refresh"
+
+	LoginOutcomeSuccess = "success"
+	LoginOutcomeFailure = "failure"
+)
+
+// LoginEvent records a login or token refresh and its outcome.  UID is empty when the identity was not recognised.
+type LoginEvent struct {
+	ID        int64     `json:"id"`
+	UID       string    `json:"uid,omitempty"`
+	Type      string    `json:"type"`
+	Provider  string    `json:"provider,omitempty"`
+	IPAddress string    `json:"ip_address"`
+	UserAgent string    `json:"user_agent"`
+	Outcome   string    `json:"outcome"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// LoginEventQuery selects a page of a user's login events, newest first, before the event with the ID Before
+type LoginEventQuery struct {
+	UID    string
+	Limit  int
+	Before int64
+}
+
+// LoginEventPage is a page of login events and the cursor of the next page, which is empty on the last page
+type LoginEventPage struct {
+	Logins     []LoginEvent `json:"logins"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
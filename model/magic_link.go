@@ -0,0 +1,11 @@
+package model
+
+import "time"
+
+// MagicLink is a single use passwordless login link issued to an email address
+type MagicLink struct {
+	ID         string     `json:"id"`
+	Email      string     `json:"email"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	ConsumedAt *time.Time `json:"consumed_at,omitempty"`
+}
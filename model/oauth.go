@@ -0,0 +1,62 @@
+package model
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// OAuthClient is an application registered to use this service as its identity provider
+type OAuthClient struct {
+	ClientID     string     `json:"client_id"`
+	SecretHash   string     `json:"-"`
+	Name         string     `json:"name"`
+	RedirectURIs StringList `json:"redirect_uris"`
+	Confidential bool       `json:"confidential"`
+}
+
+// AllowsRedirect returns true if the redirect uri is registered for the client
+func (c *OAuthClient) AllowsRedirect(redirectURI string) bool {
+	for _, uri := range c.RedirectURIs {
+		if uri == redirectURI {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthorizationCode is a single use code issued by the authorize endpoint
+type AuthorizationCode struct {
+	CodeHash            string
+	ClientID            string
+	UID                 string
+	RedirectURI         string
+	Scope               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	AuthTime            time.Time
+	ExpiresAt           time.Time
+}
+
+// StringList is a list of strings stored as a jsonb array
+type StringList []string
+
+// for pg jsonb value
+func (l StringList) Value() (driver.Value, error) {
+	if l == nil {
+		return json.Marshal([]string{})
+	}
+	return json.Marshal([]string(l))
+}
+
+// for pg jsonb value
+func (l *StringList) Scan(value interface{}) error {
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("type assertion to []byte failed")
+	}
+
+	return json.Unmarshal(b, l)
+}
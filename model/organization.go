@@ -0,0 +1,18 @@
+package model
+
+import "time"
+
+// Organization is a customer tenant.  Users belong to organizations through memberships.
+type Organization struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	CreatedDate time.Time `json:"created_date"`
+}
+
+// Membership grants a user roles within an organization in addition to their global roles
+type Membership struct {
+	OrgID   string     `json:"organization_id"`
+	OrgName string     `json:"organization_name,omitempty"`
+	UID     string     `json:"uid"`
+	Roles   StringList `json:"roles"`
+}
@@ -0,0 +1,8 @@
+package model
+
+// Preferences are the settings a user's clients store for them.  Version is incremented by every change so that
+// clients can detect changes made from another device.
+type Preferences struct {
+	Version int     `json:"version"`
+	Values  JSONMap `json:"values"`
+}
@@ -0,0 +1,10 @@
+package model
+
+// Role is a named set of permissions which can be granted to users.  A role also has the permissions of the roles
+// it inherits.
+type Role struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Permissions StringList `json:"permissions"`
+	Inherits    StringList `json:"inherits"`
+}
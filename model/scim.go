@@ -0,0 +1,164 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// SCIM 2.0 schema and message urns, RFC 7643 and RFC 7644
+const (
+	SCIMUserSchema                  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	SCIMGroupSchema                 = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	SCIMListResponseSchema          = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	SCIMPatchOpSchema               = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	SCIMErrorSchema                 = "urn:ietf:params:scim:api:messages:2.0:Error"
+	SCIMServiceProviderConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	SCIMResourceTypeSchema          = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+)
+
+// ProvisioningClient is an identity provider which manages users and groups through the SCIM endpoints.  It
+// authenticates with a bearer token which is stored as a hash.
+type ProvisioningClient struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	TokenHash string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ProvisionedUser is a user with the id the provisioning client knows them by
+type ProvisionedUser struct {
+	User
+	ExternalID string
+}
+
+// ProvisionedUserQuery selects a page of the users which have not been deleted.  Zero values do not filter, userName
+// and email are matched ignoring case.
+type ProvisionedUserQuery struct {
+	UID        string
+	UserName   string
+	ExternalID string
+	Email      string
+	Active     *bool
+	Offset     int
+	Limit      int
+}
+
+// ProvisionedUserPage is a page of users and the number of users the query selects
+type ProvisionedUserPage struct {
+	Users []ProvisionedUser
+	Total int
+}
+
+// SCIMUser is the SCIM representation of a user
+type SCIMUser struct {
+	Schemas     []string         `json:"schemas"`
+	ID          string           `json:"id,omitempty"`
+	ExternalID  string           `json:"externalId,omitempty"`
+	UserName    string           `json:"userName"`
+	Name        *SCIMName        `json:"name,omitempty"`
+	DisplayName string           `json:"displayName,omitempty"`
+	Emails      []SCIMMultiValue `json:"emails,omitempty"`
+	Active      *SCIMBool        `json:"active,omitempty"`
+	Roles       []SCIMMultiValue `json:"roles,omitempty"`
+	Meta        *SCIMMeta        `json:"meta,omitempty"`
+}
+
+type SCIMName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+// SCIMMultiValue is a value of a multi-valued attribute such as emails, roles or members
+type SCIMMultiValue struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+// SCIMBool is a boolean which some provisioning clients send as the string "True" or "False"
+type SCIMBool bool
+
+func (b *SCIMBool) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case bool:
+		*b = SCIMBool(v)
+		return nil
+	case string:
+		switch strings.ToLower(v) {
+		case "true":
+			*b = true
+			return nil
+		case "false":
+			*b = false
+			return nil
+		}
+	}
+	return errors.New("must be a boolean")
+}
+
+// SCIMGroup is the SCIM representation of a group
+type SCIMGroup struct {
+	Schemas     []string         `json:"schemas"`
+	ID          string           `json:"id,omitempty"`
+	DisplayName string           `json:"displayName"`
+	Members     []SCIMMultiValue `json:"members,omitempty"`
+	Meta        *SCIMMeta        `json:"meta,omitempty"`
+}
+
+type SCIMMeta struct {
+	ResourceType string     `json:"resourceType"`
+	Created      *time.Time `json:"created,omitempty"`
+	Location     string     `json:"location"`
+}
+
+// SCIMListResponse is a page of resources, StartIndex is one based
+type SCIMListResponse struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int           `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+// SCIMPatchRequest changes a resource with a list of operations which are applied in order
+type SCIMPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []SCIMPatchOperation `json:"Operations"`
+}
+
+// SCIMPatchOperation adds, replaces or removes the value at the path.  Without a path the value is an object of
+// attributes.
+type SCIMPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// SCIMError is the body of an error response, Status is the http status as a string
+type SCIMError struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail"`
+}
+
+// SCIMRequestError is an error the provisioning client can correct, ScimType is the SCIM detail error keyword such as
+// invalidFilter or uniqueness
+type SCIMRequestError struct {
+	Status   int
+	ScimType string
+	Err      error
+}
+
+func (e *SCIMRequestError) Error() string {
+	return e.Err.Error()
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql/driver"
 	"encoding/json"
 	"errors"
+	"strings"
 	"time"
 )
 
@@ -15,16 +16,43 @@ type User struct {
 	ProviderID   string      `json:"provider_id"`
 	UserName     string      `json:"user_name"`
 	CreatedDate  time.Time   `json:"created_date"`
-	LastLogin    time.Time   `json:"last_login_date"`
+	LastLogin    *time.Time  `json:"last_login_date"`
 	UserDetails  UserDetails `json:"user_details,omitempty"`
+	Status       string      `json:"status"`
+	StatusReason string      `json:"status_reason,omitempty"`
+	// OrgID is the active organization of an authenticated user, it is not stored
+	OrgID string `json:"-"`
 }
 
+const (
+	UserStatusActive      = "active"
+	UserStatusSuspended   = "suspended"
+	UserStatusDeactivated = "deactivated"
+	UserStatusDeleted     = "deleted"
+	// UserStatusPending and UserStatusRejected are new users waiting for, or refused, approval of their registration
+	UserStatusPending  = "pending"
+	UserStatusRejected = "rejected"
+)
+
+// UserStatuses are the states of the user lifecycle.  Only active users can log in or use their tokens.
+var UserStatuses = []string{UserStatusActive, UserStatusSuspended, UserStatusDeactivated, UserStatusDeleted}
+
+// RegistrationStatuses are the states of new users before an admin has approved them
+var RegistrationStatuses = []string{UserStatusPending, UserStatusRejected}
+
 type UserDetails struct {
 	FirstName string   `json:"first_name,omitempty"`
 	LastName  string   `json:"last_name,omitempty"`
 	Email     string   `json:"email,omitempty"`
 	FullName  string   `json:"full_name"`
 	Roles     []string `json:"roles"`
+	// EmailVerified is true when the identity provider verified the email, it is set at login
+	EmailVerified bool `json:"email_verified,omitempty"`
+}
+
+// KeepEmailVerified carries the verification of the stored email over to details which have the same email
+func (ud *UserDetails) KeepEmailVerified(stored UserDetails) {
+	ud.EmailVerified = stored.EmailVerified && strings.EqualFold(ud.Email, stored.Email)
 }
 
 // HasRole returns true if the user is in the role
@@ -37,6 +65,14 @@ func (u *User) HasRole(roleName string) bool {
 	return false
 }
 
+// CheckActive returns a UserInactiveError unless the user is active.  A user without a status is active.
+func (u *User) CheckActive() error {
+	if u.Status != "" && u.Status != UserStatusActive {
+		return &UserInactiveError{Status: u.Status}
+	}
+	return nil
+}
+
 // for pg jsonb value : Make the Attrs struct implement the driver.Valuer interface. This method
 // simply returns the JSON-encoded representation of the struct.
 func (ud UserDetails) Value() (driver.Value, error) {
@@ -0,0 +1,45 @@
+package model
+
+const (
+	// ImportMatchProviderID updates the user with the auth provider and provider id of a record
+	ImportMatchProviderID = "provider_id"
+	// ImportMatchEmail updates the user whose verified email is the email of a record, ignoring case
+	ImportMatchEmail = "email"
+
+	// MaxUserImportRecords is the most users one import can create or update
+	MaxUserImportRecords = 10000
+)
+
+// UserRecordFields are the columns of a bulk import or export in CSV.  uid and status are exported but not imported.
+var UserRecordFields = []string{"uid", "auth_provider", "provider_id", "user_name", "email", "first_name", "last_name",
+	"full_name", "roles", "status"}
+
+// UserRecord is a user in a bulk import or export
+type UserRecord struct {
+	UID          string   `json:"uid,omitempty"`
+	AuthProvider string   `json:"auth_provider,omitempty"`
+	ProviderID   string   `json:"provider_id,omitempty"`
+	UserName     string   `json:"user_name,omitempty"`
+	Email        string   `json:"email,omitempty"`
+	FirstName    string   `json:"first_name,omitempty"`
+	LastName     string   `json:"last_name,omitempty"`
+	FullName     string   `json:"full_name,omitempty"`
+	Roles        []string `json:"roles,omitempty"`
+	Status       string   `json:"status,omitempty"`
+}
+
+// UserImportResult is what an import did, or would have done when it is a dry run.  Nothing is imported when any
+// record has errors.
+type UserImportResult struct {
+	DryRun  bool              `json:"dry_run"`
+	Match   string            `json:"match"`
+	Created int               `json:"created"`
+	Updated int               `json:"updated"`
+	Errors  []UserImportError `json:"errors"`
+}
+
+// UserImportError is a record which can not be imported.  Line is the line of the record in the import.
+type UserImportError struct {
+	Line   int          `json:"line"`
+	Fields []FieldError `json:"fields"`
+}
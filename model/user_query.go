@@ -0,0 +1,100 @@
+package model
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	DefaultUserPageSize = 50
+	MaxUserPageSize     = 200
+)
+
+// UserSortFields are the fields a user listing can be sorted by
+var UserSortFields = []string{"created_date", "last_login_date", "user_name"}
+
+// UserQuery selects a page of users.  Zero values do not filter.
+type UserQuery struct {
+	Limit         int
+	Sort          string
+	Desc          bool
+	After         *UserCursor
+	Role          string
+	EmailDomain   string
+	Provider      string
+	Status        string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	UpdatedAfter  time.Time
+	UpdatedBefore time.Time
+}
+
+// UserCursor is the position of the last user on a page.  It records the sort it was issued for so that it can not
+// be used with a different ordering.
+type UserCursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d,omitempty"`
+	Value string `json:"v"`
+	UID   string `json:"u"`
+}
+
+// UserSearch selects a page of the users which best match a search term
+type UserSearch struct {
+	Q     string
+	Limit int
+	After *UserSearchCursor
+}
+
+// UserSearchCursor is the position of the last user on a page of search results.  It records the search term it was
+// issued for so that it can not be used with a different search.
+type UserSearchCursor struct {
+	Q    string  `json:"q"`
+	Rank float32 `json:"r"`
+	UID  string  `json:"u"`
+}
+
+// UserPage is a page of users and the cursor of the next page, which is empty on the last page
+type UserPage struct {
+	Users      []User `json:"users"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// Encode returns the opaque form of the cursor used by clients
+func (c *UserCursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeUserCursor parses a cursor returned by Encode
+func DecodeUserCursor(s string) (*UserCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, &ValidationError{Err: errors.New("invalid cursor")}
+	}
+	c := &UserCursor{}
+	if err := json.Unmarshal(b, c); err != nil || c.Sort == "" || c.UID == "" {
+		return nil, &ValidationError{Err: errors.New("invalid cursor")}
+	}
+	return c, nil
+}
+
+// Encode returns the opaque form of the cursor used by clients
+func (c *UserSearchCursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeUserSearchCursor parses a cursor returned by Encode
+func DecodeUserSearchCursor(s string) (*UserSearchCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, &ValidationError{Err: errors.New("invalid cursor")}
+	}
+	c := &UserSearchCursor{}
+	if err := json.Unmarshal(b, c); err != nil || c.Q == "" || c.UID == "" {
+		return nil, &ValidationError{Err: errors.New("invalid cursor")}
+	}
+	return c, nil
+}
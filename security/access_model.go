@@ -0,0 +1,30 @@
+package security
+
+import (
+	"net/http"
+
+	"github.com/gkontos/goapi/model"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// OwnerAccessModel allows a user to access the record addressed by the {uid} url parameter when it is their own
+	OwnerAccessModel = "owner"
+)
+
+// AccessRule decides from the request's target resource whether the user may access it without holding the route's permissions
+type AccessRule func(r *http.Request, user *model.User) bool
+
+var accessModels = map[string]AccessRule{
+	OwnerAccessModel: ownerRule,
+}
+
+// RegisterAccessModel will make a rule available to AuthorizeModel.  Models must be registered before routes are set up.
+func RegisterAccessModel(name string, rule AccessRule) {
+	accessModels[name] = rule
+}
+
+func ownerRule(r *http.Request, user *model.User) bool {
+	uid := chi.URLParam(r, "uid")
+	return uid != "" && user.UID != "" && uid == user.UID
+}
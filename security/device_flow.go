@@ -0,0 +1,208 @@
+package security
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gkontos/goapi/model"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	DeviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+	// user codes avoid vowels and easily confused characters
+	userCodeCharacters = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength     = 8
+)
+
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// DeviceApprovalRequest describes a pending device request to the user who is asked to approve it
+type DeviceApprovalRequest struct {
+	UserCode   string    `json:"user_code"`
+	ClientID   string    `json:"client_id"`
+	ClientName string    `json:"client_name"`
+	Scope      string    `json:"scope"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// StartDeviceAuthorization creates the device and user codes for a registered client
+func (s *authorizationServer) StartDeviceAuthorization(clientID, scope string) (*DeviceAuthorizationResponse, error) {
+
+	client, err := s.dbh.GetOAuthClient(clientID)
+	if err != nil {
+		var notFound *model.ResourceDoesNotExistError
+		if errors.As(err, &notFound) {
+			return nil, &OAuthError{Code: "invalid_client", Description: "unknown client", Status: http.StatusUnauthorized}
+		}
+		return nil, err
+	}
+	for _, sc := range strings.Fields(scope) {
+		if !containsString(supportedScopes, sc) {
+			return nil, &OAuthError{Code: "invalid_scope", Description: "unsupported scope " + sc, Status: http.StatusBadRequest}
+		}
+	}
+
+	deviceCode, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+	userCode, err := randomUserCode()
+	if err != nil {
+		return nil, err
+	}
+
+	expiresIn := time.Minute * time.Duration(deviceCodeExpirationMinutes)
+	err = s.dbh.InsertDeviceAuthorization(&model.DeviceAuthorization{
+		DeviceCodeHash: hashSecret(deviceCode),
+		UserCode:       userCode,
+		ClientID:       client.ClientID,
+		Scope:          scope,
+		Status:         model.DeviceAuthorizationPending,
+		Interval:       devicePollIntervalSeconds,
+		ExpiresAt:      time.Now().Add(expiresIn),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeviceAuthorizationResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         deviceVerificationURL,
+		VerificationURIComplete: appendQuery(deviceVerificationURL, map[string]string{"user_code": userCode}),
+		ExpiresIn:               int(expiresIn.Seconds()),
+		Interval:                devicePollIntervalSeconds,
+	}, nil
+}
+
+// GetDeviceApprovalRequest returns the pending request for a user code so that it can be shown to the user
+func (s *authorizationServer) GetDeviceApprovalRequest(userCode string) (*DeviceApprovalRequest, error) {
+
+	d, err := s.dbh.GetPendingDeviceAuthorization(normalizeUserCode(userCode))
+	if err != nil {
+		return nil, err
+	}
+	client, err := s.dbh.GetOAuthClient(d.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	return &DeviceApprovalRequest{
+		UserCode:   d.UserCode,
+		ClientID:   client.ClientID,
+		ClientName: client.Name,
+		Scope:      d.Scope,
+		ExpiresAt:  d.ExpiresAt,
+	}, nil
+}
+
+// DecideDeviceAuthorization will approve or deny the pending request for the authenticated user
+func (s *authorizationServer) DecideDeviceAuthorization(userCode string, approve bool, claims Claims) error {
+	if claims.UID == "" {
+		return errors.New("user is not authenticated")
+	}
+	status := model.DeviceAuthorizationDenied
+	if approve {
+		status = model.DeviceAuthorizationApproved
+	}
+	return s.dbh.DecideDeviceAuthorization(normalizeUserCode(userCode), claims.UID, status)
+}
+
+// PollDeviceToken returns the user's token pair once they have approved the request.  The client is authenticated as it
+// is at the token endpoint.  Until then an OAuthError with the rfc 8628 error code is returned.
+func (s *authorizationServer) PollDeviceToken(clientID, clientSecret, deviceCode string) (*model.Token, string, error) {
+
+	client, err := s.authenticateClient(clientID, clientSecret)
+	if err != nil {
+		return nil, "", err
+	}
+	return s.pollDeviceToken(client, deviceCode)
+}
+
+func (s *authorizationServer) pollDeviceToken(client *model.OAuthClient, deviceCode string) (*model.Token, string, error) {
+
+	d, err := s.dbh.PollDeviceAuthorization(hashSecret(deviceCode))
+	if err != nil {
+		var notFound *model.ResourceDoesNotExistError
+		if errors.As(err, &notFound) {
+			return nil, "", &OAuthError{Code: "invalid_grant", Description: "device code is invalid", Status: http.StatusBadRequest}
+		}
+		return nil, "", err
+	}
+	if d.ClientID != client.ClientID {
+		return nil, "", &OAuthError{Code: "invalid_grant", Description: "device code is invalid", Status: http.StatusBadRequest}
+	}
+	if time.Now().After(d.ExpiresAt) {
+		return nil, "", &OAuthError{Code: "expired_token", Status: http.StatusBadRequest}
+	}
+
+	switch d.Status {
+	case model.DeviceAuthorizationDenied:
+		return nil, "", &OAuthError{Code: "access_denied", Status: http.StatusBadRequest}
+	case model.DeviceAuthorizationPending:
+		if d.LastPolledAt != nil && time.Since(*d.LastPolledAt) < time.Second*time.Duration(d.Interval) {
+			return nil, "", &OAuthError{Code: "slow_down", Status: http.StatusBadRequest}
+		}
+		return nil, "", &OAuthError{Code: "authorization_pending", Status: http.StatusBadRequest}
+	}
+
+	d, err = s.dbh.ConsumeDeviceAuthorization(d.DeviceCodeHash)
+	if err != nil {
+		var notFound *model.ResourceDoesNotExistError
+		if errors.As(err, &notFound) {
+			return nil, "", &OAuthError{Code: "invalid_grant", Description: "device code has already been used", Status: http.StatusBadRequest}
+		}
+		return nil, "", err
+	}
+
+	user, err := s.dbh.GetUserByUID(d.UID)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := user.CheckActive(); err != nil {
+		return nil, "", &OAuthError{Code: "invalid_grant", Description: err.Error(), Status: http.StatusBadRequest}
+	}
+	// the cli acts as the user on the api, so it gets the user's token pair rather than a token for the client
+	claims := CreateClaimsFromUser(user)
+	claims.AuthTime = jwt.NewNumericDate(time.Now())
+
+	tokens, err := s.th.obtainAccessTokens(claims)
+	if err != nil {
+		return nil, "", err
+	}
+	return tokens, d.Scope, nil
+}
+
+func randomUserCode() (string, error) {
+	code := make([]byte, userCodeLength)
+	max := big.NewInt(int64(len(userCodeCharacters)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = userCodeCharacters[n.Int64()]
+	}
+	return string(code[:userCodeLength/2]) + "-" + string(code[userCodeLength/2:]), nil
+}
+
+// normalizeUserCode lets the user type the code in lower case, with or without the dash
+func normalizeUserCode(userCode string) string {
+	code := strings.ToUpper(userCode)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	if len(code) != userCodeLength {
+		return code
+	}
+	return code[:userCodeLength/2] + "-" + code[userCodeLength/2:]
+}
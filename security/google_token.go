@@ -13,6 +13,9 @@ import (
 	"github.com/golang-jwt/jwt/v4"
 )
 
+// googleIssuer is the issuer of google sign-in tokens and the auth provider of the users they log in
+const googleIssuer = "accounts.google.com"
+
 type GoogleClaims struct {
 	GID           string `json:"sub"`
 	Email         string `json:"email"`
@@ -21,6 +24,7 @@ type GoogleClaims struct {
 	LastName      string `json:"family_name"`
 	FullName      string `json:"name"`
 	Image         string `json:"picture"`
+	Nonce         string `json:"nonce"`
 	jwt.RegisteredClaims
 }
 
@@ -28,7 +32,8 @@ type GoogleClaims struct {
 // The jwt library contains ParseUnverified
 // which can be used to get the issuer w/o actually
 // parsing the token.  That would allow an implementation based on provider to be used
-func validateGoogleJWT(tokenString string) (GoogleClaims, error) {
+// The token must have been issued to the audience, the client id the token was requested for.
+func validateGoogleJWT(tokenString string, audience string) (GoogleClaims, error) {
 	claimsStruct := GoogleClaims{}
 	jwt.TimeFunc = func() time.Time {
 		return time.Now().UTC().Add(time.Second * time.Duration(tokenGraceSeconds))
@@ -57,11 +62,11 @@ func validateGoogleJWT(tokenString string) (GoogleClaims, error) {
 		return GoogleClaims{}, errors.New("invalid token")
 	}
 
-	if claims.Issuer != "accounts.google.com" && claims.Issuer != "https://accounts.google.com" {
+	if claims.Issuer != googleIssuer && claims.Issuer != "https://"+googleIssuer {
 		return GoogleClaims{}, errors.New("iss is invalid")
 	}
 
-	if !claims.VerifyAudience(googleTokenAudience, true) {
+	if !claims.VerifyAudience(audience, true) {
 		return GoogleClaims{}, errors.New("aud is invalid")
 	}
 
@@ -0,0 +1,54 @@
+package security
+
+import (
+	"errors"
+
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+)
+
+// maxUserAgentLength is the length of the login_events user_agent column
+const maxUserAgentLength = 512
+
+// LoginClient is where a login or refresh request came from
+type LoginClient struct {
+	IPAddress string
+	UserAgent string
+}
+
+// recordLogin adds the outcome of a login or refresh to the login history.  uid is empty when the identity was not
+// recognised.  The login is not failed when it can not be recorded.
+func (s *tokenHandler) recordLogin(client LoginClient, eventType string, provider string, uid string, err error) {
+	userAgent := client.UserAgent
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	event := &model.LoginEvent{
+		UID:       uid,
+		Type:      eventType,
+		Provider:  provider,
+		IPAddress: client.IPAddress,
+		UserAgent: userAgent,
+		Outcome:   model.LoginOutcomeSuccess,
+	}
+	if err != nil {
+		event.Outcome = model.LoginOutcomeFailure
+		event.Reason = loginFailureReason(err)
+	}
+	if recordErr := s.dbh.InsertLoginEvent(event); recordErr != nil {
+		logger.Logger.Error().Err(recordErr).Str("uid", uid).Str("type", eventType).Msg("unable to record login")
+	}
+}
+
+// loginFailureReason describes a failed login without the details of the error, which may be internal
+func loginFailureReason(err error) string {
+	var inactive *model.UserInactiveError
+	if errors.As(err, &inactive) {
+		return inactive.Error()
+	}
+	var uninvited *model.InvitationRequiredError
+	if errors.As(err, &uninvited) {
+		return uninvited.Error()
+	}
+	return "authentication failed"
+}
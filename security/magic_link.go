@@ -0,0 +1,112 @@
+package security
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+)
+
+const magicLinkSubject = "magic_link"
+
+type MagicLinkClaims struct {
+	Email string `json:"email"`
+	jwt.RegisteredClaims
+}
+
+// CreateMagicLink will register a single use login link for the email address and return the url which should be sent to the user
+func (s *tokenHandler) CreateMagicLink(email string) (string, error) {
+
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return "", errors.New("email is required to create a magic link")
+	}
+
+	link := &model.MagicLink{
+		ID:        uuid.NewString(),
+		Email:     email,
+		ExpiresAt: time.Now().Add(time.Minute * time.Duration(magicLinkExpirationMinutes)),
+	}
+	if err := s.dbh.InsertMagicLink(link); err != nil {
+		return "", err
+	}
+
+	claims := MagicLinkClaims{
+		Email: email,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        link.ID,
+			ExpiresAt: jwt.NewNumericDate(link.ExpiresAt),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Issuer:    "local",
+			Subject:   magicLinkSubject,
+			Audience:  []string{"local"},
+		},
+	}
+	signedToken, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(signingKey)
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("unable to create magic link token")
+		return "", err
+	}
+
+	u, err := url.Parse(magicLinkURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("token", signedToken)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// ValidateMagicLinkAndCreateAccessToken will
+// validate and consume the magic link token; add / update the email user; create access tokens for the local issuer
+func (s *tokenHandler) ValidateMagicLinkAndCreateAccessToken(t string, client LoginClient) (*model.Token, error) {
+
+	claims, err := s.consumeMagicLink(t)
+	if err != nil {
+		s.recordLogin(client, model.LoginTypeLogin, EmailProvider, "", err)
+		return nil, err
+	}
+	return s.loginLocalUser(claims, client)
+}
+
+// consumeMagicLink validates the magic link token and returns the claims of the email user it logs in
+func (s *tokenHandler) consumeMagicLink(t string) (Claims, error) {
+
+	token, err := jwt.ParseWithClaims(t, &MagicLinkClaims{}, func(token *jwt.Token) (interface{}, error) {
+		return verificationKey, nil
+	})
+	if err != nil {
+		return Claims{}, err
+	}
+	linkClaims, ok := token.Claims.(*MagicLinkClaims)
+	if !ok || !token.Valid {
+		return Claims{}, errors.New("invalid token")
+	}
+	if linkClaims.Subject != magicLinkSubject {
+		return Claims{}, errors.New("invalid token subject")
+	}
+
+	link, err := s.dbh.ConsumeMagicLink(linkClaims.ID)
+	if err != nil {
+		return Claims{}, err
+	}
+	if link.Email != linkClaims.Email {
+		return Claims{}, errors.New("magic link email does not match token")
+	}
+
+	return Claims{
+		Username:  link.Email,
+		Email:     link.Email,
+		Activated: true,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:     link.Email,
+			Issuer: EmailProvider,
+		},
+	}, nil
+}
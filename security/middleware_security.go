@@ -2,6 +2,7 @@ package security
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 
@@ -9,24 +10,37 @@ import (
 	"github.com/gkontos/goapi/logger"
 	"github.com/gkontos/goapi/model"
 	"github.com/gkontos/goapi/util"
+	"github.com/go-chi/chi/v5"
 	"golang.org/x/net/context"
 )
 
 type RouterSecurity interface {
 	CorsHeaders(next http.Handler) http.Handler
 	AuthenticateAuthHeader(next http.Handler) http.Handler
+	AuthenticateProvisioningClient(next http.Handler) http.Handler
 	Authorize(permissions ...Permission) func(next http.HandlerFunc) http.HandlerFunc
+	AuthorizeModel(accessModel string, permissions ...Permission) func(next http.HandlerFunc) http.HandlerFunc
+	EnforcePolicy(routes chi.Routes) func(next http.Handler) http.Handler
+	ValidatePolicy(routes chi.Routes) error
 }
 
 type defaultRouterSecurity struct {
 	allowedOrigin string
 	dbh           db.DbHandler
+	policies      routePolicies
 }
 
+// NewRouterSecurity will panic if the route policy document can not be loaded
 func NewRouterSecurity(allow_origin string, dbHandler db.DbHandler) RouterSecurity {
+	policies, err := loadRoutePolicies()
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("unable to load route policies")
+		panic(err)
+	}
 	return &defaultRouterSecurity{
 		allowedOrigin: allow_origin,
 		dbh:           dbHandler,
+		policies:      policies,
 	}
 }
 
@@ -36,9 +50,9 @@ func (s *defaultRouterSecurity) CorsHeaders(next http.Handler) http.Handler {
 
 		w.Header().Set("Access-Control-Allow-Origin", s.allowedOrigin)
 
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, PATCH, DELETE")
 		w.Header().Set("Access-Control-Allow-Headers",
-			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+			"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, If-Match")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 
 		// Stop here if its Preflighted OPTIONS request
@@ -52,36 +66,11 @@ func (s *defaultRouterSecurity) CorsHeaders(next http.Handler) http.Handler {
 
 func (s *defaultRouterSecurity) AuthenticateAuthHeader(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var tokenString string
-
-		// Get token from the Authorization header
-		// format: Authorization: Bearer
-
-		// TODO : case sensitivity in header
-		tokens, ok := r.Header["Authorization"]
-		if ok && len(tokens) >= 1 {
-			tokenString = tokens[0]
-			tokenString = strings.TrimPrefix(tokenString, "Bearer ")
-		}
-		// If the token is empty...
-		if tokenString == "" {
-			// If we get here, the required token is missing
-			loginErr := &model.AuthenticationError{
-				Err: errors.New(http.StatusText(http.StatusUnauthorized)),
-			}
-			util.ReturnErrorJSONWithCode(w, loginErr, http.StatusUnauthorized)
-			return
-		}
-
-		s := GetNewHandler(s.dbh)
-		claims, err := s.ValidateAccessToken(tokenString)
 
+		claims, err := s.authenticate(r)
 		if err != nil {
 			logger.Logger.Error().Err(err).Msg("parse with claims error")
-			loginErr := &model.AuthenticationError{
-				Err: errors.New(http.StatusText(http.StatusUnauthorized)),
-			}
-			util.ReturnErrorJSONWithCode(w, loginErr, http.StatusUnauthorized)
+			unauthenticated(w, err)
 			return
 		}
 
@@ -91,11 +80,66 @@ func (s *defaultRouterSecurity) AuthenticateAuthHeader(next http.Handler) http.H
 
 }
 
+// authenticate returns the claims of the access token in the Authorization header of an active user.  When
+// FRESH_ROLES is enabled the roles in the claims are the user's current roles.
+func (s *defaultRouterSecurity) authenticate(r *http.Request) (Claims, error) {
+	var tokenString string
+
+	// Get token from the Authorization header
+	// format: Authorization: Bearer
+
+	// TODO : case sensitivity in header
+	tokens, ok := r.Header["Authorization"]
+	if ok && len(tokens) >= 1 {
+		tokenString = tokens[0]
+		tokenString = strings.TrimPrefix(tokenString, "Bearer ")
+	}
+	// If the token is empty, the required token is missing
+	if tokenString == "" {
+		return Claims{}, errors.New("authorization token is missing")
+	}
+
+	th := GetNewHandler(s.dbh)
+	claims, err := th.ValidateAccessToken(tokenString)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	// the roles in the token may have changed since it was issued, a client's token has none
+	if freshRoles && claims.UID != "" && claims.ClientID == "" {
+		roles, orgRoles, err := th.resolveRoles(claims)
+		if err != nil {
+			return Claims{}, err
+		}
+		claims.Roles, claims.OrgRoles = roles, orgRoles
+	}
+
+	// the user may have been suspended or deleted since the token was issued
+	if claims.UID != "" {
+		if err := th.checkActive(claims.UID); err != nil {
+			return Claims{}, err
+		}
+	}
+	return claims, nil
+}
+
 // Authorize provides authorization middleware for our handlers
 func (s *defaultRouterSecurity) Authorize(permissions ...Permission) func(next http.HandlerFunc) http.HandlerFunc {
 	return s.AuthorizeModel("", permissions...)
 }
+
+// AuthorizeModel provides resource scoped authorization middleware for our handlers.
+// The request is allowed when the access model's rule passes for the target resource, otherwise the user must hold
+// every permission.  eg AuthorizeModel(OwnerAccessModel, "admin") lets a user access their own record and admins any record.
 func (s *defaultRouterSecurity) AuthorizeModel(accessModel string, permissions ...Permission) func(next http.HandlerFunc) http.HandlerFunc {
+	var rule AccessRule
+	if accessModel != "" {
+		var ok bool
+		if rule, ok = accessModels[accessModel]; !ok {
+			logger.Logger.Error().Msg(fmt.Sprintf("access model %s is not registered", accessModel))
+			panic("unknown access model")
+		}
+	}
 	return func(next http.HandlerFunc) http.HandlerFunc {
 
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -109,6 +153,10 @@ func (s *defaultRouterSecurity) AuthorizeModel(accessModel string, permissions .
 				util.ReturnErrorJSONWithCode(w, loginErr, http.StatusUnauthorized)
 				return
 			}
+			if rule != nil && rule(r, user) {
+				next.ServeHTTP(w, r)
+				return
+			}
 			for _, permission := range permissions {
 				s := GetNewHandler(s.dbh)
 				if err := s.CheckPermission(user, permission); err != nil {
@@ -0,0 +1,71 @@
+package security
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorizeModelOwner(t *testing.T) {
+	InvalidatePolicy()
+	rs := NewRouterSecurity("http://localhost", &policyTestDbHandler{})
+
+	cases := []struct {
+		claims       Claims
+		uid          string
+		expectedCode int
+	}{
+		// own record
+		{claims: Claims{UID: "tom-uid", Username: "tom", Roles: []string{UserRole}}, uid: "tom-uid", expectedCode: http.StatusOK},
+		// someone else's record
+		{claims: Claims{UID: "tom-uid", Username: "tom", Roles: []string{UserRole}}, uid: "sergei-uid", expectedCode: http.StatusForbidden},
+		// admins may access any record
+		{claims: Claims{UID: "admin-uid", Username: "admin", Roles: []string{AdministratorRole}}, uid: "sergei-uid", expectedCode: http.StatusOK},
+		// not authenticated
+		{claims: Claims{}, uid: "sergei-uid", expectedCode: http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		r := chi.NewRouter()
+		r.Use(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), UserContextKey, c.claims)))
+			})
+		})
+		r.Get("/users/{uid}", rs.AuthorizeModel(OwnerAccessModel, Permission("admin"))(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/users/"+c.uid, nil)
+		r.ServeHTTP(rr, req)
+
+		assert.Equal(t, c.expectedCode, rr.Code, "claims %v uid %s", c.claims, c.uid)
+	}
+}
+
+func TestAuthorizeModelUnknownModel(t *testing.T) {
+	rs := NewRouterSecurity("http://localhost", &policyTestDbHandler{})
+	assert.Panics(t, func() { rs.AuthorizeModel("nobody") })
+}
+
+func TestCorsHeaders(t *testing.T) {
+	rs := &defaultRouterSecurity{allowedOrigin: "http://localhost"}
+	handler := rs.CorsHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// the preflight of a merge patch with the version of the preferences
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("OPTIONS", "/v1/users/me/preferences", nil)
+	req.Header.Set("Access-Control-Request-Method", "PATCH")
+	req.Header.Set("Access-Control-Request-Headers", "If-Match")
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "http://localhost", rr.Header().Get("Access-Control-Allow-Origin"))
+	assert.Contains(t, rr.Header().Get("Access-Control-Allow-Methods"), "PATCH")
+	assert.Contains(t, rr.Header().Get("Access-Control-Allow-Headers"), "If-Match")
+}
@@ -0,0 +1,333 @@
+package security
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	oauthFlowSubject   = "oauth_flow"
+	oauthFlowValidTime = time.Minute * 10
+	GithubProvider     = "github"
+	GoogleProvider     = "google"
+)
+
+var oauthHTTPClient = &http.Client{Timeout: time.Second * 10}
+
+// OAuthProvider is an upstream identity provider which supports the authorization code flow
+type OAuthProvider struct {
+	Name         string
+	ClientID     string
+	ClientSecret string
+	AuthURL      string
+	TokenURL     string
+	Scopes       []string
+	// mapClaims will convert the token response from the provider into local claims
+	mapClaims func(p *OAuthProvider, tokenResponse *oauthTokenResponse, nonce string) (Claims, error)
+}
+
+// ProviderLogin contains the redirect to the provider and the signed flow state which must be presented on callback
+type ProviderLogin struct {
+	AuthURL   string
+	FlowToken string
+}
+
+type oauthFlowClaims struct {
+	Provider     string `json:"provider"`
+	State        string `json:"state"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+	jwt.RegisteredClaims
+}
+
+type oauthTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	IDToken          string `json:"id_token"`
+	TokenType        string `json:"token_type"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// loadOAuthProviders will configure the providers which have client credentials in the environment
+func loadOAuthProviders() map[string]*OAuthProvider {
+	providers := make(map[string]*OAuthProvider)
+
+	if secret := os.Getenv("GOOGLE_CLIENT_SECRET"); secret != "" {
+		providers[GoogleProvider] = &OAuthProvider{
+			Name:         GoogleProvider,
+			ClientID:     getenvOrString("GOOGLE_CLIENT_ID", googleTokenAudience),
+			ClientSecret: secret,
+			AuthURL:      "https://accounts.google.com/o/oauth2/v2/auth",
+			TokenURL:     "https://oauth2.googleapis.com/token",
+			Scopes:       []string{"openid", "email", "profile"},
+			mapClaims:    mapGoogleTokenResponse,
+		}
+	}
+	if secret := os.Getenv("GITHUB_CLIENT_SECRET"); secret != "" {
+		providers[GithubProvider] = &OAuthProvider{
+			Name:         GithubProvider,
+			ClientID:     mustGetenv("GITHUB_CLIENT_ID"),
+			ClientSecret: secret,
+			AuthURL:      "https://github.com/login/oauth/authorize",
+			TokenURL:     "https://github.com/login/oauth/access_token",
+			Scopes:       []string{"read:user", "user:email"},
+			mapClaims:    mapGithubTokenResponse,
+		}
+	}
+	return providers
+}
+
+func (p *OAuthProvider) redirectURL() string {
+	return fmt.Sprintf("%s/v1/login/%s/callback", strings.TrimSuffix(oauthCallbackBaseURL, "/"), p.Name)
+}
+
+// StartProviderLogin will create the authorization request for the provider.
+// The returned flow token holds the state, nonce and pkce verifier and must be returned to CompleteProviderLogin.
+func (s *tokenHandler) StartProviderLogin(provider string) (*ProviderLogin, error) {
+	p, ok := oauthProviders[provider]
+	if !ok {
+		return nil, &model.ResourceDoesNotExistError{Err: fmt.Errorf("login provider %s is not configured", provider)}
+	}
+
+	state, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	flowClaims := oauthFlowClaims{
+		Provider:     p.Name,
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(oauthFlowValidTime)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Issuer:    "local",
+			Subject:   oauthFlowSubject,
+			Audience:  []string{"local"},
+		},
+	}
+	flowToken, err := jwt.NewWithClaims(jwt.SigningMethodRS256, flowClaims).SignedString(signingKey)
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("unable to create oauth flow token")
+		return nil, err
+	}
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.ClientID)
+	q.Set("redirect_uri", p.redirectURL())
+	q.Set("scope", strings.Join(p.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", pkceChallenge(verifier))
+	q.Set("code_challenge_method", "S256")
+
+	return &ProviderLogin{
+		AuthURL:   p.AuthURL + "?" + q.Encode(),
+		FlowToken: flowToken,
+	}, nil
+}
+
+// CompleteProviderLogin will
+// verify the callback state; exchange the code with the provider; add / update user; create access tokens for the local issuer
+func (s *tokenHandler) CompleteProviderLogin(provider, code, state, flowToken string, client LoginClient) (*model.Token, error) {
+	p, ok := oauthProviders[provider]
+	if !ok {
+		return nil, &model.ResourceDoesNotExistError{Err: fmt.Errorf("login provider %s is not configured", provider)}
+	}
+
+	claims, err := s.providerClaims(p, code, state, flowToken)
+	if err != nil {
+		s.recordLogin(client, model.LoginTypeLogin, p.Name, "", err)
+		return nil, err
+	}
+	return s.loginLocalUser(claims, client)
+}
+
+// providerClaims verifies the callback of the provider's login flow and returns the claims of the provider's user
+func (s *tokenHandler) providerClaims(p *OAuthProvider, code, state, flowToken string) (Claims, error) {
+
+	token, err := jwt.ParseWithClaims(flowToken, &oauthFlowClaims{}, func(token *jwt.Token) (interface{}, error) {
+		return verificationKey, nil
+	})
+	if err != nil {
+		return Claims{}, err
+	}
+	flow, ok := token.Claims.(*oauthFlowClaims)
+	if !ok || !token.Valid || flow.Subject != oauthFlowSubject {
+		return Claims{}, errors.New("invalid oauth flow token")
+	}
+	if flow.Provider != p.Name {
+		return Claims{}, errors.New("oauth flow provider does not match callback")
+	}
+	if state == "" || flow.State != state {
+		return Claims{}, errors.New("oauth state does not match")
+	}
+	if code == "" {
+		return Claims{}, errors.New("authorization code is required")
+	}
+
+	tokenResponse, err := p.exchangeCode(code, flow.CodeVerifier)
+	if err != nil {
+		return Claims{}, err
+	}
+
+	return p.mapClaims(p, tokenResponse, flow.Nonce)
+}
+
+func (p *OAuthProvider) exchangeCode(code, verifier string) (*oauthTokenResponse, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectURL())
+	form.Set("client_id", p.ClientID)
+	form.Set("client_secret", p.ClientSecret)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequest(http.MethodPost, p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	tokenResponse := &oauthTokenResponse{}
+	if err := doJSONRequest(req, tokenResponse); err != nil {
+		return nil, err
+	}
+	if tokenResponse.Error != "" {
+		return nil, fmt.Errorf("%s token exchange failed: %s %s", p.Name, tokenResponse.Error, tokenResponse.ErrorDescription)
+	}
+	return tokenResponse, nil
+}
+
+func mapGoogleTokenResponse(p *OAuthProvider, tokenResponse *oauthTokenResponse, nonce string) (Claims, error) {
+	if tokenResponse.IDToken == "" {
+		return Claims{}, errors.New("google token response did not include an id token")
+	}
+	// the id token is issued to the client which made the code exchange
+	googleClaims, err := validateGoogleJWT(tokenResponse.IDToken, p.ClientID)
+	if err != nil {
+		return Claims{}, err
+	}
+	if googleClaims.Nonce != nonce {
+		return Claims{}, errors.New("nonce is invalid")
+	}
+	return mapGoogleClaimToClaims(googleClaims), nil
+}
+
+func mapGithubTokenResponse(p *OAuthProvider, tokenResponse *oauthTokenResponse, nonce string) (Claims, error) {
+	type githubUser struct {
+		ID        int64  `json:"id"`
+		Login     string `json:"login"`
+		Name      string `json:"name"`
+		Email     string `json:"email"`
+		AvatarURL string `json:"avatar_url"`
+	}
+	type githubEmail struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+
+	user := githubUser{}
+	if err := githubGet("https://api.github.com/user", tokenResponse.AccessToken, &user); err != nil {
+		return Claims{}, err
+	}
+	if user.ID == 0 {
+		return Claims{}, errors.New("github user id is missing")
+	}
+
+	// the public profile email is optional, so look up the primary verified address
+	email := ""
+	emails := []githubEmail{}
+	if err := githubGet("https://api.github.com/user/emails", tokenResponse.AccessToken, &emails); err != nil {
+		return Claims{}, err
+	}
+	for _, e := range emails {
+		if e.Primary && e.Verified {
+			email = e.Email
+		}
+	}
+
+	userName := user.Name
+	if userName == "" {
+		userName = user.Login
+	}
+
+	return Claims{
+		Username:  userName,
+		Email:     email,
+		Activated: email != "",
+		Image:     user.AvatarURL,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:     strconv.FormatInt(user.ID, 10),
+			Issuer: GithubProvider,
+		},
+	}, nil
+}
+
+func githubGet(endpoint, accessToken string, val interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	return doJSONRequest(req, val)
+}
+
+func doJSONRequest(req *http.Request, val interface{}) error {
+	resp, err := oauthHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1048576))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("request to %s failed with status %d", req.URL.Host, resp.StatusCode)
+	}
+	return json.Unmarshal(body, val)
+}
+
+// randomString returns a url safe string encoding n random bytes
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
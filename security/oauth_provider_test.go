@@ -0,0 +1,43 @@
+package security
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMapGoogleTokenResponseAudience(t *testing.T) {
+	GetNewHandler(&policyTestDbHandler{})
+	googleCerts["test-kid"] = verificationKey
+	p := &OAuthProvider{Name: GoogleProvider, ClientID: "web-client"}
+
+	idToken := func(audience string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, GoogleClaims{
+			GID:   "12345",
+			Email: "tom@example.com",
+			Nonce: "somenonce",
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    "https://" + googleIssuer,
+				Audience:  jwt.ClaimStrings{audience},
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+			},
+		})
+		token.Header["kid"] = "test-kid"
+		signed, err := token.SignedString(signingKey)
+		assert.NoError(t, err)
+		return signed
+	}
+
+	claims, err := mapGoogleTokenResponse(p, &oauthTokenResponse{IDToken: idToken("web-client")}, "somenonce")
+	assert.NoError(t, err)
+	assert.Equal(t, "tom@example.com", claims.Email)
+
+	// a token issued for GOOGLE_TOKEN_AUDIENCE was not issued to the provider's client
+	_, err = mapGoogleTokenResponse(p, &oauthTokenResponse{IDToken: idToken("test-audience")}, "somenonce")
+	assert.EqualError(t, err, "aud is invalid")
+
+	_, err = mapGoogleTokenResponse(p, &oauthTokenResponse{IDToken: idToken("web-client")}, "othernonce")
+	assert.EqualError(t, err, "nonce is invalid")
+}
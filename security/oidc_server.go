@@ -0,0 +1,460 @@
+package security
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gkontos/goapi/db"
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const authorizationCodeValidTime = time.Minute * 2
+
+var supportedScopes = []string{"openid", "profile", "email"}
+
+// AuthorizationServer lets first party applications use this service as their OpenID Connect identity provider
+type AuthorizationServer interface {
+	Authorize(req *AuthorizationRequest, claims Claims) (string, error)
+	ExchangeToken(req *TokenExchangeRequest) (*OAuthTokenResponse, error)
+	UserInfo(claims Claims) *UserInfo
+	Discovery() *OpenIDConfiguration
+	JWKS() *JSONWebKeySet
+	StartDeviceAuthorization(clientID, scope string) (*DeviceAuthorizationResponse, error)
+	GetDeviceApprovalRequest(userCode string) (*DeviceApprovalRequest, error)
+	DecideDeviceAuthorization(userCode string, approve bool, claims Claims) error
+	PollDeviceToken(clientID, clientSecret, deviceCode string) (*model.Token, string, error)
+}
+
+type authorizationServer struct {
+	dbh db.DbHandler
+	th  *tokenHandler
+}
+
+func NewAuthorizationServer(dbHandler db.DbHandler) AuthorizationServer {
+	return &authorizationServer{
+		dbh: dbHandler,
+		th:  GetNewHandler(dbHandler),
+	}
+}
+
+// OAuthError is an error response as defined by rfc 6749.
+// When RedirectURI is set the error should be returned to the client through the redirect uri.
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+	Status      int    `json:"-"`
+	RedirectURI string `json:"-"`
+}
+
+func (e *OAuthError) Error() string {
+	if e.Description != "" {
+		return e.Code + ": " + e.Description
+	}
+	return e.Code
+}
+
+type AuthorizationRequest struct {
+	ResponseType        string
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+type TokenExchangeRequest struct {
+	GrantType    string
+	Code         string
+	RedirectURI  string
+	ClientID     string
+	ClientSecret string
+	CodeVerifier string
+	RefreshToken string
+	DeviceCode   string
+	// Client is where the request came from, it is recorded with refreshes in the login history
+	Client LoginClient
+}
+
+type OAuthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// IDTokenClaims are the OpenID Connect claims for the profile fields of the local Claims
+type IDTokenClaims struct {
+	Nonce         string           `json:"nonce,omitempty"`
+	AuthTime      *jwt.NumericDate `json:"auth_time,omitempty"`
+	Name          string           `json:"name,omitempty"`
+	GivenName     string           `json:"given_name,omitempty"`
+	FamilyName    string           `json:"family_name,omitempty"`
+	Email         string           `json:"email,omitempty"`
+	EmailVerified bool             `json:"email_verified,omitempty"`
+	Picture       string           `json:"picture,omitempty"`
+	jwt.RegisteredClaims
+}
+
+type UserInfo struct {
+	Subject       string   `json:"sub"`
+	Name          string   `json:"name,omitempty"`
+	GivenName     string   `json:"given_name,omitempty"`
+	FamilyName    string   `json:"family_name,omitempty"`
+	Picture       string   `json:"picture,omitempty"`
+	Email         string   `json:"email,omitempty"`
+	EmailVerified bool     `json:"email_verified,omitempty"`
+	Roles         []string `json:"roles,omitempty"`
+}
+
+type OpenIDConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	DeviceAuthorizationEndpoint       string   `json:"device_authorization_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Modulus   string `json:"n"`
+	Exponent  string `json:"e"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// Authorize will issue an authorization code to the client for the authenticated user and return the client redirect
+func (s *authorizationServer) Authorize(req *AuthorizationRequest, claims Claims) (string, error) {
+
+	// errors for an unknown client or redirect uri must not be sent to the redirect uri
+	client, err := s.dbh.GetOAuthClient(req.ClientID)
+	if err != nil {
+		var notFound *model.ResourceDoesNotExistError
+		if errors.As(err, &notFound) {
+			return "", &OAuthError{Code: "invalid_request", Description: "unknown client", Status: http.StatusBadRequest}
+		}
+		return "", err
+	}
+	if req.RedirectURI == "" || !client.AllowsRedirect(req.RedirectURI) {
+		return "", &OAuthError{Code: "invalid_request", Description: "redirect_uri is not registered for the client", Status: http.StatusBadRequest}
+	}
+
+	redirectErr := func(code, description string) error {
+		return &OAuthError{
+			Code:        code,
+			Description: description,
+			Status:      http.StatusFound,
+			RedirectURI: appendQuery(req.RedirectURI, map[string]string{"error": code, "error_description": description, "state": req.State}),
+		}
+	}
+	if req.ResponseType != "code" {
+		return "", redirectErr("unsupported_response_type", "only the code response type is supported")
+	}
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != "S256" {
+		return "", redirectErr("invalid_request", "a S256 code_challenge is required")
+	}
+	for _, scope := range strings.Fields(req.Scope) {
+		if !containsString(supportedScopes, scope) {
+			return "", redirectErr("invalid_scope", "unsupported scope "+scope)
+		}
+	}
+	if claims.UID == "" {
+		return "", redirectErr("access_denied", "user is not authenticated")
+	}
+
+	code, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+	authTime := time.Now()
+	if claims.AuthTime != nil {
+		authTime = claims.AuthTime.Time
+	}
+	err = s.dbh.InsertAuthorizationCode(&model.AuthorizationCode{
+		CodeHash:            hashSecret(code),
+		ClientID:            client.ClientID,
+		UID:                 claims.UID,
+		RedirectURI:         req.RedirectURI,
+		Scope:               req.Scope,
+		Nonce:               req.Nonce,
+		CodeChallenge:       req.CodeChallenge,
+		CodeChallengeMethod: req.CodeChallengeMethod,
+		AuthTime:            authTime,
+		ExpiresAt:           time.Now().Add(authorizationCodeValidTime),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return appendQuery(req.RedirectURI, map[string]string{"code": code, "state": req.State}), nil
+}
+
+// ExchangeToken implements the token endpoint for the authorization_code, refresh_token and device_code grants
+func (s *authorizationServer) ExchangeToken(req *TokenExchangeRequest) (*OAuthTokenResponse, error) {
+
+	client, err := s.authenticateClient(req.ClientID, req.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	switch req.GrantType {
+	case "authorization_code":
+		return s.exchangeAuthorizationCode(client, req)
+	case "refresh_token":
+		return s.exchangeRefreshToken(client, req)
+	case DeviceCodeGrantType:
+		tokens, scope, err := s.pollDeviceToken(client, req.DeviceCode)
+		if err != nil {
+			return nil, err
+		}
+		return s.tokenResponse(tokens, scope), nil
+	default:
+		return nil, &OAuthError{Code: "unsupported_grant_type", Status: http.StatusBadRequest}
+	}
+}
+
+// authenticateClient returns the registered client.  Confidential clients must present their secret.
+func (s *authorizationServer) authenticateClient(clientID, secret string) (*model.OAuthClient, error) {
+	invalidClient := &OAuthError{Code: "invalid_client", Description: "client authentication failed", Status: http.StatusUnauthorized}
+	if clientID == "" {
+		return nil, invalidClient
+	}
+	client, err := s.dbh.GetOAuthClient(clientID)
+	if err != nil {
+		var notFound *model.ResourceDoesNotExistError
+		if errors.As(err, &notFound) {
+			return nil, invalidClient
+		}
+		return nil, err
+	}
+	if client.Confidential && subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(client.SecretHash)) != 1 {
+		return nil, invalidClient
+	}
+	return client, nil
+}
+
+func (s *authorizationServer) exchangeAuthorizationCode(client *model.OAuthClient, req *TokenExchangeRequest) (*OAuthTokenResponse, error) {
+	invalidGrant := &OAuthError{Code: "invalid_grant", Description: "authorization code is invalid", Status: http.StatusBadRequest}
+
+	code, err := s.dbh.ConsumeAuthorizationCode(hashSecret(req.Code))
+	if err != nil {
+		var notFound *model.ResourceDoesNotExistError
+		if errors.As(err, &notFound) {
+			return nil, invalidGrant
+		}
+		return nil, err
+	}
+	if code.ClientID != client.ClientID || code.RedirectURI != req.RedirectURI {
+		return nil, invalidGrant
+	}
+	if req.CodeVerifier == "" || subtle.ConstantTimeCompare([]byte(pkceChallenge(req.CodeVerifier)), []byte(code.CodeChallenge)) != 1 {
+		return nil, &OAuthError{Code: "invalid_grant", Description: "code_verifier is invalid", Status: http.StatusBadRequest}
+	}
+
+	user, err := s.dbh.GetUserByUID(code.UID)
+	if err != nil {
+		return nil, err
+	}
+	if err := user.CheckActive(); err != nil {
+		return nil, &OAuthError{Code: "invalid_grant", Description: err.Error(), Status: http.StatusBadRequest}
+	}
+	claims := CreateClaimsFromUser(user)
+	claims.Scope = code.Scope
+	claims.ClientID = client.ClientID
+	claims.AuthTime = jwt.NewNumericDate(code.AuthTime)
+
+	tokens, err := s.th.obtainAccessTokens(claims)
+	if err != nil {
+		return nil, err
+	}
+	response := s.tokenResponse(tokens, code.Scope)
+
+	if containsString(strings.Fields(code.Scope), "openid") {
+		idToken, err := s.createIDToken(claims, code.Nonce)
+		if err != nil {
+			return nil, err
+		}
+		response.IDToken = idToken
+	}
+	return response, nil
+}
+
+func (s *authorizationServer) exchangeRefreshToken(client *model.OAuthClient, req *TokenExchangeRequest) (*OAuthTokenResponse, error) {
+	invalidGrant := &OAuthError{Code: "invalid_grant", Description: "refresh token is invalid", Status: http.StatusBadRequest}
+
+	claims, err := s.th.ValidateAccessToken(req.RefreshToken)
+	if err != nil || claims.ClientID != client.ClientID {
+		return nil, invalidGrant
+	}
+	tokens, err := s.th.RefreshToken(req.RefreshToken, req.Client)
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("unable to refresh client token")
+		return nil, invalidGrant
+	}
+	return s.tokenResponse(tokens, claims.Scope), nil
+}
+
+func (s *authorizationServer) tokenResponse(tokens *model.Token, scope string) *OAuthTokenResponse {
+	return &OAuthTokenResponse{
+		AccessToken:  tokens.Token,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(time.Until(tokens.ExpiresAt).Seconds()),
+		RefreshToken: tokens.RefreshToken,
+		Scope:        scope,
+	}
+}
+
+func (s *authorizationServer) createIDToken(claims Claims, nonce string) (string, error) {
+	now := time.Now()
+	idClaims := IDTokenClaims{
+		Nonce:         nonce,
+		AuthTime:      claims.AuthTime,
+		Name:          claims.Username,
+		GivenName:     claims.FirstName,
+		FamilyName:    claims.LastName,
+		Email:         claims.Email,
+		EmailVerified: claims.Activated,
+		Picture:       claims.Image,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    oidcIssuer,
+			Subject:   claims.UID,
+			Audience:  []string{claims.ClientID},
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute * time.Duration(tokenExpirationMinutes))),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, idClaims)
+	token.Header["kid"] = signingKeyID()
+	signedToken, err := token.SignedString(signingKey)
+	if err != nil {
+		logger.Logger.Error().Err(err).Msg("unable to create id token")
+		return "", err
+	}
+	return signedToken, nil
+}
+
+// UserInfo returns the profile for the token.  Tokens issued to a client only include the claims for the granted scopes.
+func (s *authorizationServer) UserInfo(claims Claims) *UserInfo {
+	info := &UserInfo{Subject: claims.UID}
+	scopes := strings.Fields(claims.Scope)
+	if claims.ClientID == "" || containsString(scopes, "profile") {
+		info.Name = claims.Username
+		info.GivenName = claims.FirstName
+		info.FamilyName = claims.LastName
+		info.Picture = claims.Image
+		info.Roles = claims.Roles
+	}
+	if claims.ClientID == "" || containsString(scopes, "email") {
+		info.Email = claims.Email
+		info.EmailVerified = claims.Activated
+	}
+	return info
+}
+
+func (s *authorizationServer) Discovery() *OpenIDConfiguration {
+	issuer := strings.TrimSuffix(oidcIssuer, "/")
+	return &OpenIDConfiguration{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             issuer + "/oauth2/authorize",
+		TokenEndpoint:                     issuer + "/oauth2/token",
+		UserInfoEndpoint:                  issuer + "/oauth2/userinfo",
+		DeviceAuthorizationEndpoint:       issuer + "/v1/login/device",
+		JWKSURI:                           issuer + "/oauth2/jwks",
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code", "refresh_token", DeviceCodeGrantType},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{"RS256"},
+		ScopesSupported:                   supportedScopes,
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported:                   []string{"sub", "name", "given_name", "family_name", "picture", "email", "email_verified", "roles"},
+	}
+}
+
+func (s *authorizationServer) JWKS() *JSONWebKeySet {
+	return &JSONWebKeySet{
+		Keys: []JSONWebKey{
+			{
+				KeyType:   "RSA",
+				Use:       "sig",
+				Algorithm: "RS256",
+				KeyID:     signingKeyID(),
+				Modulus:   base64.RawURLEncoding.EncodeToString(verificationKey.N.Bytes()),
+				Exponent:  base64.RawURLEncoding.EncodeToString(big.NewInt(int64(verificationKey.E)).Bytes()),
+			},
+		},
+	}
+}
+
+// signingKeyID is the rfc 7638 thumbprint of the verification key
+func signingKeyID() string {
+	thumbprintInput, _ := json.Marshal(struct {
+		E   string `json:"e"`
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+	}{
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(verificationKey.E)).Bytes()),
+		Kty: "RSA",
+		N:   base64.RawURLEncoding.EncodeToString(verificationKey.N.Bytes()),
+	})
+	sum := sha256.Sum256(thumbprintInput)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// hashSecret is used to store codes and client secrets.  These are random values so a fast hash is sufficient.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func appendQuery(rawURL string, params map[string]string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	q := u.Query()
+	for k, v := range params {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func containsString(list []string, val string) bool {
+	for _, item := range list {
+		if item == val {
+			return true
+		}
+	}
+	return false
+}
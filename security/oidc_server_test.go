@@ -0,0 +1,200 @@
+package security
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gkontos/goapi/model"
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExchangeAuthorizationCode(t *testing.T) {
+	InvalidateUsers()
+	dbh := &oidcTestDbHandler{
+		policyTestDbHandler: policyTestDbHandler{users: map[string]*model.User{
+			"tom-uid": {UID: "tom-uid", UserName: "tom", Status: model.UserStatusActive,
+				UserDetails: model.UserDetails{Email: "tom@example.com", EmailVerified: true, Roles: []string{AdministratorRole}}},
+		}},
+		codes: map[string]*model.AuthorizationCode{
+			hashSecret("somecode"): {ClientID: "my-app", UID: "tom-uid", RedirectURI: "https://my-app.example.com/callback",
+				Scope: "openid profile email", Nonce: "n-0S6", CodeChallenge: pkceChallenge("verifier"), AuthTime: time.Now()},
+		},
+	}
+	as := NewAuthorizationServer(dbh)
+
+	response, err := as.ExchangeToken(&TokenExchangeRequest{GrantType: "authorization_code", Code: "somecode",
+		RedirectURI: "https://my-app.example.com/callback", ClientID: "my-app", ClientSecret: "secret", CodeVerifier: "verifier"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// the access token is the client's, without the user's roles
+	claims, err := GetNewHandler(dbh).ValidateAccessToken(response.AccessToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "my-app", claims.ClientID)
+	assert.Equal(t, jwt.ClaimStrings{"my-app"}, claims.Audience)
+	assert.Empty(t, claims.Roles)
+	assert.Empty(t, claims.OrgRoles)
+
+	idClaims := &IDTokenClaims{}
+	_, err = jwt.ParseWithClaims(response.IDToken, idClaims, func(token *jwt.Token) (interface{}, error) {
+		return verificationKey, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "tom-uid", idClaims.Subject)
+	assert.Equal(t, jwt.ClaimStrings{"my-app"}, idClaims.Audience)
+	assert.Equal(t, "n-0S6", idClaims.Nonce)
+	// the provider verified the email when tom logged in
+	assert.Equal(t, "tom@example.com", idClaims.Email)
+	assert.True(t, idClaims.EmailVerified)
+	assert.True(t, as.UserInfo(claims).EmailVerified)
+
+	// the code is single use
+	_, err = as.ExchangeToken(&TokenExchangeRequest{GrantType: "authorization_code", Code: "somecode",
+		RedirectURI: "https://my-app.example.com/callback", ClientID: "my-app", ClientSecret: "secret", CodeVerifier: "verifier"})
+	assert.Equal(t, &OAuthError{Code: "invalid_grant", Description: "authorization code is invalid", Status: 400}, err)
+}
+
+func TestPollDeviceToken(t *testing.T) {
+	InvalidateUsers()
+	polledAt := time.Now()
+	dbh := &oidcTestDbHandler{
+		policyTestDbHandler: policyTestDbHandler{users: map[string]*model.User{
+			"tom-uid": {UID: "tom-uid", UserName: "tom", Status: model.UserStatusActive},
+		}},
+		devices: map[string]*model.DeviceAuthorization{
+			hashSecret("pending"): {DeviceCodeHash: hashSecret("pending"), ClientID: "my-app",
+				Status: model.DeviceAuthorizationPending, Interval: 5, ExpiresAt: time.Now().Add(time.Minute)},
+			hashSecret("polled"): {DeviceCodeHash: hashSecret("polled"), ClientID: "my-app",
+				Status: model.DeviceAuthorizationPending, Interval: 5, ExpiresAt: time.Now().Add(time.Minute), LastPolledAt: &polledAt},
+			hashSecret("expired"): {DeviceCodeHash: hashSecret("expired"), ClientID: "my-app",
+				Status: model.DeviceAuthorizationPending, Interval: 5, ExpiresAt: time.Now().Add(-time.Minute)},
+			hashSecret("denied"): {DeviceCodeHash: hashSecret("denied"), ClientID: "my-app",
+				Status: model.DeviceAuthorizationDenied, Interval: 5, ExpiresAt: time.Now().Add(time.Minute)},
+			hashSecret("approved"): {DeviceCodeHash: hashSecret("approved"), ClientID: "my-app", UID: "tom-uid", Scope: "openid",
+				Status: model.DeviceAuthorizationApproved, Interval: 5, ExpiresAt: time.Now().Add(time.Minute)},
+		},
+	}
+	as := NewAuthorizationServer(dbh)
+
+	tests := []struct {
+		name       string
+		secret     string
+		deviceCode string
+		wantCode   string
+	}{
+		{name: "confidential client without its secret", deviceCode: "approved", wantCode: "invalid_client"},
+		{name: "wrong secret", secret: "wrong", deviceCode: "approved", wantCode: "invalid_client"},
+		{name: "unknown device code", secret: "secret", deviceCode: "unknown", wantCode: "invalid_grant"},
+		{name: "pending", secret: "secret", deviceCode: "pending", wantCode: "authorization_pending"},
+		{name: "polled within the interval", secret: "secret", deviceCode: "polled", wantCode: "slow_down"},
+		{name: "expired", secret: "secret", deviceCode: "expired", wantCode: "expired_token"},
+		{name: "denied", secret: "secret", deviceCode: "denied", wantCode: "access_denied"},
+		{name: "approved", secret: "secret", deviceCode: "approved"},
+		{name: "approved code is single use", secret: "secret", deviceCode: "approved", wantCode: "invalid_grant"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, scope, err := as.PollDeviceToken("my-app", tt.secret, tt.deviceCode)
+			if tt.wantCode != "" {
+				var oauthErr *OAuthError
+				if assert.ErrorAs(t, err, &oauthErr) {
+					assert.Equal(t, tt.wantCode, oauthErr.Code)
+				}
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.NotEmpty(t, tokens.Token)
+				assert.Equal(t, "openid", scope)
+			}
+		})
+	}
+}
+
+func TestDeviceTokenOnAPIRoutes(t *testing.T) {
+	InvalidatePolicy()
+	InvalidateUsers()
+	dbh := &oidcTestDbHandler{
+		policyTestDbHandler: policyTestDbHandler{users: map[string]*model.User{
+			"tom-uid": {UID: "tom-uid", UserName: "tom", Status: model.UserStatusActive,
+				UserDetails: model.UserDetails{Roles: []string{UserRole}}},
+		}},
+		devices: map[string]*model.DeviceAuthorization{
+			hashSecret("approved"): {DeviceCodeHash: hashSecret("approved"), ClientID: "my-app", UID: "tom-uid", Scope: "openid",
+				Status: model.DeviceAuthorizationApproved, Interval: 5, ExpiresAt: time.Now().Add(time.Minute)},
+		},
+	}
+	tokens, _, err := NewAuthorizationServer(dbh).PollDeviceToken("my-app", "secret", "approved")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// the cli uses the api as the user
+	claims, err := GetNewHandler(dbh).ValidateAccessToken(tokens.Token)
+	assert.NoError(t, err)
+	assert.Empty(t, claims.ClientID)
+	assert.Equal(t, []string{UserRole}, claims.Roles)
+
+	policies, err := parseRoutePolicies(defaultPolicy)
+	assert.NoError(t, err)
+	rs := &defaultRouterSecurity{dbh: dbh, policies: policies}
+	r := chi.NewRouter()
+	r.Use(rs.EnforcePolicy(r))
+	r.Get("/v1/users/me", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/users/me", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.Token)
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+// oidcTestDbHandler has the confidential client my-app with the secret "secret" and the authorization codes and device
+// requests by hash
+type oidcTestDbHandler struct {
+	policyTestDbHandler
+	codes   map[string]*model.AuthorizationCode
+	devices map[string]*model.DeviceAuthorization
+}
+
+func (d *oidcTestDbHandler) GetOAuthClient(clientID string) (*model.OAuthClient, error) {
+	if clientID != "my-app" {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("client does not exist")}
+	}
+	return &model.OAuthClient{ClientID: "my-app", SecretHash: hashSecret("secret"), Name: "My App",
+		RedirectURIs: model.StringList{"https://my-app.example.com/callback"}, Confidential: true}, nil
+}
+
+func (d *oidcTestDbHandler) ConsumeAuthorizationCode(codeHash string) (*model.AuthorizationCode, error) {
+	code, ok := d.codes[codeHash]
+	if !ok {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("authorization code does not exist")}
+	}
+	delete(d.codes, codeHash)
+	return code, nil
+}
+
+func (d *oidcTestDbHandler) PollDeviceAuthorization(deviceCodeHash string) (*model.DeviceAuthorization, error) {
+	device, ok := d.devices[deviceCodeHash]
+	if !ok {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("device code does not exist")}
+	}
+	polled := *device
+	return &polled, nil
+}
+
+func (d *oidcTestDbHandler) ConsumeDeviceAuthorization(deviceCodeHash string) (*model.DeviceAuthorization, error) {
+	device, ok := d.devices[deviceCodeHash]
+	if !ok || device.Status != model.DeviceAuthorizationApproved {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("device code does not exist or has not been approved")}
+	}
+	delete(d.devices, deviceCodeHash)
+	return device, nil
+}
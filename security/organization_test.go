@@ -0,0 +1,59 @@
+package security
+
+import (
+	"testing"
+
+	"github.com/gkontos/goapi/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetOrganization(t *testing.T) {
+	s := &tokenHandler{dbh: &policyTestDbHandler{
+		memberships: []model.Membership{
+			{OrgID: "org-a", UID: "tom-uid", Roles: model.StringList{AdministratorRole}},
+			{OrgID: "org-b", UID: "tom-uid", Roles: model.StringList{UserRole}},
+		},
+	}}
+
+	cases := []struct {
+		org              string
+		expectedOrg      string
+		expectedOrgRoles []string
+	}{
+		// the first organization is active by default
+		{org: "", expectedOrg: "org-a", expectedOrgRoles: []string{AdministratorRole}},
+		{org: "org-b", expectedOrg: "org-b", expectedOrgRoles: []string{UserRole}},
+		// no longer a member
+		{org: "org-c", expectedOrg: "org-a", expectedOrgRoles: []string{AdministratorRole}},
+	}
+
+	for _, c := range cases {
+		claims := Claims{UID: "tom-uid", Roles: []string{UserRole}, Org: c.org}
+		assert.NoError(t, s.setOrganization(&claims))
+		assert.Equal(t, c.expectedOrg, claims.Org)
+		assert.Equal(t, c.expectedOrgRoles, claims.OrgRoles)
+		// an organization admin is not a global admin
+		assert.Equal(t, []string{UserRole}, claims.Roles)
+	}
+
+	// a token for a user without memberships has no organization
+	s = &tokenHandler{dbh: &policyTestDbHandler{}}
+	claims := Claims{UID: "sergei-uid", Roles: []string{UserRole}, Org: "org-a", OrgRoles: []string{AdministratorRole}}
+	assert.NoError(t, s.setOrganization(&claims))
+	assert.Equal(t, "", claims.Org)
+	assert.Nil(t, claims.OrgRoles)
+	assert.Equal(t, []string{UserRole}, claims.Roles)
+}
+
+func TestObtainAccessTokensAddsGroupRoles(t *testing.T) {
+	s := &tokenHandler{dbh: &policyTestDbHandler{
+		groupRoles: map[string][]string{"tom-uid": {"ROLE_AUDITOR", UserRole}},
+	}}
+
+	tokens, err := s.obtainAccessTokens(Claims{UID: "tom-uid", Username: "tom", Roles: []string{UserRole}})
+	assert.NoError(t, err)
+
+	claims, err := s.ValidateAccessToken(tokens.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{UserRole, "ROLE_AUDITOR"}, claims.Roles)
+}
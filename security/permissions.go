@@ -2,16 +2,61 @@ package security
 
 import (
 	"errors"
+	"sort"
+	"strings"
 
 	"github.com/gkontos/goapi/model"
 )
 
 type Permission string
 
+// EffectivePermissions are the roles a user holds, including inherited and group roles, and what they grant
+type EffectivePermissions struct {
+	Roles []string `json:"roles"`
+	// Grants may contain wildcards, eg users:*
+	Grants []string `json:"grants"`
+	// Permissions are the defined permissions which the grants cover
+	Permissions []string `json:"permissions"`
+	// Organization is what the user holds, with their organization roles, on the routes scoped to the active
+	// organization
+	Organization *EffectivePermissions `json:"organization,omitempty"`
+}
+
 func (p Permission) String() string {
 	return string(p)
 }
 
+// GrantedBy returns true if the grant is the permission or a wildcard which covers it.
+// Permissions are namespaced with ':', eg users:roles:write is granted by users:roles:write, users:roles:*, users:* and *
+func (p Permission) GrantedBy(grant string) bool {
+	if grant == string(p) || grant == "*" {
+		return true
+	}
+	return strings.HasSuffix(grant, ":*") && strings.HasPrefix(string(p), strings.TrimSuffix(grant, "*"))
+}
+
+// granted returns true if one of the roles grants the permission
+func granted(policies map[string]*rolePolicy, roles []string, permission Permission) bool {
+	for _, role := range roles {
+		rp, ok := policies[role]
+		if !ok {
+			continue
+		}
+		if rp.grants[permission.String()] {
+			return true
+		}
+		for grant := range rp.grants {
+			if permission.GrantedBy(grant) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CheckPermission will return an error unless one of the user's roles grants the permission directly, through a
+// wildcard or through an inherited role.  The user's roles include the roles of their groups, which are resolved when
+// the token is minted or, with FRESH_ROLES, cached with the user.
 func (s *tokenHandler) CheckPermission(user *model.User, permission Permission) error {
 	if user == nil {
 		return errors.New("CheckPermission: No user supplied")
@@ -21,15 +66,83 @@ func (s *tokenHandler) CheckPermission(user *model.User, permission Permission)
 		return errors.New("CheckPermission: You must supply a valid permission to check against")
 	}
 
-	if user.HasRole(AdministratorRole) {
-		// Admins can do anything
-		return nil
+	roles, err := policy.get(s.dbh)
+	if err != nil {
+		return err
 	}
 
-	if permission.String() == "read" || permission.String() == "write" && user.HasRole(UserRole) {
-		// User has role
+	if granted(roles, user.UserDetails.Roles, permission) {
 		return nil
 	}
 
 	return errors.New("CheckPermission: User not authorized")
 }
+
+// HasRole returns true if one of the user's roles is the role or inherits it
+func (s *tokenHandler) HasRole(user *model.User, role string) (bool, error) {
+	if user.HasRole(role) {
+		return true, nil
+	}
+	roles, err := policy.get(s.dbh)
+	if err != nil {
+		return false, err
+	}
+	for _, userRole := range user.UserDetails.Roles {
+		if rp, ok := roles[userRole]; ok && rp.roles[role] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// GetEffectivePermissions resolves the user's roles and permissions with the same rules as CheckPermission
+func (s *tokenHandler) GetEffectivePermissions(user *model.User) (*EffectivePermissions, error) {
+	policies, err := policy.get(s.dbh)
+	if err != nil {
+		return nil, err
+	}
+	userRoles := user.UserDetails.Roles
+	defined, err := s.dbh.GetPermissions()
+	if err != nil {
+		return nil, err
+	}
+
+	roles := make(map[string]bool)
+	grants := make(map[string]bool)
+	for _, role := range userRoles {
+		roles[role] = true
+		if rp, ok := policies[role]; ok {
+			for inherited := range rp.roles {
+				roles[inherited] = true
+			}
+			for grant := range rp.grants {
+				grants[grant] = true
+			}
+		}
+	}
+
+	effective := &EffectivePermissions{
+		Roles:       sortedKeys(roles),
+		Grants:      sortedKeys(grants),
+		Permissions: make([]string, 0),
+	}
+	for _, permission := range defined {
+		if strings.HasSuffix(permission, "*") {
+			continue
+		}
+		if granted(policies, effective.Roles, Permission(permission)) {
+			effective.Permissions = append(effective.Permissions, permission)
+		}
+	}
+	sort.Strings(effective.Permissions)
+	return effective, nil
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,249 @@
+package security
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gkontos/goapi/db"
+	"github.com/gkontos/goapi/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckPermission(t *testing.T) {
+	InvalidatePolicy()
+	s := &tokenHandler{dbh: &policyTestDbHandler{}}
+
+	cases := []struct {
+		roles      []string
+		permission Permission
+		allowed    bool
+	}{
+		{roles: []string{UserRole}, permission: "read", allowed: true},
+		{roles: []string{UserRole}, permission: "write", allowed: true},
+		{roles: []string{UserRole}, permission: "admin", allowed: false},
+		{roles: []string{AdministratorRole}, permission: "admin", allowed: true},
+		// roles are data, not code
+		{roles: []string{"ROLE_AUDITOR"}, permission: "audit", allowed: true},
+		{roles: []string{"ROLE_AUDITOR"}, permission: "read", allowed: false},
+		// no roles means no permissions
+		{roles: nil, permission: "read", allowed: false},
+		{roles: []string{"ROLE_UNKNOWN"}, permission: "read", allowed: false},
+	}
+
+	for _, c := range cases {
+		user := &model.User{UserName: "tom", UserDetails: model.UserDetails{Roles: c.roles}}
+		err := s.CheckPermission(user, c.permission)
+		assert.Equal(t, c.allowed, err == nil, "roles %v permission %s", c.roles, c.permission)
+	}
+}
+
+func TestCheckPermissionKeepsCachedPolicyOnReloadError(t *testing.T) {
+	InvalidatePolicy()
+	dbh := &policyTestDbHandler{}
+	s := &tokenHandler{dbh: dbh}
+	user := &model.User{UserName: "tom", UserDetails: model.UserDetails{Roles: []string{UserRole}}}
+
+	assert.Nil(t, s.CheckPermission(user, "read"))
+
+	dbh.throwDbError = true
+	InvalidatePolicy()
+	assert.Nil(t, s.CheckPermission(user, "read"))
+}
+
+func TestCheckPermissionInheritsGroupRoles(t *testing.T) {
+	InvalidatePolicy()
+	dbh := &policyTestDbHandler{
+		groupRoles: map[string][]string{"tom-uid": {AdministratorRole}},
+	}
+	s := &tokenHandler{dbh: dbh}
+
+	// the group roles are resolved with the user's roles, checking a permission does not look them up
+	claims := Claims{UID: "tom-uid", Username: "tom", Roles: []string{UserRole}}
+	assert.NotNil(t, s.CheckPermission(CreateUserFromClaims(claims), "admin"))
+	assert.Equal(t, 0, dbh.groupRoleLoads)
+
+	assert.NoError(t, s.addGroupRoles(&claims))
+	assert.Nil(t, s.CheckPermission(CreateUserFromClaims(claims), "admin"))
+	assert.Nil(t, s.CheckPermission(CreateUserFromClaims(claims), "read"))
+	assert.Equal(t, 1, dbh.groupRoleLoads)
+}
+
+func TestPermissionGrantedBy(t *testing.T) {
+	cases := []struct {
+		permission Permission
+		grant      string
+		expected   bool
+	}{
+		{permission: "users:read", grant: "users:read", expected: true},
+		{permission: "users:read", grant: "users:*", expected: true},
+		{permission: "users:roles:write", grant: "users:*", expected: true},
+		{permission: "users:roles:write", grant: "users:roles:*", expected: true},
+		{permission: "users:roles:write", grant: "*", expected: true},
+		{permission: "users:roles:write", grant: "users:read", expected: false},
+		{permission: "users:read", grant: "users:roles:*", expected: false},
+		{permission: "groups:read", grant: "users:*", expected: false},
+		// a wildcard only matches whole segments
+		{permission: "usersettings:read", grant: "users:*", expected: false},
+		{permission: "users", grant: "users:*", expected: false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.expected, c.permission.GrantedBy(c.grant), "%s granted by %s", c.permission, c.grant)
+	}
+}
+
+func TestCheckPermissionHierarchy(t *testing.T) {
+	InvalidatePolicy()
+	s := &tokenHandler{dbh: &policyTestDbHandler{}}
+	user := func(roles ...string) *model.User {
+		return &model.User{UserName: "tom", UserDetails: model.UserDetails{Roles: roles}}
+	}
+
+	cases := []struct {
+		user       *model.User
+		permission Permission
+		expected   bool
+	}{
+		{user: user("ROLE_SUPPORT"), permission: "users:read", expected: true},
+		// wildcard grant
+		{user: user("ROLE_SUPPORT"), permission: "tickets:close", expected: true},
+		// inherited from ROLE_USER
+		{user: user("ROLE_SUPPORT"), permission: "write", expected: true},
+		{user: user("ROLE_SUPPORT"), permission: "users:roles:write", expected: false},
+		// inherited through two levels
+		{user: user("ROLE_OPERATOR"), permission: "users:roles:write", expected: true},
+		{user: user("ROLE_OPERATOR"), permission: "tickets:close", expected: true},
+		{user: user("ROLE_OPERATOR"), permission: "read", expected: true},
+		{user: user("ROLE_ROOT"), permission: "anything:at:all", expected: true},
+		{user: user("ROLE_CYCLE_A"), permission: "b", expected: true},
+		{user: user("ROLE_CYCLE_A"), permission: "c", expected: false},
+	}
+	for _, c := range cases {
+		err := s.CheckPermission(c.user, c.permission)
+		assert.Equal(t, c.expected, err == nil, "%v %s", c.user.UserDetails.Roles, c.permission)
+	}
+
+	ok, err := s.HasRole(user("ROLE_OPERATOR"), UserRole)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = s.HasRole(user(UserRole), "ROLE_SUPPORT")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestGetEffectivePermissions(t *testing.T) {
+	InvalidatePolicy()
+	dbh := &policyTestDbHandler{}
+	s := &tokenHandler{dbh: dbh}
+	// ROLE_AUDITOR is the role of one of tom's groups
+	user := &model.User{UID: "tom-uid", UserName: "tom", UserDetails: model.UserDetails{Roles: []string{"ROLE_SUPPORT", "ROLE_AUDITOR"}}}
+
+	effective, err := s.GetEffectivePermissions(user)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ROLE_AUDITOR", "ROLE_SUPPORT", UserRole}, effective.Roles)
+	assert.Equal(t, []string{"audit", "read", "tickets:*", "users:read", "write"}, effective.Grants)
+	assert.Equal(t, []string{"audit", "read", "tickets:close", "users:read", "write"}, effective.Permissions)
+
+	// every effective permission passes CheckPermission
+	for _, permission := range effective.Permissions {
+		assert.Nil(t, s.CheckPermission(user, Permission(permission)))
+	}
+	assert.Equal(t, 0, dbh.groupRoleLoads)
+}
+
+type policyTestDbHandler struct {
+	db.DbHandler
+	throwDbError bool
+	memberships  []model.Membership
+	groupRoles   map[string][]string
+	// groupRoleLoads counts the group role lookups
+	groupRoleLoads int
+	users          map[string]*model.User
+	userLoads      int
+	invitations    []*model.Invitation
+	logins         []*model.LoginEvent
+}
+
+func (d *policyTestDbHandler) GetRoles() ([]model.Role, error) {
+	if d.throwDbError {
+		return nil, errors.New("db error")
+	}
+	return []model.Role{
+		{Name: AdministratorRole, Permissions: model.StringList{"read", "write", "admin"}},
+		{Name: UserRole, Permissions: model.StringList{"read", "write"}},
+		{Name: "ROLE_AUDITOR", Permissions: model.StringList{"audit"}},
+		{Name: "ROLE_SUPPORT", Permissions: model.StringList{"users:read", "tickets:*"}, Inherits: model.StringList{UserRole}},
+		{Name: "ROLE_OPERATOR", Permissions: model.StringList{"users:*"}, Inherits: model.StringList{"ROLE_SUPPORT"}},
+		{Name: "ROLE_ROOT", Permissions: model.StringList{"*"}},
+		// an inheritance cycle must not recurse forever
+		{Name: "ROLE_CYCLE_A", Permissions: model.StringList{"a"}, Inherits: model.StringList{"ROLE_CYCLE_B"}},
+		{Name: "ROLE_CYCLE_B", Permissions: model.StringList{"b"}, Inherits: model.StringList{"ROLE_CYCLE_A"}},
+	}, nil
+}
+
+func (d *policyTestDbHandler) GetMemberships(uid string) ([]model.Membership, error) {
+	return d.memberships, nil
+}
+
+func (d *policyTestDbHandler) WithTenant(orgID string) db.DbHandler {
+	return d
+}
+
+func (d *policyTestDbHandler) GetGroupRoles(uid string) ([]string, error) {
+	d.groupRoleLoads++
+	return d.groupRoles[uid], nil
+}
+
+func (d *policyTestDbHandler) GetUserByUID(uid string) (*model.User, error) {
+	d.userLoads++
+	if user, ok := d.users[uid]; ok {
+		return user, nil
+	}
+	return nil, &model.ResourceDoesNotExistError{Err: errors.New("user does not exist")}
+}
+
+func (d *policyTestDbHandler) GetUserByProvider(authProvider string, providerID string) (*model.User, error) {
+	for _, user := range d.users {
+		if user.AuthProvider == authProvider && user.ProviderID == providerID {
+			return user, nil
+		}
+	}
+	return &model.User{}, nil
+}
+
+func (d *policyTestDbHandler) UpsertUser(u *model.User) (*model.User, error) {
+	if u.UID == "" {
+		u.UID = u.ProviderID + "-uid"
+	}
+	d.users[u.UID] = u
+	return u, nil
+}
+
+func (d *policyTestDbHandler) GetPermissions() ([]string, error) {
+	return []string{"*", "read", "write", "admin", "audit", "users:*", "users:read", "users:roles:write", "tickets:close"}, nil
+}
+
+func (d *policyTestDbHandler) GetPendingInvitation(email string) (*model.Invitation, error) {
+	for _, i := range d.invitations {
+		if i.Email == email && i.AcceptedAt == nil {
+			return i, nil
+		}
+	}
+	return nil, nil
+}
+
+func (d *policyTestDbHandler) AcceptInvitation(id string, uid string) error {
+	for _, i := range d.invitations {
+		if i.ID == id && i.AcceptedAt == nil {
+			now := time.Now()
+			i.AcceptedAt, i.AcceptedUID = &now, uid
+			return nil
+		}
+	}
+	return &model.ResourceDoesNotExistError{Err: errors.New("invitation does not exist or has been accepted")}
+}
+
+func (d *policyTestDbHandler) InsertLoginEvent(e *model.LoginEvent) error {
+	d.logins = append(d.logins, e)
+	return nil
+}
@@ -0,0 +1,96 @@
+package security
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gkontos/goapi/db"
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+)
+
+// policyCache holds the role to permission mappings from the database so that authorization does not need
+// a query per request.  The mappings are reloaded after policyRefreshSeconds.
+type policyCache struct {
+	mu       sync.RWMutex
+	roles    map[string]*rolePolicy
+	loadedAt time.Time
+}
+
+// rolePolicy is a role with the role hierarchy resolved
+type rolePolicy struct {
+	// grants are the permissions of the role and every role it inherits, they may be wildcards
+	grants map[string]bool
+	// roles are the role and every role it inherits
+	roles map[string]bool
+}
+
+var policy = &policyCache{}
+
+// InvalidatePolicy will force the role permissions to be reloaded on the next authorization check
+func InvalidatePolicy() {
+	policy.mu.Lock()
+	defer policy.mu.Unlock()
+	policy.loadedAt = time.Time{}
+}
+
+// get returns the current role mappings, reloading them if they are stale.
+// If a reload fails the previous mappings are kept.
+func (p *policyCache) get(dbh db.DbHandler) (map[string]*rolePolicy, error) {
+	p.mu.RLock()
+	roles, loadedAt := p.roles, p.loadedAt
+	p.mu.RUnlock()
+
+	if roles != nil && time.Since(loadedAt) < time.Second*time.Duration(policyRefreshSeconds) {
+		return roles, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// another request may have reloaded while we waited for the lock
+	if p.roles != nil && time.Since(p.loadedAt) < time.Second*time.Duration(policyRefreshSeconds) {
+		return p.roles, nil
+	}
+
+	dbRoles, err := dbh.GetRoles()
+	if err != nil {
+		if p.roles != nil {
+			logger.Logger.Error().Err(err).Msg("unable to reload role permissions, using cached permissions")
+			return p.roles, nil
+		}
+		return nil, err
+	}
+
+	byName := make(map[string]model.Role, len(dbRoles))
+	for _, role := range dbRoles {
+		byName[role.Name] = role
+	}
+	roles = make(map[string]*rolePolicy, len(dbRoles))
+	for _, role := range dbRoles {
+		resolved := &rolePolicy{grants: make(map[string]bool), roles: make(map[string]bool)}
+		resolveRole(byName, role.Name, resolved)
+		roles[role.Name] = resolved
+	}
+	p.roles = roles
+	p.loadedAt = time.Now()
+	return roles, nil
+}
+
+// resolveRole adds the permissions of the role and the roles it inherits.  A role which has already been visited is
+// skipped, so an inheritance cycle can not recurse forever.
+func resolveRole(byName map[string]model.Role, name string, resolved *rolePolicy) {
+	if resolved.roles[name] {
+		return
+	}
+	resolved.roles[name] = true
+	role, ok := byName[name]
+	if !ok {
+		return
+	}
+	for _, permission := range role.Permissions {
+		resolved.grants[permission] = true
+	}
+	for _, inherited := range role.Inherits {
+		resolveRole(byName, inherited, resolved)
+	}
+}
@@ -0,0 +1,50 @@
+package security
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/util"
+	"golang.org/x/net/context"
+)
+
+// ProvisioningClientContextKey holds the *model.ProvisioningClient which made a SCIM request
+const ProvisioningClientContextKey = "provisioningclient"
+
+// AuthenticateProvisioningClient provides middleware which authenticates a SCIM provisioning client from the bearer
+// token in the Authorization header.  The routes it protects are public in the route policy, provisioning clients are
+// not users and do not have user tokens.
+func (s *defaultRouterSecurity) AuthenticateProvisioningClient(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		client, err := s.authenticateProvisioningClient(r)
+		if err != nil {
+			logger.Logger.Error().Err(err).Msg("unable to authenticate provisioning client")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+			var notFound *model.ResourceDoesNotExistError
+			if err == errMissingBearerToken || errors.As(err, &notFound) {
+				err = &model.SCIMRequestError{Status: http.StatusUnauthorized, Err: errors.New(http.StatusText(http.StatusUnauthorized))}
+			}
+			util.ReturnSCIMError(w, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), ProvisioningClientContextKey, client)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+var errMissingBearerToken = errors.New("bearer token is missing")
+
+func (s *defaultRouterSecurity) authenticateProvisioningClient(r *http.Request) (*model.ProvisioningClient, error) {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	token = strings.TrimSpace(token)
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return nil, errMissingBearerToken
+	}
+	// the lookup is by hash, so the time it takes does not reveal the token
+	return s.dbh.GetProvisioningClient(hashSecret(token))
+}
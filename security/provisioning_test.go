@@ -0,0 +1,59 @@
+package security
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gkontos/goapi/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthenticateProvisioningClient(t *testing.T) {
+	rs := NewRouterSecurity("http://localhost", &policyTestDbHandler{})
+
+	cases := []struct {
+		authorization string
+		expectedCode  int
+	}{
+		{authorization: "Bearer scim-secret", expectedCode: http.StatusOK},
+		{authorization: "bearer scim-secret", expectedCode: http.StatusOK},
+		{authorization: "Bearer other-secret", expectedCode: http.StatusUnauthorized},
+		{authorization: "Basic c2NpbTpzZWNyZXQ=", expectedCode: http.StatusUnauthorized},
+		{authorization: "", expectedCode: http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		var client *model.ProvisioningClient
+		handler := rs.AuthenticateProvisioningClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client, _ = r.Context().Value(ProvisioningClientContextKey).(*model.ProvisioningClient)
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/scim/v2/Users", nil)
+		if c.authorization != "" {
+			req.Header.Set("Authorization", c.authorization)
+		}
+		handler.ServeHTTP(rr, req)
+
+		assert.Equal(t, c.expectedCode, rr.Code, "authorization %s", c.authorization)
+		if c.expectedCode == http.StatusOK {
+			if assert.NotNil(t, client) {
+				assert.Equal(t, "idp", client.ID)
+			}
+		} else {
+			assert.Nil(t, client)
+			assert.Equal(t, `Bearer realm="scim"`, rr.Header().Get("WWW-Authenticate"))
+			assert.Equal(t, "application/scim+json", rr.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func (d *policyTestDbHandler) GetProvisioningClient(tokenHash string) (*model.ProvisioningClient, error) {
+	if tokenHash != hashSecret("scim-secret") {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("provisioning client does not exist")}
+	}
+	return &model.ProvisioningClient{ID: "idp", Name: "Corporate IdP", TokenHash: tokenHash}, nil
+}
@@ -0,0 +1,244 @@
+package security
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/gkontos/goapi/logger"
+	"github.com/gkontos/goapi/model"
+	"github.com/gkontos/goapi/util"
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultPolicy is used when POLICY_FILE is not set
+//
+//go:embed policy.yaml
+var defaultPolicy []byte
+
+// RoutePolicy is the authorization rule for a method and chi route pattern.
+// A route which is not public requires an authenticated user.  When the access model's rule passes for the target
+// resource the request is allowed, otherwise the user must hold every permission and at least one of the roles.
+// Tokens issued to a registered client must also carry every scope.  The user's organization roles only count on
+// tenant routes, whose handlers are scoped to the active organization.
+type RoutePolicy struct {
+	Method      string   `yaml:"method"`
+	Pattern     string   `yaml:"pattern"`
+	Public      bool     `yaml:"public"`
+	Tenant      bool     `yaml:"tenant"`
+	Model       string   `yaml:"model"`
+	Permissions []string `yaml:"permissions"`
+	Roles       []string `yaml:"roles"`
+	Scopes      []string `yaml:"scopes"`
+}
+
+type PolicyDocument struct {
+	Routes []RoutePolicy `yaml:"routes"`
+}
+
+type routePolicies map[string]*RoutePolicy
+
+// loadRoutePolicies will read the policy document from POLICY_FILE or use the embedded default
+func loadRoutePolicies() (routePolicies, error) {
+	doc := defaultPolicy
+	if policyFile := os.Getenv("POLICY_FILE"); policyFile != "" {
+		var err error
+		if doc, err = os.ReadFile(policyFile); err != nil {
+			return nil, err
+		}
+	}
+	return parseRoutePolicies(doc)
+}
+
+func parseRoutePolicies(doc []byte) (routePolicies, error) {
+	policyDoc := PolicyDocument{}
+	if err := yaml.Unmarshal(doc, &policyDoc); err != nil {
+		return nil, err
+	}
+
+	policies := make(routePolicies)
+	for i := range policyDoc.Routes {
+		p := &policyDoc.Routes[i]
+		if p.Method == "" || p.Pattern == "" {
+			return nil, fmt.Errorf("policy %d requires a method and pattern", i)
+		}
+		if p.Model != "" {
+			if _, ok := accessModels[p.Model]; !ok {
+				return nil, fmt.Errorf("policy for %s %s uses unknown access model %s", p.Method, p.Pattern, p.Model)
+			}
+		}
+		if p.Public && (p.Tenant || p.Model != "" || len(p.Permissions) > 0 || len(p.Roles) > 0 || len(p.Scopes) > 0) {
+			return nil, fmt.Errorf("public policy for %s %s can not have authorization rules", p.Method, p.Pattern)
+		}
+		key := policyKey(p.Method, p.Pattern)
+		if _, exists := policies[key]; exists {
+			return nil, fmt.Errorf("duplicate policy for %s %s", p.Method, p.Pattern)
+		}
+		policies[key] = p
+	}
+	return policies, nil
+}
+
+func (p routePolicies) lookup(method, pattern string) *RoutePolicy {
+	if policy, ok := p[policyKey(method, pattern)]; ok {
+		return policy
+	}
+	return p[policyKey("*", pattern)]
+}
+
+// chi reports a mounted router's index route with a trailing slash when walking and without one when matching
+func policyKey(method, pattern string) string {
+	if len(pattern) > 1 {
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+	return strings.ToUpper(method) + " " + pattern
+}
+
+// ValidatePolicy returns an error listing every route which does not have a policy
+func (s *defaultRouterSecurity) ValidatePolicy(routes chi.Routes) error {
+	missing := make([]string, 0)
+	err := chi.Walk(routes, func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		if s.policies.lookup(method, route) == nil {
+			missing = append(missing, method+" "+route)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("routes without a policy: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// EnforcePolicy provides middleware which authenticates and authorizes each request from the route policies.
+// Requests for a route without a policy are denied.
+func (s *defaultRouterSecurity) EnforcePolicy(routes chi.Routes) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			rctx := chi.NewRouteContext()
+			if !routes.Match(rctx, r.Method, r.URL.Path) {
+				// let the router respond with not found / method not allowed
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			policy := s.policies.lookup(r.Method, rctx.RoutePattern())
+			if policy == nil {
+				logger.Logger.Error().Msg(fmt.Sprintf("no policy for %s %s", r.Method, rctx.RoutePattern()))
+				forbidden(w)
+				return
+			}
+			if policy.Public {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			claims, err := s.authenticate(r)
+			if err != nil {
+				logger.Logger.Error().Err(err).Msg("parse with claims error")
+				unauthenticated(w, err)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), UserContextKey, claims))
+
+			// chi has not routed the request yet so the access model is given the matched url parameters
+			routed := r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+			if err := s.checkPolicy(routed, claims, policy); err != nil {
+				logger.Logger.Error().Err(err).Msg(fmt.Sprintf("policy denied %s %s", r.Method, rctx.RoutePattern()))
+				forbidden(w)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (s *defaultRouterSecurity) checkPolicy(r *http.Request, claims Claims, policy *RoutePolicy) error {
+	user := CreateUserFromClaims(claims)
+	if user.UserName == "" {
+		return errors.New("token does not identify a user")
+	}
+	if policy.Tenant {
+		// the handler only reaches the active organization's resources
+		user.UserDetails.Roles = claims.TenantRoles()
+	}
+
+	if claims.ClientID != "" {
+		// a client's token only reaches the routes which declare the scopes it was granted
+		if len(policy.Scopes) == 0 {
+			return errors.New("client token can not be used on a route without scopes")
+		}
+		granted := strings.Fields(claims.Scope)
+		for _, scope := range policy.Scopes {
+			if !containsString(granted, scope) {
+				return fmt.Errorf("client token is missing scope %s", scope)
+			}
+		}
+	}
+
+	if policy.Model != "" && accessModels[policy.Model](r, user) {
+		return nil
+	}
+
+	th := GetNewHandler(s.dbh)
+	if len(policy.Roles) > 0 {
+		hasRole := false
+		for _, role := range policy.Roles {
+			ok, err := th.HasRole(user, role)
+			if err != nil {
+				return err
+			}
+			if ok {
+				hasRole = true
+				break
+			}
+		}
+		if !hasRole {
+			return errors.New("user does not have a required role")
+		}
+	}
+
+	for _, permission := range policy.Permissions {
+		if err := th.CheckPermission(user, Permission(permission)); err != nil {
+			return err
+		}
+	}
+
+	// a policy with a model and no other rules only allows the model
+	if policy.Model != "" && len(policy.Roles) == 0 && len(policy.Permissions) == 0 {
+		return errors.New("access model denied the request")
+	}
+	return nil
+}
+
+// unauthenticated responds to a request which could not be authenticated.  An inactive user is told why so that
+// clients do not keep retrying with a refreshed token.
+func unauthenticated(w http.ResponseWriter, err error) {
+	var inactive *model.UserInactiveError
+	if errors.As(err, &inactive) {
+		util.ReturnErrorJSON(w, inactive)
+		return
+	}
+	loginErr := &model.AuthenticationError{
+		Err: errors.New(http.StatusText(http.StatusUnauthorized)),
+	}
+	util.ReturnErrorJSONWithCode(w, loginErr, http.StatusUnauthorized)
+}
+
+func forbidden(w http.ResponseWriter) {
+	loginErr := &model.AuthenticationError{
+		Err: errors.New(http.StatusText(http.StatusForbidden)),
+	}
+	util.ReturnErrorJSONWithCode(w, loginErr, http.StatusForbidden)
+}
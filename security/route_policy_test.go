@@ -0,0 +1,201 @@
+package security
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gkontos/goapi/model"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+const testPolicy = `
+routes:
+  - {method: GET, pattern: /public, public: true}
+  - {method: GET, pattern: /users, permissions: [admin]}
+  - {method: GET, pattern: "/users/{uid}", model: owner, permissions: [admin]}
+  - {method: GET, pattern: /audit, roles: [ROLE_AUDITOR, ROLE_ADMIN]}
+  - {method: GET, pattern: /userinfo, scopes: [openid]}
+`
+
+func TestEnforcePolicy(t *testing.T) {
+	InvalidatePolicy()
+	InvalidateUsers()
+	policies, err := parseRoutePolicies([]byte(testPolicy))
+	assert.NoError(t, err)
+	rs := &defaultRouterSecurity{dbh: &policyTestDbHandler{
+		users: map[string]*model.User{
+			"tom-uid":       {UID: "tom-uid", Status: model.UserStatusActive},
+			"admin-uid":     {UID: "admin-uid", Status: model.UserStatusActive},
+			"audit-uid":     {UID: "audit-uid", Status: model.UserStatusActive},
+			"suspended-uid": {UID: "suspended-uid", Status: model.UserStatusSuspended},
+		},
+	}, policies: policies}
+
+	th := GetNewHandler(rs.dbh)
+	token := func(claims Claims) string {
+		tokens, err := th.obtainAccessTokens(claims)
+		assert.NoError(t, err)
+		return tokens.Token
+	}
+	user := token(Claims{UID: "tom-uid", Username: "tom", Roles: []string{UserRole}})
+	admin := token(Claims{UID: "admin-uid", Username: "admin", Roles: []string{AdministratorRole}})
+	auditor := token(Claims{UID: "audit-uid", Username: "auditor", Roles: []string{"ROLE_AUDITOR"}})
+	client := token(Claims{UID: "tom-uid", Username: "tom", Roles: []string{UserRole}, ClientID: "cli", Scope: "profile"})
+	openidClient := token(Claims{UID: "tom-uid", Username: "tom", Roles: []string{UserRole}, ClientID: "cli", Scope: "openid profile"})
+	suspended := token(Claims{UID: "suspended-uid", Username: "suspended", Roles: []string{AdministratorRole}})
+	deleted := token(Claims{UID: "sergei-uid", Username: "sergei", Roles: []string{AdministratorRole}})
+
+	cases := []struct {
+		method       string
+		path         string
+		token        string
+		expectedCode int
+		expectedBody string
+	}{
+		{method: "GET", path: "/public", expectedCode: http.StatusOK},
+		{method: "GET", path: "/users", expectedCode: http.StatusUnauthorized},
+		{method: "GET", path: "/users", token: "garbage", expectedCode: http.StatusUnauthorized},
+		{method: "GET", path: "/users", token: user, expectedCode: http.StatusForbidden},
+		{method: "GET", path: "/users", token: admin, expectedCode: http.StatusOK},
+		// tokens of users who are no longer active
+		{method: "GET", path: "/users", token: suspended, expectedCode: http.StatusForbidden, expectedBody: `{"error":"user is suspended","code":"user_inactive"}`},
+		{method: "GET", path: "/users", token: deleted, expectedCode: http.StatusUnauthorized},
+		// owner model
+		{method: "GET", path: "/users/tom-uid", token: user, expectedCode: http.StatusOK},
+		{method: "GET", path: "/users/sergei-uid", token: user, expectedCode: http.StatusForbidden},
+		{method: "GET", path: "/users/sergei-uid", token: admin, expectedCode: http.StatusOK},
+		// any of the roles
+		{method: "GET", path: "/audit", token: auditor, expectedCode: http.StatusOK},
+		{method: "GET", path: "/audit", token: user, expectedCode: http.StatusForbidden},
+		// scopes only restrict tokens issued to clients
+		{method: "GET", path: "/userinfo", token: user, expectedCode: http.StatusOK},
+		{method: "GET", path: "/userinfo", token: client, expectedCode: http.StatusForbidden},
+		{method: "GET", path: "/userinfo", token: openidClient, expectedCode: http.StatusOK},
+		// a client's token is denied on routes without scopes, whatever the user's roles
+		{method: "GET", path: "/users/tom-uid", token: openidClient, expectedCode: http.StatusForbidden},
+		{method: "GET", path: "/public", token: openidClient, expectedCode: http.StatusOK},
+		// a mounted route without a policy is denied
+		{method: "GET", path: "/unlisted", token: admin, expectedCode: http.StatusForbidden},
+		// requests which do not match a route are left to the router
+		{method: "GET", path: "/nowhere", expectedCode: http.StatusNotFound},
+	}
+
+	r := chi.NewRouter()
+	r.Use(rs.EnforcePolicy(r))
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+	for _, pattern := range []string{"/public", "/users", "/users/{uid}", "/audit", "/userinfo", "/unlisted"} {
+		r.Get(pattern, ok)
+	}
+
+	for _, c := range cases {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest(c.method, c.path, nil)
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		r.ServeHTTP(rr, req)
+
+		assert.Equal(t, c.expectedCode, rr.Code, "%s %s", c.method, c.path)
+		if c.expectedBody != "" {
+			assert.Equal(t, c.expectedBody, strings.TrimSpace(rr.Body.String()))
+		}
+	}
+}
+
+func TestValidatePolicy(t *testing.T) {
+	policies, err := parseRoutePolicies([]byte(testPolicy))
+	assert.NoError(t, err)
+	rs := &defaultRouterSecurity{policies: policies}
+
+	r := chi.NewRouter()
+	r.Get("/public", func(w http.ResponseWriter, r *http.Request) {})
+	r.Mount("/users", func() chi.Router {
+		r := chi.NewRouter()
+		r.Get("/", func(w http.ResponseWriter, r *http.Request) {})
+		r.Get("/{uid}", func(w http.ResponseWriter, r *http.Request) {})
+		return r
+	}())
+	assert.NoError(t, rs.ValidatePolicy(r))
+
+	r.Post("/users/{uid}/roles", func(w http.ResponseWriter, r *http.Request) {})
+	assert.EqualError(t, rs.ValidatePolicy(r), "routes without a policy: POST /users/{uid}/roles")
+}
+
+func TestParseRoutePolicies(t *testing.T) {
+	cases := []struct {
+		doc         string
+		expectedErr string
+	}{
+		{doc: `routes: [{method: GET}]`, expectedErr: "policy 0 requires a method and pattern"},
+		{doc: `routes: [{method: GET, pattern: /a, model: nobody}]`, expectedErr: "policy for GET /a uses unknown access model nobody"},
+		{doc: `routes: [{method: GET, pattern: /a, public: true, roles: [ROLE_ADMIN]}]`, expectedErr: "public policy for GET /a can not have authorization rules"},
+		{doc: `routes: [{method: GET, pattern: /a/}, {method: get, pattern: /a}]`, expectedErr: "duplicate policy for get /a"},
+	}
+	for _, c := range cases {
+		_, err := parseRoutePolicies([]byte(c.doc))
+		assert.EqualError(t, err, c.expectedErr)
+	}
+
+	// the embedded default policy must always load
+	_, err := parseRoutePolicies(defaultPolicy)
+	assert.NoError(t, err)
+}
+
+func TestEnforcePolicyOrganizationRoles(t *testing.T) {
+	InvalidatePolicy()
+	InvalidateUsers()
+	policies, err := parseRoutePolicies(defaultPolicy)
+	assert.NoError(t, err)
+	// tom administers org-a but is only a user everywhere else
+	rs := &defaultRouterSecurity{dbh: &policyTestDbHandler{
+		memberships: []model.Membership{{OrgID: "org-a", UID: "tom-uid", Roles: model.StringList{"ROLE_ROOT"}}},
+		users: map[string]*model.User{
+			"tom-uid": {UID: "tom-uid", Status: model.UserStatusActive},
+		},
+	}, policies: policies}
+
+	tokens, err := GetNewHandler(rs.dbh).obtainAccessTokens(Claims{UID: "tom-uid", Username: "tom", Roles: []string{UserRole}})
+	assert.NoError(t, err)
+
+	cases := []struct {
+		method       string
+		pattern      string
+		path         string
+		expectedCode int
+	}{
+		// organization roles count on the routes scoped to the organization
+		{method: "GET", path: "/v1/users", expectedCode: http.StatusOK},
+		// but do not grant global permissions
+		{method: "GET", path: "/v1/invitations", expectedCode: http.StatusForbidden},
+		{method: "POST", path: "/v1/invitations", expectedCode: http.StatusForbidden},
+		{method: "GET", path: "/v1/users/registrations", expectedCode: http.StatusForbidden},
+		{method: "PUT", pattern: "/v1/users/{uid}/registration", path: "/v1/users/sergei-uid/registration", expectedCode: http.StatusForbidden},
+		{method: "POST", path: "/v1/users/import", expectedCode: http.StatusForbidden},
+	}
+
+	r := chi.NewRouter()
+	r.Use(rs.EnforcePolicy(r))
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+	for _, c := range cases {
+		if c.pattern == "" {
+			c.pattern = c.path
+		}
+		r.MethodFunc(c.method, c.pattern, ok)
+	}
+
+	for _, c := range cases {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest(c.method, c.path, nil)
+		req.Header.Set("Authorization", "Bearer "+tokens.Token)
+		r.ServeHTTP(rr, req)
+
+		assert.Equal(t, c.expectedCode, rr.Code, "%s %s", c.method, c.path)
+	}
+}
@@ -22,18 +22,49 @@ var (
 	tokenExpirationMinutes        int
 	refreshTokenExpirationMinutes int
 	tokenGraceSeconds             int
+	magicLinkURL                  string
+	magicLinkExpirationMinutes    int
+	oauthCallbackBaseURL          string
+	oauthProviders                map[string]*OAuthProvider
+	oidcIssuer                    string
+	deviceVerificationURL         string
+	deviceCodeExpirationMinutes   int
+	devicePollIntervalSeconds     int
+	policyRefreshSeconds          int
+	// freshRoles resolves the roles of an authenticated user from the database instead of trusting the token
+	freshRoles       bool
+	userCacheSeconds int
+	// registrationMode is how identities which have not logged in before become users, see the Registration constants
+	registrationMode string
 )
 
 const (
 	UserContextKey    = "usercxt"
 	AdministratorRole = "ROLE_ADMIN"
 	UserRole          = "ROLE_USER"
+	EmailProvider     = "email"
+)
+
+const (
+	// RegistrationOpen creates an active user for every new identity
+	RegistrationOpen = "open"
+	// RegistrationInvite only creates users for emails with an invitation
+	RegistrationInvite = "invite"
+	// RegistrationApproval creates new users without an invitation as pending until an admin approves them
+	RegistrationApproval = "approval"
 )
 
 type TokenHandler interface {
-	ValidateLoginAndCreateAccessToken(t string) (*model.Token, error)
-	RefreshToken(t string) (*model.Token, error)
+	ValidateLoginAndCreateAccessToken(t string, client LoginClient) (*model.Token, error)
+	RefreshToken(t string, client LoginClient) (*model.Token, error)
 	ValidateAccessToken(tokenString string) (Claims, error)
+	CreateMagicLink(email string) (string, error)
+	ValidateMagicLinkAndCreateAccessToken(t string, client LoginClient) (*model.Token, error)
+	StartProviderLogin(provider string) (*ProviderLogin, error)
+	CompleteProviderLogin(provider, code, state, flowToken string, client LoginClient) (*model.Token, error)
+	SwitchOrganization(claims Claims, orgID string) (*model.Token, error)
+	GetEffectivePermissions(user *model.User) (*EffectivePermissions, error)
+	HasRole(user *model.User, role string) (bool, error)
 }
 type tokenHandler struct {
 	dbh db.DbHandler
@@ -59,6 +90,46 @@ func initModule() {
 	if tokenGraceSeconds == 0 {
 		tokenGraceSeconds = getenvOrInt("TOKEN_GRACE_SECONDS", 5)
 	}
+	if magicLinkURL == "" {
+		magicLinkURL = getenvOrString("MAGIC_LINK_URL", "http://localhost/login/magic")
+	}
+	if magicLinkExpirationMinutes == 0 {
+		magicLinkExpirationMinutes = getenvOrInt("MAGIC_LINK_VALID_MINUTES", 15)
+	}
+	if oauthCallbackBaseURL == "" {
+		oauthCallbackBaseURL = getenvOrString("OAUTH_CALLBACK_BASE_URL", "http://localhost:8080")
+	}
+	if oauthProviders == nil {
+		oauthProviders = loadOAuthProviders()
+	}
+	if oidcIssuer == "" {
+		oidcIssuer = getenvOrString("OIDC_ISSUER", "http://localhost:8080")
+	}
+	if deviceVerificationURL == "" {
+		deviceVerificationURL = getenvOrString("DEVICE_VERIFICATION_URL", "http://localhost/device")
+	}
+	if deviceCodeExpirationMinutes == 0 {
+		deviceCodeExpirationMinutes = getenvOrInt("DEVICE_CODE_VALID_MINUTES", 10)
+	}
+	if devicePollIntervalSeconds == 0 {
+		devicePollIntervalSeconds = getenvOrInt("DEVICE_POLL_INTERVAL_SECONDS", 5)
+	}
+	if policyRefreshSeconds == 0 {
+		policyRefreshSeconds = getenvOrInt("POLICY_REFRESH_SECONDS", 60)
+	}
+	if !freshRoles {
+		freshRoles = getenvOrBool("FRESH_ROLES", false)
+	}
+	if userCacheSeconds == 0 {
+		userCacheSeconds = getenvOrInt("USER_CACHE_SECONDS", 30)
+	}
+	if registrationMode == "" {
+		registrationMode = getenvOrString("REGISTRATION_MODE", RegistrationOpen)
+		if registrationMode != RegistrationOpen && registrationMode != RegistrationInvite && registrationMode != RegistrationApproval {
+			logger.Logger.Error().Msg(fmt.Sprintf("unknown REGISTRATION_MODE %s, using %s", registrationMode, RegistrationInvite))
+			registrationMode = RegistrationInvite
+		}
+	}
 	if googleCerts == nil {
 		googleCerts = make(map[string]*rsa.PublicKey)
 	}
@@ -114,17 +185,57 @@ func getenvOrInt(k string, defaultValue int) int {
 	return val
 }
 
+func getenvOrBool(k string, defaultValue bool) bool {
+	v := os.Getenv(k)
+	if v == "" {
+		return defaultValue
+	}
+	val, err := strconv.ParseBool(v)
+	if err != nil {
+		logger.Logger.Error().Err(err)
+		return defaultValue
+	}
+	return val
+}
+
+func getenvOrString(k string, defaultValue string) string {
+	v := os.Getenv(k)
+	if v == "" {
+		return defaultValue
+	}
+	return v
+}
+
+// CreateClaimsFromUser will create local claims for a stored user
+func CreateClaimsFromUser(user *model.User) Claims {
+	return Claims{
+		UID:       user.UID,
+		Username:  user.UserName,
+		Email:     user.UserDetails.Email,
+		Activated: user.UserDetails.EmailVerified,
+		Roles:     user.UserDetails.Roles,
+		FirstName: user.UserDetails.FirstName,
+		LastName:  user.UserDetails.LastName,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:     user.ProviderID,
+			Issuer: user.AuthProvider,
+		},
+	}
+}
+
 func CreateUserFromClaims(claims Claims) *model.User {
 	user := &model.User{
 		UID:          claims.UID,
 		AuthProvider: claims.Issuer,
 		ProviderID:   claims.ID,
 		UserName:     claims.Username,
+		OrgID:        claims.Org,
 		UserDetails: model.UserDetails{
-			FirstName: claims.FirstName,
-			LastName:  claims.LastName,
-			Email:     claims.Email,
-			Roles:     claims.Roles,
+			FirstName:     claims.FirstName,
+			LastName:      claims.LastName,
+			Email:         claims.Email,
+			EmailVerified: claims.Activated,
+			Roles:         claims.Roles,
 		},
 	}
 	return user
@@ -0,0 +1,31 @@
+package security
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"testing"
+
+	"github.com/gkontos/goapi/logger"
+)
+
+// TestMain sets up a signing key pair so that the package can be initialized without a deployment environment
+func TestMain(m *testing.M) {
+	logger.InitLogger(false, true)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("PRIVATE_KEY", string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})))
+	os.Setenv("PUBLIC_KEY", string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey})))
+	os.Setenv("GOOGLE_TOKEN_AUDIENCE", "test-audience")
+
+	os.Exit(m.Run())
+}
@@ -2,6 +2,7 @@ package security
 
 import (
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/gkontos/goapi/logger"
@@ -9,6 +10,8 @@ import (
 	"github.com/golang-jwt/jwt/v4"
 )
 
+const accessSubject = "access"
+
 type Claims struct {
 	UID       string   `json:"uid"`
 	Username  string   `json:"user_name"`
@@ -18,71 +21,281 @@ type Claims struct {
 	FirstName string   `json:"first_name"`
 	LastName  string   `json:"last_name"`
 	Image     string   `json:"image"`
+	// Scope and ClientID are set on tokens issued to a registered client by the authorization server
+	Scope    string           `json:"scope,omitempty"`
+	ClientID string           `json:"client_id,omitempty"`
+	AuthTime *jwt.NumericDate `json:"auth_time,omitempty"`
+	// Org is the active organization.  OrgRoles are the user's roles in that organization and its groups, they only
+	// apply to the routes which are scoped to the organization.  Roles are the user's global roles.
+	Org      string   `json:"org,omitempty"`
+	OrgRoles []string `json:"org_roles,omitempty"`
 	jwt.RegisteredClaims
 }
 
 // ValidateLoginAndCreateToken will
 // validate token; add / update user; create access tokens for the local issuer
 // assumes the tokenrequest is a google auth token
-func (s *tokenHandler) ValidateLoginAndCreateAccessToken(t string) (*model.Token, error) {
+func (s *tokenHandler) ValidateLoginAndCreateAccessToken(t string, client LoginClient) (*model.Token, error) {
 
-	googleClaims, err := validateGoogleJWT(t)
+	googleClaims, err := validateGoogleJWT(t, googleTokenAudience)
 	if err != nil {
+		s.recordLogin(client, model.LoginTypeLogin, googleIssuer, "", err)
 		return nil, err
 	}
 	// SAVE / UPDATE USER
 	claims := mapGoogleClaimToClaims(googleClaims)
 
+	return s.loginLocalUser(claims, client)
+
+}
+
+// loginLocalUser will add / update the user identified by the provider claims and create access tokens for the local
+// issuer.  The outcome is recorded in the login history.
+func (s *tokenHandler) loginLocalUser(claims Claims, client LoginClient) (tokens *model.Token, err error) {
+
+	var user *model.User
+	defer func() {
+		uid := ""
+		if user != nil {
+			uid = user.UID
+		}
+		s.recordLogin(client, model.LoginTypeLogin, claims.Issuer, uid, err)
+	}()
+
 	if claims.Issuer == "" || claims.ID == "" {
 		return nil, errors.New("issuer and ID are required claim fields")
 	}
 
-	user, err := s.createOrUpdateLocalUser(claims)
+	user, err = s.createOrUpdateLocalUser(claims)
 	if err != nil {
 		return nil, err
 	}
 
 	claims.UID = user.UID
+	claims.Roles = user.UserDetails.Roles
+	claims.AuthTime = jwt.NewNumericDate(time.Now())
 
 	// get tokens
 	return s.obtainAccessTokens(claims)
-
 }
 
+// createOrUpdateLocalUser stores the user identified by the provider claims.  A stored user who is not active is
+// returned with the error.
 func (s *tokenHandler) createOrUpdateLocalUser(claims Claims) (*model.User, error) {
 
 	user, err := s.dbh.GetUserByProvider(claims.Issuer, claims.ID)
 	if err != nil {
 		return nil, err
 	}
+	// a valid provider token does not reactivate a user
+	if err := user.CheckActive(); err != nil {
+		return user, err
+	}
 
 	claims.Roles = user.UserDetails.Roles
 
 	u := CreateUserFromClaims(claims)
+	var invitation *model.Invitation
 	if user.UID != "" {
 		u.UID = user.UID
+		u.UserDetails = providerDetails(user.UserDetails, u.UserDetails)
 	} else {
-		// add a default role for new users
-		u.UserDetails.Roles = append(u.UserDetails.Roles, UserRole)
+		u.Status = model.UserStatusActive
+		// new users get the roles of their invitation, otherwise the registration mode decides
+		if invitation, err = s.pendingInvitation(claims); err != nil {
+			return nil, err
+		}
+		switch {
+		case invitation != nil:
+			u.UserDetails.Roles = append([]string{}, invitation.Roles...)
+		case registrationMode == RegistrationInvite:
+			return nil, &model.InvitationRequiredError{Err: errors.New("registration requires an invitation")}
+		case registrationMode == RegistrationApproval:
+			u.Status = model.UserStatusPending
+			u.UserDetails.Roles = []string{}
+		default:
+			u.UserDetails.Roles = append(u.UserDetails.Roles, UserRole)
+		}
 	}
 
 	user, err = s.dbh.UpsertUser(u)
 	if err != nil {
 		return nil, err
 	}
+	if invitation != nil {
+		if err := s.dbh.AcceptInvitation(invitation.ID, user.UID); err != nil {
+			logger.Logger.Error().Err(err).Str("invitation_id", invitation.ID).Msg("unable to accept invitation")
+		}
+	}
+	// a new user waiting for approval is stored but can not log in yet
+	if err := user.CheckActive(); err != nil {
+		return user, err
+	}
 	return user, nil
 }
 
-func (s *tokenHandler) RefreshToken(token string) (*model.Token, error) {
+// pendingInvitation returns the invitation for the email of the login.  Only an email the provider has verified can
+// accept an invitation.
+func (s *tokenHandler) pendingInvitation(claims Claims) (*model.Invitation, error) {
+	email := strings.ToLower(strings.TrimSpace(claims.Email))
+	if email == "" || !claims.Activated {
+		return nil, nil
+	}
+	return s.dbh.GetPendingInvitation(email)
+}
+
+// providerDetails returns the stored details updated from the identity provider.  The provider's email replaces the
+// stored email, names the user has edited are kept and only filled in from the provider when they are blank.
+func providerDetails(stored model.UserDetails, provider model.UserDetails) model.UserDetails {
+	details := stored
+	if provider.Email != "" {
+		details.Email = provider.Email
+		details.EmailVerified = provider.EmailVerified
+	}
+	if details.FirstName == "" {
+		details.FirstName = provider.FirstName
+	}
+	if details.LastName == "" {
+		details.LastName = provider.LastName
+	}
+	details.Roles = provider.Roles
+	return details
+}
+
+// RefreshToken issues new tokens for a refresh token.  The outcome is recorded in the login history.
+func (s *tokenHandler) RefreshToken(token string, client LoginClient) (tokens *model.Token, err error) {
+
+	var user *model.User
+	defer func() {
+		uid, provider := "", ""
+		if user != nil {
+			uid, provider = user.UID, user.AuthProvider
+		}
+		s.recordLogin(client, model.LoginTypeRefresh, provider, uid, err)
+	}()
 
 	claims, err := s.ValidateAccessToken(token)
 	if err != nil {
 		return nil, err
 	}
+
+	// roles and status may have been changed since the token was issued
+	user, err = s.dbh.GetUserByUID(claims.UID)
+	if err != nil {
+		return nil, err
+	}
+	if err := user.CheckActive(); err != nil {
+		return nil, err
+	}
+	claims.Roles = user.UserDetails.Roles
+
+	return s.obtainAccessTokens(claims)
+
+}
+
+// SwitchOrganization issues new tokens for the user with orgID as the active organization
+func (s *tokenHandler) SwitchOrganization(claims Claims, orgID string) (*model.Token, error) {
+
+	memberships, err := s.dbh.GetMemberships(claims.UID)
+	if err != nil {
+		return nil, err
+	}
+	if findMembership(memberships, orgID) == nil {
+		return nil, &model.ResourceDoesNotExistError{Err: errors.New("organization does not exist")}
+	}
+
+	user, err := s.dbh.GetUserByUID(claims.UID)
+	if err != nil {
+		return nil, err
+	}
+	if err := user.CheckActive(); err != nil {
+		return nil, err
+	}
+	claims.Roles = user.UserDetails.Roles
+	claims.Org = orgID
+
 	return s.obtainAccessTokens(claims)
 
 }
 
+// setOrganization will keep the active organization if the user is still a member, otherwise the user's first
+// organization becomes active.  The organization roles are kept apart from the global roles, an organization admin
+// is not a global admin.
+func (s *tokenHandler) setOrganization(claims *Claims) error {
+	memberships, err := s.dbh.GetMemberships(claims.UID)
+	if err != nil {
+		return err
+	}
+	membership := findMembership(memberships, claims.Org)
+	if membership == nil && len(memberships) > 0 {
+		membership = &memberships[0]
+	}
+	claims.Org, claims.OrgRoles = "", nil
+	if membership == nil {
+		return nil
+	}
+
+	claims.Org = membership.OrgID
+	claims.OrgRoles = unionRoles([]string{}, membership.Roles)
+	return nil
+}
+
+// addGroupRoles adds the roles of the user's global groups to their roles and the roles of the active organization's
+// groups to their organization roles
+func (s *tokenHandler) addGroupRoles(claims *Claims) error {
+	globalRoles, orgRoles, err := s.groupRoles(claims.UID, claims.Org)
+	if err != nil {
+		return err
+	}
+	claims.Roles = unionRoles(claims.Roles, globalRoles)
+	if claims.Org != "" {
+		claims.OrgRoles = unionRoles(claims.OrgRoles, orgRoles)
+	}
+	return nil
+}
+
+// groupRoles returns the roles of the user's global groups and of their groups in the organization
+func (s *tokenHandler) groupRoles(uid string, org string) ([]string, []string, error) {
+	globalRoles, err := s.dbh.WithTenant("").GetGroupRoles(uid)
+	if err != nil || org == "" {
+		return globalRoles, nil, err
+	}
+	// the tenant's handler also returns the global groups, which are already in the global roles
+	orgRoles, err := s.dbh.WithTenant(org).GetGroupRoles(uid)
+	if err != nil {
+		return nil, nil, err
+	}
+	return globalRoles, orgRoles, nil
+}
+
+// TenantRoles returns the roles which apply to the resources of the active organization
+func (c Claims) TenantRoles() []string {
+	return unionRoles(c.Roles, c.OrgRoles)
+}
+
+// unionRoles returns the roles in a followed by the roles in b which are not in a
+func unionRoles(a []string, b []string) []string {
+	roles := append([]string{}, a...)
+	for _, role := range b {
+		if !containsString(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+func findMembership(memberships []model.Membership, orgID string) *model.Membership {
+	if orgID == "" {
+		return nil
+	}
+	for i := range memberships {
+		if memberships[i].OrgID == orgID {
+			return &memberships[i]
+		}
+	}
+	return nil
+}
+
 func (s *tokenHandler) ValidateAccessToken(tokenString string) (Claims, error) {
 
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
@@ -93,6 +306,9 @@ func (s *tokenHandler) ValidateAccessToken(tokenString string) (Claims, error) {
 		return Claims{}, err
 	}
 	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
+		if claims.Subject != accessSubject {
+			return Claims{}, errors.New("invalid token subject")
+		}
 		return *claims, nil
 	}
 
@@ -101,8 +317,24 @@ func (s *tokenHandler) ValidateAccessToken(tokenString string) (Claims, error) {
 }
 
 // create a local jwt token
+// claims.Roles must be the user's direct roles, the roles of the active organization and groups are added here.
+// Tokens issued to a client have the client as their audience and no roles.
 func (s *tokenHandler) obtainAccessTokens(claims Claims) (*model.Token, error) {
 
+	if err := s.setOrganization(&claims); err != nil {
+		return nil, err
+	}
+	if err := s.addGroupRoles(&claims); err != nil {
+		return nil, err
+	}
+
+	audience := []string{"local"}
+	if claims.ClientID != "" {
+		// a client's token is only good for its scopes, the user's roles are not delegated to it
+		audience = []string{claims.ClientID}
+		claims.Roles, claims.OrgRoles = nil, nil
+	}
+
 	token_expires_at := time.Now().Add(time.Minute * time.Duration(tokenExpirationMinutes))
 	refresh_expires_at := time.Now().Add(time.Minute * time.Duration(refreshTokenExpirationMinutes))
 	claims.RegisteredClaims = jwt.RegisteredClaims{
@@ -110,8 +342,8 @@ func (s *tokenHandler) obtainAccessTokens(claims Claims) (*model.Token, error) {
 		IssuedAt:  jwt.NewNumericDate(time.Now()),
 		NotBefore: jwt.NewNumericDate(time.Now()),
 		Issuer:    "local",
-		Subject:   "access",
-		Audience:  []string{"local"},
+		Subject:   accessSubject,
+		Audience:  audience,
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
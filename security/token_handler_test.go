@@ -0,0 +1,109 @@
+package security
+
+import (
+	"testing"
+
+	"github.com/gkontos/goapi/model"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvitedUserRoles(t *testing.T) {
+	InvalidateUsers()
+	defer InvalidateUsers()
+
+	invitation := &model.Invitation{ID: "invite-1", Email: "anna@example.com", Roles: model.StringList{"ROLE_SUPPORT"}}
+	dbh := &policyTestDbHandler{users: map[string]*model.User{}, invitations: []*model.Invitation{invitation}}
+	th := GetNewHandler(dbh)
+	login := func(id string, email string, verified bool) *model.User {
+		_, err := th.loginLocalUser(Claims{Username: id, Email: email, Activated: verified, RegisteredClaims: jwt.RegisteredClaims{Issuer: "google", ID: id}}, LoginClient{})
+		assert.NoError(t, err)
+		return dbh.users[id+"-uid"]
+	}
+
+	// an email the provider has not verified does not accept the invitation
+	assert.Equal(t, []string{UserRole}, login("mallory", "anna@example.com", false).UserDetails.Roles)
+	assert.Nil(t, invitation.AcceptedAt)
+	assert.False(t, dbh.users["mallory-uid"].UserDetails.EmailVerified)
+
+	// the invitation's roles replace the default role and it can only be accepted once
+	assert.Equal(t, []string{"ROLE_SUPPORT"}, login("anna", " Anna@example.com", true).UserDetails.Roles)
+	assert.NotNil(t, invitation.AcceptedAt)
+	assert.Equal(t, "anna-uid", invitation.AcceptedUID)
+	assert.True(t, dbh.users["anna-uid"].UserDetails.EmailVerified)
+	assert.Equal(t, []string{UserRole}, login("anna2", "anna@example.com", true).UserDetails.Roles)
+
+	// returning users keep their roles
+	dbh.users["anna-uid"].UserDetails.Roles = []string{AdministratorRole}
+	assert.Equal(t, []string{AdministratorRole}, login("anna", "anna@example.com", true).UserDetails.Roles)
+}
+
+func TestRegistrationModes(t *testing.T) {
+	InvalidateUsers()
+	defer InvalidateUsers()
+	defer func(mode string) { registrationMode = mode }(registrationMode)
+
+	invitation := &model.Invitation{ID: "invite-1", Email: "anna@example.com", Roles: model.StringList{UserRole}}
+	dbh := &policyTestDbHandler{users: map[string]*model.User{}, invitations: []*model.Invitation{invitation}}
+	th := GetNewHandler(dbh)
+	login := func(id string, email string) error {
+		_, err := th.loginLocalUser(Claims{Username: id, Email: email, Activated: true, RegisteredClaims: jwt.RegisteredClaims{Issuer: "google", ID: id}}, LoginClient{})
+		return err
+	}
+
+	// invite only does not create users without an invitation
+	registrationMode = RegistrationInvite
+	assert.IsType(t, &model.InvitationRequiredError{}, login("tom", "tom@example.com"))
+	assert.Nil(t, dbh.users["tom-uid"])
+
+	// approval stores the user as pending without roles until an admin decides
+	registrationMode = RegistrationApproval
+	assert.Equal(t, &model.UserInactiveError{Status: model.UserStatusPending}, login("tom", "tom@example.com"))
+	assert.Equal(t, model.UserStatusPending, dbh.users["tom-uid"].Status)
+	assert.Empty(t, dbh.users["tom-uid"].UserDetails.Roles)
+	assert.Equal(t, &model.UserInactiveError{Status: model.UserStatusPending}, login("tom", "tom@example.com"))
+
+	// an invitation skips the approval
+	assert.NoError(t, login("anna", "anna@example.com"))
+	assert.Equal(t, model.UserStatusActive, dbh.users["anna-uid"].Status)
+
+	registrationMode = RegistrationOpen
+	assert.NoError(t, login("sergei", "sergei@example.com"))
+	assert.Equal(t, []string{UserRole}, dbh.users["sergei-uid"].UserDetails.Roles)
+}
+
+func TestLoginHistory(t *testing.T) {
+	InvalidateUsers()
+	defer InvalidateUsers()
+
+	dbh := &policyTestDbHandler{
+		users: map[string]*model.User{
+			"tom-uid": {UID: "tom-uid", AuthProvider: "google", ProviderID: "tom", UserName: "tom", Status: model.UserStatusActive},
+		},
+	}
+	th := GetNewHandler(dbh)
+	client := LoginClient{IPAddress: "192.0.2.1", UserAgent: "curl/8.0"}
+	login := Claims{Username: "tom", RegisteredClaims: jwt.RegisteredClaims{Issuer: "google", ID: "tom"}}
+
+	tokens, err := th.loginLocalUser(login, client)
+	assert.NoError(t, err)
+	_, err = th.RefreshToken(tokens.RefreshToken, client)
+	assert.NoError(t, err)
+	dbh.users["tom-uid"].Status = model.UserStatusSuspended
+	_, err = th.loginLocalUser(login, client)
+	assert.Error(t, err)
+	_, err = th.RefreshToken("notatoken", client)
+	assert.Error(t, err)
+
+	assert.Equal(t, []*model.LoginEvent{
+		{UID: "tom-uid", Type: model.LoginTypeLogin, Provider: "google", IPAddress: "192.0.2.1", UserAgent: "curl/8.0",
+			Outcome: model.LoginOutcomeSuccess},
+		{UID: "tom-uid", Type: model.LoginTypeRefresh, Provider: "google", IPAddress: "192.0.2.1", UserAgent: "curl/8.0",
+			Outcome: model.LoginOutcomeSuccess},
+		// failures are recorded against the user when they are known, without the details of the error
+		{UID: "tom-uid", Type: model.LoginTypeLogin, Provider: "google", IPAddress: "192.0.2.1", UserAgent: "curl/8.0",
+			Outcome: model.LoginOutcomeFailure, Reason: "user is suspended"},
+		{Type: model.LoginTypeRefresh, IPAddress: "192.0.2.1", UserAgent: "curl/8.0",
+			Outcome: model.LoginOutcomeFailure, Reason: "authentication failed"},
+	}, dbh.logins)
+}
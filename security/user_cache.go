@@ -0,0 +1,106 @@
+package security
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// userCache holds the current roles of authenticated users when FRESH_ROLES is enabled, so that a change takes effect
+// within userCacheSeconds instead of when the token expires.  The cache is per instance, InvalidateUser only clears this
+// instance and other instances wait for the entry to expire.  The user's status is not cached, a deprovisioned user
+// loses access on every instance straight away.
+type userCache struct {
+	mu    sync.Mutex
+	users map[string]map[string]*cachedUser
+}
+
+type cachedUser struct {
+	roles    []string
+	orgRoles []string
+	loadedAt time.Time
+}
+
+var users = &userCache{users: make(map[string]map[string]*cachedUser)}
+
+// InvalidateUser will force the user's roles to be resolved again on their next request
+func InvalidateUser(uid string) {
+	users.mu.Lock()
+	defer users.mu.Unlock()
+	delete(users.users, uid)
+}
+
+// InvalidateUsers will force the roles of every user to be resolved again, eg after a group's roles change
+func InvalidateUsers() {
+	users.mu.Lock()
+	defer users.mu.Unlock()
+	users.users = make(map[string]map[string]*cachedUser)
+}
+
+func (c *userCache) get(uid string, org string) *cachedUser {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.users[uid][org]; ok && time.Since(cached.loadedAt) < time.Second*time.Duration(userCacheSeconds) {
+		return cached
+	}
+	return nil
+}
+
+func (c *userCache) put(uid string, org string, roles []string, orgRoles []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.users[uid] == nil {
+		c.users[uid] = make(map[string]*cachedUser)
+	}
+	c.users[uid][org] = &cachedUser{roles: roles, orgRoles: orgRoles, loadedAt: time.Now()}
+}
+
+// checkActive returns an error unless the user exists and is active.  The status is read from the database on every
+// request since InvalidateUser does not reach the other instances.
+func (s *tokenHandler) checkActive(uid string) error {
+	user, err := s.dbh.GetUserByUID(uid)
+	if err != nil {
+		return err
+	}
+	return user.CheckActive()
+}
+
+// resolveRoles returns the user's current global roles, their direct roles and the roles of their global groups, and
+// their roles in the token's organization, the membership roles and the roles of the organization's groups.  A user
+// who has been deleted or removed from the organization is an error.
+func (s *tokenHandler) resolveRoles(claims Claims) ([]string, []string, error) {
+	if cached := users.get(claims.UID, claims.Org); cached != nil {
+		return cached.roles, cached.orgRoles, nil
+	}
+
+	user, err := s.dbh.GetUserByUID(claims.UID)
+	if err != nil {
+		return nil, nil, err
+	}
+	roles := unionRoles([]string{}, user.UserDetails.Roles)
+
+	var orgRoles []string
+	if claims.Org != "" {
+		memberships, err := s.dbh.GetMemberships(claims.UID)
+		if err != nil {
+			return nil, nil, err
+		}
+		membership := findMembership(memberships, claims.Org)
+		if membership == nil {
+			return nil, nil, errors.New("user is no longer a member of the organization")
+		}
+		orgRoles = unionRoles([]string{}, membership.Roles)
+	}
+
+	globalGroupRoles, orgGroupRoles, err := s.groupRoles(claims.UID, claims.Org)
+	if err != nil {
+		return nil, nil, err
+	}
+	roles = unionRoles(roles, globalGroupRoles)
+	if claims.Org != "" {
+		orgRoles = unionRoles(orgRoles, orgGroupRoles)
+	}
+
+	users.put(claims.UID, claims.Org, roles, orgRoles)
+	return roles, orgRoles, nil
+}
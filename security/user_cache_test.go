@@ -0,0 +1,170 @@
+package security
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gkontos/goapi/model"
+	"github.com/go-chi/chi/v5"
+	jwt "github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFreshRoles(t *testing.T) {
+	InvalidatePolicy()
+	InvalidateUsers()
+	freshRoles = true
+	defer func() {
+		freshRoles = false
+		InvalidateUsers()
+	}()
+
+	dbh := &policyTestDbHandler{
+		users: map[string]*model.User{
+			"tom-uid": {UID: "tom-uid", UserName: "tom", UserDetails: model.UserDetails{Roles: []string{UserRole}}},
+		},
+		memberships: []model.Membership{{OrgID: "org-a", UID: "tom-uid"}},
+	}
+	policies, err := parseRoutePolicies([]byte(testPolicy))
+	assert.NoError(t, err)
+	rs := &defaultRouterSecurity{dbh: dbh, policies: policies}
+
+	r := chi.NewRouter()
+	r.Use(rs.EnforcePolicy(r))
+	r.Get("/users", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	get := func(claims Claims) int {
+		// tokens are minted with the roles frozen in the claims
+		token, err := jwtForClaims(claims)
+		assert.NoError(t, err)
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/users", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// the admin role in the token was removed in the database
+	admin := Claims{UID: "tom-uid", Username: "tom", Roles: []string{AdministratorRole}}
+	assert.Equal(t, http.StatusForbidden, get(admin))
+
+	// the roles are cached until the user is invalidated
+	dbh.users["tom-uid"].UserDetails.Roles = []string{AdministratorRole}
+	assert.Equal(t, http.StatusForbidden, get(admin))
+	loads := dbh.userLoads
+	InvalidateUser("tom-uid")
+	assert.Equal(t, http.StatusOK, get(admin))
+	// the roles are resolved again and the status is read on every request
+	assert.Equal(t, loads+2, dbh.userLoads)
+	assert.Equal(t, http.StatusOK, get(admin))
+	assert.Equal(t, loads+3, dbh.userLoads)
+
+	// group roles are resolved and cached with the user's roles, not looked up on every request
+	dbh.users["tom-uid"].UserDetails.Roles = []string{UserRole}
+	dbh.groupRoles = map[string][]string{"tom-uid": {AdministratorRole}}
+	InvalidateUser("tom-uid")
+	groupLoads := dbh.groupRoleLoads
+	assert.Equal(t, http.StatusOK, get(admin))
+	assert.Equal(t, http.StatusOK, get(admin))
+	assert.Equal(t, groupLoads+1, dbh.groupRoleLoads)
+
+	// leaving the group takes effect when the membership change invalidates the user
+	dbh.groupRoles = nil
+	InvalidateUser("tom-uid")
+	assert.Equal(t, http.StatusForbidden, get(admin))
+	dbh.users["tom-uid"].UserDetails.Roles = []string{AdministratorRole}
+	InvalidateUser("tom-uid")
+
+	// a deleted user and a user removed from the token's organization are no longer authenticated
+	assert.Equal(t, http.StatusUnauthorized, get(Claims{UID: "sergei-uid", Username: "sergei", Roles: []string{AdministratorRole}}))
+	assert.Equal(t, http.StatusOK, get(Claims{UID: "tom-uid", Username: "tom", Org: "org-a"}))
+	assert.Equal(t, http.StatusUnauthorized, get(Claims{UID: "tom-uid", Username: "tom", Org: "org-b"}))
+}
+
+func TestInactiveUsers(t *testing.T) {
+	InvalidateUsers()
+	defer InvalidateUsers()
+
+	dbh := &policyTestDbHandler{
+		users: map[string]*model.User{
+			"tom-uid": {UID: "tom-uid", AuthProvider: "google", ProviderID: "tom", UserName: "tom", Status: model.UserStatusActive},
+		},
+	}
+	th := GetNewHandler(dbh)
+	login := Claims{Username: "tom", RegisteredClaims: jwt.RegisteredClaims{Issuer: "google", ID: "tom"}}
+
+	tokens, err := th.loginLocalUser(login, LoginClient{})
+	assert.NoError(t, err)
+	assert.NoError(t, th.checkActive("tom-uid"))
+
+	// new users are active
+	_, err = th.loginLocalUser(Claims{Username: "sergei", RegisteredClaims: jwt.RegisteredClaims{Issuer: "google", ID: "sergei"}}, LoginClient{})
+	assert.NoError(t, err)
+	assert.Equal(t, model.UserStatusActive, dbh.users["sergei-uid"].Status)
+
+	// a suspended user can not log in or refresh, and their tokens stop working straight away
+	dbh.users["tom-uid"].Status = model.UserStatusSuspended
+	_, err = th.loginLocalUser(login, LoginClient{})
+	assert.Equal(t, &model.UserInactiveError{Status: model.UserStatusSuspended}, err)
+	_, err = th.RefreshToken(tokens.RefreshToken, LoginClient{})
+	assert.Equal(t, &model.UserInactiveError{Status: model.UserStatusSuspended}, err)
+	assert.Equal(t, &model.UserInactiveError{Status: model.UserStatusSuspended}, th.checkActive("tom-uid"))
+
+	// a user who no longer exists is not active
+	assert.Error(t, th.checkActive("anna-uid"))
+}
+
+func TestDeprovisionedUserLosesAccess(t *testing.T) {
+	InvalidatePolicy()
+	InvalidateUsers()
+	freshRoles = true
+	defer func() {
+		freshRoles = false
+		InvalidateUsers()
+	}()
+
+	dbh := &policyTestDbHandler{
+		users: map[string]*model.User{
+			"tom-uid": {UID: "tom-uid", UserName: "tom", Status: model.UserStatusActive,
+				UserDetails: model.UserDetails{Roles: []string{AdministratorRole}}},
+		},
+	}
+	policies, err := parseRoutePolicies([]byte(testPolicy))
+	assert.NoError(t, err)
+	rs := &defaultRouterSecurity{dbh: dbh, policies: policies}
+
+	r := chi.NewRouter()
+	r.Use(rs.EnforcePolicy(r))
+	r.Get("/users", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	token, err := jwtForClaims(Claims{UID: "tom-uid", Username: "tom", Roles: []string{AdministratorRole}})
+	assert.NoError(t, err)
+	get := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/users", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// tom's roles are cached by the first request
+	assert.Equal(t, http.StatusOK, get().Code)
+
+	// SCIM deactivates tom on another instance, so this instance's cache is not invalidated
+	dbh.users["tom-uid"].Status = model.UserStatusDeactivated
+	rr := get()
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), "user_inactive")
+
+	dbh.users["tom-uid"].Status = model.UserStatusActive
+	assert.Equal(t, http.StatusOK, get().Code)
+}
+
+// jwtForClaims signs the claims without resolving the organization or groups
+func jwtForClaims(claims Claims) (string, error) {
+	claims.Subject = accessSubject
+	return jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(signingKey)
+}
@@ -0,0 +1,87 @@
+package util
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gkontos/goapi/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONPatch(t *testing.T) {
+
+	doc := `{"name":"tom","tags":["a","b"],"a/b":1,"m~n":2,"address":{"city":"Leeds"}}`
+	cases := []struct {
+		name          string
+		patch         string
+		expectedDoc   string
+		expectedError string
+	}{
+		{name: "add member", patch: `[{"op":"add","path":"/email","value":"tom@example.com"}]`,
+			expectedDoc: `{"a/b":1,"address":{"city":"Leeds"},"email":"tom@example.com","m~n":2,"name":"tom","tags":["a","b"]}`},
+		{name: "add to the end of an array", patch: `[{"op":"add","path":"/tags/-","value":"c"}]`,
+			expectedDoc: `{"a/b":1,"address":{"city":"Leeds"},"m~n":2,"name":"tom","tags":["a","b","c"]}`},
+		{name: "insert into an array", patch: `[{"op":"add","path":"/tags/0","value":"c"}]`,
+			expectedDoc: `{"a/b":1,"address":{"city":"Leeds"},"m~n":2,"name":"tom","tags":["c","a","b"]}`},
+		{name: "add after the last item", patch: `[{"op":"add","path":"/tags/2","value":"c"}]`,
+			expectedDoc: `{"a/b":1,"address":{"city":"Leeds"},"m~n":2,"name":"tom","tags":["a","b","c"]}`},
+		{name: "add out of bounds", patch: `[{"op":"add","path":"/tags/3","value":"c"}]`,
+			expectedError: "operation 0 (add /tags/3): array index is out of bounds"},
+		{name: "remove the end of an array", patch: `[{"op":"remove","path":"/tags/-"}]`,
+			expectedError: "operation 0 (remove /tags/-): invalid array index"},
+		{name: "leading zero index", patch: `[{"op":"remove","path":"/tags/01"}]`,
+			expectedError: "operation 0 (remove /tags/01): invalid array index"},
+		{name: "escaped slash", patch: `[{"op":"replace","path":"/a~1b","value":3}]`,
+			expectedDoc: `{"a/b":3,"address":{"city":"Leeds"},"m~n":2,"name":"tom","tags":["a","b"]}`},
+		{name: "escaped tilde", patch: `[{"op":"remove","path":"/m~0n"}]`,
+			expectedDoc: `{"a/b":1,"address":{"city":"Leeds"},"name":"tom","tags":["a","b"]}`},
+		// ~01 is ~1 and not /, so it names a member which does not exist
+		{name: "escapes are unescaped in order", patch: `[{"op":"remove","path":"/a~01b"}]`,
+			expectedError: "operation 0 (remove /a~01b): path does not exist"},
+		{name: "replace nested", patch: `[{"op":"replace","path":"/address/city","value":"York"}]`,
+			expectedDoc: `{"a/b":1,"address":{"city":"York"},"m~n":2,"name":"tom","tags":["a","b"]}`},
+		{name: "replace missing member", patch: `[{"op":"replace","path":"/email","value":"tom@example.com"}]`,
+			expectedError: "operation 0 (replace /email): path does not exist"},
+		{name: "move", patch: `[{"op":"move","from":"/address/city","path":"/city"}]`,
+			expectedDoc: `{"a/b":1,"address":{},"city":"Leeds","m~n":2,"name":"tom","tags":["a","b"]}`},
+		{name: "move into itself", patch: `[{"op":"move","from":"/address","path":"/address/home"}]`,
+			expectedError: "operation 0 (move /address/home): a value can not be moved into itself"},
+		{name: "copy is not changed with the original", patch: `[{"op":"copy","from":"/address","path":"/home"},{"op":"replace","path":"/address/city","value":"York"}]`,
+			expectedDoc: `{"a/b":1,"address":{"city":"York"},"home":{"city":"Leeds"},"m~n":2,"name":"tom","tags":["a","b"]}`},
+		{name: "test", patch: `[{"op":"test","path":"/tags","value":["a","b"]},{"op":"remove","path":"/tags/0"}]`,
+			expectedDoc: `{"a/b":1,"address":{"city":"Leeds"},"m~n":2,"name":"tom","tags":["b"]}`},
+		// the patch fails as a whole when a later test fails
+		{name: "test fails", patch: `[{"op":"remove","path":"/name"},{"op":"test","path":"/address","value":{"city":"York"}}]`,
+			expectedError: "operation 1 (test /address): test failed"},
+		{name: "test of a number against a string", patch: `[{"op":"test","path":"/a~1b","value":"1"}]`,
+			expectedError: "operation 0 (test /a~1b): test failed"},
+		{name: "test of a missing member", patch: `[{"op":"test","path":"/email","value":null}]`,
+			expectedError: "operation 0 (test /email): path does not exist"},
+		{name: "test without a value", patch: `[{"op":"test","path":"/name"}]`,
+			expectedError: "operation 0 (test /name): value is required"},
+		{name: "path without a slash", patch: `[{"op":"remove","path":"name"}]`,
+			expectedError: "operation 0 (remove name): path must start with /"},
+		{name: "unknown operation", patch: `[{"op":"merge","path":"/name"}]`,
+			expectedError: "operation 0 (merge /name): unknown operation"},
+		{name: "replace the document", patch: `[{"op":"replace","path":"","value":{"name":"anna"}}]`,
+			expectedDoc: `{"name":"anna"}`},
+	}
+
+	for _, c := range cases {
+		patched, err := JSONPatch([]byte(doc), []byte(c.patch))
+		if c.expectedError != "" {
+			var validation *model.ValidationError
+			assert.True(t, errors.As(err, &validation), c.name)
+			assert.EqualError(t, err, c.expectedError, c.name)
+			continue
+		}
+		assert.NoError(t, err, c.name)
+		assert.Equal(t, c.expectedDoc, string(patched), c.name)
+	}
+}
+
+func TestJSONPatchInvalid(t *testing.T) {
+	_, err := JSONPatch([]byte(`{}`), []byte(`{"op":"add"}`))
+	var parseErr *RequestParseError
+	assert.True(t, errors.As(err, &parseErr))
+}
@@ -0,0 +1,195 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gkontos/goapi/model"
+)
+
+// JSONSchema is the subset of JSON Schema used to validate documents stored for clients: type, enum, properties,
+// required, additionalProperties (as a boolean), items, minimum, maximum, minLength, maxLength, maxItems and pattern.
+type JSONSchema struct {
+	Type                 string                 `json:"type"`
+	Enum                 []interface{}          `json:"enum"`
+	Properties           map[string]*JSONSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *JSONSchema            `json:"items"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	MaxItems             *int                   `json:"maxItems"`
+	Pattern              string                 `json:"pattern"`
+	pattern              *regexp.Regexp
+}
+
+var schemaTypes = map[string]bool{"": true, "object": true, "array": true, "string": true, "number": true, "integer": true, "boolean": true, "null": true}
+
+// ParseJSONSchema parses a schema document.  Keywords outside the supported subset are ignored.
+func ParseJSONSchema(doc []byte) (*JSONSchema, error) {
+	schema := &JSONSchema{}
+	if err := json.Unmarshal(doc, schema); err != nil {
+		return nil, err
+	}
+	if err := schema.compile(""); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+func (s *JSONSchema) compile(field string) error {
+	if !schemaTypes[s.Type] {
+		return fmt.Errorf("schema for %s has unknown type %s", fieldName(field), s.Type)
+	}
+	if s.Pattern != "" {
+		pattern, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("schema for %s has an invalid pattern: %w", fieldName(field), err)
+		}
+		s.pattern = pattern
+	}
+	for name, property := range s.Properties {
+		if err := property.compile(joinField(field, name)); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.compile(joinField(field, "*"))
+	}
+	return nil
+}
+
+// Validate returns the fields of the decoded JSON value which do not match the schema, sorted by field.  Fields are
+// named with dots, eg notifications.email, and the document itself is named by an empty field.
+func (s *JSONSchema) Validate(value interface{}) []model.FieldError {
+	errs := s.validate("", value)
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+	return errs
+}
+
+func (s *JSONSchema) validate(field string, value interface{}) []model.FieldError {
+	invalid := func(format string, args ...interface{}) []model.FieldError {
+		return []model.FieldError{{Field: field, Message: fmt.Sprintf(format, args...)}}
+	}
+	if s.Type != "" && jsonType(value, s.Type) != s.Type {
+		return invalid("must be %s", withArticle(s.Type))
+	}
+	if len(s.Enum) > 0 && !containsValue(s.Enum, value) {
+		return invalid("must be one of %s", enumList(s.Enum))
+	}
+
+	errs := []model.FieldError{}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				errs = append(errs, model.FieldError{Field: joinField(field, name), Message: "is required"})
+			}
+		}
+		for name, item := range v {
+			if property, ok := s.Properties[name]; ok {
+				errs = append(errs, property.validate(joinField(field, name), item)...)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				errs = append(errs, model.FieldError{Field: joinField(field, name), Message: "is not allowed"})
+			}
+		}
+	case []interface{}:
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			errs = append(errs, invalid("must have at most %d items", *s.MaxItems)...)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				errs = append(errs, s.Items.validate(joinField(field, fmt.Sprint(i)), item)...)
+			}
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.MinLength != nil && length < *s.MinLength {
+			errs = append(errs, invalid("must be at least %d characters", *s.MinLength)...)
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			errs = append(errs, invalid("must be at most %d characters", *s.MaxLength)...)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			errs = append(errs, invalid("must match %s", s.Pattern)...)
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			errs = append(errs, invalid("must be at least %v", *s.Minimum)...)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			errs = append(errs, invalid("must be at most %v", *s.Maximum)...)
+		}
+	}
+	return errs
+}
+
+// jsonType returns the schema type of a decoded JSON value.  A whole number is an integer when integer is expected.
+func jsonType(value interface{}, expected string) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if expected == "integer" && v == float64(int64(v)) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return ""
+}
+
+func containsValue(values []interface{}, value interface{}) bool {
+	for _, v := range values {
+		if reflect.DeepEqual(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func enumList(values []interface{}) string {
+	items := make([]string, len(values))
+	for i, v := range values {
+		items[i] = fmt.Sprint(v)
+	}
+	return strings.Join(items, ", ")
+}
+
+func withArticle(schemaType string) string {
+	switch schemaType {
+	case "object", "array", "integer":
+		return "an " + schemaType
+	case "null":
+		return schemaType
+	}
+	return "a " + schemaType
+}
+
+func joinField(field string, name string) string {
+	if field == "" {
+		return name
+	}
+	return field + "." + name
+}
+
+func fieldName(field string) string {
+	if field == "" {
+		return "the document"
+	}
+	return field
+}
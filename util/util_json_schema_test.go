@@ -0,0 +1,123 @@
+package util
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/gkontos/goapi/model"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSchema = `{
+	"type": "object",
+	"additionalProperties": false,
+	"required": ["theme"],
+	"properties": {
+		"theme": {"type": "string", "enum": ["light", "dark"]},
+		"page_size": {"type": "integer", "minimum": 10, "maximum": 100},
+		"nickname": {"type": "string", "minLength": 2, "maxLength": 4, "pattern": "^[a-z]+$"},
+		"tags": {"type": "array", "maxItems": 2, "items": {"type": "string"}},
+		"notifications": {
+			"type": "object",
+			"required": ["email"],
+			"additionalProperties": false,
+			"properties": {
+				"email": {"type": "boolean"},
+				"digest": {
+					"type": "object",
+					"required": ["frequency"],
+					"properties": {"frequency": {"type": "string", "enum": ["daily", "weekly"]}}
+				}
+			}
+		},
+		"extra": {"type": "object"}
+	}
+}`
+
+func TestJSONSchemaValidate(t *testing.T) {
+
+	schema, err := ParseJSONSchema([]byte(testSchema))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	cases := []struct {
+		name           string
+		doc            string
+		expectedErrors []model.FieldError
+	}{
+		{name: "valid", doc: `{"theme":"dark","page_size":20,"nickname":"tom","tags":["a"],"notifications":{"email":true,"digest":{"frequency":"daily"}}}`,
+			expectedErrors: []model.FieldError{}},
+		{name: "required", doc: `{}`,
+			expectedErrors: []model.FieldError{{Field: "theme", Message: "is required"}}},
+		{name: "nested required", doc: `{"theme":"dark","notifications":{"digest":{}}}`,
+			expectedErrors: []model.FieldError{
+				{Field: "notifications.digest.frequency", Message: "is required"},
+				{Field: "notifications.email", Message: "is required"},
+			}},
+		{name: "additional properties", doc: `{"theme":"dark","colour":"red"}`,
+			expectedErrors: []model.FieldError{{Field: "colour", Message: "is not allowed"}}},
+		{name: "nested additional properties", doc: `{"theme":"dark","notifications":{"email":false,"sms":true}}`,
+			expectedErrors: []model.FieldError{{Field: "notifications.sms", Message: "is not allowed"}}},
+		// additionalProperties only applies where it is set
+		{name: "additional properties allowed", doc: `{"theme":"dark","notifications":{"email":true,"digest":{"frequency":"weekly","hour":8}},"extra":{"any":1}}`,
+			expectedErrors: []model.FieldError{}},
+		{name: "type", doc: `{"theme":1,"page_size":10.5,"notifications":"yes"}`,
+			expectedErrors: []model.FieldError{
+				{Field: "notifications", Message: "must be an object"},
+				{Field: "page_size", Message: "must be an integer"},
+				{Field: "theme", Message: "must be a string"},
+			}},
+		{name: "enum", doc: `{"theme":"blue"}`,
+			expectedErrors: []model.FieldError{{Field: "theme", Message: "must be one of light, dark"}}},
+		{name: "bounds", doc: `{"theme":"light","page_size":5,"nickname":"t","tags":["a","b","c"]}`,
+			expectedErrors: []model.FieldError{
+				{Field: "nickname", Message: "must be at least 2 characters"},
+				{Field: "page_size", Message: "must be at least 10"},
+				{Field: "tags", Message: "must have at most 2 items"},
+			}},
+		{name: "maximum", doc: `{"theme":"light","page_size":101,"nickname":"thomas"}`,
+			expectedErrors: []model.FieldError{
+				{Field: "nickname", Message: "must be at most 4 characters"},
+				{Field: "page_size", Message: "must be at most 100"},
+			}},
+		// lengths are counted in characters rather than bytes
+		{name: "pattern", doc: `{"theme":"light","nickname":"Tóm"}`,
+			expectedErrors: []model.FieldError{{Field: "nickname", Message: "must match ^[a-z]+$"}}},
+		{name: "items", doc: `{"theme":"light","tags":["a",2]}`,
+			expectedErrors: []model.FieldError{{Field: "tags.1", Message: "must be a string"}}},
+		{name: "document", doc: `[]`,
+			expectedErrors: []model.FieldError{{Field: "", Message: "must be an object"}}},
+	}
+
+	for _, c := range cases {
+		var value interface{}
+		if !assert.NoError(t, json.Unmarshal([]byte(c.doc), &value), c.name) {
+			continue
+		}
+		assert.Equal(t, c.expectedErrors, schema.Validate(value), c.name)
+	}
+}
+
+func TestParseJSONSchema(t *testing.T) {
+
+	cases := []struct {
+		schema        string
+		expectedError string
+	}{
+		{schema: `{"type":"object","properties":{"a":{"type":"map"}}}`, expectedError: "schema for a has unknown type map"},
+		{schema: `{"type":"array","items":{"type":"string","pattern":"("}}`,
+			expectedError: "schema for * has an invalid pattern: error parsing regexp: missing closing ): `(`"},
+		{schema: `{"type":"text"}`, expectedError: "schema for the document has unknown type text"},
+		{schema: `{"type":"object","unsupported":true}`},
+	}
+
+	for _, c := range cases {
+		_, err := ParseJSONSchema([]byte(c.schema))
+		if c.expectedError == "" {
+			assert.NoError(t, err, c.schema)
+		} else {
+			assert.EqualError(t, err, c.expectedError, c.schema)
+		}
+	}
+}
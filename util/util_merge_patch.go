@@ -0,0 +1,44 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// MergePatch applies a JSON merge patch (RFC 7386) to a JSON document.  A null member in the patch removes the member
+// from the document, an object member is merged recursively and any other value replaces the member.
+func MergePatch(doc []byte, patch []byte) ([]byte, error) {
+	var patchValue interface{}
+	if err := json.Unmarshal(patch, &patchValue); err != nil {
+		return nil, &RequestParseError{Message: "unable to parse merge patch", Err: err}
+	}
+	if _, ok := patchValue.(map[string]interface{}); !ok {
+		return nil, &RequestParseError{Err: errors.New("merge patch must be a JSON object")}
+	}
+	var docValue interface{}
+	if len(doc) > 0 {
+		if err := json.Unmarshal(doc, &docValue); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(mergeValue(docValue, patchValue))
+}
+
+func mergeValue(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+	for k, v := range patchObject {
+		if v == nil {
+			delete(targetObject, k)
+			continue
+		}
+		targetObject[k] = mergeValue(targetObject[k], v)
+	}
+	return targetObject
+}
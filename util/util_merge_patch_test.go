@@ -0,0 +1,44 @@
+package util
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergePatch(t *testing.T) {
+
+	cases := []struct {
+		name          string
+		doc           string
+		patch         string
+		expectedDoc   string
+		expectedError bool
+	}{
+		{name: "replace member", doc: `{"a":"b"}`, patch: `{"a":"c"}`, expectedDoc: `{"a":"c"}`},
+		{name: "add member", doc: `{"a":"b"}`, patch: `{"b":"c"}`, expectedDoc: `{"a":"b","b":"c"}`},
+		{name: "null deletes", doc: `{"a":"b","b":"c"}`, patch: `{"a":null}`, expectedDoc: `{"b":"c"}`},
+		{name: "null deletes a missing member", doc: `{"a":"b"}`, patch: `{"c":null}`, expectedDoc: `{"a":"b"}`},
+		{name: "null deletes nested", doc: `{"a":{"b":"c","d":"e"}}`, patch: `{"a":{"b":null}}`, expectedDoc: `{"a":{"d":"e"}}`},
+		// a null inside an array is a value and is kept
+		{name: "arrays are replaced", doc: `{"a":[1,2]}`, patch: `{"a":[null,3]}`, expectedDoc: `{"a":[null,3]}`},
+		{name: "object replaces value", doc: `{"a":"b"}`, patch: `{"a":{"b":"c"}}`, expectedDoc: `{"a":{"b":"c"}}`},
+		{name: "nulls are left out of new objects", doc: `{}`, patch: `{"a":{"b":null,"c":"d"}}`, expectedDoc: `{"a":{"c":"d"}}`},
+		{name: "empty document", doc: ``, patch: `{"a":"b","c":null}`, expectedDoc: `{"a":"b"}`},
+		{name: "empty patch", doc: `{"a":"b"}`, patch: `{}`, expectedDoc: `{"a":"b"}`},
+		{name: "patch which is not an object", doc: `{"a":"b"}`, patch: `["c"]`, expectedError: true},
+		{name: "patch which is not json", doc: `{"a":"b"}`, patch: `{"a":`, expectedError: true},
+	}
+
+	for _, c := range cases {
+		patched, err := MergePatch([]byte(c.doc), []byte(c.patch))
+		if c.expectedError {
+			var parseErr *RequestParseError
+			assert.True(t, errors.As(err, &parseErr), c.name)
+			continue
+		}
+		assert.NoError(t, err, c.name)
+		assert.Equal(t, c.expectedDoc, string(patched), c.name)
+	}
+}
@@ -2,46 +2,99 @@ package util
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
 
 	"github.com/gkontos/goapi/logger"
 	"github.com/gkontos/goapi/model"
 )
 
+// codedError is an error with a machine readable code which is returned with the message
+type codedError interface {
+	ErrorCode() string
+}
+
 // ReturnErrorJSON will create and return a json encoded exception
 func ReturnErrorJSONWithCode(w http.ResponseWriter, err error, httpStatus int) {
 	type errorResponse struct {
-		Message string `json:"error"`
+		Message string             `json:"error"`
+		Code    string             `json:"code,omitempty"`
+		Fields  []model.FieldError `json:"fields,omitempty"`
 	}
 	response := errorResponse{
 		Message: err.Error(),
 	}
+	var coded codedError
+	if errors.As(err, &coded) {
+		response.Code = coded.ErrorCode()
+	}
+	var validation *model.ValidationError
+	if errors.As(err, &validation) {
+		response.Fields = validation.Fields
+	}
 	w.WriteHeader(httpStatus)
 	if encodeErr := json.NewEncoder(w).Encode(response); encodeErr != nil {
 		logger.Logger.Error().Err(encodeErr).Msg("Error encoding JSON for response")
 	}
 }
 func ReturnErrorJSON(w http.ResponseWriter, err error) {
-
-	httpStatus := http.StatusInternalServerError
-	if err != nil {
-		switch err.(type) {
-		case *RequestParseError:
-			httpStatus = http.StatusBadRequest
-		case *model.ValidationError:
-			httpStatus = http.StatusBadRequest // 422 // http.StatusUnprocessableEntity -- appengine does not like this httpStatus
-		case *model.ResourceDoesNotExistError:
-			httpStatus = http.StatusNotFound
-		default:
-			err = &model.GenericError{
-				Err: err,
-			}
-			httpStatus = http.StatusInternalServerError
+	httpStatus := errorStatus(err)
+	if httpStatus == http.StatusInternalServerError {
+		err = &model.GenericError{
+			Err: err,
 		}
 	}
 	ReturnErrorJSONWithCode(w, err, httpStatus)
 }
 
+// errorStatus returns the http status of an error
+func errorStatus(err error) int {
+	switch e := err.(type) {
+	case *RequestParseError:
+		return http.StatusBadRequest
+	case *model.ValidationError:
+		return http.StatusBadRequest // 422 // http.StatusUnprocessableEntity -- appengine does not like this httpStatus
+	case *model.ResourceDoesNotExistError:
+		return http.StatusNotFound
+	case *model.UserInactiveError, *model.InvitationRequiredError, *model.PermissionDeniedError:
+		return http.StatusForbidden
+	case *model.ReauthenticationRequiredError:
+		return http.StatusUnauthorized
+	case *model.VersionConflictError:
+		return http.StatusPreconditionFailed
+	case *model.SCIMRequestError:
+		return e.Status
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// ReturnSCIMError will return an error in the format of the SCIM protocol (RFC 7644).  Errors which are not caused by
+// the request are returned without their details.
+func ReturnSCIMError(w http.ResponseWriter, err error) {
+	httpStatus := errorStatus(err)
+	response := model.SCIMError{
+		Schemas: []string{model.SCIMErrorSchema},
+		Status:  strconv.Itoa(httpStatus),
+		Detail:  err.Error(),
+	}
+	var scimErr *model.SCIMRequestError
+	var parseErr *RequestParseError
+	switch {
+	case errors.As(err, &scimErr):
+		response.ScimType = scimErr.ScimType
+	case errors.As(err, &parseErr):
+		response.ScimType = "invalidSyntax"
+	case httpStatus == http.StatusBadRequest:
+		response.ScimType = "invalidValue"
+	case httpStatus == http.StatusInternalServerError:
+		response.Detail = http.StatusText(httpStatus)
+	}
+	w.Header().Set("Content-Type", "application/scim+json")
+	ReturnBodyJSON(w, response, httpStatus)
+}
+
 // ReturnBodyJSON will return the body object as a JSON message
 func ReturnBodyJSON(w http.ResponseWriter, body interface{}, httpStatus int) {
 	w.WriteHeader(httpStatus)